@@ -0,0 +1,163 @@
+// package accesslog implements the server's per-request access log, in Common
+// or Combined Log Format (for existing log tooling) or as JSON.  Destination
+// hosts can be hashed (the same way as in the audit log, so that a suspected
+// host can still be looked up) or omitted for privacy.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/audit"
+)
+
+const (
+	FORMAT_COMMON   = "common"   // Common Log Format, followed by the country and the duration in milliseconds
+	FORMAT_COMBINED = "combined" // Combined Log Format, followed by the country and the duration in milliseconds
+	FORMAT_JSON     = "json"     // one JSON object per line
+
+	PRIVACY_NONE = "none" // destination hosts are logged as they are
+	PRIVACY_HASH = "hash" // destination hosts are logged as salted hashes (see audit.HashHost)
+	PRIVACY_OMIT = "omit" // destination hosts aren't logged
+
+	// CLF_TIME_FORMAT is the format of timestamps in Common Log Format
+	CLF_TIME_FORMAT = "02/Jan/2006:15:04:05 -0700"
+)
+
+var (
+	FORMATS   = []string{FORMAT_COMMON, FORMAT_COMBINED, FORMAT_JSON}
+	PRIVACIES = []string{PRIVACY_NONE, PRIVACY_HASH, PRIVACY_OMIT}
+)
+
+// Entry is a single request
+type Entry struct {
+	Time      time.Time     `json:"time"`
+	ClientIP  string        `json:"clientIp"`
+	Country   string        `json:"country,omitempty"` // two letter code, if known
+	Method    string        `json:"method"`
+	Host      string        `json:"host,omitempty"` // destination (or the requested host for requests to the server itself)
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"` // sent to the client
+	Duration  time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"userAgent,omitempty"`
+}
+
+// jsonEntry is an Entry as written in FORMAT_JSON, with the duration in
+// milliseconds like in the other formats
+type jsonEntry struct {
+	*Entry
+	DurationMillis int64 `json:"durationMs"`
+}
+
+// Log is an access log
+type Log struct {
+	File    string // file to which to append entries
+	Format  string // (optional) one of FORMATS, defaults to FORMAT_COMBINED
+	Privacy string // (optional) one of PRIVACIES, defaults to PRIVACY_NONE
+	Salt    string // secret salt used for hashing hosts with PRIVACY_HASH
+
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// Open checks the settings and opens the log for appending
+func (log *Log) Open() error {
+	if !contains(FORMATS, log.format()) {
+		return fmt.Errorf("Unknown access log format %s, available formats are %v", log.Format, FORMATS)
+	}
+	if !contains(PRIVACIES, log.privacy()) {
+		return fmt.Errorf("Unknown access log privacy mode %s, available modes are %v", log.Privacy, PRIVACIES)
+	}
+	var err error
+	log.file, err = os.OpenFile(log.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open access log: %s", err)
+	}
+	return nil
+}
+
+// Record appends the given entry to the log
+func (log *Log) Record(entry *Entry) {
+	line := log.line(entry)
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.file.WriteString(line)
+}
+
+// line renders the entry as a line, applying the privacy mode
+func (log *Log) line(entry *Entry) string {
+	e := *entry
+	switch log.privacy() {
+	case PRIVACY_HASH:
+		if e.Host != "" {
+			e.Host = audit.HashHost(log.Salt, e.Host)
+		}
+	case PRIVACY_OMIT:
+		e.Host = ""
+	}
+	durationMillis := int64(e.Duration / time.Millisecond)
+
+	if log.format() == FORMAT_JSON {
+		data, err := json.Marshal(&jsonEntry{&e, durationMillis})
+		if err != nil {
+			return ""
+		}
+		return string(data) + "\n"
+	}
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s",
+		orDash(e.ClientIP),
+		e.Time.Format(CLF_TIME_FORMAT),
+		e.Method,
+		orDash(e.Host),
+		e.Proto,
+		e.Status,
+		bytesOrDash(e.Bytes))
+	if log.format() == FORMAT_COMBINED {
+		line += fmt.Sprintf(" %s %s", strconv.Quote(orDash(e.Referer)), strconv.Quote(orDash(e.UserAgent)))
+	}
+	return line + fmt.Sprintf(" %s %d\n", orDash(e.Country), durationMillis)
+}
+
+func (log *Log) format() string {
+	if log.Format == "" {
+		return FORMAT_COMBINED
+	}
+	return log.Format
+}
+
+func (log *Log) privacy() string {
+	if log.Privacy == "" {
+		return PRIVACY_NONE
+	}
+	return log.Privacy
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// bytesOrDash renders a byte count the way CLF does, with - for nothing
+func bytesOrDash(bytes int64) string {
+	if bytes == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(bytes, 10)
+}
+
+func contains(list []string, item string) bool {
+	for _, candidate := range list {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/audit"
+)
+
+var entry = &Entry{
+	Time:      time.Date(2014, 10, 10, 13, 55, 36, 0, time.UTC),
+	ClientIP:  "203.0.113.7",
+	Country:   "IR",
+	Method:    "CONNECT",
+	Host:      "www.example.com:443",
+	Proto:     "HTTP/1.1",
+	Status:    200,
+	Bytes:     2326,
+	Duration:  1500 * time.Millisecond,
+	UserAgent: "Go 1.1 package http",
+}
+
+func TestFormats(t *testing.T) {
+	log := &Log{Format: FORMAT_COMMON}
+	expected := `203.0.113.7 - - [10/Oct/2014:13:55:36 +0000] "CONNECT www.example.com:443 HTTP/1.1" 200 2326 IR 1500` + "\n"
+	if line := log.line(entry); line != expected {
+		t.Errorf("Expected %q, got %q", expected, line)
+	}
+
+	log.Format = FORMAT_COMBINED
+	expected = `203.0.113.7 - - [10/Oct/2014:13:55:36 +0000] "CONNECT www.example.com:443 HTTP/1.1" 200 2326 "-" "Go 1.1 package http" IR 1500` + "\n"
+	if line := log.line(entry); line != expected {
+		t.Errorf("Expected %q, got %q", expected, line)
+	}
+
+	log.Format = FORMAT_JSON
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(log.line(entry)), &decoded); err != nil {
+		t.Fatalf("Unable to parse JSON entry: %s", err)
+	}
+	if decoded["host"] != "www.example.com:443" || decoded["durationMs"] != float64(1500) || decoded["country"] != "IR" {
+		t.Errorf("Unexpected JSON entry %v", decoded)
+	}
+}
+
+func TestPrivacy(t *testing.T) {
+	log := &Log{Format: FORMAT_COMMON, Privacy: PRIVACY_HASH, Salt: "salt"}
+	line := log.line(entry)
+	if strings.Contains(line, "example") || !strings.Contains(line, audit.HashHost("salt", entry.Host)) {
+		t.Errorf("Expected hashed host, got %q", line)
+	}
+
+	log.Privacy = PRIVACY_OMIT
+	if line := log.line(entry); !strings.Contains(line, `"CONNECT - HTTP/1.1"`) {
+		t.Errorf("Expected omitted host, got %q", line)
+	}
+	if entry.Host != "www.example.com:443" {
+		t.Errorf("Entry shouldn't be modified, host is now %s", entry.Host)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	file, err := ioutil.TempFile("", "accesslog")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	if err := (&Log{File: file.Name(), Format: "apache"}).Open(); err == nil {
+		t.Error("Unknown format should be refused")
+	}
+	log := &Log{File: file.Name()}
+	if err := log.Open(); err != nil {
+		t.Fatalf("Unable to open: %s", err)
+	}
+	log.Record(entry)
+	log.Record(entry)
+	data, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read log: %s", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("Expected 2 lines, got %d", lines)
+	}
+}
@@ -0,0 +1,237 @@
+// package admin implements an HTTP API for controlling a running client or
+// server, as a foundation for dashboards and orchestration:
+//
+//	GET  /status              the status, as JSON
+//	POST /reload              re-read the config file
+//	POST /rotatecert          replace the server certificate
+//	POST /drain?timeout=30s   stop accepting connections, and exit once the open ones are done (follow with /status)
+//	POST /restart             hand the listening sockets to a new process (e.g. after upgrading the binary) and drain
+//	GET  /healthz             whether the upstream dial path works
+//	GET  /readyz              whether the upstream dial path works and new traffic is accepted
+//
+// Every response is a JSON Response.  Operations that the running role
+// doesn't support are answered with 501 Not Implemented.  /healthz and /readyz
+// answer 503 Service Unavailable when failing and don't require the token, so
+// that load balancers and orchestrators can probe them; they reveal nothing
+// but the error.  Everything else requires the token, even on localhost,
+// where any web page could otherwise post to the API.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/hotrestart"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// TOKEN_HEADER carries the Token, if one is required
+	TOKEN_HEADER = "X-Flashlight-Admin-Token"
+
+	// DEFAULT_DRAIN_TIMEOUT is how long draining waits for open connections,
+	// if the request doesn't say
+	DEFAULT_DRAIN_TIMEOUT = 30 * time.Second
+
+	// HEALTH_CHECK_TTL is how long the outcome of Healthy is reused, so that
+	// frequent (and unauthenticated) probes don't each dial upstream
+	HEALTH_CHECK_TTL = 10 * time.Second
+)
+
+// API is the admin API
+type API struct {
+	Addr       string                            // address at which to listen
+	Token      string                            // secret that requests other than health checks need to carry in TOKEN_HEADER
+	Status     func() interface{}                // returns the status
+	Reload     func() error                      // (optional) reloads the config file
+	RotateCert func() error                      // (optional) replaces the server certificate
+	Drain      func(timeout time.Duration) error // (optional) stops accepting connections and starts waiting for the open ones to finish
+	Restart    func() error                      // (optional) starts a new process that takes over the listening sockets, and drains this one
+	Healthy    func() error                      // (optional) checks that the upstream dial path actually works
+	Ready      func() error                      // (optional) checks that new traffic is accepted (e.g. not draining)
+
+	l             net.Listener
+	lastChecked   time.Time
+	lastHealthErr error
+	healthMutex   sync.Mutex
+}
+
+// Response is the response to every request
+type Response struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Status interface{} `json:"status,omitempty"`
+}
+
+// Start starts serving the API in the background
+func (api *API) Start() error {
+	if api.Token == "" {
+		return fmt.Errorf("The admin API at %s needs a token", api.Addr)
+	}
+	var err error
+	api.l, err = hotrestart.Listen("tcp", api.Addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for admin API at %s: %s", api.Addr, err)
+	}
+	log.Infof("About to start admin API at http://%s/", api.l.Addr())
+	go func() {
+		log.Debugf("Stopped serving admin API: %s", http.Serve(api.l, api))
+	}()
+	return nil
+}
+
+// Close stops serving the API
+func (api *API) Close() error {
+	if api.l == nil {
+		return nil
+	}
+	return api.l.Close()
+}
+
+func (api *API) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if IsLocalhost(api.Addr) && !IsLocalhost(req.Host) {
+		// Web pages could otherwise reach the API by pointing a name of
+		// theirs at 127.0.0.1 (DNS rebinding)
+		api.respond(resp, http.StatusForbidden, fmt.Errorf("Bad host %s", req.Host))
+		return
+	}
+	if req.URL.Path == "/healthz" || req.URL.Path == "/readyz" {
+		api.serveCheck(resp, req)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get(TOKEN_HEADER)), []byte(api.Token)) != 1 {
+		log.Errorf("Rejecting admin request from %s with bad token", req.RemoteAddr)
+		api.respond(resp, http.StatusForbidden, fmt.Errorf("Bad token"))
+		return
+	}
+	if req.URL.Path == "/status" {
+		if req.Method != "GET" {
+			api.respond(resp, http.StatusMethodNotAllowed, nil)
+			return
+		}
+		api.respond(resp, http.StatusOK, nil)
+		return
+	}
+	var operation func() error
+	switch req.URL.Path {
+	case "/reload":
+		operation = api.Reload
+	case "/rotatecert":
+		operation = api.RotateCert
+	case "/restart":
+		operation = api.Restart
+	case "/drain":
+		if api.Drain != nil {
+			timeout := DEFAULT_DRAIN_TIMEOUT
+			if value := req.URL.Query().Get("timeout"); value != "" {
+				var err error
+				if timeout, err = time.ParseDuration(value); err != nil {
+					api.respond(resp, http.StatusBadRequest, fmt.Errorf("Invalid timeout: %s", err))
+					return
+				}
+			}
+			operation = func() error {
+				return api.Drain(timeout)
+			}
+		}
+	default:
+		api.respond(resp, http.StatusNotFound, fmt.Errorf("Unknown operation %s", req.URL.Path))
+		return
+	}
+	if req.Method != "POST" {
+		api.respond(resp, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	if operation == nil {
+		api.respond(resp, http.StatusNotImplemented, fmt.Errorf("%s is not supported here", req.URL.Path))
+		return
+	}
+	log.Infof("Admin API: %s", req.URL.Path)
+	if err := operation(); err != nil {
+		api.respond(resp, http.StatusInternalServerError, err)
+		return
+	}
+	api.respond(resp, http.StatusOK, nil)
+}
+
+// serveCheck answers /healthz and /readyz
+func (api *API) serveCheck(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		api.write(resp, http.StatusMethodNotAllowed, &Response{})
+		return
+	}
+	if api.Healthy == nil {
+		api.write(resp, http.StatusNotImplemented, &Response{Error: fmt.Sprintf("%s is not supported here", req.URL.Path)})
+		return
+	}
+	var err error
+	if req.URL.Path == "/readyz" && api.Ready != nil {
+		err = api.Ready()
+	}
+	if err == nil {
+		err = api.checkHealth()
+	}
+	if err != nil {
+		log.Debugf("Admin API: %s failing: %s", req.URL.Path, err)
+		api.write(resp, http.StatusServiceUnavailable, &Response{Error: err.Error()})
+		return
+	}
+	api.write(resp, http.StatusOK, &Response{OK: true})
+}
+
+// checkHealth runs Healthy, reusing its outcome for HEALTH_CHECK_TTL
+func (api *API) checkHealth() error {
+	api.healthMutex.Lock()
+	defer api.healthMutex.Unlock()
+	if api.lastChecked.IsZero() || time.Now().Sub(api.lastChecked) > HEALTH_CHECK_TTL {
+		api.lastHealthErr = api.Healthy()
+		api.lastChecked = time.Now()
+	}
+	return api.lastHealthErr
+}
+
+// respond writes a Response with the given error (if any), including the
+// status when successful
+func (api *API) respond(resp http.ResponseWriter, code int, err error) {
+	response := &Response{OK: err == nil && code == http.StatusOK}
+	if err != nil {
+		response.Error = err.Error()
+	} else if response.OK && api.Status != nil {
+		response.Status = api.Status()
+	}
+	api.write(resp, code, response)
+}
+
+// write writes the given Response with the given status code
+func (api *API) write(resp http.ResponseWriter, code int, response *Response) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Errorf("Unable to marshal admin response: %s", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	resp.Write(data)
+}
+
+// IsLocalhost determines whether the given host:port is on localhost, which
+// only local processes can reach.  The port may be left out, as in the Host
+// of a request.
+func IsLocalhost(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
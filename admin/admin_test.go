@@ -0,0 +1,147 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func request(api *API, method string, path string, token string) (int, *Response) {
+	req, _ := http.NewRequest(method, "http://127.0.0.1"+path, nil)
+	if token != "" {
+		req.Header.Set(TOKEN_HEADER, token)
+	}
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	response := &Response{}
+	json.Unmarshal(rec.Body.Bytes(), response)
+	return rec.Code, response
+}
+
+func TestOperations(t *testing.T) {
+	reloads := 0
+	drained := make(chan time.Duration, 1)
+	api := &API{
+		Token:  "s3cret",
+		Status: func() interface{} { return map[string]int{"activeConns": 3} },
+		Reload: func() error {
+			reloads++
+			return nil
+		},
+		Drain: func(timeout time.Duration) error {
+			drained <- timeout
+			return nil
+		},
+	}
+
+	if code, _ := request(api, "GET", "/status", "wrong"); code != http.StatusForbidden {
+		t.Errorf("Expected bad token to be rejected, got %d", code)
+	}
+	code, response := request(api, "GET", "/status", "s3cret")
+	if code != http.StatusOK || !response.OK || fmt.Sprint(response.Status) != "map[activeConns:3]" {
+		t.Errorf("Unexpected status response %d %+v", code, response)
+	}
+	if code, _ := request(api, "GET", "/reload", "s3cret"); code != http.StatusMethodNotAllowed || reloads != 0 {
+		t.Errorf("Expected GET of an operation to be refused, got %d", code)
+	}
+	if code, response := request(api, "POST", "/reload", "s3cret"); code != http.StatusOK || !response.OK || reloads != 1 {
+		t.Errorf("Expected reload, got %d %+v", code, response)
+	}
+	if code, _ := request(api, "POST", "/rotatecert", "s3cret"); code != http.StatusNotImplemented {
+		t.Errorf("Expected missing operation to be not implemented, got %d", code)
+	}
+	if code, _ := request(api, "POST", "/drain?timeout=5s", "s3cret"); code != http.StatusOK {
+		t.Errorf("Expected drain to start, got %d", code)
+	}
+	select {
+	case timeout := <-drained:
+		if timeout != 5*time.Second {
+			t.Errorf("Expected timeout of 5s, got %s", timeout)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("Drain wasn't called")
+	}
+}
+
+func TestTokenRequired(t *testing.T) {
+	if err := (&API{Addr: "127.0.0.1:0"}).Start(); err == nil {
+		t.Error("Expected API without token to be refused, even on localhost")
+	}
+	api := &API{Addr: "127.0.0.1:0", Token: "s3cret"}
+	if err := api.Start(); err != nil {
+		t.Errorf("Unable to start with token: %s", err)
+	}
+	api.Close()
+}
+
+func TestOnlyLocalhostNames(t *testing.T) {
+	api := &API{
+		Addr:   "127.0.0.1:15680",
+		Token:  "s3cret",
+		Status: func() interface{} { return nil },
+	}
+	if code, _ := request(api, "GET", "/status", "s3cret"); code != http.StatusOK {
+		t.Errorf("Expected request for 127.0.0.1 to be served, got %d", code)
+	}
+	hosts := map[string]int{
+		"localhost:15680":             http.StatusOK,
+		"[::1]":                       http.StatusOK,
+		"rebound.example.com:15680":   http.StatusForbidden,
+		"rebound.example.com":         http.StatusForbidden,
+		"127.0.0.1.example.com:15680": http.StatusForbidden,
+	}
+	for host, expected := range hosts {
+		req, _ := http.NewRequest("GET", "http://"+host+"/status", nil)
+		req.Header.Set(TOKEN_HEADER, "s3cret")
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Errorf("Expected request for %s to get %d, got %d", host, expected, rec.Code)
+		}
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	checks := 0
+	var healthErr, readyErr error
+	api := &API{
+		Token: "s3cret",
+		Healthy: func() error {
+			checks++
+			return healthErr
+		},
+		Ready: func() error { return readyErr },
+	}
+
+	if code, response := request(api, "GET", "/healthz", ""); code != http.StatusOK || !response.OK {
+		t.Errorf("Expected healthy without token, got %d %+v", code, response)
+	}
+	if code, _ := request(api, "GET", "/readyz", ""); code != http.StatusOK {
+		t.Errorf("Expected ready, got %d", code)
+	}
+	if checks != 1 {
+		t.Errorf("Expected the health check to be reused, ran %d times", checks)
+	}
+
+	readyErr = fmt.Errorf("Draining")
+	code, response := request(api, "GET", "/readyz", "")
+	if code != http.StatusServiceUnavailable || response.OK || response.Error != "Draining" {
+		t.Errorf("Expected not ready while draining, got %d %+v", code, response)
+	}
+	if code, _ := request(api, "GET", "/healthz", ""); code != http.StatusOK {
+		t.Errorf("Expected still healthy while draining, got %d", code)
+	}
+
+	healthErr = fmt.Errorf("Unable to reach the server")
+	api.lastChecked = time.Time{}
+	if code, _ := request(api, "GET", "/healthz", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected unhealthy, got %d", code)
+	}
+
+	if code, _ := request(&API{}, "GET", "/healthz", ""); code != http.StatusNotImplemented {
+		t.Errorf("Expected missing check to be not implemented, got %d", code)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/getlantern/flashlight/diskcache"
+	"github.com/getlantern/flashlight/instance"
+	"github.com/getlantern/flashlight/lifecycle"
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/proxy"
+	"github.com/getlantern/flashlight/trace"
+	"github.com/getlantern/tls"
+)
+
+// App is a flashlight client or server.  It holds the state that's set up
+// while starting (or changed by reloads), so that what depends on it is
+// explicit.  The flags remain the configuration and hotrestart keeps its
+// sockets in package state, so there's still one App per process.
+type App struct {
+	role string // "client" or "server"
+
+	clientCertificate *tls.Certificate       // if set, is presented to the server (see -clientcert)
+	sessionCache      tls.ClientSessionCache // shared by all connections to the server, so that sessions can be resumed (see -tlssessioncache)
+	cache             *diskcache.Cache       // persists what the client learns (DNS answers for the server and its masquerades, route overrides) across restarts
+	instanceLock      *instance.Lock         // held while running as a client
+	lifecycle         *lifecycle.Manager     // starts and stops the subsystems (see addComponents)
+	client            *proxy.Client          // the running client proxy, if a client
+	server            *proxy.Server          // the running server proxy, if a server
+	reloader          *reloader              // reloads the config file on SIGHUP or request
+	tracer            *trace.Tracer          // records how the server is reached (see -tracefile), nil unless tracing
+
+	upstreamHost  string            // FQDN of the server, which can change on reload
+	protocol      protocol.Protocol // used to reach the server, built on demand (and rebuilt after the server changed)
+	upstreamMutex sync.RWMutex      // guards upstreamHost and protocol
+}
+
+// newApp creates an App running in the given role, reaching the server at
+// upstreamHost if it's a client
+func newApp(role string, upstreamHost string) *App {
+	return &App{
+		role:         role,
+		upstreamHost: upstreamHost,
+		lifecycle:    &lifecycle.Manager{},
+	}
+}
+
+// isClient determines whether the App runs the client proxy
+func (app *App) isClient() bool {
+	return app.role == "client"
+}
@@ -0,0 +1,66 @@
+// package atomicfile writes files so that readers (including flashlight itself
+// after a crash or power loss) see either the old or the new contents, never a
+// partially written file.
+package atomicfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile writes data to a temporary file next to filename, syncs it to disk
+// and then renames it over filename.  The file ends up with the given
+// permissions regardless of the umask.
+func WriteFile(filename string, data []byte, perm os.FileMode) (err error) {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file for %s: %s", filename, err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err = f.Chmod(perm); err != nil {
+		return fmt.Errorf("Unable to set permissions on %s: %s", f.Name(), err)
+	}
+	if _, err = f.Write(data); err != nil {
+		return fmt.Errorf("Unable to write %s: %s", f.Name(), err)
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync %s: %s", f.Name(), err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("Unable to close %s: %s", f.Name(), err)
+	}
+	if err = os.Rename(f.Name(), filename); err != nil {
+		return fmt.Errorf("Unable to rename %s to %s: %s", f.Name(), filename, err)
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir syncs the directory so that the rename itself survives a power loss.
+// This isn't supported everywhere (e.g. Windows), so failures are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// QuarantineCorrupt moves a file that couldn't be parsed out of the way (to
+// <filename>.corrupt) so that it can be regenerated, while keeping it around
+// for inspection.
+func QuarantineCorrupt(filename string) error {
+	return os.Rename(filename, filename+".corrupt")
+}
@@ -0,0 +1,42 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "key.pem")
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write file: %s", err)
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Unable to read file: %s", err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected %s, got %s", content, data)
+		}
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Unable to stat file: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected permissions 0600, got %s", info.Mode().Perm())
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Temp files left behind: %d files in dir", len(files))
+	}
+}
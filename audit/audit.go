@@ -0,0 +1,108 @@
+// package audit implements a privacy-preserving audit log of proxied
+// destinations.  Destination hosts are recorded only as salted hashes, so the
+// log can be used to confirm whether a specific suspected host was accessed
+// (see Search) without revealing what else users browsed.
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/atomicfile"
+)
+
+// Log is an append-only audit log
+type Log struct {
+	File string // file to which to append entries
+	Salt string // secret salt used for hashing hosts, keep this to be able to search the log
+
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// Open opens the log for appending
+func (log *Log) Open() error {
+	var err error
+	log.file, err = os.OpenFile(log.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open audit log: %s", err)
+	}
+	return nil
+}
+
+// Record records a connection to the given host that started at start and
+// transferred the given numbers of bytes.
+func (log *Log) Record(host string, start time.Time, duration time.Duration, bytesSent int64, bytesReceived int64) error {
+	line := fmt.Sprintf("%s %s %d %d %d\n",
+		start.UTC().Format(time.RFC3339),
+		HashHost(log.Salt, host),
+		int64(duration/time.Millisecond),
+		bytesSent,
+		bytesReceived)
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if _, err := log.file.WriteString(line); err != nil {
+		return fmt.Errorf("Unable to write to audit log: %s", err)
+	}
+	return nil
+}
+
+// HashHost computes the salted hash under which a host is recorded
+func HashHost(salt string, host string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(strings.ToLower(host)))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Search returns all entries in the given log file that were recorded for the
+// given host.
+func Search(file string, salt string, host string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open audit log: %s", err)
+	}
+	defer f.Close()
+	hash := HashHost(salt, host)
+	var matches []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == hash {
+			matches = append(matches, scanner.Text())
+		}
+	}
+	return matches, scanner.Err()
+}
+
+// LoadOrCreateSalt loads the salt from the given file, generating and saving a
+// random salt if the file doesn't exist yet.
+func LoadOrCreateSalt(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		salt := strings.TrimSpace(string(data))
+		if salt != "" {
+			return salt, nil
+		}
+		// An empty salt file was left behind by an interrupted write, replace it
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("Unable to read audit salt: %s", err)
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("Unable to generate audit salt: %s", err)
+	}
+	salt := hex.EncodeToString(raw)
+	if err := atomicfile.WriteFile(file, []byte(salt), 0600); err != nil {
+		return "", fmt.Errorf("Unable to save audit salt: %s", err)
+	}
+	return salt, nil
+}
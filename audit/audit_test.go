@@ -0,0 +1,89 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	return dir
+}
+
+func TestRecordAndSearch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	log := &Log{File: filepath.Join(dir, "audit.log"), Salt: "s3cret"}
+	if err := log.Open(); err != nil {
+		t.Fatalf("Unable to open log: %s", err)
+	}
+	start := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, host := range []string{"www.example.com", "other.example.com", "WWW.EXAMPLE.COM"} {
+		if err := log.Record(host, start, 1500*time.Millisecond, 100, 2000); err != nil {
+			t.Fatalf("Unable to record: %s", err)
+		}
+	}
+
+	data, _ := ioutil.ReadFile(log.File)
+	if strings.Contains(string(data), "example.com") {
+		t.Error("Hosts should only be recorded as hashes")
+	}
+	matches, err := Search(log.File, "s3cret", "www.example.com")
+	if err != nil {
+		t.Fatalf("Unable to search: %s", err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("Expected 2 case-insensitive matches, got %v", matches)
+	}
+	if matches[0] != "2014-06-01T12:00:00Z "+HashHost("s3cret", "www.example.com")+" 1500 100 2000" {
+		t.Errorf("Unexpected entry %s", matches[0])
+	}
+	if matches, _ := Search(log.File, "other salt", "www.example.com"); len(matches) != 0 {
+		t.Errorf("Expected no matches with another salt, got %v", matches)
+	}
+	if _, err := Search(filepath.Join(dir, "missing.log"), "s3cret", "www.example.com"); err == nil {
+		t.Error("Expected error searching missing log")
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	log := &Log{File: filepath.Join(dir, "audit.log"), Salt: "s3cret"}
+	if err := log.Open(); err != nil {
+		t.Fatalf("Unable to open log: %s", err)
+	}
+	log.file.Close()
+	if err := log.Record("www.example.com", time.Now(), 0, 0, 0); err == nil {
+		t.Error("Expected error writing to closed log")
+	}
+}
+
+func TestLoadOrCreateSalt(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "auditsalt")
+	salt, err := LoadOrCreateSalt(file)
+	if err != nil || len(salt) != 64 {
+		t.Fatalf("Expected new salt, got %q %v", salt, err)
+	}
+	if loaded, _ := LoadOrCreateSalt(file); loaded != salt {
+		t.Errorf("Expected salt to be loaded again, got %q", loaded)
+	}
+	if info, _ := os.Stat(file); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected salt to be private, has mode %s", info.Mode())
+	}
+
+	// Left behind empty by an interrupted write
+	ioutil.WriteFile(file, nil, 0600)
+	if replaced, err := LoadOrCreateSalt(file); err != nil || replaced == "" || replaced == salt {
+		t.Errorf("Expected empty salt to be replaced, got %q %v", replaced, err)
+	}
+}
@@ -0,0 +1,256 @@
+// package auth provides pluggable schemes with which flashlight servers
+// authenticate their clients.  Each Scheme both signs requests (on the client)
+// and authenticates them (on the server), so that client and server can be
+// configured with the same spec.
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// AUTH_HEADER is the header in which clients send their credentials
+	AUTH_HEADER = "X-Lantern-Auth"
+
+	// DECOY_NOT_FOUND is the body of the response to rejected requests, which
+	// looks like an ordinary web server's 404 page so that probing the server
+	// without valid credentials doesn't reveal that it's a proxy
+	DECOY_NOT_FOUND = "<html>\r\n<head><title>404 Not Found</title></head>\r\n<body>\r\n<center><h1>404 Not Found</h1></center>\r\n<hr><center>nginx</center>\r\n</body>\r\n</html>\r\n"
+)
+
+const (
+	// Classes of clients, as told apart by a Classifier
+	CLASS_MEMBER = "member" // class of clients that aren't guests
+	CLASS_GUEST  = "guest"  // class of clients with guest tokens
+)
+
+// Authenticator authenticates requests received by the server
+type Authenticator interface {
+	// Authenticate returns an error if the request isn't allowed through
+	Authenticate(req *http.Request) error
+}
+
+// Scheme is an Authenticator that also knows how to add credentials to
+// outgoing requests on the client.
+type Scheme interface {
+	Authenticator
+
+	// Sign adds credentials to the given request
+	Sign(req *http.Request) error
+}
+
+// Accountant is implemented by Authenticators that limit how much data each
+// credential may transfer
+type Accountant interface {
+	// Meter returns a function to call with the number of bytes transferred
+	// on behalf of the request's credentials, or nil if they aren't metered.
+	Meter(req *http.Request) func(bytes int64)
+}
+
+// Classifier is implemented by Authenticators whose credentials tell clients
+// apart
+type Classifier interface {
+	// Classify returns an id for the client that sent the request and its
+	// class (e.g. CLASS_GUEST), or "" if the credentials don't identify a
+	// client.
+	Classify(req *http.Request) (id string, class string)
+}
+
+// Any is an Authenticator that accepts requests accepted by any of its
+// Authenticators, e.g. to accept guests alongside regular clients.
+type Any []Authenticator
+
+func (any Any) Authenticate(req *http.Request) error {
+	err := fmt.Errorf("No authenticators")
+	for _, authenticator := range any {
+		if err = authenticator.Authenticate(req); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (any Any) Meter(req *http.Request) func(bytes int64) {
+	for _, authenticator := range any {
+		if accountant, ok := authenticator.(Accountant); ok {
+			if meter := accountant.Meter(req); meter != nil {
+				return meter
+			}
+		}
+	}
+	return nil
+}
+
+func (any Any) Classify(req *http.Request) (string, string) {
+	for _, authenticator := range any {
+		if classifier, ok := authenticator.(Classifier); ok {
+			if id, class := classifier.Classify(req); id != "" {
+				return id, class
+			}
+		}
+	}
+	return "", ""
+}
+
+// New constructs a Scheme from a spec of the form "<scheme>:<secret>", e.g.
+// "token:s3cret", "totp:JBSWY3DPEHPK3PXP", "hmac:s3cret" or "guest:<token>"
+// (for clients using a token minted by a GuestAuthority).
+func New(spec string) (Scheme, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Auth spec must look like <scheme>:<secret>, got: %s", spec)
+	}
+	switch parts[0] {
+	case "token":
+		return &Token{Token: parts[1]}, nil
+	case "totp":
+		return NewTOTP(parts[1])
+	case "hmac":
+		return &HMAC{Key: []byte(parts[1])}, nil
+	case "guest":
+		return &Guest{Token: parts[1]}, nil
+	default:
+		return nil, fmt.Errorf("Unknown auth scheme: %s", parts[0])
+	}
+}
+
+// Handler wraps the given handler, rejecting requests that the Authenticator
+// doesn't accept with a decoy 404 Not Found.  Authenticated requests for
+// replacement credentials are answered by the Authenticator if it's a Renewer.
+func Handler(authenticator Authenticator, handler http.Handler) http.Handler {
+	return HandlerWithDecoy(authenticator, handler, nil)
+}
+
+// HandlerWithDecoy is like Handler, but passes rejected requests (minus their
+// credentials) to the given decoy, e.g. an innocuous website, if it's not nil.
+func HandlerWithDecoy(authenticator Authenticator, handler http.Handler, decoy http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if err := authenticator.Authenticate(req); err != nil {
+			log.Debugf("Rejecting request from %s: %s", req.RemoteAddr, err)
+			if decoy == nil {
+				notFound(resp)
+				return
+			}
+			req.Header.Del(AUTH_HEADER)
+			decoy.ServeHTTP(resp, req)
+			return
+		}
+		if req.Header.Get(RENEW_HEADER) != "" {
+			renew(authenticator, resp, req)
+			return
+		}
+		if accountant, ok := authenticator.(Accountant); ok {
+			if meter := accountant.Meter(req); meter != nil {
+				resp = &meteredResponseWriter{resp, meter}
+				if req.Body != nil {
+					req.Body = &meteredBody{req.Body, meter}
+				}
+			}
+		}
+		req.Header.Del(AUTH_HEADER)
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// notFound responds with the decoy 404
+func notFound(resp http.ResponseWriter) {
+	resp.Header().Set("Server", "nginx")
+	resp.Header().Set("Content-Type", "text/html")
+	resp.WriteHeader(http.StatusNotFound)
+	resp.Write([]byte(DECOY_NOT_FOUND))
+}
+
+// meteredResponseWriter meters the bytes written to it
+type meteredResponseWriter struct {
+	http.ResponseWriter
+	meter func(bytes int64)
+}
+
+func (w *meteredResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.meter(int64(n))
+	return n, err
+}
+
+func (w *meteredResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hijacks the connection (e.g. for a WebSocket stream), which remains
+// metered
+func (w *meteredResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection can't be hijacked")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	metered := &meteredConn{conn, w.meter}
+	// Keep whatever the server already read ahead (at most a buffer's worth,
+	// which goes unmetered) and meter everything read from now on
+	pending, _ := buffered.Reader.Peek(buffered.Reader.Buffered())
+	buffered.Reader = bufio.NewReader(io.MultiReader(bytes.NewReader(append([]byte{}, pending...)), metered))
+	buffered.Writer = bufio.NewWriter(metered)
+	return metered, buffered, nil
+}
+
+// meteredConn meters the bytes read from and written to it
+type meteredConn struct {
+	net.Conn
+	meter func(bytes int64)
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.meter(int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.meter(int64(n))
+	return n, err
+}
+
+// meteredBody meters the bytes read from it
+type meteredBody struct {
+	io.ReadCloser
+	meter func(bytes int64)
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.meter(int64(n))
+	return n, err
+}
+
+// Token is a Scheme in which clients present a static shared token
+type Token struct {
+	Token string
+}
+
+func (t *Token) Sign(req *http.Request) error {
+	req.Header.Set(AUTH_HEADER, t.Token)
+	return nil
+}
+
+func (t *Token) Authenticate(req *http.Request) error {
+	presented := req.Header.Get(AUTH_HEADER)
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(t.Token)) != 1 {
+		return fmt.Errorf("Invalid token")
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/storage"
+)
+
+func TestTOTPMatchesRFC6238(t *testing.T) {
+	totp := &TOTP{Secret: []byte("12345678901234567890")}
+	// Test vectors from RFC 6238, truncated to 6 digits
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		if code := totp.code(time.Unix(unix, 0), 0); code != expected {
+			t.Errorf("At %d expected %s, got %s", unix, expected, code)
+		}
+	}
+}
+
+func TestSchemes(t *testing.T) {
+	for _, spec := range []string{"token:s3cret", "totp:JBSWY3DPEHPK3PXP", "hmac:s3cret"} {
+		scheme, err := New(spec)
+		if err != nil {
+			t.Fatalf("Unable to create scheme %s: %s", spec, err)
+		}
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if err := scheme.Authenticate(req); err == nil {
+			t.Errorf("%s accepted request without credentials", spec)
+		}
+		if err := scheme.Sign(req); err != nil {
+			t.Fatalf("%s unable to sign: %s", spec, err)
+		}
+		if err := scheme.Authenticate(req); err != nil {
+			t.Errorf("%s rejected signed request: %s", spec, err)
+		}
+	}
+	if _, err := New("bogus:secret"); err == nil {
+		t.Error("Unknown scheme should have failed")
+	}
+}
+
+func TestHandlerRejectsWithDecoy(t *testing.T) {
+	handler := Handler(&Token{Token: "s3cret"}, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("proxied"))
+	}))
+	for _, token := range []string{"", "wrong", "s3cre"} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if token != "" {
+			req.Header.Set(AUTH_HEADER, token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound || rec.Body.String() != DECOY_NOT_FOUND {
+			t.Errorf("Expected decoy 404 for token %q, got %d %q", token, rec.Code, rec.Body.String())
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	(&Token{Token: "s3cret"}).Sign(req)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Body.String() != "proxied" {
+		t.Errorf("Valid token rejected with %d", rec.Code)
+	}
+}
+
+func TestHMACRejectsReplay(t *testing.T) {
+	h := &HMAC{Key: []byte("s3cret")}
+	req, _ := http.NewRequest("POST", "http://example.com/", nil)
+	h.Sign(req)
+	if err := h.Authenticate(req); err != nil {
+		t.Fatalf("Rejected signed request: %s", err)
+	}
+	if err := h.Authenticate(req); err == nil {
+		t.Error("Accepted replayed request")
+	}
+
+	req, _ = http.NewRequest("POST", "http://example.com/", nil)
+	h.Sign(req)
+	req.Host = "other.com"
+	if err := h.Authenticate(req); err == nil {
+		t.Error("Accepted request for a different host")
+	}
+}
+
+func TestGuestTokens(t *testing.T) {
+	authority := &GuestAuthority{Key: []byte("s3cret")}
+	token, err := authority.Mint("friend", time.Hour, 100)
+	if err != nil {
+		t.Fatalf("Unable to mint token: %s", err)
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	(&Guest{Token: token}).Sign(req)
+	if err := authority.Authenticate(req); err != nil {
+		t.Fatalf("Fresh token rejected: %s", err)
+	}
+	authority.Meter(req)(100)
+	if err := authority.Authenticate(req); err == nil {
+		t.Error("Token accepted after using up its cap")
+	}
+
+	expired, _ := authority.Mint("friend", -time.Minute, 0)
+	req.Header.Set(AUTH_HEADER, expired)
+	if err := authority.Authenticate(req); err == nil {
+		t.Error("Expired token accepted")
+	}
+
+	forged, _ := (&GuestAuthority{Key: []byte("other")}).Mint("friend", time.Hour, 0)
+	req.Header.Set(AUTH_HEADER, forged)
+	if err := authority.Authenticate(req); err == nil {
+		t.Error("Forged token accepted")
+	}
+}
+
+func TestClassifyGuests(t *testing.T) {
+	authority := &GuestAuthority{Key: []byte("s3cret")}
+	any := Any{&Token{Token: "member"}, authority}
+	token, _ := authority.Mint("friend", time.Hour, 0)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	(&Guest{Token: token}).Sign(req)
+	if id, class := any.Classify(req); id != "guest:friend" || class != CLASS_GUEST {
+		t.Errorf("Expected guest:friend of class guest, got %s of class %s", id, class)
+	}
+	(&Token{Token: "member"}).Sign(req)
+	if id, _ := any.Classify(req); id != "" {
+		t.Errorf("Expected no id for shared token, got %s", id)
+	}
+}
+
+func TestRenewGuestTokens(t *testing.T) {
+	authority := &GuestAuthority{Key: []byte("s3cret")}
+	now := time.Now().Unix()
+	token, _ := authority.mint(&GuestClaims{Id: "friend", Issued: now - 3000, Expires: now + 600, RenewUntil: now + 86400})
+	guest := &Guest{Token: token}
+	if renewAt := guest.RenewAt(); renewAt.Unix() != now-600 {
+		t.Errorf("Expected renewal once a third of the lifetime remains, got %s", renewAt)
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set(RENEW_HEADER, "1")
+	guest.Sign(req)
+	rec := httptest.NewRecorder()
+	Handler(Any{&Token{Token: "other"}, authority}, nil).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Renewal refused with %d", rec.Code)
+	}
+	if err := guest.Renewed(rec.Body.String()); err != nil {
+		t.Fatalf("Unable to switch to renewed token: %s", err)
+	}
+	claims, _ := parseGuestClaims(guest.Token)
+	if claims.Id != "friend" || claims.Expires < now+3600 {
+		t.Errorf("Renewed token should be for the same guest and last as long as the original, got %v", claims)
+	}
+
+	// Renewals stop at RenewUntil
+	last, _ := authority.mint(&GuestClaims{Id: "friend", Issued: now - 3000, Expires: now + 600, RenewUntil: now + 600})
+	req.Header.Set(AUTH_HEADER, last)
+	if _, err := authority.Renew(req); err == nil {
+		t.Error("Token renewed beyond RenewUntil")
+	}
+	if !(&Guest{Token: last}).RenewAt().IsZero() {
+		t.Error("Token that can't be renewed shouldn't have a renewal time")
+	}
+
+	other, _ := authority.Mint("stranger", time.Hour, 0)
+	if err := guest.Renewed(other); err == nil {
+		t.Error("Switched to a token for a different guest")
+	}
+}
+
+func TestPersistGuestUsage(t *testing.T) {
+	store := &storage.Memory{}
+	authority := &GuestAuthority{Key: []byte("s3cret"), Store: store}
+	token, _ := authority.Mint("friend", time.Hour, 100)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	(&Guest{Token: token}).Sign(req)
+	authority.Meter(req)(60)
+	authority.MergeState(&State{GuestUsage: map[string]int64{"peer": 10}})
+	if err := authority.SaveUsage(); err != nil {
+		t.Fatalf("Unable to save usage: %s", err)
+	}
+
+	restarted := &GuestAuthority{Key: []byte("s3cret"), Store: store}
+	if err := restarted.LoadUsage(); err != nil {
+		t.Fatalf("Unable to load usage: %s", err)
+	}
+	if restarted.Usage("friend") != 60 || restarted.Usage("peer") != 10 {
+		t.Errorf("Usage not restored, got %d and %d", restarted.Usage("friend"), restarted.Usage("peer"))
+	}
+	restarted.Meter(req)(40)
+	if err := restarted.Authenticate(req); err == nil {
+		t.Error("Cap reset by restart")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	calls := 0
+	failing := false
+	endpoint := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		calls++
+		request := &WebhookRequest{}
+		json.NewDecoder(req.Body).Decode(request)
+		switch {
+		case failing:
+			resp.WriteHeader(http.StatusInternalServerError)
+		case request.Credentials != "alice:s3cret":
+			resp.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer endpoint.Close()
+
+	webhook := &Webhook{URL: endpoint.URL}
+	check := func(credentials string) error {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = "1.2.3.4:5678"
+		req.Header.Set(AUTH_HEADER, credentials)
+		return webhook.Authenticate(req)
+	}
+	if err := check("alice:s3cret"); err != nil {
+		t.Errorf("Valid credentials rejected: %s", err)
+	}
+	if err := check("alice:wrong"); err == nil {
+		t.Error("Invalid credentials accepted")
+	}
+	if err := check(""); err == nil || calls != 2 {
+		t.Errorf("Missing credentials should be rejected without a call, got %v after %d calls", err, calls)
+	}
+
+	failing = true
+	if err := check("alice:s3cret"); err != nil || calls != 2 {
+		t.Errorf("Expected cached answer, got %v after %d calls", err, calls)
+	}
+	if err := check("bob:s3cret"); err == nil {
+		t.Error("Failing webhook should reject by default")
+	}
+	webhook.FailOpen = true
+	if err := check("bob:s3cret"); err != nil {
+		t.Errorf("Failing webhook should let clients through with FailOpen: %s", err)
+	}
+}
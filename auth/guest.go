@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/storage"
+)
+
+// GuestClaims are the claims carried by a guest token
+type GuestClaims struct {
+	Id         string `json:"id"`
+	Issued     int64  `json:"iat,omitempty"`   // unix time at which the token was minted
+	Expires    int64  `json:"exp"`             // unix time after which the token is no longer valid
+	MaxBytes   int64  `json:"cap,omitempty"`   // maximum bytes that may be transferred with the token, 0 means unlimited
+	RenewUntil int64  `json:"renew,omitempty"` // unix time until which the token may be renewed (see Renewer), 0 means it can't be
+}
+
+// Guest is the client side of guest access, presenting a token minted by a
+// GuestAuthority.
+type Guest struct {
+	Token string
+
+	mutex sync.RWMutex
+}
+
+func (g *Guest) Sign(req *http.Request) error {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	req.Header.Set(AUTH_HEADER, g.Token)
+	return nil
+}
+
+func (g *Guest) Authenticate(req *http.Request) error {
+	return fmt.Errorf("Guest tokens can only be verified with the GuestAuthority's key")
+}
+
+// GuestAuthority mints and verifies time-limited, optionally bandwidth-capped
+// guest tokens.  Tokens are signed with the authority's Key, so the server
+// needs no record of the tokens it minted.  Usage is tracked in memory and,
+// if there's a Store, saved to it with SaveUsage so that bandwidth caps
+// survive restarts.
+type GuestAuthority struct {
+	Key   []byte
+	Store storage.Store // (optional) store in which usage is saved
+
+	usage   map[string]int64
+	expires map[string]int64 // unix time at which each id's tokens stop being valid, so its usage can be forgotten
+	mutex   sync.Mutex
+}
+
+// Mint mints a token valid for the given duration and allowing the given
+// number of bytes (0 means unlimited).
+func (authority *GuestAuthority) Mint(id string, validFor time.Duration, maxBytes int64) (string, error) {
+	now := time.Now()
+	return authority.mint(&GuestClaims{
+		Id:       id,
+		Issued:   now.Unix(),
+		Expires:  now.Add(validFor).Unix(),
+		MaxBytes: maxBytes,
+	})
+}
+
+// MintRenewable mints a token like Mint, except that the token itself is only
+// valid for rotateEvery, after which the client has to have renewed it.
+// Renewals continue until the end of validFor, so a leaked token is only
+// useful for a short while.
+func (authority *GuestAuthority) MintRenewable(id string, validFor time.Duration, rotateEvery time.Duration, maxBytes int64) (string, error) {
+	if rotateEvery <= 0 || rotateEvery >= validFor {
+		return authority.Mint(id, validFor, maxBytes)
+	}
+	now := time.Now()
+	return authority.mint(&GuestClaims{
+		Id:         id,
+		Issued:     now.Unix(),
+		Expires:    now.Add(rotateEvery).Unix(),
+		MaxBytes:   maxBytes,
+		RenewUntil: now.Add(validFor).Unix(),
+	})
+}
+
+func (authority *GuestAuthority) mint(guestClaims *GuestClaims) (string, error) {
+	claims, err := json.Marshal(guestClaims)
+	if err != nil {
+		return "", fmt.Errorf("Unable to marshal guest claims: %s", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(claims)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(authority.sign(encoded)), nil
+}
+
+func (authority *GuestAuthority) Authenticate(req *http.Request) error {
+	claims, err := authority.verify(req.Header.Get(AUTH_HEADER))
+	if err != nil {
+		return err
+	}
+	if time.Now().Unix() > claims.Expires {
+		return fmt.Errorf("Guest token %s expired at %s", claims.Id, time.Unix(claims.Expires, 0))
+	}
+	if claims.MaxBytes > 0 && authority.Usage(claims.Id) >= claims.MaxBytes {
+		return fmt.Errorf("Guest token %s used up its %d bytes", claims.Id, claims.MaxBytes)
+	}
+	return nil
+}
+
+// Meter implements Accountant, metering the bytes transferred with capped
+// guest tokens.
+func (authority *GuestAuthority) Meter(req *http.Request) func(bytes int64) {
+	claims, err := authority.verify(req.Header.Get(AUTH_HEADER))
+	if err != nil || claims.MaxBytes == 0 {
+		return nil
+	}
+	expires := claims.Expires
+	if claims.RenewUntil > expires {
+		expires = claims.RenewUntil
+	}
+	return func(bytes int64) {
+		authority.mutex.Lock()
+		defer authority.mutex.Unlock()
+		if authority.usage == nil {
+			authority.usage = make(map[string]int64)
+		}
+		if authority.expires == nil {
+			authority.expires = make(map[string]int64)
+		}
+		authority.usage[claims.Id] += bytes
+		authority.expires[claims.Id] = expires
+	}
+}
+
+// Classify implements Classifier, telling guests apart by their token's id
+func (authority *GuestAuthority) Classify(req *http.Request) (string, string) {
+	claims, err := authority.verify(req.Header.Get(AUTH_HEADER))
+	if err != nil {
+		return "", ""
+	}
+	return "guest:" + claims.Id, CLASS_GUEST
+}
+
+// Usage returns the bytes transferred so far with the given guest token
+func (authority *GuestAuthority) Usage(id string) int64 {
+	authority.mutex.Lock()
+	defer authority.mutex.Unlock()
+	return authority.usage[id]
+}
+
+// verify verifies the token's signature and returns its claims
+func (authority *GuestAuthority) verify(token string) (*GuestClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Missing or malformed guest token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, authority.sign(parts[0])) {
+		return nil, fmt.Errorf("Invalid guest token signature")
+	}
+	return parseGuestClaims(token)
+}
+
+// parseGuestClaims parses the claims in the token without verifying its
+// signature, which only the GuestAuthority can do
+func parseGuestClaims(token string) (*GuestClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Missing or malformed guest token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode guest claims: %s", err)
+	}
+	claims := &GuestClaims{}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, fmt.Errorf("Unable to parse guest claims: %s", err)
+	}
+	return claims, nil
+}
+
+func (authority *GuestAuthority) sign(encodedClaims string) []byte {
+	mac := hmac.New(sha256.New, authority.Key)
+	mac.Write([]byte(encodedClaims))
+	return mac.Sum(nil)
+}
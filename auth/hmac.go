@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HMAC_MAX_SKEW is how far a request's timestamp may be from the server's
+	// clock.  Nonces are remembered for twice this long.
+	HMAC_MAX_SKEW = 2 * time.Minute
+
+	// HMAC_MAX_NONCES bounds the memory used for remembering nonces
+	HMAC_MAX_NONCES = 1000000
+)
+
+// HMAC is a Scheme in which clients sign each request's method, host, a
+// timestamp and a random nonce with a shared key.  The server rejects
+// signatures that are stale or whose nonce it has already seen, so captured
+// credentials can't be replayed.
+type HMAC struct {
+	Key []byte
+
+	nonces      map[string]time.Time
+	noncesMutex sync.Mutex
+}
+
+func (h *HMAC) Sign(req *http.Request) error {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := h.sign(req, timestamp, nonce)
+	req.Header.Set(AUTH_HEADER, timestamp+":"+nonce+":"+base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+func (h *HMAC) Authenticate(req *http.Request) error {
+	parts := strings.Split(req.Header.Get(AUTH_HEADER), ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("Missing or malformed signature")
+	}
+	timestamp, nonce := parts[0], parts[1]
+	sig, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("Unable to decode signature: %s", err)
+	}
+	if !hmac.Equal(sig, h.sign(req, timestamp, nonce)) {
+		return fmt.Errorf("Invalid signature")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid timestamp: %s", timestamp)
+	}
+	skew := time.Now().Sub(time.Unix(unix, 0))
+	if skew > HMAC_MAX_SKEW || skew < -HMAC_MAX_SKEW {
+		return fmt.Errorf("Timestamp off by %s", skew)
+	}
+	return h.useNonce(nonce)
+}
+
+// sign calculates the signature over the canonical form of the request
+func (h *HMAC) sign(req *http.Request, timestamp string, nonce string) []byte {
+	mac := hmac.New(sha256.New, h.Key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", strings.ToUpper(req.Method), strings.ToLower(req.Host), timestamp, nonce)
+	return mac.Sum(nil)
+}
+
+// useNonce records the given nonce, failing if it was already used
+func (h *HMAC) useNonce(nonce string) error {
+	h.noncesMutex.Lock()
+	defer h.noncesMutex.Unlock()
+	now := time.Now()
+	if h.nonces == nil {
+		h.nonces = make(map[string]time.Time)
+	}
+	if expires, found := h.nonces[nonce]; found && now.Before(expires) {
+		return fmt.Errorf("Nonce already used")
+	}
+	if len(h.nonces) >= HMAC_MAX_NONCES {
+		for n, expires := range h.nonces {
+			if now.After(expires) {
+				delete(h.nonces, n)
+			}
+		}
+		if len(h.nonces) >= HMAC_MAX_NONCES {
+			return fmt.Errorf("Too many outstanding nonces")
+		}
+	}
+	h.nonces[nonce] = now.Add(2 * HMAC_MAX_SKEW)
+	return nil
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// RENEW_HEADER marks requests from the client for replacement credentials
+	RENEW_HEADER = "X-Flashlight-Renew"
+
+	// RENEW_OVERLAP determines when clients renew their credentials, namely
+	// once only 1/RENEW_OVERLAP of their lifetime remains.  The old
+	// credentials stay valid for the rest of it, so a failed renewal can be
+	// retried.
+	RENEW_OVERLAP = 3
+)
+
+// Renewer is implemented by Authenticators that issue replacements for
+// credentials that are about to expire
+type Renewer interface {
+	// Renew returns replacement credentials for the (already authenticated)
+	// request's credentials
+	Renew(req *http.Request) (string, error)
+}
+
+// Renewable is implemented by Schemes whose credentials can be renewed
+type Renewable interface {
+	Scheme
+
+	// RenewAt returns when to renew the credentials, which is zero if they
+	// can't be renewed
+	RenewAt() time.Time
+
+	// Renewed switches to the given replacement credentials
+	Renewed(credentials string) error
+}
+
+// renew answers a request for replacement credentials
+func renew(authenticator Authenticator, resp http.ResponseWriter, req *http.Request) {
+	renewer, ok := authenticator.(Renewer)
+	if !ok {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	credentials, err := renewer.Renew(req)
+	if err != nil {
+		log.Debugf("Not renewing credentials for %s: %s", req.RemoteAddr, err)
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write([]byte(credentials))
+}
+
+func (any Any) Renew(req *http.Request) (string, error) {
+	for _, authenticator := range any {
+		if renewer, ok := authenticator.(Renewer); ok && authenticator.Authenticate(req) == nil {
+			return renewer.Renew(req)
+		}
+	}
+	return "", fmt.Errorf("Credentials can't be renewed")
+}
+
+// Renew implements Renewer, minting a replacement for a renewable guest token
+// that's valid for as long as the original was (but not beyond its
+// RenewUntil).  Usage is tracked by id, so caps carry over.
+func (authority *GuestAuthority) Renew(req *http.Request) (string, error) {
+	claims, err := authority.verify(req.Header.Get(AUTH_HEADER))
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if claims.RenewUntil == 0 || claims.Issued == 0 {
+		return "", fmt.Errorf("Guest token %s isn't renewable", claims.Id)
+	}
+	expires := now.Unix() + (claims.Expires - claims.Issued)
+	if expires > claims.RenewUntil {
+		expires = claims.RenewUntil
+	}
+	if expires <= claims.Expires {
+		return "", fmt.Errorf("Guest token %s can't be renewed beyond %s", claims.Id, time.Unix(claims.RenewUntil, 0))
+	}
+	return authority.mint(&GuestClaims{
+		Id:         claims.Id,
+		Issued:     now.Unix(),
+		Expires:    expires,
+		MaxBytes:   claims.MaxBytes,
+		RenewUntil: claims.RenewUntil,
+	})
+}
+
+// RenewAt implements Renewable
+func (g *Guest) RenewAt() time.Time {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	claims, err := parseGuestClaims(g.Token)
+	if err != nil || claims.Issued == 0 || claims.Expires >= claims.RenewUntil {
+		return time.Time{}
+	}
+	lifetime := claims.Expires - claims.Issued
+	return time.Unix(claims.Expires-lifetime/RENEW_OVERLAP, 0)
+}
+
+// Renewed implements Renewable, switching to a token for the same guest that
+// expires later than the current one
+func (g *Guest) Renewed(credentials string) error {
+	renewed, err := parseGuestClaims(credentials)
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	current, err := parseGuestClaims(g.Token)
+	if err != nil {
+		return err
+	}
+	if renewed.Id != current.Id {
+		return fmt.Errorf("Renewed token is for %s, not %s", renewed.Id, current.Id)
+	}
+	if renewed.Expires <= current.Expires {
+		return fmt.Errorf("Renewed token doesn't expire later than the current one")
+	}
+	g.Token = credentials
+	return nil
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"time"
+)
+
+// State is the soft state of a server's Authenticators, which a pair of
+// servers (an active server and its warm standby) share so that failing over
+// doesn't reset guests' bandwidth usage or allow replaying HMAC signatures.
+type State struct {
+	GuestUsage map[string]int64     `json:"guestUsage,omitempty"` // bytes transferred per guest token id
+	Nonces     map[string]time.Time `json:"nonces,omitempty"`     // HMAC nonces in use, with their expiry
+}
+
+// Stateful is implemented by Authenticators with soft state
+type Stateful interface {
+	// AddState adds the Authenticator's state to the given State
+	AddState(state *State)
+
+	// MergeState merges state received from a peer into the Authenticator's
+	// own.  Merging is idempotent, so receiving the same state twice is
+	// harmless.
+	MergeState(state *State)
+}
+
+func (any Any) AddState(state *State) {
+	for _, authenticator := range any {
+		if stateful, ok := authenticator.(Stateful); ok {
+			stateful.AddState(state)
+		}
+	}
+}
+
+func (any Any) MergeState(state *State) {
+	for _, authenticator := range any {
+		if stateful, ok := authenticator.(Stateful); ok {
+			stateful.MergeState(state)
+		}
+	}
+}
+
+// AddState adds the usage of capped guest tokens
+func (authority *GuestAuthority) AddState(state *State) {
+	authority.mutex.Lock()
+	defer authority.mutex.Unlock()
+	if state.GuestUsage == nil {
+		state.GuestUsage = make(map[string]int64, len(authority.usage))
+	}
+	for id, bytes := range authority.usage {
+		state.GuestUsage[id] = bytes
+	}
+}
+
+// MergeState merges the peer's guest usage.  Usage only ever grows, so the
+// larger of the two values wins.
+func (authority *GuestAuthority) MergeState(state *State) {
+	authority.mutex.Lock()
+	defer authority.mutex.Unlock()
+	if authority.usage == nil {
+		authority.usage = make(map[string]int64)
+	}
+	for id, bytes := range state.GuestUsage {
+		if bytes > authority.usage[id] {
+			authority.usage[id] = bytes
+		}
+	}
+}
+
+// AddState adds the nonces that haven't expired yet
+func (h *HMAC) AddState(state *State) {
+	h.noncesMutex.Lock()
+	defer h.noncesMutex.Unlock()
+	if state.Nonces == nil {
+		state.Nonces = make(map[string]time.Time, len(h.nonces))
+	}
+	now := time.Now()
+	for nonce, expires := range h.nonces {
+		if now.Before(expires) {
+			state.Nonces[nonce] = expires
+		}
+	}
+}
+
+// MergeState marks the peer's nonces as used, up to HMAC_MAX_NONCES
+func (h *HMAC) MergeState(state *State) {
+	h.noncesMutex.Lock()
+	defer h.noncesMutex.Unlock()
+	if h.nonces == nil {
+		h.nonces = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for nonce, expires := range state.Nonces {
+		if len(h.nonces) >= HMAC_MAX_NONCES {
+			return
+		}
+		if now.Before(expires) && expires.After(h.nonces[nonce]) {
+			h.nonces[nonce] = expires
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// GUEST_USAGE_KEY is the key under which guest usage is saved in the
+	// GuestAuthority's Store
+	GUEST_USAGE_KEY = "guestusage"
+
+	// GUEST_USAGE_RETENTION is how long usage whose expiry isn't known (i.e.
+	// merged from a peer) is kept
+	GUEST_USAGE_RETENTION = 30 * 24 * time.Hour
+)
+
+// savedUsage is the usage of a guest token id as saved in the Store
+type savedUsage struct {
+	Bytes   int64 `json:"bytes"`
+	Expires int64 `json:"exp"`
+}
+
+// LoadUsage loads the usage saved in the Store, if any
+func (authority *GuestAuthority) LoadUsage() error {
+	if authority.Store == nil {
+		return nil
+	}
+	saved := make(map[string]*savedUsage)
+	if !authority.Store.Get(GUEST_USAGE_KEY, &saved) {
+		return nil
+	}
+	authority.mutex.Lock()
+	defer authority.mutex.Unlock()
+	if authority.usage == nil {
+		authority.usage = make(map[string]int64)
+	}
+	if authority.expires == nil {
+		authority.expires = make(map[string]int64)
+	}
+	now := time.Now().Unix()
+	for id, usage := range saved {
+		if usage.Expires > now && usage.Bytes > authority.usage[id] {
+			authority.usage[id] = usage.Bytes
+			authority.expires[id] = usage.Expires
+		}
+	}
+	return nil
+}
+
+// SaveUsage saves the usage of tokens that haven't expired to the Store,
+// forgetting the rest
+func (authority *GuestAuthority) SaveUsage() error {
+	if authority.Store == nil {
+		return nil
+	}
+	authority.mutex.Lock()
+	saved := make(map[string]*savedUsage, len(authority.usage))
+	now := time.Now().Unix()
+	for id, bytes := range authority.usage {
+		expires, known := authority.expires[id]
+		if !known {
+			expires = now + int64(GUEST_USAGE_RETENTION/time.Second)
+			if authority.expires == nil {
+				authority.expires = make(map[string]int64)
+			}
+			authority.expires[id] = expires
+		}
+		if expires <= now {
+			delete(authority.usage, id)
+			delete(authority.expires, id)
+			continue
+		}
+		saved[id] = &savedUsage{bytes, expires}
+	}
+	authority.mutex.Unlock()
+	if err := authority.Store.Set(GUEST_USAGE_KEY, saved, 0); err != nil {
+		return fmt.Errorf("Unable to save guest usage: %s", err)
+	}
+	return nil
+}
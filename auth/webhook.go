@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// WEBHOOK_CACHE_TTL is how long answers from the webhook are remembered
+	// if no CacheTTL is given
+	WEBHOOK_CACHE_TTL = 5 * time.Minute
+
+	// WEBHOOK_TIMEOUT limits how long a call to the webhook may take
+	WEBHOOK_TIMEOUT = 5 * time.Second
+
+	// WEBHOOK_MAX_CACHED bounds the memory used for remembering answers
+	WEBHOOK_MAX_CACHED = 100000
+)
+
+// WebhookRequest is what the Webhook POSTs (as JSON) to its URL.  The
+// endpoint answers with a 2xx status if the credentials are valid, and with
+// 401 or 403 if they aren't.  Any other answer counts as a failure.
+type WebhookRequest struct {
+	Credentials string `json:"credentials"` // as sent by the client, e.g. the token from -auth token:<token>
+	ClientIP    string `json:"clientIp"`
+}
+
+// Webhook is an Authenticator that has an external HTTP endpoint check the
+// credentials in each request, so that operators can authenticate clients
+// against an existing user database.  Answers are cached, so the endpoint
+// only sees each set of credentials once per CacheTTL.
+type Webhook struct {
+	URL      string        // endpoint to which credentials are POSTed
+	CacheTTL time.Duration // (optional) how long to remember answers, defaults to WEBHOOK_CACHE_TTL
+	FailOpen bool          // if true, requests with credentials are let through while the endpoint fails, otherwise they're rejected
+
+	client *http.Client
+	cache  map[string]*webhookAnswer // by hash of the credentials
+	mutex  sync.Mutex
+}
+
+type webhookAnswer struct {
+	err     error // nil if the credentials are valid
+	expires time.Time
+}
+
+func (webhook *Webhook) Authenticate(req *http.Request) error {
+	credentials := req.Header.Get(AUTH_HEADER)
+	if credentials == "" {
+		// Don't bother the endpoint with scanners and the like
+		return fmt.Errorf("Missing credentials")
+	}
+	sum := sha256.Sum256([]byte(credentials))
+	key := hex.EncodeToString(sum[:])
+	if err, found := webhook.cached(key); found {
+		return err
+	}
+
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	valid, err := webhook.call(&WebhookRequest{Credentials: credentials, ClientIP: ip})
+	if err != nil {
+		if webhook.FailOpen {
+			log.Errorf("Letting %s through, unable to check credentials: %s", req.RemoteAddr, err)
+			return nil
+		}
+		return fmt.Errorf("Unable to check credentials: %s", err)
+	}
+	var answer error
+	if !valid {
+		answer = fmt.Errorf("Credentials rejected by webhook")
+	}
+	webhook.remember(key, answer)
+	return answer
+}
+
+// call calls the endpoint, returning whether the credentials are valid, or an
+// error if the endpoint failed to answer
+func (webhook *Webhook) call(request *WebhookRequest) (bool, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return false, err
+	}
+	webhook.mutex.Lock()
+	if webhook.client == nil {
+		webhook.client = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	}
+	client := webhook.client
+	webhook.mutex.Unlock()
+
+	resp, err := client.Post(webhook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Webhook answered %s", resp.Status)
+	}
+}
+
+func (webhook *Webhook) cached(key string) (error, bool) {
+	webhook.mutex.Lock()
+	defer webhook.mutex.Unlock()
+	answer, found := webhook.cache[key]
+	if !found || time.Now().After(answer.expires) {
+		return nil, false
+	}
+	return answer.err, true
+}
+
+func (webhook *Webhook) remember(key string, answer error) {
+	ttl := webhook.CacheTTL
+	if ttl == 0 {
+		ttl = WEBHOOK_CACHE_TTL
+	}
+	now := time.Now()
+	webhook.mutex.Lock()
+	defer webhook.mutex.Unlock()
+	if webhook.cache == nil {
+		webhook.cache = make(map[string]*webhookAnswer)
+	}
+	if len(webhook.cache) >= WEBHOOK_MAX_CACHED {
+		for k, answer := range webhook.cache {
+			if now.After(answer.expires) {
+				delete(webhook.cache, k)
+			}
+		}
+		if len(webhook.cache) >= WEBHOOK_MAX_CACHED {
+			// Everything's still fresh, start over rather than grow
+			webhook.cache = make(map[string]*webhookAnswer)
+		}
+	}
+	webhook.cache[key] = &webhookAnswer{err: answer, expires: now.Add(ttl)}
+}
@@ -0,0 +1,361 @@
+// package balancer decides in which order the client tries the addresses at
+// which it can reach the server (the server itself or its masquerades), so
+// that connections can be spread across them rather than always going to the
+// first one that works.  It also tracks the health of each address for
+// debugging.
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	STRATEGY_FAILOVER      = "failover"     // always try addresses in the given order
+	STRATEGY_ROUND_ROBIN   = "roundrobin"   // start with the next address on each dial
+	STRATEGY_LEAST_LATENCY = "leastlatency" // start with the address that has been quickest to dial
+	STRATEGY_WEIGHTED      = "weighted"     // start with addresses in proportion to their weights
+
+	// UNHEALTHY_AFTER_FAILURES is how many consecutive failures make an
+	// address unhealthy
+	UNHEALTHY_AFTER_FAILURES = 3
+
+	// UNHEALTHY_BACKOFF is how long an unhealthy address is tried only after
+	// all healthy ones
+	UNHEALTHY_BACKOFF = 1 * time.Minute
+
+	// LATENCY_SMOOTHING is the weight given to the latest latency in the
+	// moving average
+	LATENCY_SMOOTHING = 0.3
+
+	// THROUGHPUT_MIN_BYTES is how much a measured connection must have read
+	// for its throughput to count, so that short requests (whose duration is
+	// mostly latency) don't skew the average
+	THROUGHPUT_MIN_BYTES = 256 * 1024
+)
+
+var (
+	Strategies = []string{STRATEGY_FAILOVER, STRATEGY_ROUND_ROBIN, STRATEGY_LEAST_LATENCY, STRATEGY_WEIGHTED}
+)
+
+// UpstreamStatus is the health of a single address
+type UpstreamStatus struct {
+	Addr                string        `json:"addr"`
+	Weight              int           `json:"weight"`
+	Healthy             bool          `json:"healthy"`
+	Successes           int64         `json:"successes"`
+	Failures            int64         `json:"failures"`
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	Latency             time.Duration `json:"latency"`    // moving average of the time taken by successful dials
+	Throughput          int64         `json:"throughput"` // moving average of bytes per second read on measured connections
+	LastDial            time.Time     `json:"lastDial"`
+	LastError           string        `json:"lastError,omitempty"`
+	current             int           // smooth weighted round-robin state
+}
+
+// Balancer orders addresses according to its strategy
+type Balancer struct {
+	strategy  string
+	weights   map[string]int
+	upstreams map[string]*UpstreamStatus
+	next      int // round-robin position
+	mutex     sync.Mutex
+}
+
+// New creates a Balancer using the given strategy.  weights (used by the
+// weighted strategy) are keyed by address or host, addresses without a
+// weight get a weight of 1.
+func New(strategy string, weights map[string]int) (*Balancer, error) {
+	known := false
+	for _, s := range Strategies {
+		known = known || s == strategy
+	}
+	if !known {
+		return nil, fmt.Errorf("Unknown balancing strategy %s, available strategies are %v", strategy, Strategies)
+	}
+	for host, weight := range weights {
+		if weight < 1 {
+			return nil, fmt.Errorf("Weight for %s must be at least 1, not %d", host, weight)
+		}
+	}
+	return &Balancer{
+		strategy:  strategy,
+		weights:   weights,
+		upstreams: make(map[string]*UpstreamStatus),
+	}, nil
+}
+
+// Strategy returns the Balancer's strategy
+func (b *Balancer) Strategy() string {
+	return b.strategy
+}
+
+// Order returns the given addresses in the order in which they should be
+// tried.  Unhealthy addresses come last, so that they're still tried if
+// nothing else works.  Addresses that are no longer among the given ones are
+// forgotten.
+func (b *Balancer) Order(addrs []string) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.forgetAllBut(addrs)
+	ordered := make([]string, len(addrs))
+	copy(ordered, addrs)
+	switch b.strategy {
+	case STRATEGY_ROUND_ROBIN:
+		if len(ordered) > 0 {
+			start := b.next % len(ordered)
+			ordered = append(ordered[start:], ordered[:start]...)
+			b.next = start + 1
+		}
+	case STRATEGY_LEAST_LATENCY:
+		sort.Stable(byLatency{ordered, b.upstreams})
+	case STRATEGY_WEIGHTED:
+		b.orderByWeight(ordered)
+	}
+
+	now := time.Now()
+	healthy := make([]string, 0, len(ordered))
+	var unhealthy []string
+	for _, addr := range ordered {
+		if b.upstream(addr).isHealthy(now) {
+			healthy = append(healthy, addr)
+		} else {
+			unhealthy = append(unhealthy, addr)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// OrderByThroughput is like Order, but puts the healthy addresses with the
+// highest throughput first, for connections that carry lots of data like
+// video.  Addresses whose throughput hasn't been measured yet come first, so
+// that they get measured.
+func (b *Balancer) OrderByThroughput(addrs []string) []string {
+	ordered := b.Order(addrs)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	healthy := 0
+	for healthy < len(ordered) && b.upstream(ordered[healthy]).isHealthy(now) {
+		healthy++
+	}
+	sort.Stable(byThroughput{ordered[:healthy], b.upstreams})
+	return ordered
+}
+
+// Record records the outcome of dialing addr, which took the given time
+func (b *Balancer) Record(addr string, latency time.Duration, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	upstream := b.upstream(addr)
+	upstream.LastDial = time.Now()
+	if err != nil {
+		upstream.Failures++
+		upstream.ConsecutiveFailures++
+		upstream.LastError = err.Error()
+		return
+	}
+	upstream.Successes++
+	upstream.ConsecutiveFailures = 0
+	if upstream.Latency == 0 {
+		upstream.Latency = latency
+	} else {
+		upstream.Latency = time.Duration(LATENCY_SMOOTHING*float64(latency) + (1-LATENCY_SMOOTHING)*float64(upstream.Latency))
+	}
+}
+
+// RecordThroughput records the throughput (in bytes per second) of a
+// connection to addr
+func (b *Balancer) RecordThroughput(addr string, bytesPerSecond int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	upstream := b.upstream(addr)
+	if upstream.Throughput == 0 {
+		upstream.Throughput = bytesPerSecond
+	} else {
+		upstream.Throughput = int64(LATENCY_SMOOTHING*float64(bytesPerSecond) + (1-LATENCY_SMOOTHING)*float64(upstream.Throughput))
+	}
+}
+
+// Measure wraps a connection to addr so that its throughput is recorded when
+// it's closed
+func (b *Balancer) Measure(addr string, conn net.Conn) net.Conn {
+	return &measuredConn{Conn: conn, addr: addr, balancer: b}
+}
+
+// Status returns a snapshot of the health of each address, sorted by address.
+// A nil Balancer has no status.
+func (b *Balancer) Status() []*UpstreamStatus {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	status := make([]*UpstreamStatus, 0, len(b.upstreams))
+	for _, upstream := range b.upstreams {
+		snapshot := *upstream
+		snapshot.Healthy = upstream.isHealthy(now)
+		status = append(status, &snapshot)
+	}
+	sort.Sort(byAddr(status))
+	return status
+}
+
+// upstream returns the status for addr, creating it if necessary.  Must be
+// called while holding the mutex.
+func (b *Balancer) upstream(addr string) *UpstreamStatus {
+	upstream, found := b.upstreams[addr]
+	if !found {
+		upstream = &UpstreamStatus{Addr: addr, Weight: b.weight(addr)}
+		b.upstreams[addr] = upstream
+	}
+	return upstream
+}
+
+func (b *Balancer) weight(addr string) int {
+	if weight, found := b.weights[addr]; found {
+		return weight
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		if weight, found := b.weights[host]; found {
+			return weight
+		}
+	}
+	return 1
+}
+
+// orderByWeight picks the first address using smooth weighted round-robin
+// (each address accumulates its weight on every pick and the picked one pays
+// back the total), followed by the remaining addresses by descending weight.
+// Must be called while holding the mutex.
+func (b *Balancer) orderByWeight(addrs []string) {
+	if len(addrs) == 0 {
+		return
+	}
+	total := 0
+	best := 0
+	for i, addr := range addrs {
+		upstream := b.upstream(addr)
+		upstream.current += upstream.Weight
+		total += upstream.Weight
+		if upstream.current > b.upstream(addrs[best]).current {
+			best = i
+		}
+	}
+	b.upstream(addrs[best]).current -= total
+	first := addrs[best]
+	rest := append(append([]string{}, addrs[:best]...), addrs[best+1:]...)
+	sort.Stable(byWeight{rest, b.upstreams})
+	copy(addrs, append([]string{first}, rest...))
+}
+
+// forgetAllBut drops the status of addresses that aren't among addrs.  Must
+// be called while holding the mutex.
+func (b *Balancer) forgetAllBut(addrs []string) {
+	for addr := range b.upstreams {
+		found := false
+		for _, candidate := range addrs {
+			found = found || candidate == addr
+		}
+		if !found {
+			delete(b.upstreams, addr)
+		}
+	}
+}
+
+// isHealthy determines whether the address should be tried before others
+func (upstream *UpstreamStatus) isHealthy(now time.Time) bool {
+	return upstream.ConsecutiveFailures < UNHEALTHY_AFTER_FAILURES || now.Sub(upstream.LastDial) > UNHEALTHY_BACKOFF
+}
+
+// byLatency sorts addresses by their average latency, with addresses that
+// haven't been dialed successfully yet first so that they get measured
+type byLatency struct {
+	addrs     []string
+	upstreams map[string]*UpstreamStatus
+}
+
+func (s byLatency) Len() int      { return len(s.addrs) }
+func (s byLatency) Swap(i, j int) { s.addrs[i], s.addrs[j] = s.addrs[j], s.addrs[i] }
+func (s byLatency) Less(i, j int) bool {
+	return s.latency(i) < s.latency(j)
+}
+
+func (s byLatency) latency(i int) time.Duration {
+	if upstream, found := s.upstreams[s.addrs[i]]; found {
+		return upstream.Latency
+	}
+	return 0
+}
+
+// byWeight sorts addresses by descending weight
+type byWeight struct {
+	addrs     []string
+	upstreams map[string]*UpstreamStatus
+}
+
+func (s byWeight) Len() int      { return len(s.addrs) }
+func (s byWeight) Swap(i, j int) { s.addrs[i], s.addrs[j] = s.addrs[j], s.addrs[i] }
+func (s byWeight) Less(i, j int) bool {
+	return s.upstreams[s.addrs[i]].Weight > s.upstreams[s.addrs[j]].Weight
+}
+
+// byThroughput sorts addresses by descending throughput, with addresses whose
+// throughput hasn't been measured yet first
+type byThroughput struct {
+	addrs     []string
+	upstreams map[string]*UpstreamStatus
+}
+
+func (s byThroughput) Len() int      { return len(s.addrs) }
+func (s byThroughput) Swap(i, j int) { s.addrs[i], s.addrs[j] = s.addrs[j], s.addrs[i] }
+func (s byThroughput) Less(i, j int) bool {
+	ti, tj := s.upstreams[s.addrs[i]].Throughput, s.upstreams[s.addrs[j]].Throughput
+	return (ti == 0 && tj != 0) || (tj != 0 && ti > tj)
+}
+
+type byAddr []*UpstreamStatus
+
+func (s byAddr) Len() int           { return len(s) }
+func (s byAddr) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byAddr) Less(i, j int) bool { return s[i].Addr < s[j].Addr }
+
+// measuredConn measures the rate at which data is read between its first and
+// last reads and records it with the balancer on Close
+type measuredConn struct {
+	net.Conn
+	addr      string
+	balancer  *Balancer
+	bytesRead int64
+	firstRead time.Time
+	lastRead  time.Time
+	closeOnce sync.Once
+}
+
+func (conn *measuredConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		now := time.Now()
+		if conn.firstRead.IsZero() {
+			conn.firstRead = now
+		}
+		conn.lastRead = now
+		conn.bytesRead += int64(n)
+	}
+	return n, err
+}
+
+func (conn *measuredConn) Close() error {
+	conn.closeOnce.Do(func() {
+		elapsed := conn.lastRead.Sub(conn.firstRead)
+		if conn.bytesRead >= THROUGHPUT_MIN_BYTES && elapsed > 0 {
+			conn.balancer.RecordThroughput(conn.addr, int64(float64(conn.bytesRead)/elapsed.Seconds()))
+		}
+	})
+	return conn.Conn.Close()
+}
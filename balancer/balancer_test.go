@@ -0,0 +1,139 @@
+package balancer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	addrs = []string{"a:443", "b:443", "c:443"}
+)
+
+func TestUnknownStrategy(t *testing.T) {
+	if _, err := New("random", nil); err == nil {
+		t.Error("Unknown strategy should have been rejected")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	b, _ := New(STRATEGY_FAILOVER, nil)
+	for i := 0; i < 3; i++ {
+		if ordered := b.Order(addrs); !reflect.DeepEqual(ordered, addrs) {
+			t.Errorf("Failover should keep order, got %v", ordered)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	b, _ := New(STRATEGY_ROUND_ROBIN, nil)
+	var firsts []string
+	for i := 0; i < 4; i++ {
+		ordered := b.Order(addrs)
+		if len(ordered) != len(addrs) {
+			t.Fatalf("Expected all addresses, got %v", ordered)
+		}
+		firsts = append(firsts, ordered[0])
+	}
+	if expected := []string{"a:443", "b:443", "c:443", "a:443"}; !reflect.DeepEqual(firsts, expected) {
+		t.Errorf("Expected rotation %v, got %v", expected, firsts)
+	}
+}
+
+func TestLeastLatency(t *testing.T) {
+	b, _ := New(STRATEGY_LEAST_LATENCY, nil)
+	b.Record("a:443", 300*time.Millisecond, nil)
+	b.Record("b:443", 100*time.Millisecond, nil)
+	if ordered := b.Order(addrs); !reflect.DeepEqual(ordered, []string{"c:443", "b:443", "a:443"}) {
+		t.Errorf("Expected unmeasured address then quickest first, got %v", ordered)
+	}
+	b.Record("c:443", 200*time.Millisecond, nil)
+	if ordered := b.Order(addrs); !reflect.DeepEqual(ordered, []string{"b:443", "c:443", "a:443"}) {
+		t.Errorf("Expected quickest first, got %v", ordered)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	b, _ := New(STRATEGY_WEIGHTED, map[string]int{"a": 3, "b:443": 2})
+	counts := make(map[string]int)
+	for i := 0; i < 60; i++ {
+		counts[b.Order(addrs)[0]]++
+	}
+	if expected := map[string]int{"a:443": 30, "b:443": 20, "c:443": 10}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected first picks %v, got %v", expected, counts)
+	}
+	if _, err := New(STRATEGY_WEIGHTED, map[string]int{"a": 0}); err == nil {
+		t.Error("Zero weight should have been rejected")
+	}
+}
+
+func TestUnhealthyLast(t *testing.T) {
+	b, _ := New(STRATEGY_FAILOVER, nil)
+	for i := 0; i < UNHEALTHY_AFTER_FAILURES; i++ {
+		b.Record("a:443", 0, fmt.Errorf("refused"))
+	}
+	if ordered := b.Order(addrs); !reflect.DeepEqual(ordered, []string{"b:443", "c:443", "a:443"}) {
+		t.Errorf("Expected unhealthy address last, got %v", ordered)
+	}
+	status := b.Status()
+	if len(status) != 3 || status[0].Healthy || status[0].LastError != "refused" || status[0].Failures != UNHEALTHY_AFTER_FAILURES {
+		t.Errorf("Unexpected status for unhealthy address: %+v", status[0])
+	}
+	b.upstreams["a:443"].LastDial = time.Now().Add(-2 * UNHEALTHY_BACKOFF)
+	if ordered := b.Order(addrs); !reflect.DeepEqual(ordered, addrs) {
+		t.Errorf("Expected unhealthy address to be retried after backoff, got %v", ordered)
+	}
+	b.Record("a:443", time.Millisecond, nil)
+	if !b.Status()[0].Healthy {
+		t.Error("Address should be healthy after success")
+	}
+}
+
+func TestForget(t *testing.T) {
+	b, _ := New(STRATEGY_FAILOVER, nil)
+	b.Order(addrs)
+	b.Order(addrs[1:])
+	if status := b.Status(); len(status) != 2 || status[0].Addr != "b:443" {
+		t.Errorf("Expected removed address to be forgotten, got %+v", status)
+	}
+}
+
+func TestOrderByThroughput(t *testing.T) {
+	b, _ := New(STRATEGY_FAILOVER, nil)
+	b.RecordThroughput("a:443", 1000)
+	b.RecordThroughput("c:443", 5000)
+	if ordered := b.OrderByThroughput(addrs); !reflect.DeepEqual(ordered, []string{"b:443", "c:443", "a:443"}) {
+		t.Errorf("Expected unmeasured address then fastest first, got %v", ordered)
+	}
+	b.RecordThroughput("b:443", 3000)
+	for i := 0; i < UNHEALTHY_AFTER_FAILURES; i++ {
+		b.Record("c:443", 0, fmt.Errorf("unreachable"))
+	}
+	if ordered := b.OrderByThroughput(addrs); !reflect.DeepEqual(ordered, []string{"b:443", "a:443", "c:443"}) {
+		t.Errorf("Expected fastest healthy address first and unhealthy last, got %v", ordered)
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	b, _ := New(STRATEGY_FAILOVER, nil)
+	local, remote := net.Pipe()
+	conn := b.Measure("a:443", local)
+	go func() {
+		chunk := make([]byte, 64*1024)
+		for i := 0; i < 8; i++ {
+			remote.Write(chunk)
+			time.Sleep(5 * time.Millisecond)
+		}
+		remote.Close()
+	}()
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+	status := b.Status()
+	if len(status) != 1 || status[0].Throughput <= 0 {
+		t.Errorf("Expected throughput to be recorded, got %v", status)
+	}
+}
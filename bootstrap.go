@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/getlantern/flashlight/atomicfile"
+	"github.com/getlantern/flashlight/bootstrap"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// BOOTSTRAP_DIR is the directory in the server's configdir from which
+	// bootstrap bundles are served
+	BOOTSTRAP_DIR = "bootstrap"
+
+	// BOOTSTRAPPED_CONFIG is the file in the client's configdir to which the
+	// config file fetched with -bootstrap is saved
+	BOOTSTRAPPED_CONFIG = "bootstrap.yaml"
+)
+
+// createBootstrapCode seals the -bootstrapconfig file into a bundle served by
+// the server and prints the code with which clients can fetch it
+func createBootstrapCode() {
+	config, err := ioutil.ReadFile(*bootstrapConfig)
+	if err != nil {
+		log.Fatalf("Unable to read bootstrap config: %s", err)
+	}
+	rendezvous := *bootstrapAt
+	if rendezvous == "" {
+		rendezvous = net.JoinHostPort(*upstreamHost, strconv.Itoa(*upstreamPort))
+	}
+	code, err := bootstrap.NewCode(rendezvous)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if code.String() == "" {
+		log.Fatalf("Invalid bootstrapat %s, expected host:port", rendezvous)
+	}
+	sealed, err := code.Seal(config)
+	if err != nil {
+		log.Fatalf("Unable to seal bootstrap config: %s", err)
+	}
+	dir := inConfigDir(BOOTSTRAP_DIR)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatalf("Unable to create %s: %s", dir, err)
+	}
+	bundle := filepath.Join(dir, code.Id())
+	if err := atomicfile.WriteFile(bundle, sealed, 0644); err != nil {
+		log.Fatalf("Unable to save bootstrap bundle: %s", err)
+	}
+	fmt.Printf("Bootstrap code:\n\n  %s\n\n", code)
+	fmt.Printf("Run the client with:\n\n  flashlight client -addr localhost:8080 -bootstrap %s\n\n", code)
+	fmt.Printf("The bundle is saved to %s and served by the server.  To serve it from another HTTPS host instead, create the code with -bootstrapat and upload the bundle there under %s%s\n", bundle, bootstrap.BOOTSTRAP_PATH, code.Id())
+}
+
+// applyBootstrap fetches the client's config file with the code given by
+// -bootstrap, saves it to the configdir and applies it
+func applyBootstrap(fs *flag.FlagSet) {
+	if *bootstrapCode == "" {
+		return
+	}
+	code, err := bootstrap.ParseCode(*bootstrapCode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Debugf("Fetching bootstrap bundle from %s", code.Addr)
+	config, err := code.Fetch()
+	if err != nil {
+		log.Fatal(err)
+	}
+	initConfigDir()
+	if err := os.MkdirAll(*configDir, 0700); err != nil {
+		log.Fatalf("Unable to create %s: %s", *configDir, err)
+	}
+	*configFile = inConfigDir(BOOTSTRAPPED_CONFIG)
+	if err := atomicfile.WriteFile(*configFile, config, 0600); err != nil {
+		log.Fatalf("Unable to save bootstrapped config: %s", err)
+	}
+	log.Debugf("Saved bootstrapped config to %s, run with -config %s from now on", *configFile, *configFile)
+	applyConfigFile(fs)
+}
@@ -0,0 +1,222 @@
+// package bootstrap gets a client going from a code that's short enough to be
+// sent by SMS or read out over the phone, for users who can't receive a full
+// config.
+//
+// A Code holds the address of a rendezvous (an HTTPS host, e.g. the server
+// itself or a front, that serves the bundle at BOOTSTRAP_PATH) and a key.
+// The bundle is the client's full config file, sealed with the key, so the
+// rendezvous needn't be trusted (its certificate isn't verified, the client
+// doesn't have the server's root CA yet).  The bundle's path is derived from
+// the key, so the code doesn't need to contain it.
+package bootstrap
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// BOOTSTRAP_PATH is the path under which bundles are served, followed by
+	// their Id
+	BOOTSTRAP_PATH = "/flashlight-bootstrap/"
+
+	// KEY_LENGTH is the length of the key with which bundles are sealed
+	KEY_LENGTH = 16
+
+	// MAX_BUNDLE_LENGTH limits the size of fetched bundles
+	MAX_BUNDLE_LENGTH = 64 * 1024
+
+	// FETCH_TIMEOUT limits how long fetching a bundle may take
+	FETCH_TIMEOUT = 1 * time.Minute
+
+	// GROUP_LENGTH is the number of characters between dashes in a formatted
+	// code, which makes it easier to read out
+	GROUP_LENGTH = 4
+)
+
+const (
+	ADDR_IPV4 = 1
+	ADDR_IPV6 = 2
+	ADDR_NAME = 3
+)
+
+var (
+	encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// Code is what the user needs to bootstrap a client
+type Code struct {
+	Addr string // host:port of the rendezvous
+	Key  []byte // key with which the bundle is sealed
+}
+
+// NewCode creates a Code with a new random key for the given rendezvous
+func NewCode(addr string) (*Code, error) {
+	key := make([]byte, KEY_LENGTH)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("Unable to generate bootstrap key: %s", err)
+	}
+	return &Code{Addr: addr, Key: key}, nil
+}
+
+// String encodes the code in base32, in dash-separated groups
+func (code *Code) String() string {
+	host, portString, err := net.SplitHostPort(code.Addr)
+	if err != nil {
+		return ""
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return ""
+	}
+	var b bytes.Buffer
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		b.WriteByte(ADDR_IPV4)
+		b.Write(ip.To4())
+	case ip != nil:
+		b.WriteByte(ADDR_IPV6)
+		b.Write(ip.To16())
+	case len(host) > 255:
+		return ""
+	default:
+		b.WriteByte(ADDR_NAME)
+		b.WriteByte(byte(len(host)))
+		b.WriteString(host)
+	}
+	binary.Write(&b, binary.BigEndian, uint16(port))
+	b.Write(code.Key)
+
+	encoded := encoding.EncodeToString(b.Bytes())
+	var groups []string
+	for len(encoded) > GROUP_LENGTH {
+		groups = append(groups, encoded[:GROUP_LENGTH])
+		encoded = encoded[GROUP_LENGTH:]
+	}
+	return strings.Join(append(groups, encoded), "-")
+}
+
+// ParseCode parses a code as returned by String, ignoring case, dashes and
+// whitespace
+func ParseCode(s string) (*Code, error) {
+	s = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(s))
+	data, err := encoding.DecodeString(s)
+	if err != nil || len(data) < 1 {
+		return nil, fmt.Errorf("Unable to decode bootstrap code, check for typos")
+	}
+	kind, data := data[0], data[1:]
+	var host string
+	switch {
+	case kind == ADDR_IPV4 && len(data) >= 4:
+		host, data = net.IP(data[:4]).String(), data[4:]
+	case kind == ADDR_IPV6 && len(data) >= 16:
+		host, data = net.IP(data[:16]).String(), data[16:]
+	case kind == ADDR_NAME && len(data) >= 1 && len(data) >= 1+int(data[0]):
+		host, data = string(data[1:1+data[0]]), data[1+data[0]:]
+	default:
+		return nil, fmt.Errorf("Bootstrap code is truncated or unknown")
+	}
+	if len(data) != 2+KEY_LENGTH {
+		return nil, fmt.Errorf("Bootstrap code is truncated or unknown")
+	}
+	port := binary.BigEndian.Uint16(data)
+	return &Code{
+		Addr: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		Key:  data[2:],
+	}, nil
+}
+
+// Id returns the id under which the code's bundle is stored and served
+func (code *Code) Id() string {
+	return Id(code.Key)
+}
+
+// Id returns the id under which the bundle sealed with key is stored and
+// served.  It's derived from the key, but doesn't reveal it.
+func Id(key []byte) string {
+	sum := sha256.Sum256(append([]byte("flashlight bootstrap id "), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Seal seals a bundle with the code's key
+func (code *Code) Seal(bundle []byte) ([]byte, error) {
+	aead, err := newAEAD(code.Key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	return aead.Seal(nonce, nonce, bundle, nil), nil
+}
+
+// Open opens a bundle sealed with the code's key
+func (code *Code) Open(sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(code.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("Bootstrap bundle is truncated")
+	}
+	bundle, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Bootstrap bundle doesn't match the code: %s", err)
+	}
+	return bundle, nil
+}
+
+// Fetch fetches the code's bundle from the rendezvous and opens it
+func (code *Code) Fetch() ([]byte, error) {
+	client := &http.Client{
+		Timeout: FETCH_TIMEOUT,
+		Transport: &http.Transport{
+			// The bundle is authenticated by the key, and the rendezvous
+			// most likely has a certificate that we can't verify yet
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get("https://" + code.Addr + BOOTSTRAP_PATH + code.Id())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch bootstrap bundle: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to fetch bootstrap bundle, got %s", resp.Status)
+	}
+	sealed, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_BUNDLE_LENGTH))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read bootstrap bundle: %s", err)
+	}
+	return code.Open(sealed)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bootstrap key: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,64 @@
+package bootstrap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCodes(t *testing.T) {
+	for _, addr := range []string{"203.0.113.7:443", "[2001:db8::1]:8443", "cdn.example.com:443"} {
+		code, err := NewCode(addr)
+		if err != nil {
+			t.Fatalf("Unable to create code: %s", err)
+		}
+		s := code.String()
+		// Users may read it out or retype it sloppily
+		parsed, err := ParseCode(strings.ToLower(strings.Replace(s, "-", " ", -1)))
+		if err != nil {
+			t.Fatalf("Unable to parse %s: %s", s, err)
+		}
+		if parsed.Addr != addr || parsed.Id() != code.Id() {
+			t.Errorf("Code for %s came back as %s", addr, parsed.Addr)
+		}
+	}
+
+	code, _ := NewCode("203.0.113.7:443")
+	if n := len(strings.Replace(code.String(), "-", "", -1)); n > 40 {
+		t.Errorf("Code for an IPv4 rendezvous should fit in an SMS easily, but is %d characters", n)
+	}
+	if _, err := ParseCode(code.String()[:20]); err == nil {
+		t.Error("Truncated code should have failed")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	code, _ := NewCode("127.0.0.1:0")
+	sealed, err := code.Seal([]byte("server: example.com\n"))
+	if err != nil {
+		t.Fatalf("Unable to seal: %s", err)
+	}
+	rendezvous := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != BOOTSTRAP_PATH+code.Id() {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp.Write(sealed)
+	}))
+	defer rendezvous.Close()
+	code.Addr = rendezvous.Listener.Addr().String()
+
+	bundle, err := code.Fetch()
+	if err != nil {
+		t.Fatalf("Unable to fetch: %s", err)
+	}
+	if string(bundle) != "server: example.com\n" {
+		t.Errorf("Unexpected bundle %q", bundle)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := code.Fetch(); err == nil {
+		t.Error("Tampered bundle should have been rejected")
+	}
+}
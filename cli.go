@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/companion"
+	"github.com/getlantern/flashlight/instance"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/proxy"
+)
+
+const (
+	COMMAND_USAGE = `Commands for controlling a running client:
+  flashlight status [-json]              show the client's status
+  flashlight bypass on|off               turn the quick bypass on or off
+  flashlight bypass add <host>           send requests to host directly
+  flashlight bypass proxy <host>         always tunnel requests to host
+  flashlight bypass remove <host>        remove the override for host
+                                         host may be a pattern like *.example.com or /regex/
+  flashlight dump <host> headers|bodies  dump requests to host to the client's log
+  flashlight dump <host> off             stop dumping requests to host
+  flashlight loglevel                    show the log levels
+  flashlight loglevel <level>            set the log level (debug, info, warn or error)
+  flashlight loglevel <module> <level>   set the log level of a module (package) like proxy
+  flashlight loglevel <module> default   make the module use the log level again
+  flashlight reload                      reload server, masquerade, dumpheaders and loglevel from the config file`
+)
+
+// lockFile is the lockfile held by the running client
+func lockFile() string {
+	return inConfigDir("client.lock")
+}
+
+// startControlling serves the control endpoint for the given client on a
+// random localhost port (or a unix socket in the configdir with -controlsocket)
+// and records it in the lockfile, exiting if another client is already running.
+func (app *App) startControlling(client *proxy.Client, companionServer *companion.Server) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		log.Fatalf("Unable to generate control token: %s", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+	info := &instance.Info{
+		PID:          os.Getpid(),
+		Addr:         client.Addr,
+		ControlToken: token,
+	}
+	var l net.Listener
+	var err error
+	if *controlSocket {
+		// The socket's address is known up front, so lock first.  Whatever is
+		// left at the address once we hold the lock is stale.
+		info.ControlNet, info.ControlAddr = "unix", inConfigDir("control.sock")
+		app.acquireInstanceLock(info)
+		os.Remove(info.ControlAddr)
+		if l, err = net.Listen("unix", info.ControlAddr); err != nil {
+			log.Fatalf("Unable to listen for control requests: %s", err)
+		}
+		// Only our user may connect, on top of needing the token
+		if err := os.Chmod(info.ControlAddr, 0600); err != nil {
+			log.Fatalf("Unable to restrict access to control socket: %s", err)
+		}
+	} else {
+		if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			log.Fatalf("Unable to listen for control requests: %s", err)
+		}
+		info.ControlNet, info.ControlAddr = "tcp", l.Addr().String()
+		app.acquireInstanceLock(info)
+	}
+	go func() {
+		err := http.Serve(l, companionServer.ControlHandler(token))
+		if err != nil {
+			log.Errorf("Unable to serve control endpoint: %s", err)
+		}
+	}()
+}
+
+// acquireInstanceLock locks the configdir for this instance, exiting if
+// another one is running
+func (app *App) acquireInstanceLock(info *instance.Info) {
+	var err error
+	app.instanceLock, err = instance.Acquire(lockFile(), info)
+	if err != nil {
+		if _, running := err.(*instance.AlreadyRunningError); running {
+			log.Fatalf("%s.  Stop it first, or control it with 'flashlight status' and friends.", err)
+		}
+		log.Fatalf("Unable to lock configdir: %s", err)
+	}
+}
+
+// runCommand runs a command against the running client, exiting with status 1
+// if it fails.
+func runCommand(args []string) {
+	req, err := commandRequest(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n\n%s\n", err, COMMAND_USAGE)
+		os.Exit(1)
+	}
+	resp, err := sendCommand(req)
+	if *jsonOutput {
+		if err != nil {
+			resp = &companion.Response{Type: req.Type, Error: err.Error()}
+		}
+		printJSON(resp)
+		if !resp.OK {
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !resp.OK {
+		log.Fatal(resp.Error)
+	}
+	if resp.Status != nil {
+		printStatus(resp.Status)
+	}
+	if resp.LogLevels != "" {
+		fmt.Println(resp.LogLevels)
+	}
+}
+
+// commandRequest translates command line arguments into a companion request
+func commandRequest(args []string) (*companion.Request, error) {
+	switch {
+	case len(args) == 1 && args[0] == "status":
+		return &companion.Request{Type: "status"}, nil
+	case len(args) == 2 && args[0] == "bypass" && (args[1] == "on" || args[1] == "off"):
+		return &companion.Request{Type: "bypass", Enabled: args[1] == "on"}, nil
+	case len(args) == 3 && args[0] == "bypass":
+		routes := map[string]string{"add": proxy.ROUTE_DIRECT, "proxy": proxy.ROUTE_PROXY, "remove": ""}
+		route, found := routes[args[1]]
+		if found {
+			return &companion.Request{Type: "route", Host: args[2], Route: route}, nil
+		}
+	}
+	if len(args) == 1 && args[0] == "reload" {
+		return &companion.Request{Type: "reload"}, nil
+	}
+	if len(args) == 3 && args[0] == "dump" {
+		level := args[2]
+		if level == "off" {
+			level = proxy.DUMP_OFF
+		}
+		return &companion.Request{Type: "dump", Host: args[1], Level: level}, nil
+	}
+	if len(args) >= 1 && len(args) <= 3 && args[0] == "loglevel" {
+		req := &companion.Request{Type: "loglevel"}
+		if len(args) == 2 {
+			req.Level = args[1]
+		} else if len(args) == 3 {
+			req.Module, req.Level = args[1], args[2]
+		}
+		return req, nil
+	}
+	return nil, fmt.Errorf("Unknown command: %s", strings.Join(args, " "))
+}
+
+// sendCommand sends the request to the running client's control endpoint
+func sendCommand(req *companion.Request) (*companion.Response, error) {
+	info, err := instance.Find(lockFile())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find running client: %s", err)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to marshal command: %s", err)
+	}
+	httpReq, err := http.NewRequest("POST", "http://flashlight/", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to build command request: %s", err)
+	}
+	httpReq.Header.Set(companion.CONTROL_TOKEN_HEADER, info.ControlToken)
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return info.DialControl()
+			},
+		},
+	}
+	httpResp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to send command: %s", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Client refused command: %s", httpResp.Status)
+	}
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read command response: %s", err)
+	}
+	resp := &companion.Response{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return nil, fmt.Errorf("Unable to parse command response: %s", err)
+	}
+	return resp, nil
+}
+
+// printJSON prints the response as JSON, for consumption by scripts
+func printJSON(resp *companion.Response) {
+	data, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		log.Fatalf("Unable to marshal response: %s", err)
+	}
+	fmt.Println(string(data))
+}
+
+func printStatus(status *proxy.ClientStatus) {
+	fmt.Printf("Proxying at: %s\n", status.Addr)
+	fmt.Printf("Connected:   %v (via %s to %s, last dialed %s)\n", status.Connected, status.Transport, status.Upstream, status.LastDial)
+	fmt.Printf("Traffic:     %d bytes up, %d bytes down\n", status.BytesUp, status.BytesDown)
+	fmt.Printf("Bypass:      %v\n", status.Bypass)
+	for host, route := range status.Overrides {
+		fmt.Printf("Override:    %s -> %s\n", host, route)
+	}
+	for host, level := range status.Dumping {
+		fmt.Printf("Dumping:     %s for %s\n", level, host)
+	}
+	for _, device := range status.Devices {
+		fmt.Printf("Device:      %s (%d bytes up, %d bytes down, last seen %s)\n", device.IP, device.BytesUp, device.BytesDown, device.LastSeen)
+	}
+	for _, upstream := range status.Upstreams {
+		fmt.Printf("Upstream:    %s (healthy: %v, weight %d, %d ok, %d failed, latency %s)\n", upstream.Addr, upstream.Healthy, upstream.Weight, upstream.Successes, upstream.Failures, upstream.Latency)
+	}
+	for _, notice := range status.Notices {
+		fmt.Printf("Notice:      %s (posted %s)\n", notice.Message, notice.Posted.Format(time.RFC3339))
+	}
+	for _, recent := range status.RecentErrors {
+		fmt.Printf("Error:       %s %s\n", recent.Time.Format(time.RFC3339), recent.Error)
+	}
+}
@@ -0,0 +1,209 @@
+// package cloak hides a TLS server from probes by requiring clients to open
+// each connection with a preamble authenticated by a pre-shared key, before
+// the TLS handshake.  Connections without a valid preamble never see the
+// server's TLS handshake (and thus its certificate); instead they're handed to
+// a decoy or, absent one, simply closed after a random delay.
+//
+// The preamble consists of a random nonce, the current unix time and an
+// HMAC-SHA256 of both keyed with the PSK.  Stale timestamps and reused nonces
+// are rejected, so recorded preambles can't be replayed.
+package cloak
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	NONCE_LENGTH    = 16
+	PREAMBLE_LENGTH = NONCE_LENGTH + 8 + sha256.Size
+
+	// MAX_SKEW is how far the client's clock may be from the server's
+	MAX_SKEW = 2 * time.Minute
+
+	// PREAMBLE_TIMEOUT is how long the server waits for the preamble
+	PREAMBLE_TIMEOUT = 10 * time.Second
+)
+
+// Dial dials the given address and sends the preamble for the given PSK.  The
+// returned connection is ready for the TLS handshake.
+func Dial(dialer *net.Dialer, network string, addr string, psk []byte) (net.Conn, error) {
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := Start(conn, psk); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Start sends the preamble for the given PSK on an already established
+// connection (e.g. one that's obfuscated), after which it's ready for the TLS
+// handshake.
+func Start(conn net.Conn, psk []byte) error {
+	preamble, err := NewPreamble(psk)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(preamble); err != nil {
+		return fmt.Errorf("Unable to write preamble: %s", err)
+	}
+	return nil
+}
+
+// NewPreamble creates a new preamble for the given PSK
+func NewPreamble(psk []byte) ([]byte, error) {
+	preamble := make([]byte, PREAMBLE_LENGTH)
+	if _, err := rand.Read(preamble[:NONCE_LENGTH]); err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	binary.BigEndian.PutUint64(preamble[NONCE_LENGTH:], uint64(time.Now().Unix()))
+	copy(preamble[NONCE_LENGTH+8:], mac(psk, preamble[:NONCE_LENGTH+8]))
+	return preamble, nil
+}
+
+// Verifier verifies preambles, remembering their nonces to reject replays
+type Verifier struct {
+	PSK []byte
+
+	nonces map[string]time.Time
+	mutex  sync.Mutex
+}
+
+// Verify verifies the preamble
+func (v *Verifier) Verify(preamble []byte) error {
+	if len(preamble) != PREAMBLE_LENGTH {
+		return fmt.Errorf("Preamble has wrong length %d", len(preamble))
+	}
+	if !hmac.Equal(preamble[NONCE_LENGTH+8:], mac(v.PSK, preamble[:NONCE_LENGTH+8])) {
+		return fmt.Errorf("Invalid preamble")
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(preamble[NONCE_LENGTH:])), 0)
+	now := time.Now()
+	if skew := now.Sub(timestamp); skew > MAX_SKEW || skew < -MAX_SKEW {
+		return fmt.Errorf("Preamble timestamp off by %s", skew)
+	}
+	nonce := string(preamble[:NONCE_LENGTH])
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.nonces == nil {
+		v.nonces = make(map[string]time.Time)
+	}
+	for n, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, n)
+		}
+	}
+	if _, used := v.nonces[nonce]; used {
+		return fmt.Errorf("Preamble replayed")
+	}
+	v.nonces[nonce] = now.Add(2 * MAX_SKEW)
+	return nil
+}
+
+// Listener is a net.Listener that only accepts connections that start with a
+// valid preamble (which is consumed).
+type Listener struct {
+	net.Listener
+	PSK   []byte // the pre-shared key
+	Decoy string // (optional) address (e.g. of an innocuous web server) to which to forward connections without a valid preamble
+
+	verifier  *Verifier
+	accepted  chan net.Conn
+	errors    chan error
+	startOnce sync.Once
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() {
+		l.accepted = make(chan net.Conn)
+		l.errors = make(chan error)
+		l.verifier = &Verifier{PSK: l.PSK}
+		go l.acceptRaw()
+	})
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case err := <-l.errors:
+		return nil, err
+	}
+}
+
+// acceptRaw accepts connections from the underlying listener and checks their
+// preambles in the background, so that slow or malicious clients can't block
+// others.
+func (l *Listener) acceptRaw() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.errors <- err
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.checkPreamble(conn)
+	}
+}
+
+func (l *Listener) checkPreamble(conn net.Conn) {
+	preamble := make([]byte, PREAMBLE_LENGTH)
+	conn.SetReadDeadline(time.Now().Add(PREAMBLE_TIMEOUT))
+	n, err := io.ReadFull(conn, preamble)
+	conn.SetReadDeadline(time.Time{})
+	if err == nil {
+		err = l.verifier.Verify(preamble)
+	}
+	if err != nil {
+		log.Debugf("Rejecting connection from %s: %s", conn.RemoteAddr(), err)
+		l.reject(conn, preamble[:n])
+		return
+	}
+	l.accepted <- conn
+}
+
+// reject hands the connection to the decoy, replaying whatever was already
+// read from it, or closes it after a random delay if there's no decoy.
+func (l *Listener) reject(conn net.Conn, alreadyRead []byte) {
+	if l.Decoy == "" {
+		delay, _ := rand.Int(rand.Reader, big.NewInt(int64(PREAMBLE_TIMEOUT)))
+		time.Sleep(time.Duration(delay.Int64()))
+		conn.Close()
+		return
+	}
+	decoy, err := net.DialTimeout("tcp", l.Decoy, PREAMBLE_TIMEOUT)
+	if err != nil {
+		log.Errorf("Unable to dial decoy: %s", err)
+		conn.Close()
+		return
+	}
+	if _, err := decoy.Write(alreadyRead); err != nil {
+		conn.Close()
+		decoy.Close()
+		return
+	}
+	go func() {
+		io.Copy(decoy, conn)
+		decoy.Close()
+	}()
+	io.Copy(conn, decoy)
+	conn.Close()
+}
+
+func mac(psk []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, psk)
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,61 @@
+package cloak
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloak(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	l := &Listener{Listener: raw, PSK: []byte("s3cret")}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+
+	conn, err := Dial(dialer, "tcp", raw.Addr().String(), []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	data, _ := ioutil.ReadAll(conn)
+	if string(data) != "hello" {
+		t.Errorf("Valid preamble not accepted, got: %s", data)
+	}
+
+	conn, err = Dial(dialer, "tcp", raw.Addr().String(), []byte("wrong"))
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(PREAMBLE_TIMEOUT + time.Second))
+	data, _ = ioutil.ReadAll(conn)
+	if len(data) != 0 {
+		t.Errorf("Invalid preamble accepted, got: %s", data)
+	}
+}
+
+func TestReplayRejected(t *testing.T) {
+	v := &Verifier{PSK: []byte("s3cret")}
+	preamble, err := NewPreamble(v.PSK)
+	if err != nil {
+		t.Fatalf("Unable to create preamble: %s", err)
+	}
+	if err := v.Verify(preamble); err != nil {
+		t.Fatalf("Valid preamble rejected: %s", err)
+	}
+	if err := v.Verify(preamble); err == nil {
+		t.Error("Replayed preamble accepted")
+	}
+}
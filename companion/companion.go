@@ -0,0 +1,208 @@
+// package companion implements a localhost WebSocket endpoint that lets a
+// companion browser extension inspect and control the client proxy.
+//
+// Messages are JSON objects.  Requests look like:
+//
+//	{"id": 1, "type": "status"}
+//	{"id": 2, "type": "bypass", "enabled": true}
+//	{"id": 3, "type": "route", "host": "example.com", "route": "direct"}
+//	{"id": 4, "type": "dump", "host": "example.com", "level": "headers"}
+//	{"id": 5, "type": "reload"}
+//
+// and responses echo the id and type along with "ok", an optional "error" and
+// (for status) the client's "status".  A route of "" removes the override for
+// the host, which the extension can use to implement per-tab overrides by
+// overriding the hosts used by a tab.  A dump level ("headers", "bodies" or ""
+// for off) enables dumping requests to a single host to the log.
+//
+// Any local process can connect to localhost and claim an extension's Origin,
+// so the extension has to be paired: it connects with the server's Token in
+// the token query parameter (e.g. ws://localhost:15678/?token=...).
+package companion
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/flashlight/admin"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/proxy"
+	"github.com/getlantern/flashlight/websocket"
+)
+
+var (
+	// Origins from which browser extensions connect
+	extensionOrigins = []string{"chrome-extension://", "moz-extension://", "safari-web-extension://"}
+)
+
+// Server serves the companion protocol
+type Server struct {
+	Addr           string        // address at which to listen, must be on localhost
+	Token          string        // secret with which the extension pairs, passed in the token query parameter
+	Client         *proxy.Client // the client proxy being controlled
+	AllowedOrigins []string      // (optional) additional origins allowed to connect
+	Reload         func() error  // (optional) reloads the client's configuration
+}
+
+// Request is a request from the extension
+type Request struct {
+	Id      int    `json:"id"`
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Route   string `json:"route,omitempty"`
+	Level   string `json:"level,omitempty"`
+	Module  string `json:"module,omitempty"`
+}
+
+// Response is a response to the extension
+type Response struct {
+	Id     int                 `json:"id"`
+	Type   string              `json:"type"`
+	OK     bool                `json:"ok"`
+	Error  string              `json:"error,omitempty"`
+	Status *proxy.ClientStatus `json:"status,omitempty"`
+
+	LogLevels string `json:"logLevels,omitempty"` // global level followed by module levels, e.g. "info proxy=debug"
+}
+
+// ListenAndServe starts serving the companion protocol
+func (server *Server) ListenAndServe() error {
+	if !admin.IsLocalhost(server.Addr) {
+		return fmt.Errorf("The companion endpoint must be on localhost (e.g. 127.0.0.1:15678), got %s", server.Addr)
+	}
+	if server.Token == "" {
+		return fmt.Errorf("The companion endpoint requires a token")
+	}
+	httpServer := &http.Server{
+		Addr:    server.Addr,
+		Handler: http.HandlerFunc(server.serveWebSocket),
+	}
+	log.Infof("About to start companion endpoint at %s", server.Addr)
+	return httpServer.ListenAndServe()
+}
+
+func (server *Server) serveWebSocket(resp http.ResponseWriter, req *http.Request) {
+	// Web pages can open WebSockets to localhost too, so only accept
+	// connections from extensions
+	if !server.originAllowed(req.Header.Get("Origin")) {
+		log.Errorf("Rejecting companion connection from origin: %s", req.Header.Get("Origin"))
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// ... and even those could be forged, so require the pairing token
+	if subtle.ConstantTimeCompare([]byte(req.URL.Query().Get("token")), []byte(server.Token)) != 1 {
+		log.Errorf("Rejecting companion connection from %s with bad token", req.RemoteAddr)
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	conn, err := websocket.Upgrade(resp, req)
+	if err != nil {
+		log.Errorf("Unable to upgrade companion connection: %s", err)
+		return
+	}
+	defer conn.Close()
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Unable to read from companion: %s", err)
+			}
+			return
+		}
+		reply, err := json.Marshal(server.Handle(msg))
+		if err != nil {
+			log.Errorf("Unable to marshal companion response: %s", err)
+			return
+		}
+		if err := conn.WriteMessage(websocket.OP_TEXT, reply); err != nil {
+			log.Errorf("Unable to write to companion: %s", err)
+			return
+		}
+	}
+}
+
+// Handle handles a single JSON encoded request
+func (server *Server) Handle(msg []byte) *Response {
+	req := &Request{}
+	if err := json.Unmarshal(msg, req); err != nil {
+		return &Response{Error: fmt.Sprintf("Unable to parse request: %s", err)}
+	}
+	resp := &Response{Id: req.Id, Type: req.Type, OK: true}
+	switch req.Type {
+	case "status":
+		resp.Status = server.Client.Status()
+	case "bypass":
+		if err := server.Client.SetBypass(req.Enabled); err != nil {
+			resp.Error = err.Error()
+		}
+	case "route":
+		if req.Host == "" {
+			resp.Error = "Missing host"
+		} else if err := server.Client.SetRouteOverride(req.Host, req.Route); err != nil {
+			resp.Error = err.Error()
+		}
+	case "reload":
+		if server.Reload == nil {
+			resp.Error = "Reloading not supported"
+		} else if err := server.Reload(); err != nil {
+			resp.Error = err.Error()
+		}
+	case "dump":
+		if req.Host == "" {
+			resp.Error = "Missing host"
+		} else if err := server.Client.SetDumpLevel(req.Host, req.Level); err != nil {
+			resp.Error = err.Error()
+		}
+	case "loglevel":
+		if err := setLogLevel(req.Module, req.Level); err != nil {
+			resp.Error = err.Error()
+		}
+		resp.LogLevels = log.Levels()
+	default:
+		resp.Error = fmt.Sprintf("Unknown request type: %s", req.Type)
+	}
+	resp.OK = resp.Error == ""
+	return resp
+}
+
+// setLogLevel sets the global log level, or the level of module if given.  An
+// empty level changes nothing and the level "default" makes the module use
+// the global level again.
+func setLogLevel(module string, level string) error {
+	if level == "" {
+		return nil
+	}
+	if module != "" && level == "default" {
+		log.ClearModuleLevel(module)
+		return nil
+	}
+	parsed, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if module == "" {
+		log.SetLevel(parsed)
+	} else {
+		log.SetModuleLevel(module, parsed)
+	}
+	return nil
+}
+
+func (server *Server) originAllowed(origin string) bool {
+	for _, prefix := range extensionOrigins {
+		if strings.HasPrefix(origin, prefix) {
+			return true
+		}
+	}
+	for _, allowed := range server.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
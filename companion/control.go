@@ -0,0 +1,47 @@
+package companion
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// CONTROL_TOKEN_HEADER carries the secret required by the control endpoint
+	CONTROL_TOKEN_HEADER = "X-Flashlight-Control-Token"
+)
+
+// ControlHandler returns a plain HTTP handler for the companion protocol, used
+// by command line invocations to control the running client.  Each request is
+// a POST of a single JSON Request, answered with a JSON Response.  Since any
+// local process (including web pages) can reach localhost, requests must
+// carry the given token in CONTROL_TOKEN_HEADER.
+func (server *Server) ControlHandler(token string) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get(CONTROL_TOKEN_HEADER)), []byte(token)) != 1 {
+			log.Errorf("Rejecting control request from %s with bad token", req.RemoteAddr)
+			resp.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if req.Method != "POST" {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		msg, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reply, err := json.Marshal(server.Handle(msg))
+		if err != nil {
+			log.Errorf("Unable to marshal control response: %s", err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(reply)
+	})
+}
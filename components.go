@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/getlantern/flashlight/admin"
+	"github.com/getlantern/flashlight/atomicfile"
+	"github.com/getlantern/flashlight/dashboard"
+	"github.com/getlantern/flashlight/lifecycle"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/metrics"
+)
+
+// addComponents adds the subsystems that make up a running client or server
+// to the App's lifecycle, so that they start in order and stop in reverse on
+// shutdown.  Subcommands start only the ones they need.
+func (app *App) addComponents(registry *metrics.Registry) {
+	var metricsListener, debugListener net.Listener
+
+	app.lifecycle.Add(&lifecycle.Component{
+		Name: "profiling",
+		Start: func() error {
+			if *cpuprofile != "" {
+				startCPUProfiling(*cpuprofile)
+			}
+			return nil
+		},
+		Stop: func() error {
+			if *cpuprofile != "" {
+				stopCPUProfiling(*cpuprofile)
+			}
+			if *memprofile != "" {
+				saveMemProfile(*memprofile)
+			}
+			return nil
+		},
+	})
+	app.lifecycle.Add(&lifecycle.Component{
+		Name: "metrics",
+		Start: func() error {
+			if *pushGateway != "" {
+				startPushingMetrics(registry)
+			}
+			if *statsdAddr != "" {
+				startSendingMetricsToStatsD(registry)
+			}
+			if *metricsAddr != "" {
+				metricsListener = serveMetrics(registry)
+			}
+			return nil
+		},
+		Stop: func() error {
+			return closeIfOpen(metricsListener)
+		},
+	})
+	app.lifecycle.Add(&lifecycle.Component{
+		Name:      "debug",
+		DependsOn: []string{"metrics"},
+		Start: func() error {
+			if *debugAddr != "" {
+				debugListener = app.serveDebug(registry)
+			}
+			return nil
+		},
+		Stop: func() error {
+			return closeIfOpen(debugListener)
+		},
+	})
+	app.lifecycle.Add(&lifecycle.Component{
+		// The certificates of clients, the server's are managed by
+		// proxy.Server
+		Name: "certs",
+		Start: func() error {
+			app.loadClientCerts()
+			return nil
+		},
+	})
+	app.lifecycle.Add(&lifecycle.Component{
+		// The self-tests dial the server like the client does
+		Name:      "selftests",
+		DependsOn: []string{"certs"},
+		Start: func() error {
+			app.runSelfTests()
+			return nil
+		},
+	})
+	app.lifecycle.Add(&lifecycle.Component{
+		Name:      "proxy",
+		DependsOn: []string{"profiling", "metrics", "certs", "selftests"},
+		Start: func() error {
+			if app.isClient() {
+				app.runClientProxy(proxyConfig(), registry)
+			} else {
+				app.runServerProxy(proxyConfig(), registry)
+			}
+			return nil
+		},
+		Stop: func() error {
+			if app.instanceLock != nil {
+				return app.instanceLock.Release()
+			}
+			return nil
+		},
+	})
+	var board *dashboard.Dashboard
+	app.lifecycle.Add(&lifecycle.Component{
+		Name:      "dashboard",
+		DependsOn: []string{"proxy"},
+		Start: func() error {
+			if *dashboardAddr == "" || !app.isClient() {
+				return nil
+			}
+			board = &dashboard.Dashboard{
+				Addr:   *dashboardAddr,
+				Status: app.client.Status,
+				Server: app.upstreamServer,
+			}
+			return board.Start()
+		},
+		Stop: func() error {
+			if board == nil {
+				return nil
+			}
+			return board.Close()
+		},
+	})
+	var api *admin.API
+	app.lifecycle.Add(&lifecycle.Component{
+		Name:      "admin",
+		DependsOn: []string{"proxy"},
+		Start: func() error {
+			if *adminAddr == "" {
+				return nil
+			}
+			token, err := adminTokenOrGenerate()
+			if err != nil {
+				return err
+			}
+			api = app.adminAPI(token)
+			return api.Start()
+		},
+		Stop: func() error {
+			if api == nil {
+				return nil
+			}
+			return api.Close()
+		},
+	})
+}
+
+// adminAPI builds the admin API (see -adminaddr) for the running client or
+// server
+func (app *App) adminAPI(token string) *admin.API {
+	api := &admin.API{
+		Addr:   *adminAddr,
+		Token:  token,
+		Reload: app.reloader.reload,
+	}
+	if app.isClient() {
+		api.Status = func() interface{} { return app.client.Status() }
+		api.Healthy = app.checkUpstreamDialable
+	} else {
+		api.Status = func() interface{} { return app.server.Status() }
+		api.RotateCert = app.server.RotateCert
+		api.Drain = app.server.Drain
+		api.Restart = app.restart
+		api.Healthy = checkOutbound
+		api.Ready = func() error {
+			if app.server.Status().Draining {
+				return fmt.Errorf("Draining")
+			}
+			return nil
+		}
+	}
+	return api
+}
+
+// adminTokenOrGenerate returns the -admintoken, or if none was given, a random
+// token, saved to admintoken in the configdir (readable only by our user) for
+// local tools
+func adminTokenOrGenerate() (string, error) {
+	if *adminToken != "" {
+		return *adminToken, nil
+	}
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("Unable to generate admin token: %s", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+	filename := inConfigDir("admintoken")
+	if err := atomicfile.WriteFile(filename, []byte(token), 0600); err != nil {
+		return "", fmt.Errorf("Unable to save admin token: %s", err)
+	}
+	log.Infof("No admintoken given, the admin API's token is in %s", filename)
+	return token, nil
+}
+
+// companionTokenOrGenerate returns the -companiontoken, or if none was given,
+// the token saved to companiontoken in the configdir, generating and saving one
+// (readable only by our user) if there's none yet.  It's kept across restarts
+// so that the extension only needs to be paired once.
+func companionTokenOrGenerate() (string, error) {
+	if *companionToken != "" {
+		return *companionToken, nil
+	}
+	filename := inConfigDir("companiontoken")
+	if saved, err := ioutil.ReadFile(filename); err == nil && len(saved) > 0 {
+		return string(saved), nil
+	}
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("Unable to generate companion token: %s", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+	if err := atomicfile.WriteFile(filename, []byte(token), 0600); err != nil {
+		return "", fmt.Errorf("Unable to save companion token: %s", err)
+	}
+	log.Infof("No companiontoken given, pair the companion extension using the token in %s", filename)
+	return token, nil
+}
+
+// stopOnSignal stops the App's components (saving profiles and releasing the
+// instance lock among other things) and exits when interrupted or terminated
+func (app *App) stopOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		app.lifecycle.Stop()
+		os.Exit(2)
+	}()
+}
+
+func closeIfOpen(l net.Listener) error {
+	if l == nil {
+		return nil
+	}
+	return l.Close()
+}
@@ -0,0 +1,57 @@
+// package configdir locates the platform-appropriate directory for flashlight's
+// configuration and migrates configuration from older layouts into it.
+package configdir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+// Default returns the default configuration directory for the named app on
+// this platform (see platformDir).  If the platform's location can't be
+// determined, it falls back to the current directory.
+func Default(app string) string {
+	dir := platformDir(app)
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
+
+// Migrate moves the given files from the directory from into the directory to,
+// skipping files that don't exist in from or that already exist in to.  This
+// lets installations that kept their configuration in the working directory
+// keep their keys and state when moving to the platform default.
+func Migrate(from string, to string, files ...string) error {
+	if err := os.MkdirAll(to, 0700); err != nil {
+		return fmt.Errorf("Unable to create config dir %s: %s", to, err)
+	}
+	for _, file := range files {
+		source := filepath.Join(from, file)
+		target := filepath.Join(to, file)
+		if _, err := os.Stat(source); err != nil {
+			continue
+		}
+		if _, err := os.Stat(target); err == nil {
+			log.Debugf("Not migrating %s, %s already exists", source, target)
+			continue
+		}
+		log.Debugf("Migrating %s to %s", source, target)
+		if err := os.Rename(source, target); err != nil {
+			return fmt.Errorf("Unable to migrate %s to %s: %s", source, target, err)
+		}
+	}
+	return nil
+}
+
+// capitalized capitalizes the app name, as is customary on Windows and OS X
+func capitalized(app string) string {
+	if app == "" {
+		return app
+	}
+	return strings.ToUpper(app[:1]) + app[1:]
+}
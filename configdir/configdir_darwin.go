@@ -0,0 +1,15 @@
+package configdir
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// platformDir returns ~/Library/Application Support/<App>
+func platformDir(app string) string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, "Library", "Application Support", capitalized(app))
+}
@@ -0,0 +1,22 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package configdir
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// platformDir returns $XDG_CONFIG_HOME/<app>, which defaults to
+// ~/.config/<app>
+func platformDir(app string) string {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, app)
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".config", app)
+}
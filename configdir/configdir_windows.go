@@ -0,0 +1,15 @@
+package configdir
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// platformDir returns %APPDATA%\<App>
+func platformDir(app string) string {
+	appData := os.Getenv("APPDATA")
+	if appData == "" {
+		return ""
+	}
+	return filepath.Join(appData, capitalized(app))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/getlantern/flashlight/configfile"
+	"github.com/getlantern/flashlight/log"
+)
+
+// applyConfigFile sets flags from the config file, if one was given, skipping
+// those that were set explicitly in the given FlagSet (the command line wins).
+// Config files in older schemas are migrated first.
+func applyConfigFile(fs *flag.FlagSet) {
+	fs.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+	if explicitFlags["localdomains"] {
+		log.Error("DEPRECATED: -localdomains has been renamed to -localhosts")
+	}
+	if *configFile == "" {
+		return
+	}
+	version, err := configfile.Migrate(*configFile)
+	if err != nil {
+		log.Errorf("Unable to migrate config file %s: %s", *configFile, err)
+	} else if version > 0 {
+		log.Debugf("Migrated config file %s from version %d to %d", *configFile, version, configfile.CURRENT_VERSION)
+	}
+	values, err := configfile.Load(*configFile)
+	if err != nil {
+		log.Fatalf("Unable to load config file %s: %s", *configFile, err)
+	}
+	for name, value := range values {
+		if name == "config" || flag.Lookup(name) == nil {
+			log.Fatalf("Unknown setting %s in config file %s", name, *configFile)
+		}
+		if explicitFlags[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			log.Fatalf("Invalid value for %s in config file %s: %s", name, *configFile, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// package configfile loads flashlight's configuration from a JSON or YAML file
+// whose keys are the names of command-line flags, e.g.
+//
+//	addr: 0.0.0.0:443
+//	server: getiantem.org
+//	masquerade:
+//	  - cdnjs.com
+//	  - www.example.com
+//
+// Lists are turned into the comma-separated form that list flags expect.  Only
+// the simple subset of YAML that's needed for this (top-level scalars and
+// lists of scalars, plus comments) is understood.
+//
+// Files carry the version of their schema under VERSION_KEY, files without one
+// are version 1.  Older files are upgraded when loaded, and Migrate rewrites
+// them in the current schema.
+package configfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Load loads the file at filename, returning the value for each key as it
+// would be given on the command line.  Files ending in .json (or starting with
+// a {) are parsed as JSON, everything else as YAML.
+func Load(filename string) (map[string]string, error) {
+	values, _, err := load(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := upgrade(values); err != nil {
+		return nil, err
+	}
+	delete(values, VERSION_KEY)
+	return values, nil
+}
+
+// load loads the file at filename as is, also indicating whether it's JSON
+func load(filename string) (map[string]string, bool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to read config file: %s", err)
+	}
+	if isJSON(filename, data) {
+		values, err := parseJSON(data)
+		return values, true, err
+	}
+	values, err := parseYAML(data)
+	return values, false, err
+}
+
+func isJSON(filename string, data []byte) bool {
+	return strings.ToLower(filepath.Ext(filename)) == ".json" || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+func parseJSON(data []byte) (map[string]string, error) {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Unable to parse config file as JSON: %s", err)
+	}
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		s, err := toFlagValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %s: %s", key, err)
+		}
+		values[key] = s
+	}
+	return values, nil
+}
+
+func toFlagValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := toFlagValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+func parseYAML(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	var listKey string
+	var list []string
+	endList := func() {
+		if listKey != "" {
+			values[listKey] = strings.Join(list, ",")
+			listKey, list = "", nil
+		}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := stripComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if listKey == "" {
+				return nil, fmt.Errorf("Line %d: list item without a key", lineNumber)
+			}
+			list = append(list, unquote(strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))))
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("Line %d: nested values aren't supported", lineNumber)
+		}
+		endList()
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Line %d: expected key: value", lineNumber)
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if value == "" {
+			// Either a list follows or the value is empty
+			listKey = key
+			values[key] = ""
+			continue
+		}
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			var items []string
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = unquote(strings.TrimSpace(item)); item != "" {
+					items = append(items, item)
+				}
+			}
+			value = strings.Join(items, ",")
+		} else {
+			value = unquote(value)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read config file: %s", err)
+	}
+	endList()
+	return values, nil
+}
+
+// stripComment removes a trailing # comment, ignoring #s inside of quotes
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		if s[0] == '"' {
+			if unquoted, err := strconv.Unquote(s); err == nil {
+				return unquoted
+			}
+		}
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,124 @@
+package configfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := map[string]string{
+		"addr":       "0.0.0.0:443",
+		"server":     "getiantem.org",
+		"masquerade": "cdnjs.com,www.example.com",
+		"retries":    "3",
+		"mdns":       "true",
+		"auth":       "token:a#b",
+	}
+	files := map[string]string{
+		"config.yaml": `# flashlight config
+addr: 0.0.0.0:443
+server: "getiantem.org"  # the server
+masquerade:
+  - cdnjs.com
+  - 'www.example.com'
+retries: 3
+mdns: true
+auth: "token:a#b"
+`,
+		"config.json": `{"addr": "0.0.0.0:443", "server": "getiantem.org", "masquerade": ["cdnjs.com", "www.example.com"],
+			"retries": 3, "mdns": true, "auth": "token:a#b"}`,
+		"inline.yml": `addr: 0.0.0.0:443
+server: getiantem.org
+masquerade: [cdnjs.com, www.example.com]
+retries: 3
+mdns: true
+auth: token:a#b
+`,
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %s", name, err)
+		}
+		values, err := Load(filename)
+		if err != nil {
+			t.Errorf("Unable to load %s: %s", name, err)
+			continue
+		}
+		if len(values) != len(expected) {
+			t.Errorf("%s: expected %d values, got %d: %v", name, len(expected), len(values), values)
+		}
+		for key, value := range expected {
+			if values[key] != value {
+				t.Errorf("%s: expected %s to be %q, got %q", name, key, value, values[key])
+			}
+		}
+	}
+}
+
+func TestNested(t *testing.T) {
+	if _, err := parseYAML([]byte("server:\n  host: example.com\n")); err == nil {
+		t.Error("Nested values should be rejected")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"old.yaml", "old.json"} {
+		filename := filepath.Join(dir, name)
+		content := "addr: localhost:8787\nlocaldomains: [corp.example.com, \"*.lan\"]\n"
+		if name == "old.json" {
+			content = `{"addr": "localhost:8787", "localdomains": ["corp.example.com", "*.lan"]}`
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write %s: %s", name, err)
+		}
+
+		// Old files are upgraded on load even without migrating them
+		values, err := Load(filename)
+		if err != nil {
+			t.Fatalf("Unable to load %s: %s", name, err)
+		}
+		if values["localhosts"] != "corp.example.com,*.lan" || values["localdomains"] != "" || values[VERSION_KEY] != "" {
+			t.Errorf("%s wasn't upgraded on load: %v", name, values)
+		}
+
+		version, err := Migrate(filename)
+		if err != nil || version != 1 {
+			t.Fatalf("Unable to migrate %s: %d %s", name, version, err)
+		}
+		backup, err := ioutil.ReadFile(filename + ".v1.bak")
+		if err != nil || string(backup) != content {
+			t.Errorf("%s wasn't backed up: %s", name, err)
+		}
+		migrated, _, err := load(filename)
+		if err != nil {
+			t.Fatalf("Unable to load migrated %s: %s", name, err)
+		}
+		if migrated[VERSION_KEY] != "2" || migrated["localhosts"] != "corp.example.com,*.lan" || migrated["addr"] != "localhost:8787" {
+			t.Errorf("Unexpected migrated %s: %v", name, migrated)
+		}
+		if version, err := Migrate(filename); err != nil || version != 0 {
+			t.Errorf("Current file shouldn't be migrated again: %d %s", version, err)
+		}
+	}
+
+	newer := filepath.Join(dir, "newer.yaml")
+	ioutil.WriteFile(newer, []byte("version: 99\n"), 0600)
+	if _, err := Load(newer); err == nil {
+		t.Error("Files from newer versions should be rejected")
+	}
+}
@@ -0,0 +1,119 @@
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/getlantern/flashlight/atomicfile"
+)
+
+const (
+	VERSION_KEY     = "version"
+	CURRENT_VERSION = 2
+)
+
+var (
+	// migrations[i] upgrades values from version i+1 to version i+2
+	migrations = []func(values map[string]string){
+		// Version 2 renamed localdomains to localhosts, since it takes host
+		// patterns rather than just domain suffixes
+		func(values map[string]string) {
+			rename(values, "localdomains", "localhosts")
+		},
+	}
+)
+
+// upgrade upgrades values to CURRENT_VERSION in place, returning the version
+// they had
+func upgrade(values map[string]string) (int, error) {
+	version := 1
+	if v, found := values[VERSION_KEY]; found {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			return 0, fmt.Errorf("Invalid config file version %s", v)
+		}
+	}
+	if version > CURRENT_VERSION {
+		return 0, fmt.Errorf("Config file version %d is newer than this flashlight supports (%d), please upgrade flashlight", version, CURRENT_VERSION)
+	}
+	for v := version; v < CURRENT_VERSION; v++ {
+		migrations[v-1](values)
+	}
+	values[VERSION_KEY] = strconv.Itoa(CURRENT_VERSION)
+	return version, nil
+}
+
+// rename renames key from to key to, unless to is already set
+func rename(values map[string]string, from string, to string) {
+	value, found := values[from]
+	if !found {
+		return
+	}
+	delete(values, from)
+	if _, exists := values[to]; !exists {
+		values[to] = value
+	}
+}
+
+// Migrate rewrites the file at filename in the current schema if it's older,
+// keeping the original as filename.v<version>.bak.  It returns the version
+// from which the file was migrated, or 0 if it was already current.  Comments
+// and formatting aren't preserved in the migrated file.
+func Migrate(filename string) (int, error) {
+	values, asJSON, err := load(filename)
+	if err != nil {
+		return 0, err
+	}
+	version, err := upgrade(values)
+	if err != nil || version == CURRENT_VERSION {
+		return 0, err
+	}
+	original, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to read config file: %s", err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to stat config file: %s", err)
+	}
+	backup := fmt.Sprintf("%s.v%d.bak", filename, version)
+	if err := atomicfile.WriteFile(backup, original, info.Mode()); err != nil {
+		return 0, fmt.Errorf("Unable to back up config file: %s", err)
+	}
+	var migrated []byte
+	if asJSON {
+		migrated, err = json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return 0, fmt.Errorf("Unable to marshal migrated config: %s", err)
+		}
+	} else {
+		migrated = formatYAML(values, fmt.Sprintf("Migrated from version %d, the original is in %s", version, backup))
+	}
+	if err := atomicfile.WriteFile(filename, migrated, info.Mode()); err != nil {
+		return 0, fmt.Errorf("Unable to save migrated config file: %s", err)
+	}
+	return version, nil
+}
+
+// formatYAML formats values as YAML that parseYAML understands, with the
+// version first and the other keys sorted
+func formatYAML(values map[string]string, comment string) []byte {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if key != VERSION_KEY {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# %s\n%s: %s\n", comment, VERSION_KEY, values[VERSION_KEY])
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s: %s\n", key, strconv.Quote(values[key]))
+	}
+	return buf.Bytes()
+}
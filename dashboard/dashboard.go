@@ -0,0 +1,170 @@
+// package dashboard implements a small web UI, served by the client on
+// localhost, that shows whether flashlight is working: the connection to the
+// server, through which upstream (server or masquerade) it's reached, graphs
+// of the throughput and the most recent errors.
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/admin"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/proxy"
+)
+
+const (
+	// SAMPLE_INTERVAL is how often the throughput is sampled
+	SAMPLE_INTERVAL = 1 * time.Second
+
+	// MAX_SAMPLES is how many throughput samples are kept for the graphs
+	MAX_SAMPLES = 120
+)
+
+// Dashboard is the web UI
+type Dashboard struct {
+	Addr   string                     // address at which to serve, must be on localhost
+	Status func() *proxy.ClientStatus // returns the client's status
+	Server func() string              // returns the server that the client is configured to use
+
+	samples   []*Sample
+	lastUp    int64
+	lastDown  int64
+	lastTaken time.Time
+	mutex     sync.Mutex
+	l         net.Listener
+}
+
+// Sample is the throughput during a SAMPLE_INTERVAL
+type Sample struct {
+	Time time.Time `json:"time"`
+	Up   int64     `json:"up"`   // bytes per second
+	Down int64     `json:"down"` // bytes per second
+}
+
+// state is what the page shows, served as JSON at /state
+type state struct {
+	Server     string              `json:"server"`
+	Status     *proxy.ClientStatus `json:"status"`
+	Throughput []*Sample           `json:"throughput"`
+}
+
+// Start starts sampling the throughput and serving the dashboard in the
+// background
+func (dashboard *Dashboard) Start() error {
+	if !admin.IsLocalhost(dashboard.Addr) {
+		return fmt.Errorf("The dashboard must be on localhost (e.g. 127.0.0.1:15679), got %s", dashboard.Addr)
+	}
+	var err error
+	dashboard.l, err = net.Listen("tcp", dashboard.Addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for dashboard at %s: %s", dashboard.Addr, err)
+	}
+	log.Infof("Serving dashboard at http://%s/", dashboard.l.Addr())
+	go dashboard.sampleEvery(SAMPLE_INTERVAL)
+	go func() {
+		log.Debugf("Stopped serving dashboard: %s", http.Serve(dashboard.l, dashboard))
+	}()
+	return nil
+}
+
+// Close stops serving the dashboard
+func (dashboard *Dashboard) Close() error {
+	if dashboard.l == nil {
+		return nil
+	}
+	return dashboard.l.Close()
+}
+
+func (dashboard *Dashboard) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	// Only answer requests for localhost, so that web pages can't read the
+	// dashboard by pointing a name of theirs at 127.0.0.1 (DNS rebinding)
+	if !isLocalhostName(req.Host) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch req.URL.Path {
+	case "/":
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte(PAGE))
+	case "/state":
+		data, err := json.Marshal(&state{
+			Server:     dashboard.Server(),
+			Status:     dashboard.Status(),
+			Throughput: dashboard.Samples(),
+		})
+		if err != nil {
+			log.Errorf("Unable to marshal dashboard state: %s", err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("Cache-Control", "no-cache")
+		resp.Write(data)
+	default:
+		resp.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Samples returns the throughput samples, oldest first
+func (dashboard *Dashboard) Samples() []*Sample {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+	samples := make([]*Sample, len(dashboard.samples))
+	copy(samples, dashboard.samples)
+	return samples
+}
+
+func (dashboard *Dashboard) sampleEvery(interval time.Duration) {
+	for {
+		status := dashboard.Status()
+		dashboard.sample(status.BytesUp, status.BytesDown, time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// sample records the throughput since the previous sample, given the total
+// bytes transferred so far
+func (dashboard *Dashboard) sample(up int64, down int64, now time.Time) {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+	if !dashboard.lastTaken.IsZero() {
+		elapsed := now.Sub(dashboard.lastTaken).Seconds()
+		if elapsed > 0 {
+			dashboard.samples = append(dashboard.samples, &Sample{
+				Time: now,
+				Up:   int64(float64(nonNegative(up-dashboard.lastUp)) / elapsed),
+				Down: int64(float64(nonNegative(down-dashboard.lastDown)) / elapsed),
+			})
+			if len(dashboard.samples) > MAX_SAMPLES {
+				dashboard.samples = dashboard.samples[len(dashboard.samples)-MAX_SAMPLES:]
+			}
+		}
+	}
+	dashboard.lastUp, dashboard.lastDown, dashboard.lastTaken = up, down, now
+}
+
+// nonNegative guards against totals going down, e.g. when devices are
+// forgotten
+func nonNegative(delta int64) int64 {
+	if delta < 0 {
+		return 0
+	}
+	return delta
+}
+
+// isLocalhostName determines whether the given Host header names localhost
+func isLocalhostName(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
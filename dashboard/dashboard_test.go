@@ -0,0 +1,62 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/proxy"
+)
+
+func TestSample(t *testing.T) {
+	dashboard := &Dashboard{}
+	start := time.Now()
+	dashboard.sample(1000, 5000, start)
+	if len(dashboard.Samples()) != 0 {
+		t.Error("The first sample has nothing to compare with")
+	}
+	dashboard.sample(3000, 15000, start.Add(2*time.Second))
+	samples := dashboard.Samples()
+	if len(samples) != 1 || samples[0].Up != 1000 || samples[0].Down != 5000 {
+		t.Errorf("Expected 1000 up and 5000 down per second, got %+v", samples[0])
+	}
+	for i := 0; i < MAX_SAMPLES+10; i++ {
+		dashboard.sample(3000, 15000, start.Add(time.Duration(3+i)*time.Second))
+	}
+	if len(dashboard.Samples()) != MAX_SAMPLES {
+		t.Errorf("Expected %d samples to be kept, got %d", MAX_SAMPLES, len(dashboard.Samples()))
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	dashboard := &Dashboard{
+		Status: func() *proxy.ClientStatus { return &proxy.ClientStatus{Connected: true, BytesUp: 42} },
+		Server: func() string { return "fl.example.com" },
+	}
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		rec := httptest.NewRecorder()
+		dashboard.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("http://127.0.0.1:15679/state")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", rec.Code)
+	}
+	s := &state{}
+	if err := json.Unmarshal(rec.Body.Bytes(), s); err != nil {
+		t.Fatalf("Unable to parse state: %s", err)
+	}
+	if s.Server != "fl.example.com" || !s.Status.Connected || s.Status.BytesUp != 42 {
+		t.Errorf("Unexpected state %+v", s)
+	}
+	if rec := get("http://localhost:15679/"); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Expected the page, got %d", rec.Code)
+	}
+	if rec := get("http://attacker.example.com:15679/state"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected requests for other hosts to be refused, got %d", rec.Code)
+	}
+}
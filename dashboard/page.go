@@ -0,0 +1,134 @@
+package dashboard
+
+// PAGE is the dashboard itself, which polls /state
+const PAGE = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>flashlight</title>
+<style>
+  body { font-family: sans-serif; margin: 2em auto; max-width: 48em; color: #333; }
+  h1 { font-size: 1.4em; }
+  #verdict { font-size: 1.6em; padding: 0.6em 1em; border-radius: 0.3em; color: white; background: #999; }
+  #verdict.working { background: #2a8a3e; }
+  #verdict.broken { background: #c0392b; }
+  table { border-collapse: collapse; margin: 1em 0; }
+  td { padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+  td:first-child { color: #777; }
+  canvas { width: 100%; height: 10em; border: 1px solid #ddd; }
+  .up { color: #2980b9; } .down { color: #27ae60; }
+  ul { padding-left: 1.2em; } li { margin: 0.2em 0; }
+  .time { color: #777; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>flashlight</h1>
+<div id="verdict">Checking&hellip;</div>
+<table>
+  <tr><td>Server</td><td id="server"></td></tr>
+  <tr><td>Reached through</td><td id="upstream"></td></tr>
+  <tr><td>Transport</td><td id="transport"></td></tr>
+  <tr><td>Last connected</td><td id="lastDial"></td></tr>
+  <tr><td>Traffic</td><td id="traffic"></td></tr>
+</table>
+<h2>Throughput <span class="up">&#9632; up</span> <span class="down">&#9632; down</span></h2>
+<canvas id="graph" width="960" height="200"></canvas>
+<h2>Notices</h2>
+<ul id="notices"></ul>
+<h2>Recent errors</h2>
+<ul id="errors"></ul>
+<script>
+function text(id, value) { document.getElementById(id).textContent = value; }
+
+function size(bytes) {
+  var units = ["B", "KB", "MB", "GB", "TB"];
+  var i = 0;
+  while (bytes >= 1024 && i < units.length - 1) { bytes /= 1024; i++; }
+  return bytes.toFixed(i == 0 ? 0 : 1) + " " + units[i];
+}
+
+function list(id, items, render) {
+  var ul = document.getElementById(id);
+  ul.innerHTML = "";
+  if (!items || items.length == 0) {
+    var li = document.createElement("li");
+    li.textContent = "None";
+    ul.appendChild(li);
+    return;
+  }
+  items.forEach(function(item) {
+    var li = document.createElement("li");
+    var time = document.createElement("span");
+    time.className = "time";
+    time.textContent = new Date(item.time).toLocaleString() + " ";
+    li.appendChild(time);
+    li.appendChild(document.createTextNode(render(item)));
+    ul.appendChild(li);
+  });
+}
+
+function graph(samples) {
+  var canvas = document.getElementById("graph");
+  var ctx = canvas.getContext("2d");
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  var max = 1024;
+  samples.forEach(function(s) { max = Math.max(max, s.up, s.down); });
+  ctx.fillStyle = "#777";
+  ctx.font = "20px sans-serif";
+  ctx.fillText(size(max) + "/s", 8, 24);
+  [["up", "#2980b9"], ["down", "#27ae60"]].forEach(function(line) {
+    ctx.strokeStyle = line[1];
+    ctx.lineWidth = 3;
+    ctx.beginPath();
+    samples.forEach(function(s, i) {
+      var x = canvas.width - (samples.length - 1 - i) * canvas.width / 119;
+      var y = canvas.height - 4 - s[line[0]] / max * (canvas.height - 40);
+      if (i == 0) { ctx.moveTo(x, y); } else { ctx.lineTo(x, y); }
+    });
+    ctx.stroke();
+  });
+}
+
+function refresh() {
+  var req = new XMLHttpRequest();
+  req.open("GET", "/state");
+  req.onload = function() {
+    var state = JSON.parse(req.responseText);
+    var status = state.status;
+    var verdict = document.getElementById("verdict");
+    if (status.bypass) {
+      verdict.className = "broken";
+      verdict.textContent = "Bypassed: traffic doesn't go through flashlight";
+    } else if (status.connected) {
+      verdict.className = "working";
+      verdict.textContent = "Working";
+    } else if (status.lastDial && status.lastDial.indexOf("0001-") != 0) {
+      verdict.className = "broken";
+      verdict.textContent = "Not working: can't reach the server";
+    } else {
+      verdict.className = "";
+      verdict.textContent = "Not used yet";
+    }
+    text("server", state.server);
+    text("upstream", status.upstream || "-");
+    text("transport", status.transport || "-");
+    text("lastDial", status.lastDial && status.lastDial.indexOf("0001-") != 0 ? new Date(status.lastDial).toLocaleString() : "-");
+    text("traffic", size(status.bytesUp) + " up, " + size(status.bytesDown) + " down");
+    graph(state.throughput || []);
+    list("notices", (status.notices || []).map(function(n) { return {time: n.posted, message: n.message}; }), function(n) { return n.message; });
+    list("errors", (status.recentErrors || []).slice().reverse(), function(e) { return e.error; });
+  };
+  req.onerror = function() {
+    var verdict = document.getElementById("verdict");
+    verdict.className = "broken";
+    verdict.textContent = "flashlight isn't running";
+  };
+  req.send();
+}
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/getlantern/flashlight/admin"
+	"github.com/getlantern/flashlight/hotrestart"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/metrics"
+)
+
+// serveDebug serves net/http/pprof at /debug/pprof/ and expvar at /debug/vars
+// on the debugaddr, so that heap profiles, goroutine dumps and live counters
+// can be taken from a running instance, until the returned listener is closed.
+// Anyone who can reach it can see a lot about the process, so only localhost
+// addresses are allowed.
+func (app *App) serveDebug(registry *metrics.Registry) net.Listener {
+	if !admin.IsLocalhost(*debugAddr) {
+		log.Fatalf("debugaddr must be on localhost (e.g. 127.0.0.1:6060), got %s", *debugAddr)
+	}
+	l, err := hotrestart.Listen("tcp", *debugAddr)
+	if err != nil {
+		log.Fatalf("Unable to listen for debugging at %s: %s", *debugAddr, err)
+	}
+
+	started := time.Now()
+	expvar.Publish("flashlight", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"role":       *role,
+			"upstream":   app.upstreamServer(),
+			"goroutines": runtime.NumGoroutine(),
+			"uptime":     time.Now().Sub(started).String(),
+		}
+	}))
+	if registry != nil {
+		expvar.Publish("metrics", expvar.Func(func() interface{} {
+			return registry.Values()
+		}))
+	}
+
+	// Use a mux of our own rather than the DefaultServeMux that importing
+	// net/http/pprof registers with
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/debug/pprof/", pprof.Index)
+	serveMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	serveMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	serveMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	serveMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	serveMux.Handle("/debug/vars", expvar.Handler())
+	log.Infof("Serving debug endpoints at http://%s/debug/pprof/ and http://%s/debug/vars", l.Addr(), l.Addr())
+	go func() {
+		log.Debugf("Stopped serving debug endpoints: %s", http.Serve(l, serveMux))
+	}()
+	return l
+}
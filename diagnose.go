@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/getlantern/flashlight/auth"
+	"github.com/getlantern/flashlight/instance"
+	"github.com/getlantern/flashlight/log"
+)
+
+// runDiagnostics checks the things that most commonly keep the client from
+// working, printing the result of each check and exiting with status 1 if any
+// of them failed.
+func (app *App) runDiagnostics() {
+	// Only the certificates are needed, not the rest of the client
+	if err := app.lifecycle.Start("certs"); err != nil {
+		log.Fatal(err)
+	}
+	failed := false
+	report := func(err error, format string, args ...interface{}) {
+		if err != nil {
+			failed = true
+			fmt.Printf("[FAIL] %s: %s\n", fmt.Sprintf(format, args...), err)
+		} else {
+			fmt.Printf("[ OK ] %s\n", fmt.Sprintf(format, args...))
+		}
+	}
+
+	report(checkConfigDirWritable(), "Config dir %s is writable", *configDir)
+
+	if info, err := instance.Find(lockFile()); err == nil {
+		fmt.Printf("[INFO] A client (pid %d) is running, proxying at %s\n", info.PID, info.Addr)
+	}
+
+	if *authSpec != "" {
+		_, err := auth.New(*authSpec)
+		report(err, "Auth spec is valid")
+	}
+
+	for _, addr := range app.addressesForServer(splitList(*masqueradeAs)) {
+		host, _, _ := net.SplitHostPort(addr)
+		ips, err := net.LookupHost(host)
+		report(err, "Resolved %s to %v", host, ips)
+		if err != nil {
+			continue
+		}
+		start := time.Now()
+		conn, err := app.dialAddr(addr)
+		if err == nil {
+			conn.Close()
+		}
+		report(err, "TLS connection to %s (%s)", addr, time.Now().Sub(start))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,134 @@
+// package diskcache is a small key/value cache whose entries expire after a
+// TTL and which is persisted to disk, so that things the client has learned
+// (DNS answers, routing decisions, etc.) survive restarts.
+package diskcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/atomicfile"
+)
+
+// Cache is a persistent cache of JSON-encodable values
+type Cache struct {
+	File    string // file in which to persist the cache
+	entries map[string]*entry
+	mutex   sync.Mutex
+}
+
+type entry struct {
+	Value   json.RawMessage `json:"value"`
+	Expires time.Time       `json:"expires,omitempty"` // zero means never
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && now.After(e.Expires)
+}
+
+// Load loads previously persisted entries from File, dropping those that
+// expired in the meantime.  A missing file is not an error.
+func (cache *Cache) Load() error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries = make(map[string]*entry)
+	data, err := ioutil.ReadFile(cache.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Unable to read cache: %s", err)
+	}
+	entries := make(map[string]*entry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("Unable to parse cache: %s", err)
+	}
+	now := time.Now()
+	for key, e := range entries {
+		if !e.expired(now) {
+			cache.entries[key] = e
+		}
+	}
+	return nil
+}
+
+// Get decodes the value for key into value, returning false if there's no
+// (unexpired) value.
+func (cache *Cache) Get(key string, value interface{}) bool {
+	cache.mutex.Lock()
+	e, found := cache.entries[key]
+	cache.mutex.Unlock()
+	if !found || e.expired(time.Now()) {
+		return false
+	}
+	return json.Unmarshal(e.Value, value) == nil
+}
+
+// Set sets the value for key, which expires after ttl (or never, if ttl is 0),
+// and persists the cache.
+func (cache *Cache) Set(key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal cached value for %s: %s", key, err)
+	}
+	e := &entry{Value: data}
+	if ttl > 0 {
+		e.Expires = time.Now().Add(ttl)
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.entries == nil {
+		cache.entries = make(map[string]*entry)
+	}
+	cache.entries[key] = e
+	return cache.save()
+}
+
+// Delete removes the value for key and persists the cache
+func (cache *Cache) Delete(key string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if _, found := cache.entries[key]; !found {
+		return nil
+	}
+	delete(cache.entries, key)
+	return cache.save()
+}
+
+// Keys returns the (unexpired) keys starting with prefix, sorted
+func (cache *Cache) Keys(prefix string) []string {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	var keys []string
+	for key, e := range cache.entries {
+		if strings.HasPrefix(key, prefix) && !e.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (cache *Cache) save() error {
+	now := time.Now()
+	for key, e := range cache.entries {
+		if e.expired(now) {
+			delete(cache.entries, key)
+		}
+	}
+	data, err := json.Marshal(cache.entries)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal cache: %s", err)
+	}
+	if err := atomicfile.WriteFile(cache.File, data, 0644); err != nil {
+		return fmt.Errorf("Unable to save cache: %s", err)
+	}
+	return nil
+}
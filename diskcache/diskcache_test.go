@@ -0,0 +1,60 @@
+package diskcache
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPersistence(t *testing.T) {
+	file, err := ioutil.TempFile("", "diskcache")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	defer os.Remove(file.Name())
+
+	cache := &Cache{File: file.Name()}
+	if err := cache.Load(); err != nil {
+		t.Fatalf("Unable to load from missing file: %s", err)
+	}
+	if err := cache.Set("dns:a", []string{"1.2.3.4"}, time.Hour); err != nil {
+		t.Fatalf("Unable to set: %s", err)
+	}
+	if err := cache.Set("dns:b", []string{"5.6.7.8"}, 50*time.Millisecond); err != nil {
+		t.Fatalf("Unable to set: %s", err)
+	}
+	if err := cache.Set("route:c", "direct", 0); err != nil {
+		t.Fatalf("Unable to set: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Reload from disk to make sure things were persisted
+	cache = &Cache{File: file.Name()}
+	if err := cache.Load(); err != nil {
+		t.Fatalf("Unable to load: %s", err)
+	}
+	var ips []string
+	if !cache.Get("dns:a", &ips) || !reflect.DeepEqual(ips, []string{"1.2.3.4"}) {
+		t.Errorf("Unexpected value for dns:a: %v", ips)
+	}
+	if cache.Get("dns:b", &ips) {
+		t.Error("dns:b should have expired")
+	}
+	var route string
+	if !cache.Get("route:c", &route) || route != "direct" {
+		t.Errorf("Unexpected value for route:c: %s", route)
+	}
+	if keys := cache.Keys("dns:"); !reflect.DeepEqual(keys, []string{"dns:a"}) {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+	if err := cache.Delete("route:c"); err != nil {
+		t.Fatalf("Unable to delete: %s", err)
+	}
+	if cache.Get("route:c", &route) {
+		t.Error("route:c should have been deleted")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+
+	"github.com/getlantern/flashlight/diskcache"
+	"github.com/getlantern/flashlight/log"
+)
+
+// openClientCache loads the client's cache from the configdir
+func openClientCache() *diskcache.Cache {
+	cache := &diskcache.Cache{File: inConfigDir("cache.json")}
+	if err := cache.Load(); err != nil {
+		log.Errorf("Unable to load cache, starting fresh: %s", err)
+	}
+	return cache
+}
+
+// resolveCached resolves the host in addr to an IP, using a cached answer if
+// there's one that hasn't expired yet.  It returns the address to dial and the
+// host that was resolved ("" if addr was already an IP or couldn't be
+// resolved, in which case the address is returned unchanged).
+func (app *App) resolveCached(addr string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil || app.cache == nil || *dnsCacheTTL <= 0 {
+		return addr, ""
+	}
+	var ips []string
+	if !app.cache.Get("dns:"+host, &ips) || len(ips) == 0 {
+		resolved, err := net.LookupIP(host)
+		if err != nil || len(resolved) == 0 {
+			return addr, ""
+		}
+		ips = make([]string, 0, len(resolved))
+		for _, ip := range resolved {
+			ips = append(ips, ip.String())
+		}
+		if err := app.cache.Set("dns:"+host, ips, *dnsCacheTTL); err != nil {
+			log.Errorf("Unable to cache DNS answer for %s: %s", host, err)
+		}
+	}
+	return net.JoinHostPort(ips[0], port), host
+}
+
+// forgetResolved drops the cached answer for host, e.g. because dialing the
+// cached IP failed
+func (app *App) forgetResolved(host string) {
+	if host == "" || app.cache == nil {
+		return
+	}
+	if err := app.cache.Delete("dns:" + host); err != nil {
+		log.Errorf("Unable to forget DNS answer for %s: %s", host, err)
+	}
+}
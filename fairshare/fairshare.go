@@ -0,0 +1,281 @@
+// package fairshare shares a fixed amount of bandwidth among clients in
+// proportion to their weights.  The sharing is max-min fair: what clients
+// don't use of their share goes to the others, so that one heavy client can't
+// monopolize the link, yet a client alone on it can use all of it.
+package fairshare
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// REBALANCE_INTERVAL is how often the shares are recalculated from the
+	// throughput that each client had
+	REBALANCE_INTERVAL = 250 * time.Millisecond
+
+	// IDLE_TIMEOUT is how long a client can go without transferring anything
+	// before it's forgotten (unless something still holds its flow)
+	IDLE_TIMEOUT = 1 * time.Minute
+
+	// DEFAULT_WEIGHT is the weight of classes that don't have one
+	DEFAULT_WEIGHT = 1
+)
+
+// Scheduler shares Capacity among Flows
+type Scheduler struct {
+	Capacity int64          // bytes per second to share
+	Weights  map[string]int // (optional) weight of each class of client, classes without a weight get DEFAULT_WEIGHT
+
+	flows map[string]*Flow
+	stop  chan struct{}
+	mutex sync.Mutex
+}
+
+// Flow is the traffic of a single client
+type Flow struct {
+	id     string
+	class  string
+	weight int
+
+	limit       float64 // bytes per second currently allowed
+	allowance   float64
+	last        time.Time
+	transferred int64     // since the last rebalance
+	throttled   bool      // whether Wait had to wait since the last rebalance
+	throughput  float64   // bytes per second, as of the last rebalance
+	lastActive  time.Time // when the flow last transferred anything
+	holders     int       // how many Flow calls haven't been Released yet
+	mutex       sync.Mutex
+}
+
+// FlowStatus is a snapshot of a Flow
+type FlowStatus struct {
+	Id         string `json:"id"`
+	Class      string `json:"class"`
+	Weight     int    `json:"weight"`
+	Throughput int64  `json:"throughput"` // bytes per second
+	Limit      int64  `json:"limit"`      // bytes per second currently allowed
+}
+
+// Start starts rebalancing the shares periodically
+func (s *Scheduler) Start() {
+	s.mutex.Lock()
+	s.stop = make(chan struct{})
+	s.mutex.Unlock()
+	go func() {
+		last := time.Now()
+		ticker := time.NewTicker(REBALANCE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.rebalance(now, now.Sub(last))
+				last = now
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops rebalancing
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// Flow gets (or creates) the Flow of the client with the given id, which the
+// caller needs to Release once it's done with it.  Flows that are held aren't
+// forgotten, even if idle, so that a client's long-lived connections (e.g.
+// WebSockets) keep sharing its flow with its new ones.  New flows start out
+// with the share they'd have if every known flow were busy.
+func (s *Scheduler) Flow(id string, class string) *Flow {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.flows == nil {
+		s.flows = make(map[string]*Flow)
+	}
+	flow, found := s.flows[id]
+	if found {
+		flow.mutex.Lock()
+		flow.holders += 1
+		flow.mutex.Unlock()
+		return flow
+	}
+	weight := s.weight(class)
+	totalWeight := weight
+	for _, other := range s.flows {
+		totalWeight += other.weight
+	}
+	limit := float64(s.Capacity) * float64(weight) / float64(totalWeight)
+	now := time.Now()
+	flow = &Flow{
+		id:         id,
+		class:      class,
+		weight:     weight,
+		limit:      limit,
+		allowance:  limit,
+		last:       now,
+		lastActive: now,
+		holders:    1,
+	}
+	s.flows[id] = flow
+	return flow
+}
+
+// Status returns a snapshot of the known flows, the busiest first
+func (s *Scheduler) Status() []*FlowStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	statuses := make([]*FlowStatus, 0, len(s.flows))
+	for _, flow := range s.flows {
+		flow.mutex.Lock()
+		statuses = append(statuses, &FlowStatus{
+			Id:         flow.id,
+			Class:      flow.class,
+			Weight:     flow.weight,
+			Throughput: int64(flow.throughput),
+			Limit:      int64(flow.limit),
+		})
+		flow.mutex.Unlock()
+	}
+	sort.Sort(byThroughput(statuses))
+	return statuses
+}
+
+func (s *Scheduler) weight(class string) int {
+	if weight, found := s.Weights[class]; found && weight > 0 {
+		return weight
+	}
+	return DEFAULT_WEIGHT
+}
+
+// rebalance measures what each flow transferred during the elapsed time and
+// recalculates the shares, forgetting flows that have been idle for too long
+func (s *Scheduler) rebalance(now time.Time, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	flows := make([]*Flow, 0, len(s.flows))
+	weights := make([]float64, 0, len(s.flows))
+	demands := make([]float64, 0, len(s.flows))
+	for id, flow := range s.flows {
+		flow.mutex.Lock()
+		flow.throughput = float64(flow.transferred) / elapsed.Seconds()
+		if flow.transferred > 0 {
+			flow.lastActive = now
+		}
+		demand := flow.throughput
+		if flow.throttled {
+			// It would have used more if it had been allowed to
+			demand = math.Inf(1)
+		}
+		flow.transferred = 0
+		flow.throttled = false
+		idle := flow.holders == 0 && now.Sub(flow.lastActive) > IDLE_TIMEOUT
+		flow.mutex.Unlock()
+		if idle {
+			delete(s.flows, id)
+			continue
+		}
+		flows = append(flows, flow)
+		weights = append(weights, float64(flow.weight))
+		demands = append(demands, demand)
+	}
+	limits := allocate(float64(s.Capacity), weights, demands)
+	for i, flow := range flows {
+		flow.mutex.Lock()
+		flow.limit = limits[i]
+		flow.mutex.Unlock()
+	}
+}
+
+// allocate divides capacity by water-filling: going from the least demanding
+// flow (relative to its weight) to the most, each gets its weighted share of
+// what's left, and what it doesn't use of that share is left for the rest.
+// Flows are allowed their full share even if they use less, so that they
+// can grow into it.
+func allocate(capacity float64, weights []float64, demands []float64) []float64 {
+	order := make([]int, len(demands))
+	totalWeight := 0.0
+	for i := range order {
+		order[i] = i
+		totalWeight += weights[i]
+	}
+	sort.Sort(&byDemand{order, weights, demands})
+	limits := make([]float64, len(demands))
+	remaining := capacity
+	for _, i := range order {
+		share := remaining * weights[i] / totalWeight
+		limits[i] = share
+		remaining -= math.Min(share, demands[i])
+		totalWeight -= weights[i]
+	}
+	return limits
+}
+
+// Release tells the scheduler that the caller of Flow is done with the flow
+func (flow *Flow) Release() {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+	if flow.holders > 0 {
+		flow.holders -= 1
+	}
+}
+
+// Wait accounts for n bytes transferred by the flow, blocking for as long as
+// it takes to keep the flow within its share
+func (flow *Flow) Wait(n int) {
+	if n <= 0 {
+		return
+	}
+	flow.mutex.Lock()
+	now := time.Now()
+	flow.transferred += int64(n)
+	flow.allowance += now.Sub(flow.last).Seconds() * flow.limit
+	if flow.allowance > flow.limit {
+		flow.allowance = flow.limit
+	}
+	flow.last = now
+	flow.allowance -= float64(n)
+	var delay time.Duration
+	if flow.allowance < 0 {
+		flow.throttled = true
+		if flow.limit > 0 {
+			delay = time.Duration(-flow.allowance / flow.limit * float64(time.Second))
+		} else {
+			delay = REBALANCE_INTERVAL
+		}
+	}
+	flow.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+type byThroughput []*FlowStatus
+
+func (a byThroughput) Len() int           { return len(a) }
+func (a byThroughput) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byThroughput) Less(i, j int) bool { return a[i].Throughput > a[j].Throughput }
+
+// byDemand sorts indices by the demand relative to the weight at each index
+type byDemand struct {
+	order   []int
+	weights []float64
+	demands []float64
+}
+
+func (s *byDemand) Len() int      { return len(s.order) }
+func (s *byDemand) Swap(i, j int) { s.order[i], s.order[j] = s.order[j], s.order[i] }
+func (s *byDemand) Less(i, j int) bool {
+	a, b := s.order[i], s.order[j]
+	return s.demands[a]/s.weights[a] < s.demands[b]/s.weights[b]
+}
@@ -0,0 +1,104 @@
+package fairshare
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAllocate(t *testing.T) {
+	inf := math.Inf(1)
+	cases := []struct {
+		weights  []float64
+		demands  []float64
+		expected []float64
+	}{
+		// Two heavy clients split evenly
+		{[]float64{1, 1}, []float64{inf, inf}, []float64{500, 500}},
+		// Weights are honored
+		{[]float64{3, 1}, []float64{inf, inf}, []float64{750, 250}},
+		// A light client leaves what it doesn't use to the heavy one, but is
+		// still allowed its share
+		{[]float64{1, 1}, []float64{100, inf}, []float64{500, 900}},
+		// A client alone gets everything
+		{[]float64{1}, []float64{inf}, []float64{1000}},
+		// Three clients, one light
+		{[]float64{1, 1, 1}, []float64{inf, 100, inf}, []float64{450, 1000.0 / 3, 450}},
+	}
+	for _, c := range cases {
+		limits := allocate(1000, c.weights, c.demands)
+		for i := range limits {
+			if math.Abs(limits[i]-c.expected[i]) > 0.001 {
+				t.Errorf("With weights %v and demands %v, expected %v, got %v", c.weights, c.demands, c.expected, limits)
+				break
+			}
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	s := &Scheduler{Capacity: 1000, Weights: map[string]int{"member": 3}}
+	heavy := s.Flow("heavy", "member")
+	guest := s.Flow("guest", "guest")
+	idle := s.Flow("idle", "guest")
+	if s.Flow("heavy", "member") != heavy {
+		t.Error("Expected existing flow to be reused")
+	}
+	heavy.Release()
+	idle.Release()
+	if heavy.limit != 1000 || guest.limit != 250 {
+		t.Errorf("Unexpected initial limits %v and %v", heavy.limit, guest.limit)
+	}
+
+	start := time.Now()
+	heavy.transferred, heavy.throttled = 2000, true
+	guest.transferred, guest.throttled = 500, true
+	idle.lastActive = start.Add(-2 * IDLE_TIMEOUT)
+	s.rebalance(start, 2*time.Second)
+
+	statuses := s.Status()
+	if len(statuses) != 2 {
+		t.Fatalf("Expected idle flow to be forgotten, got %d flows", len(statuses))
+	}
+	if s.Flow("idle", "guest") == idle {
+		t.Error("Expected forgotten flow to be replaced")
+	}
+	if statuses[0].Id != "heavy" || statuses[0].Throughput != 1000 || statuses[0].Limit != 750 {
+		t.Errorf("Unexpected status of heavy flow %+v", statuses[0])
+	}
+	if statuses[1].Id != "guest" || statuses[1].Throughput != 250 || statuses[1].Limit != 250 {
+		t.Errorf("Unexpected status of guest flow %+v", statuses[1])
+	}
+}
+
+func TestWait(t *testing.T) {
+	s := &Scheduler{Capacity: 10000}
+	flow := s.Flow("client", "member")
+	start := time.Now()
+	flow.Wait(10000)
+	if flow.throttled {
+		t.Error("Burst within the allowance shouldn't be throttled")
+	}
+	flow.Wait(2000)
+	elapsed := time.Now().Sub(start)
+	if !flow.throttled || elapsed < 150*time.Millisecond {
+		t.Errorf("Expected to wait about 200ms beyond the allowance, waited %s", elapsed)
+	}
+}
+
+func TestHeldFlowsKept(t *testing.T) {
+	s := &Scheduler{Capacity: 1000}
+	held := s.Flow("websocket", "member")
+	start := time.Now()
+	held.lastActive = start.Add(-2 * IDLE_TIMEOUT)
+	s.rebalance(start, time.Second)
+	if s.Flow("websocket", "member") != held {
+		t.Fatal("Flow that's still held shouldn't be forgotten")
+	}
+	held.Release()
+	held.Release()
+	s.rebalance(start, time.Second)
+	if len(s.Status()) != 0 {
+		t.Error("Expected released idle flow to be forgotten")
+	}
+}
@@ -0,0 +1,127 @@
+// package flows exports sampled records of the connections that a server
+// makes to destinations ("flows") to a collector, for capacity planning across
+// a fleet of servers.  It's similar in spirit to NetFlow/IPFIX, but records
+// are batched into JSON datagrams sent over UDP.
+//
+// Flows carry no client identity, and destinations are recorded only as
+// salted hashes (see audit.HashHost), so hashes are comparable only between
+// servers that share a salt.  Each datagram states the sampling rate, so
+// that collectors can scale counts back up.
+package flows
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/audit"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// MAX_DATAGRAM_SIZE limits the size of the datagrams sent to the
+	// collector, so that they don't get fragmented
+	MAX_DATAGRAM_SIZE = 1200
+
+	// FLUSH_INTERVAL is the longest that a sampled flow waits before it's sent
+	FLUSH_INTERVAL = 10 * time.Second
+)
+
+// Flow is a single connection to a destination
+type Flow struct {
+	Start         int64  `json:"start"` // unix time at which the connection was opened
+	Destination   string `json:"dst"`   // salted hash of the destination host
+	Duration      int64  `json:"ms"`
+	BytesSent     int64  `json:"sent"`
+	BytesReceived int64  `json:"received"`
+}
+
+// Batch is the content of a datagram sent to the collector
+type Batch struct {
+	Instance   string  `json:"instance,omitempty"`
+	SampleRate int     `json:"sampling"` // 1 in this many flows is exported
+	Flows      []*Flow `json:"flows"`
+}
+
+// Exporter samples flows and sends them to a collector
+type Exporter struct {
+	Collector  string // host:port at which the collector receives datagrams
+	SampleRate int    // export 1 in this many flows
+	Salt       string // secret salt with which destination hosts are hashed
+	Instance   string // (optional) identifies this server to the collector
+
+	conn    net.Conn
+	pending []*Flow
+	size    int
+	mutex   sync.Mutex
+}
+
+// Start starts exporting to the collector
+func (exporter *Exporter) Start() error {
+	if exporter.SampleRate < 1 {
+		return fmt.Errorf("Sample rate must be at least 1, not %d", exporter.SampleRate)
+	}
+	var err error
+	exporter.conn, err = net.Dial("udp", exporter.Collector)
+	if err != nil {
+		return fmt.Errorf("Unable to dial flow collector: %s", err)
+	}
+	go exporter.flushPeriodically()
+	return nil
+}
+
+// Record records a connection to the given host, which is exported if it's
+// sampled
+func (exporter *Exporter) Record(host string, start time.Time, duration time.Duration, bytesSent int64, bytesReceived int64) {
+	if rand.Intn(exporter.SampleRate) != 0 {
+		return
+	}
+	flow := &Flow{
+		Start:         start.Unix(),
+		Destination:   audit.HashHost(exporter.Salt, host),
+		Duration:      int64(duration / time.Millisecond),
+		BytesSent:     bytesSent,
+		BytesReceived: bytesReceived,
+	}
+	encoded, _ := json.Marshal(flow)
+
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	if exporter.size+len(encoded)+1 > MAX_DATAGRAM_SIZE-len(exporter.Instance)-64 {
+		exporter.flush()
+	}
+	exporter.pending = append(exporter.pending, flow)
+	exporter.size += len(encoded) + 1
+}
+
+func (exporter *Exporter) flushPeriodically() {
+	for {
+		time.Sleep(FLUSH_INTERVAL)
+		exporter.mutex.Lock()
+		exporter.flush()
+		exporter.mutex.Unlock()
+	}
+}
+
+// flush sends the pending flows.  Must be called while holding the mutex.
+func (exporter *Exporter) flush() {
+	if len(exporter.pending) == 0 {
+		return
+	}
+	datagram, err := json.Marshal(&Batch{
+		Instance:   exporter.Instance,
+		SampleRate: exporter.SampleRate,
+		Flows:      exporter.pending,
+	})
+	exporter.pending = nil
+	exporter.size = 0
+	if err == nil {
+		_, err = exporter.conn.Write(datagram)
+	}
+	if err != nil {
+		log.Debugf("Unable to export flows: %s", err)
+	}
+}
@@ -0,0 +1,89 @@
+package flows
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/audit"
+)
+
+func TestExport(t *testing.T) {
+	exporter, collector := startExporter(t, 1)
+	defer collector.Close()
+
+	// Enough flows to fill more than one datagram
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		exporter.Record(fmt.Sprintf("host%d.example.com", i), start, 1500*time.Millisecond, 100, 2000)
+	}
+	flows := receive(t, exporter, collector)
+	if len(flows) != 20 {
+		t.Fatalf("Expected 20 flows, got %d", len(flows))
+	}
+	for i, flow := range flows {
+		expected := audit.HashHost("salt", fmt.Sprintf("host%d.example.com", i))
+		if flow.Destination != expected || flow.Duration != 1500 || flow.BytesReceived != 2000 {
+			t.Errorf("Unexpected flow %v", flow)
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	exporter, collector := startExporter(t, 10)
+	defer collector.Close()
+	for i := 0; i < 1000; i++ {
+		exporter.Record("example.com", time.Now(), 0, 0, 0)
+	}
+	if n := len(receive(t, exporter, collector)); n < 50 || n > 200 {
+		t.Errorf("Expected about 100 of 1000 flows to be sampled, got %d", n)
+	}
+}
+
+func startExporter(t *testing.T, sampleRate int) (*Exporter, net.PacketConn) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	exporter := &Exporter{
+		Collector:  collector.LocalAddr().String(),
+		SampleRate: sampleRate,
+		Salt:       "salt",
+		Instance:   "server1",
+	}
+	if err := exporter.Start(); err != nil {
+		t.Fatalf("Unable to start exporter: %s", err)
+	}
+	return exporter, collector
+}
+
+// receive flushes the exporter and returns the flows that the collector
+// received
+func receive(t *testing.T, exporter *Exporter, collector net.PacketConn) []*Flow {
+	exporter.mutex.Lock()
+	exporter.flush()
+	exporter.mutex.Unlock()
+
+	var flows []*Flow
+	buf := make([]byte, 65536)
+	for {
+		collector.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := collector.ReadFrom(buf)
+		if err != nil {
+			return flows
+		}
+		if n > MAX_DATAGRAM_SIZE {
+			t.Errorf("Datagram of %d bytes is too big", n)
+		}
+		batch := &Batch{}
+		if err := json.Unmarshal(buf[:n], batch); err != nil {
+			t.Fatalf("Unable to decode datagram: %s", err)
+		}
+		if batch.Instance != "server1" || batch.SampleRate != exporter.SampleRate {
+			t.Errorf("Unexpected batch %v", batch)
+		}
+		flows = append(flows, batch.Flows...)
+	}
+}
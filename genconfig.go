@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/proxy"
+)
+
+// generateConfig generates the server's certificate in configdir and prints
+// the command line with which clients can connect to the server, pinned to
+// that certificate.
+func generateConfig() {
+	server := &proxy.Server{
+		ProxyConfig:    proxy.ProxyConfig{Addr: *addr},
+		Host:           *upstreamHost,
+		AdvertisedHost: *advertise,
+		CertHosts:      splitList(*certHosts),
+		CertContext: &proxy.CertContext{
+			PKFile:         inConfigDir("proxypk.pem"),
+			ServerCertFile: inConfigDir("servercert.pem"),
+		},
+	}
+	if server.Addr == "" && server.AdvertisedHost == "" {
+		server.AdvertisedHost = *upstreamHost
+	}
+	if err := server.InitCert(); err != nil {
+		log.Fatalf("Unable to generate server cert: %s", err)
+	}
+	cert, err := ioutil.ReadFile(server.CertContext.ServerCertFile)
+	if err != nil {
+		log.Fatalf("Unable to read server cert: %s", err)
+	}
+
+	fmt.Printf("Generated server certificate at %s\n\n", server.CertContext.ServerCertFile)
+	fmt.Printf("Run the server with:\n\n  flashlight server -addr %s -server %s -configdir '%s'", orDefault(*addr, ":443"), *upstreamHost, *configDir)
+	if *authSpec != "" {
+		fmt.Printf(" -auth '%s'", *authSpec)
+	}
+	fmt.Printf("\n\nand clients with:\n\n  flashlight client -addr localhost:8080 -server %s -serverport %d -rootca '%s'", *upstreamHost, *upstreamPort, strings.TrimSpace(string(cert)))
+	if *authSpec != "" {
+		fmt.Printf(" -auth '%s'", *authSpec)
+	}
+	fmt.Println()
+}
+
+func orDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
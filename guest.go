@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/atomicfile"
+	"github.com/getlantern/flashlight/auth"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/storage"
+)
+
+const (
+	GUEST_LINK_PREFIX = "flashlight:"
+
+	// GUEST_USAGE_SAVE_INTERVAL is how often the server saves guest usage to
+	// its store
+	GUEST_USAGE_SAVE_INTERVAL = 1 * time.Minute
+)
+
+// GuestLink carries everything a client needs to connect to a server as a
+// guest, so that guest access can be shared as a single string.
+type GuestLink struct {
+	Server     string `json:"server"`
+	ServerPort int    `json:"serverport"`
+	Masquerade string `json:"masquerade,omitempty"`
+	RootCA     string `json:"rootca,omitempty"`
+	Token      string `json:"token"`
+}
+
+// mintGuestLink mints a guest token and prints the link containing it
+func mintGuestLink() {
+	maxBytes, err := parseBytes(*guestCap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	authority := &auth.GuestAuthority{Key: []byte(*guestKey)}
+	idBytes := make([]byte, 6)
+	if _, err := rand.Read(idBytes); err != nil {
+		log.Fatalf("Unable to generate guest id: %s", err)
+	}
+	id := "guest-" + hex.EncodeToString(idBytes)
+	token, err := authority.MintRenewable(id, *guestValid, *guestRotate, maxBytes)
+	if err != nil {
+		log.Fatalf("Unable to mint guest token: %s", err)
+	}
+	data, err := json.Marshal(&GuestLink{
+		Server:     *upstreamHost,
+		ServerPort: *upstreamPort,
+		Masquerade: *masqueradeAs,
+		RootCA:     *rootCA,
+		Token:      token,
+	})
+	if err != nil {
+		log.Fatalf("Unable to marshal guest link: %s", err)
+	}
+	fmt.Printf("Guest %s, valid for %s", id, *guestValid)
+	if maxBytes > 0 {
+		fmt.Printf(" and %s", *guestCap)
+	}
+	if *guestRotate > 0 && *guestRotate < *guestValid {
+		fmt.Printf(" with the token rotated every %s", *guestRotate)
+	}
+	fmt.Printf(".  Run the client with:\n\n  flashlight client -addr localhost:8080 -guest %s%s\n", GUEST_LINK_PREFIX, base64.RawURLEncoding.EncodeToString(data))
+}
+
+// applyGuestLink configures the client from the link given by -guest
+func applyGuestLink() {
+	if *guestLink == "" {
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(*guestLink, GUEST_LINK_PREFIX))
+	if err != nil {
+		log.Fatalf("Unable to decode guest link: %s", err)
+	}
+	link := &GuestLink{}
+	if err := json.Unmarshal(data, link); err != nil {
+		log.Fatalf("Unable to parse guest link: %s", err)
+	}
+	*upstreamHost = link.Server
+	*upstreamPort = link.ServerPort
+	*masqueradeAs = link.Masquerade
+	*rootCA = link.RootCA
+	*authSpec = "guest:" + link.Token
+}
+
+// parseBytes parses a number of bytes like 5GB or 500MB
+func parseBytes(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(upper, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse size %s: %s", s, err)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// persistGuestUsage loads the guests' usage from the server's store and keeps
+// saving it there, so that bandwidth caps survive restarts
+func persistGuestUsage(guests *auth.GuestAuthority) {
+	spec := *serverStore
+	if spec == "" {
+		spec = "file:" + inConfigDir("serverstate.json")
+	}
+	store, err := storage.Open(spec)
+	if err != nil {
+		log.Fatalf("Unable to open server store: %s", err)
+	}
+	guests.Store = store
+	if err := guests.LoadUsage(); err != nil {
+		log.Errorf("Unable to load guest usage: %s", err)
+	}
+	go func() {
+		for {
+			time.Sleep(GUEST_USAGE_SAVE_INTERVAL)
+			if err := guests.SaveUsage(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// renewableCredentials returns the client's credentials if they can be renewed
+// with the server (i.e. a guest token minted with -guestrotate), switching to
+// the renewed token saved in the configdir if there's one.
+func renewableCredentials(scheme auth.Scheme) auth.Renewable {
+	credentials, ok := scheme.(auth.Renewable)
+	if !ok || credentials.RenewAt().IsZero() {
+		return nil
+	}
+	filename := inConfigDir("guesttoken")
+	if saved, err := ioutil.ReadFile(filename); err == nil {
+		// Only works if it's for the same guest and newer than the link's
+		if err := credentials.Renewed(string(saved)); err == nil {
+			log.Debugf("Using renewed guest token from %s", filename)
+		}
+	}
+	return credentials
+}
+
+// saveRenewedCredentials saves the renewed guest token, which the link given
+// with -guest no longer matches, so that it's used after a restart
+func saveRenewedCredentials(credentials string) {
+	if err := atomicfile.WriteFile(inConfigDir("guesttoken"), []byte(credentials), 0600); err != nil {
+		log.Errorf("Unable to save renewed guest token: %s", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+var (
+	// HARDENED_SETTINGS are the flags that -hardened changes.  Each of them can
+	// still be overridden individually, on the command line or in the config
+	// file.  The admin API isn't covered: if there's an adminaddr, it still
+	// listens on TCP, protected only by the admintoken.
+	HARDENED_SETTINGS = map[string]string{
+		"tlsstrict":     "true",  // only TLS 1.2 (and strong cipher suites on servers)
+		"dumpheaders":   "false", // never log headers
+		"allowbypass":   "false", // fail closed, traffic never silently leaves the tunnel
+		"allowdumping":  "false", // requests aren't logged at runtime either
+		"controlsocket": "true",  // control endpoint only reachable by our user
+		"allowroot":     "false", // don't run with more privileges than needed
+	}
+)
+
+// applyHardening applies HARDENED_SETTINGS (if running with -hardened) to the
+// flags that weren't set explicitly.
+func applyHardening() {
+	if !*hardened {
+		return
+	}
+	set := make(map[string]bool)
+	for name := range explicitFlags {
+		set[name] = true
+	}
+	// Flags set from the config file
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, value := range HARDENED_SETTINGS {
+		if !set[name] {
+			flag.Set(name, value)
+		}
+	}
+}
+
+// refuseRootIfNecessary exits if running as root without -allowroot.  Low
+// ports can be bound without root, e.g. with setcap cap_net_bind_service on
+// Linux.
+func refuseRootIfNecessary() {
+	if !*allowRoot && os.Geteuid() == 0 {
+		log.Fatal("Refusing to run as root, run as an unprivileged user or pass -allowroot")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHardened(t *testing.T) {
+	defer resetFlags()
+	parseSubcommand([]string{"client", "-addr", "127.0.0.1:0", "-server", "fl.example.com", "-hardened", "-allowbypass"})
+	if !*tlsStrict || *dumpheaders || !*controlSocket || *allowRoot {
+		t.Errorf("Expected hardened settings, got tlsstrict=%v dumpheaders=%v controlsocket=%v allowroot=%v", *tlsStrict, *dumpheaders, *controlSocket, *allowRoot)
+	}
+	if !*allowBypass {
+		t.Error("Explicitly set flag should win over the hardened setting")
+	}
+}
+
+func TestNotHardened(t *testing.T) {
+	defer resetFlags()
+	parseSubcommand([]string{"client", "-addr", "127.0.0.1:0", "-server", "fl.example.com"})
+	if *tlsStrict || !*allowBypass || *controlSocket || !*allowRoot {
+		t.Error("Settings shouldn't be hardened without -hardened")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"time"
+
+	"github.com/getlantern/flashlight/hosthistory"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	HOST_HISTORY_FILE = "hosthistory.json"
+
+	// HOST_HISTORY_SAVE_INTERVAL is how often the host history is saved, so
+	// at most this much of it is lost when the client dies
+	HOST_HISTORY_SAVE_INTERVAL = 1 * time.Minute
+)
+
+// openHostHistory loads the client's host history from the configdir and
+// starts saving it periodically.  It returns nil (which records nothing and
+// has no opinion) if the history is disabled with -historyhalflife 0.
+func openHostHistory() *hosthistory.History {
+	if *historyHalfLife <= 0 {
+		return nil
+	}
+	history := &hosthistory.History{
+		File:     inConfigDir(HOST_HISTORY_FILE),
+		HalfLife: *historyHalfLife,
+	}
+	if err := history.Load(); err != nil {
+		log.Errorf("Unable to load host history, starting fresh: %s", err)
+	}
+	go history.SaveEvery(HOST_HISTORY_SAVE_INTERVAL)
+	return history
+}
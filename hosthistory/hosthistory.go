@@ -0,0 +1,303 @@
+// package hosthistory remembers how well each destination host could be
+// reached through each route (directly, or through the server at each of its
+// addresses) and persists it, so that routing decisions can be biased towards
+// what worked before.  Outcomes count less and less as they age (they decay
+// with a half-life), so that the history follows changing networks and
+// routes that were given up on eventually get another chance.
+package hosthistory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/atomicfile"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	ROUTE_DIRECT = "direct" // reaching the host directly, other routes are named by server address
+
+	// DEFAULT_HALF_LIFE is how long it takes for an outcome to count half as
+	// much, if no HalfLife is given
+	DEFAULT_HALF_LIFE = 24 * time.Hour
+
+	// MIN_SAMPLES is how many (decayed) outcomes a route needs before its
+	// history is trusted
+	MIN_SAMPLES = 2
+
+	// FAILING_RATE is the success rate below which a route counts as failing
+	FAILING_RATE = 0.5
+
+	// MAX_HOSTS bounds the size of the history, the least recently used hosts
+	// are forgotten first
+	MAX_HOSTS = 5000
+
+	// LATENCY_SMOOTHING is the weight given to the latest latency in the
+	// moving average
+	LATENCY_SMOOTHING = 0.3
+)
+
+// Stats are the outcomes of reaching a host through a route
+type Stats struct {
+	Successes float64       `json:"successes"` // decayed count of successful attempts
+	Failures  float64       `json:"failures"`  // decayed count of failed attempts
+	Latency   time.Duration `json:"latency"`   // moving average of the time taken by successful attempts
+	Updated   time.Time     `json:"updated"`   // when the counts were last decayed
+}
+
+// History tracks the Stats of each route to each host
+type History struct {
+	File     string        // (optional) file in which to persist the history
+	HalfLife time.Duration // (optional) half-life of outcomes, defaults to DEFAULT_HALF_LIFE
+
+	hosts map[string]map[string]*Stats // by host, then route
+	dirty bool                         // whether there are changes that haven't been saved
+	mutex sync.Mutex
+}
+
+// Load loads the previously persisted history from File, forgetting hosts
+// whose history decayed to nothing in the meantime.  A missing file is not an
+// error.
+func (history *History) Load() error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	history.hosts = make(map[string]map[string]*Stats)
+	data, err := ioutil.ReadFile(history.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Unable to read host history: %s", err)
+	}
+	hosts := make(map[string]map[string]*Stats)
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return fmt.Errorf("Unable to parse host history: %s", err)
+	}
+	now := time.Now()
+	for host, routes := range hosts {
+		for route, stats := range routes {
+			history.decay(stats, now)
+			if stats.Successes+stats.Failures < 0.01 {
+				delete(routes, route)
+			}
+		}
+		if len(routes) > 0 {
+			history.hosts[host] = routes
+		}
+	}
+	return nil
+}
+
+// Record records the outcome of reaching host through route, which took the
+// given time
+func (history *History) Record(host string, route string, latency time.Duration, err error) {
+	if history == nil {
+		return
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if history.hosts == nil {
+		history.hosts = make(map[string]map[string]*Stats)
+	}
+	routes, found := history.hosts[host]
+	if !found {
+		if len(history.hosts) >= MAX_HOSTS {
+			history.forgetLeastRecentlyUsed()
+		}
+		routes = make(map[string]*Stats)
+		history.hosts[host] = routes
+	}
+	now := time.Now()
+	stats, found := routes[route]
+	if !found {
+		stats = &Stats{Updated: now}
+		routes[route] = stats
+	}
+	history.decay(stats, now)
+	if err != nil {
+		stats.Failures++
+	} else {
+		stats.Successes++
+		if stats.Latency == 0 {
+			stats.Latency = latency
+		} else {
+			stats.Latency = time.Duration(LATENCY_SMOOTHING*float64(latency) + (1-LATENCY_SMOOTHING)*float64(stats.Latency))
+		}
+	}
+	history.dirty = true
+}
+
+// Stats returns a snapshot of the stats of route to host, or nil if there's
+// no history for it
+func (history *History) Stats(host string, route string) *Stats {
+	if history == nil {
+		return nil
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	stats, found := history.hosts[host][route]
+	if !found {
+		return nil
+	}
+	snapshot := *stats
+	history.decay(&snapshot, time.Now())
+	return &snapshot
+}
+
+// IsFailing determines whether the history shows that reaching host through
+// route mostly fails.  Routes without enough history aren't failing.
+func (history *History) IsFailing(host string, route string) bool {
+	stats := history.Stats(host, route)
+	return stats != nil && stats.trusted() && stats.successRate() < FAILING_RATE
+}
+
+// Order returns the given routes to host ordered so that routes with a better
+// history come first: a higher success rate wins, followed by a lower
+// latency.  Both are compared coarsely (success rates in steps of 20%,
+// latencies in factors of 2), so that small differences don't matter.  Routes
+// without enough history are considered as good as the best one, so routes
+// that are alike keep their original order.
+func (history *History) Order(host string, routes []string) []string {
+	ordered := make([]string, len(routes))
+	copy(ordered, routes)
+	if history == nil || len(routes) < 2 {
+		return ordered
+	}
+	now := time.Now()
+	history.mutex.Lock()
+	ranks := make([]rank, len(routes))
+	var best *rank
+	for i, route := range ordered {
+		if stats, found := history.hosts[host][route]; found {
+			snapshot := *stats
+			history.decay(&snapshot, now)
+			if snapshot.trusted() {
+				ranks[i] = rankOf(&snapshot)
+				if best == nil || ranks[i].before(*best) {
+					best = &ranks[i]
+				}
+				continue
+			}
+		}
+		ranks[i].unknown = true
+	}
+	history.mutex.Unlock()
+	if best == nil {
+		return ordered
+	}
+	for i := range ranks {
+		if ranks[i].unknown {
+			ranks[i] = *best
+		}
+	}
+	sort.Stable(byRank{ordered, ranks})
+	return ordered
+}
+
+// Save persists the history to File, if it changed since it was last saved
+func (history *History) Save() error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if !history.dirty || history.File == "" {
+		return nil
+	}
+	data, err := json.Marshal(history.hosts)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal host history: %s", err)
+	}
+	if err := atomicfile.WriteFile(history.File, data, 0644); err != nil {
+		return fmt.Errorf("Unable to save host history: %s", err)
+	}
+	history.dirty = false
+	return nil
+}
+
+// SaveEvery saves the history at the given interval and blocks forever.
+// Outcomes are recorded far too often to save each one as it comes.
+func (history *History) SaveEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := history.Save(); err != nil {
+			log.Errorf("Unable to save host history: %s", err)
+		}
+	}
+}
+
+// decay ages the counts of stats to now.  Must be called while holding the
+// mutex (or on a snapshot).
+func (history *History) decay(stats *Stats, now time.Time) {
+	halfLife := history.HalfLife
+	if halfLife <= 0 {
+		halfLife = DEFAULT_HALF_LIFE
+	}
+	elapsed := now.Sub(stats.Updated)
+	if elapsed <= 0 {
+		return
+	}
+	factor := math.Pow(0.5, float64(elapsed)/float64(halfLife))
+	stats.Successes *= factor
+	stats.Failures *= factor
+	stats.Updated = now
+}
+
+// forgetLeastRecentlyUsed forgets the host whose history was updated longest
+// ago.  Must be called while holding the mutex.
+func (history *History) forgetLeastRecentlyUsed() {
+	oldestHost := ""
+	var oldest time.Time
+	for host, routes := range history.hosts {
+		for _, stats := range routes {
+			if oldestHost == "" || stats.Updated.Before(oldest) {
+				oldestHost, oldest = host, stats.Updated
+			}
+		}
+	}
+	delete(history.hosts, oldestHost)
+}
+
+func (stats *Stats) trusted() bool {
+	return stats.Successes+stats.Failures >= MIN_SAMPLES
+}
+
+func (stats *Stats) successRate() float64 {
+	return stats.Successes / (stats.Successes + stats.Failures)
+}
+
+// rank is the coarse position of a route in the Order
+type rank struct {
+	successBucket int // higher is better
+	latencyBucket int // lower is better
+	unknown       bool
+}
+
+func rankOf(stats *Stats) rank {
+	return rank{
+		successBucket: int(stats.successRate() * 5),
+		latencyBucket: int(math.Log2(float64(stats.Latency/time.Millisecond) + 1)),
+	}
+}
+
+func (r rank) before(other rank) bool {
+	if r.successBucket != other.successBucket {
+		return r.successBucket > other.successBucket
+	}
+	return r.latencyBucket < other.latencyBucket
+}
+
+type byRank struct {
+	routes []string
+	ranks  []rank
+}
+
+func (s byRank) Len() int { return len(s.routes) }
+func (s byRank) Swap(i, j int) {
+	s.routes[i], s.routes[j] = s.routes[j], s.routes[i]
+	s.ranks[i], s.ranks[j] = s.ranks[j], s.ranks[i]
+}
+func (s byRank) Less(i, j int) bool { return s.ranks[i].before(s.ranks[j]) }
@@ -0,0 +1,88 @@
+package hosthistory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	routes = []string{"a:443", "b:443", "c:443"}
+	failed = fmt.Errorf("refused")
+)
+
+func TestOrder(t *testing.T) {
+	history := &History{}
+	if ordered := history.Order("www.example.com", routes); !reflect.DeepEqual(ordered, routes) {
+		t.Errorf("Unknown host should keep original order, got %v", ordered)
+	}
+
+	for i := 0; i < 3; i++ {
+		history.Record("www.example.com", "a:443", 0, failed)
+		history.Record("www.example.com", "b:443", 400*time.Millisecond, nil)
+		history.Record("www.example.com", "c:443", 50*time.Millisecond, nil)
+	}
+	if ordered := history.Order("www.example.com", routes); !reflect.DeepEqual(ordered, []string{"c:443", "b:443", "a:443"}) {
+		t.Errorf("Expected quickest working route first and failing route last, got %v", ordered)
+	}
+	if ordered := history.Order("other.example.com", routes); !reflect.DeepEqual(ordered, routes) {
+		t.Errorf("History of one host shouldn't affect another, got %v", ordered)
+	}
+
+	// Unknown routes are as good as the best known one
+	if ordered := history.Order("www.example.com", []string{"a:443", "d:443", "c:443"}); !reflect.DeepEqual(ordered, []string{"d:443", "c:443", "a:443"}) {
+		t.Errorf("Expected unknown route to keep its place before the best route, got %v", ordered)
+	}
+}
+
+func TestIsFailing(t *testing.T) {
+	history := &History{HalfLife: 50 * time.Millisecond}
+	history.Record("www.example.com", ROUTE_DIRECT, 0, failed)
+	if history.IsFailing("www.example.com", ROUTE_DIRECT) {
+		t.Error("A single failure shouldn't be trusted")
+	}
+	for i := 0; i < 3; i++ {
+		history.Record("www.example.com", ROUTE_DIRECT, 0, failed)
+	}
+	history.Record("www.example.com", ROUTE_DIRECT, 10*time.Millisecond, nil)
+	if !history.IsFailing("www.example.com", ROUTE_DIRECT) {
+		t.Errorf("Mostly failing route should be failing, stats %v", history.Stats("www.example.com", ROUTE_DIRECT))
+	}
+
+	// Eventually the failures are forgotten
+	time.Sleep(200 * time.Millisecond)
+	if history.IsFailing("www.example.com", ROUTE_DIRECT) {
+		t.Errorf("Failures should have decayed, stats %v", history.Stats("www.example.com", ROUTE_DIRECT))
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	file, err := ioutil.TempFile("", "hosthistory")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	defer os.Remove(file.Name())
+
+	history := &History{File: file.Name()}
+	if err := history.Load(); err != nil {
+		t.Fatalf("Unable to load from missing file: %s", err)
+	}
+	history.Record("www.example.com", ROUTE_DIRECT, 20*time.Millisecond, nil)
+	if err := history.Save(); err != nil {
+		t.Fatalf("Unable to save: %s", err)
+	}
+
+	history = &History{File: file.Name()}
+	if err := history.Load(); err != nil {
+		t.Fatalf("Unable to load: %s", err)
+	}
+	stats := history.Stats("www.example.com", ROUTE_DIRECT)
+	if stats == nil || stats.Latency != 20*time.Millisecond || stats.Successes < 0.99 {
+		t.Errorf("History wasn't persisted, got %v", stats)
+	}
+}
@@ -0,0 +1,127 @@
+// package hostmatch matches hostnames against lists of patterns, so that every
+// list of hosts (bypass lists, plaintext exemptions, route overrides, etc.)
+// understands the same syntax:
+//
+//	example.com     example.com and all of its subdomains
+//	.example.com    same as example.com
+//	*.example.com   subdomains of example.com, but not example.com itself
+//	/^cdn[0-9]+\./  hosts matching the regular expression (anchored at both
+//	                ends unless it already is)
+//
+// Matching is case insensitive and ignores a trailing dot.  Plain names and
+// wildcards are looked up by domain, so lists of thousands of them are about
+// as cheap to check as short ones.  Regexes are checked one by one.
+package hostmatch
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// List is a compiled list of patterns.  A nil List matches nothing.
+type List struct {
+	domains    map[string]bool // match the domain and its subdomains
+	subdomains map[string]bool // match only subdomains
+	regexps    []*regexp.Regexp
+}
+
+// Parse compiles the given patterns into a List
+func Parse(patterns ...string) (*List, error) {
+	list := &List{
+		domains:    make(map[string]bool),
+		subdomains: make(map[string]bool),
+	}
+	for _, pattern := range patterns {
+		if err := list.add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// MustParse is like Parse but panics if any of the patterns are invalid.  It's
+// meant for lists that are built into the program.
+func MustParse(patterns ...string) *List {
+	list, err := Parse(patterns...)
+	if err != nil {
+		panic(err)
+	}
+	return list
+}
+
+// IsPattern indicates whether the given string is a wildcard or regex pattern
+// rather than a plain hostname.
+func IsPattern(s string) bool {
+	return strings.HasPrefix(s, "*.") || (len(s) > 1 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/"))
+}
+
+func (list *List) add(pattern string) error {
+	pattern = strings.TrimSpace(pattern)
+	switch {
+	case pattern == "":
+		return nil
+	case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		expr := pattern[1 : len(pattern)-1]
+		if !strings.HasPrefix(expr, "^") {
+			expr = "^(?:" + expr
+		} else {
+			expr = "^(?:" + expr[1:]
+		}
+		if !strings.HasSuffix(expr, "$") {
+			expr = expr + ")$"
+		} else {
+			expr = expr[:len(expr)-1] + ")$"
+		}
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return fmt.Errorf("Unable to compile host pattern %s: %s", pattern, err)
+		}
+		list.regexps = append(list.regexps, re)
+	case strings.HasPrefix(pattern, "*."):
+		domain := normalize(pattern[2:])
+		if domain == "" || strings.Contains(domain, "*") {
+			return fmt.Errorf("Invalid host pattern %s", pattern)
+		}
+		list.subdomains[domain] = true
+	default:
+		domain := normalize(strings.TrimPrefix(pattern, "."))
+		if domain == "" || strings.Contains(domain, "*") {
+			return fmt.Errorf("Invalid host pattern %s, wildcards are only allowed as *.domain", pattern)
+		}
+		list.domains[domain] = true
+	}
+	return nil
+}
+
+// Matches determines whether the given host (without port) matches any of the
+// patterns in the list.
+func (list *List) Matches(host string) bool {
+	if list == nil {
+		return false
+	}
+	host = normalize(host)
+	if list.domains[host] {
+		return true
+	}
+	for parent := host; ; {
+		i := strings.IndexByte(parent, '.')
+		if i < 0 {
+			break
+		}
+		parent = parent[i+1:]
+		if list.domains[parent] || list.subdomains[parent] {
+			return true
+		}
+	}
+	for _, re := range list.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalize(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,73 @@
+package hostmatch
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMatches(t *testing.T) {
+	list, err := Parse("example.com", ".corp.example.org", "*.wild.net", "/cdn[0-9]+\\.example\\.io/", "/^exact\\.test$/")
+	if err != nil {
+		t.Fatalf("Unable to parse: %s", err)
+	}
+	cases := map[string]bool{
+		"example.com":           true,
+		"EXAMPLE.com.":          true,
+		"www.example.com":       true,
+		"notexample.com":        false,
+		"corp.example.org":      true,
+		"mail.corp.example.org": true,
+		"example.org":           false,
+		"wild.net":              false,
+		"a.wild.net":            true,
+		"a.b.wild.net":          true,
+		"cdn12.example.io":      true,
+		"cdn.example.io":        false,
+		"xcdn1.example.io":      false,
+		"cdn1.example.io.evil":  false,
+		"exact.test":            true,
+		"inexact.test":          false,
+	}
+	for host, expected := range cases {
+		if list.Matches(host) != expected {
+			t.Errorf("Expected Matches(%s) to be %v", host, expected)
+		}
+	}
+
+	var nilList *List
+	if nilList.Matches("example.com") {
+		t.Error("nil List shouldn't match anything")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, pattern := range []string{"foo.*.com", "*.", "/[/"} {
+		if _, err := Parse(pattern); err == nil {
+			t.Errorf("Expected %s to be invalid", pattern)
+		}
+	}
+}
+
+func BenchmarkMatchesDomains(b *testing.B) {
+	patterns := make([]string, 10000)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf("*.site%d.example.com", i)
+	}
+	list, _ := Parse(patterns...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		list.Matches("www.images.site9999.example.com")
+	}
+}
+
+func BenchmarkMatchesRegexps(b *testing.B) {
+	patterns := make([]string, 100)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf("/cdn[0-9]+\\.site%d\\.example\\.com/", i)
+	}
+	list, _ := Parse(patterns...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		list.Matches("cdn7.site99.example.com")
+	}
+}
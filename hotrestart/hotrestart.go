@@ -0,0 +1,228 @@
+// package hotrestart lets a server replace itself with a new process (e.g. to
+// upgrade the binary) without refusing any connections.  The new process
+// inherits the listening sockets, so that connections keep being accepted
+// throughout, while the old process finishes the connections it already has.
+//
+// Listeners that should be handed over are opened with Listen.  Spawn starts
+// the new process and waits for it to call Ready.
+package hotrestart
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// LISTENERS_ENV tells the new process which inherited file descriptor
+	// belongs to which address, as addr=fd,addr=fd
+	LISTENERS_ENV = "FLASHLIGHT_INHERITED_LISTENERS"
+
+	// READY_ENV tells the new process the file descriptor to close once it's
+	// ready
+	READY_ENV = "FLASHLIGHT_READY_FD"
+
+	// READY_TIMEOUT is how long Spawn waits for the new process to be ready
+	READY_TIMEOUT = 1 * time.Minute
+)
+
+var (
+	inherited = make(map[string]*os.File)  // inherited sockets not yet listened on, by address
+	open      = make(map[string]*listener) // sockets listened on, by address
+	ready     *os.File                     // closed to tell the parent that we're ready
+	mutex     sync.Mutex
+)
+
+func init() {
+	inherited, ready = parseEnv(os.Getenv(LISTENERS_ENV), os.Getenv(READY_ENV))
+	// Our own children get their own
+	os.Unsetenv(LISTENERS_ENV)
+	os.Unsetenv(READY_ENV)
+}
+
+// parseEnv parses the values of LISTENERS_ENV and READY_ENV
+func parseEnv(listeners string, readyFD string) (map[string]*os.File, *os.File) {
+	files := make(map[string]*os.File)
+	for _, item := range strings.Split(listeners, ",") {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			continue
+		}
+		fd, err := strconv.Atoi(item[i+1:])
+		if err != nil {
+			log.Errorf("Ignoring inherited listener %s: %s", item, err)
+			continue
+		}
+		files[item[:i]] = os.NewFile(uintptr(fd), item[:i])
+	}
+	var readyFile *os.File
+	if fd, err := strconv.Atoi(readyFD); err == nil {
+		readyFile = os.NewFile(uintptr(fd), "ready")
+	}
+	return files, readyFile
+}
+
+// Listen listens at addr like net.Listen, unless a socket for addr was
+// inherited, in which case that's used.  The listener is remembered, so that
+// Spawn can hand it over until it's closed.
+func Listen(network string, addr string) (net.Listener, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var l net.Listener
+	var err error
+	if file, found := inherited[addr]; found {
+		delete(inherited, addr)
+		l, err = net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to use inherited listener for %s: %s", addr, err)
+		}
+		log.Debugf("Inherited listener for %s", addr)
+	} else if l, err = net.Listen(network, addr); err != nil {
+		return nil, err
+	}
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		return l, nil
+	}
+	wrapped := &listener{TCPListener: tcpListener, addr: addr}
+	open[addr] = wrapped
+	return wrapped, nil
+}
+
+// Inherited determines whether a socket for addr was inherited (and not
+// listened on yet)
+func Inherited(addr string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, found := inherited[addr]
+	return found
+}
+
+// Ready tells the process that started this one, if any, that this one is
+// accepting connections, so that it can stop.  Only the first call counts.
+func Ready() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if ready != nil {
+		ready.Close()
+		ready = nil
+	}
+}
+
+// CloseAll closes all listeners opened with Listen, e.g. so that a process
+// that spawned a replacement stops accepting connections.  Closing them again
+// afterwards is a no-op, so their owners can still close them as usual.
+func CloseAll() {
+	mutex.Lock()
+	listeners := make([]*listener, 0, len(open))
+	for _, l := range open {
+		listeners = append(listeners, l)
+	}
+	mutex.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// Spawn starts a new process running the same command (which picks up the
+// binary at the same path, e.g. after an upgrade), handing it the listeners
+// opened with Listen, and waits until it's Ready.
+func Spawn() (*os.Process, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("Restarting without downtime isn't supported on Windows")
+	}
+	mutex.Lock()
+	var files []*os.File
+	var listeners []string
+	for addr, l := range open {
+		file, err := l.File()
+		if err != nil {
+			mutex.Unlock()
+			closeAll(files)
+			return nil, fmt.Errorf("Unable to hand over listener for %s: %s", addr, err)
+		}
+		// Descriptors 0 to 2 are stdin, stdout and stderr
+		listeners = append(listeners, fmt.Sprintf("%s=%d", addr, 3+len(files)))
+		files = append(files, file)
+	}
+	mutex.Unlock()
+	defer closeAll(files)
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create pipe: %s", err)
+	}
+	defer readyReader.Close()
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		LISTENERS_ENV+"="+strings.Join(listeners, ","),
+		READY_ENV+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start new process: %s", err)
+	}
+	log.Debugf("Started new process %d, waiting for it to be ready", cmd.Process.Pid)
+
+	// The pipe is closed when the new process is ready, or exits
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	readied := make(chan struct{})
+	go func() {
+		readyReader.Read(make([]byte, 1))
+		close(readied)
+	}()
+	select {
+	case <-readied:
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("New process exited before it was ready: %v", err)
+		case <-time.After(100 * time.Millisecond):
+			return cmd.Process, nil
+		}
+	case <-time.After(READY_TIMEOUT):
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("New process wasn't ready within %s", READY_TIMEOUT)
+	}
+}
+
+func closeAll(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// listener forgets the listener once it's closed
+type listener struct {
+	*net.TCPListener
+	addr   string
+	closed bool
+}
+
+func (l *listener) Close() error {
+	mutex.Lock()
+	if l.closed {
+		mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	if open[l.addr] == l {
+		delete(open, l.addr)
+	}
+	mutex.Unlock()
+	return l.TCPListener.Close()
+}
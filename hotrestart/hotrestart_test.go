@@ -0,0 +1,76 @@
+package hotrestart
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParseEnv(t *testing.T) {
+	files, ready := parseEnv("127.0.0.1:443=3,[::1]:80=4,bad,x=y", "5")
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 listeners, got %v", files)
+	}
+	if files["127.0.0.1:443"].Fd() != 3 || files["[::1]:80"].Fd() != 4 {
+		t.Errorf("Unexpected files %v", files)
+	}
+	if ready == nil || ready.Fd() != 5 {
+		t.Errorf("Unexpected ready file %v", ready)
+	}
+	files, ready = parseEnv("", "")
+	if len(files) != 0 || ready != nil {
+		t.Errorf("Expected nothing to be inherited, got %v and %v", files, ready)
+	}
+}
+
+func TestListenInherited(t *testing.T) {
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := original.Addr().String()
+	file, err := original.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	original.Close()
+
+	mutex.Lock()
+	inherited[addr] = file
+	mutex.Unlock()
+	if !Inherited(addr) {
+		t.Fatal("Expected listener to be inherited")
+	}
+	l, err := Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unable to listen on inherited socket: %s", err)
+	}
+	if Inherited(addr) {
+		t.Error("Inherited listener should only be used once")
+	}
+	if l.Addr().String() != addr {
+		t.Errorf("Expected to listen at %s, got %s", addr, l.Addr())
+	}
+
+	// The inherited socket still accepts connections
+	go func() {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			fmt.Fprint(conn, "x")
+			conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Unable to accept: %s", err)
+	}
+	conn.Close()
+
+	CloseAll()
+	if _, found := open[addr]; found {
+		t.Error("Closed listener should be forgotten")
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("Closing again should be a no-op, got %s", err)
+	}
+}
@@ -0,0 +1,157 @@
+// package instance keeps more than one flashlight client from running against
+// the same configdir, and lets later invocations find the running instance in
+// order to control it.
+//
+// The running instance holds a lockfile containing its PID and the address and
+// token of its control endpoint.  A lockfile whose control endpoint doesn't
+// answer is considered stale (e.g. left behind by a crash) and replaced,
+// unless it was created within the STARTUP_GRACE, since the instance may not
+// be listening yet.
+package instance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// STARTUP_GRACE is how long after creating its lockfile an instance has to
+	// start answering at its control endpoint
+	STARTUP_GRACE = 10 * time.Second
+)
+
+var (
+	probeTimeout = 2 * time.Second
+)
+
+// Info describes a running instance
+type Info struct {
+	PID          int    `json:"pid"`
+	Addr         string `json:"addr"`                 // address at which the instance proxies
+	ControlNet   string `json:"controlNet,omitempty"` // network of the instance's control endpoint, "tcp" (the default) or "unix"
+	ControlAddr  string `json:"controlAddr"`          // address of the instance's control endpoint
+	ControlToken string `json:"controlToken"`         // secret required by the control endpoint
+}
+
+// DialControl dials the instance's control endpoint
+func (info *Info) DialControl() (net.Conn, error) {
+	network := info.ControlNet
+	if network == "" {
+		network = "tcp"
+	}
+	return net.DialTimeout(network, info.ControlAddr, probeTimeout)
+}
+
+// AlreadyRunningError is returned by Acquire when another live instance holds
+// the lock
+type AlreadyRunningError struct {
+	Info *Info
+}
+
+func (err *AlreadyRunningError) Error() string {
+	return fmt.Sprintf("Another flashlight client (pid %d) is already running, proxying at %s", err.Info.PID, err.Info.Addr)
+}
+
+// Lock is a held lockfile
+type Lock struct {
+	File string
+}
+
+// Acquire creates the lockfile containing the given info, failing with an
+// AlreadyRunningError if a live instance already holds it.
+func Acquire(file string, info *Info) (*Lock, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to marshal instance info: %s", err)
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		err := create(file, data)
+		if err == nil {
+			return &Lock{File: file}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("Unable to create lockfile: %s", err)
+		}
+		running, err := Find(file)
+		if err == nil {
+			return nil, &AlreadyRunningError{running}
+		}
+		if starting := startingInstance(file); starting != nil {
+			return nil, &AlreadyRunningError{starting}
+		}
+		// Stale, remove and try again
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Unable to remove stale lockfile: %s", err)
+		}
+	}
+	return nil, fmt.Errorf("Unable to acquire lockfile %s", file)
+}
+
+// create creates the lockfile containing data, failing if it already exists.
+// The data is written to a temporary file that's then linked into place, so
+// that the lockfile never appears partially written.
+func create(file string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Link(f.Name(), file)
+}
+
+// startingInstance returns the info in the given lockfile if it was created
+// within the STARTUP_GRACE
+func startingInstance(file string) *Info {
+	stat, err := os.Stat(file)
+	if err != nil || time.Now().Sub(stat.ModTime()) > STARTUP_GRACE {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	info := &Info{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil
+	}
+	return info
+}
+
+// Release removes the lockfile
+func (lock *Lock) Release() error {
+	return os.Remove(lock.File)
+}
+
+// Find finds the running instance that holds the given lockfile, failing if
+// there is none.
+func Find(file string) (*Info, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("No running instance found: %s", err)
+	}
+	info := &Info{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("Unable to parse lockfile %s: %s", file, err)
+	}
+	conn, err := info.DialControl()
+	if err != nil {
+		return nil, fmt.Errorf("Instance (pid %d) not responding at %s: %s", info.PID, info.ControlAddr, err)
+	}
+	conn.Close()
+	return info, nil
+}
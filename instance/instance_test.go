@@ -0,0 +1,102 @@
+package instance
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempLockfile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "instance")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	return filepath.Join(dir, "flashlight.lock"), func() { os.RemoveAll(dir) }
+}
+
+// deadAddr returns an address at which nothing listens
+func deadAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+func TestAcquire(t *testing.T) {
+	file, cleanup := tempLockfile(t)
+	defer cleanup()
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer control.Close()
+
+	info := &Info{PID: 1234, Addr: "127.0.0.1:8787", ControlAddr: control.Addr().String(), ControlToken: "s3cret"}
+	lock, err := Acquire(file, info)
+	if err != nil {
+		t.Fatalf("Unable to acquire: %s", err)
+	}
+	if stat, _ := os.Stat(file); stat.Mode().Perm() != 0600 {
+		t.Errorf("Expected lockfile to be private, has mode %s", stat.Mode())
+	}
+	found, err := Find(file)
+	if err != nil || *found != *info {
+		t.Errorf("Expected to find %+v, got %+v %v", info, found, err)
+	}
+
+	_, err = Acquire(file, &Info{PID: 5678})
+	if running, ok := err.(*AlreadyRunningError); !ok || running.Info.PID != 1234 {
+		t.Errorf("Expected AlreadyRunningError for pid 1234, got %v", err)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Unable to release: %s", err)
+	}
+	if _, err := Find(file); err == nil {
+		t.Error("Expected no instance after releasing")
+	}
+	if _, err := Acquire(file, info); err != nil {
+		t.Errorf("Unable to acquire after release: %s", err)
+	}
+
+	// Only the lockfile is left, no temporary files
+	if entries, _ := ioutil.ReadDir(filepath.Dir(file)); len(entries) != 1 {
+		t.Errorf("Expected only the lockfile, found %d files", len(entries))
+	}
+}
+
+func TestStaleLockfileReplaced(t *testing.T) {
+	file, cleanup := tempLockfile(t)
+	defer cleanup()
+	if _, err := Acquire(file, &Info{PID: 1234, ControlAddr: deadAddr(t)}); err != nil {
+		t.Fatalf("Unable to acquire: %s", err)
+	}
+	old := time.Now().Add(-2 * STARTUP_GRACE)
+	os.Chtimes(file, old, old)
+
+	if _, err := Acquire(file, &Info{PID: 5678}); err != nil {
+		t.Fatalf("Expected stale lockfile to be replaced: %s", err)
+	}
+	data, _ := ioutil.ReadFile(file)
+	if string(data) != `{"pid":5678,"addr":"","controlAddr":"","controlToken":""}` {
+		t.Errorf("Unexpected lockfile %s", data)
+	}
+}
+
+func TestStartingInstanceKept(t *testing.T) {
+	file, cleanup := tempLockfile(t)
+	defer cleanup()
+	// Not listening yet, but just created its lockfile
+	if _, err := Acquire(file, &Info{PID: 1234, ControlAddr: deadAddr(t)}); err != nil {
+		t.Fatalf("Unable to acquire: %s", err)
+	}
+	_, err := Acquire(file, &Info{PID: 5678})
+	if running, ok := err.(*AlreadyRunningError); !ok || running.Info.PID != 1234 {
+		t.Errorf("Expected lockfile of starting instance to be kept, got %v", err)
+	}
+}
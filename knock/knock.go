@@ -0,0 +1,158 @@
+// package knock implements single packet authorization: the server's TCP port
+// only serves source IPs that recently sent a valid knock, a UDP packet
+// carrying a cloak preamble for a shared key.  Everyone else has their
+// connections reset as soon as they're accepted, which to a scanner looks much
+// like a closed port (short of firewalling, which would require privileges).
+//
+// Knocks are made with a key derived from the shared key for knocking only,
+// so that a knock can't be used as a cloak preamble or the other way around,
+// even where both use the same shared key.
+package knock
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/cloak"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// DEFAULT_WINDOW is how long a knock opens the port for its source IP
+	DEFAULT_WINDOW = 5 * time.Minute
+
+	// KNOCK_SETTLE_TIME is how long Knock waits for the knock to arrive
+	// before returning, since UDP may otherwise be overtaken by the dial that
+	// follows
+	KNOCK_SETTLE_TIME = 100 * time.Millisecond
+)
+
+var (
+	// knockContext separates the keys of knocks from those of other uses of
+	// the shared key
+	knockContext = []byte("flashlight knock")
+)
+
+// Knock sends a knock for the given key to the UDP address
+func Knock(addr string, key []byte) error {
+	preamble, err := cloak.NewPreamble(knockKey(key))
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return fmt.Errorf("Unable to dial knock address: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(preamble); err != nil {
+		return fmt.Errorf("Unable to knock: %s", err)
+	}
+	time.Sleep(KNOCK_SETTLE_TIME)
+	return nil
+}
+
+// Gate listens for knocks and only lets connections from IPs that knocked
+// through the listeners it wraps.
+type Gate struct {
+	Addr   string        // UDP address at which to listen for knocks
+	Key    []byte        // the shared key
+	Window time.Duration // (optional) how long each knock opens the port, defaults to DEFAULT_WINDOW
+
+	verifier *cloak.Verifier
+	allowed  map[string]time.Time
+	mutex    sync.Mutex
+}
+
+// Start starts listening for knocks
+func (gate *Gate) Start() error {
+	conn, err := net.ListenPacket("udp", gate.Addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for knocks at %s: %s", gate.Addr, err)
+	}
+	log.Debugf("Listening for knocks at %s", gate.Addr)
+	gate.init()
+	go gate.listen(conn)
+	return nil
+}
+
+func (gate *Gate) init() {
+	if gate.Window == 0 {
+		gate.Window = DEFAULT_WINDOW
+	}
+	gate.verifier = &cloak.Verifier{PSK: knockKey(gate.Key)}
+	gate.allowed = make(map[string]time.Time)
+}
+
+func (gate *Gate) listen(conn net.PacketConn) {
+	b := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			log.Errorf("Unable to read knock: %s", err)
+			return
+		}
+		ip := addr.(*net.UDPAddr).IP.String()
+		if err := gate.verifier.Verify(b[:n]); err != nil {
+			log.Debugf("Ignoring knock from %s: %s", ip, err)
+			continue
+		}
+		gate.mutex.Lock()
+		gate.allowed[ip] = time.Now().Add(gate.Window)
+		gate.mutex.Unlock()
+	}
+}
+
+// Allows determines whether the given IP recently knocked
+func (gate *Gate) Allows(ip string) bool {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	expires, found := gate.allowed[ip]
+	if !found {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(gate.allowed, ip)
+		return false
+	}
+	return true
+}
+
+// Wrap wraps the given listener so that it only returns connections from IPs
+// that knocked
+func (gate *Gate) Wrap(l net.Listener) net.Listener {
+	return &gatedListener{l, gate}
+}
+
+type gatedListener struct {
+	net.Listener
+	gate *Gate
+}
+
+func (l *gatedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if l.gate.Allows(ip) {
+			return conn, nil
+		}
+		// Reset rather than close gracefully, like a closed port would
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+		conn.Close()
+	}
+}
+
+// knockKey derives the key used for knocks from the shared key
+func knockKey(key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(knockContext)
+	return h.Sum(nil)
+}
@@ -0,0 +1,110 @@
+package knock
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/cloak"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func startGate(t *testing.T) (*Gate, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	gate := &Gate{Key: testKey}
+	gate.init()
+	go gate.listen(conn)
+	return gate, conn.LocalAddr().String()
+}
+
+func TestKnock(t *testing.T) {
+	gate, addr := startGate(t)
+	if gate.Allows("127.0.0.1") {
+		t.Fatal("Shouldn't allow before knocking")
+	}
+	if err := Knock(addr, []byte("wrong key")); err != nil {
+		t.Fatalf("Unable to knock: %s", err)
+	}
+	if gate.Allows("127.0.0.1") {
+		t.Error("Shouldn't allow after knocking with the wrong key")
+	}
+	if err := Knock(addr, testKey); err != nil {
+		t.Fatalf("Unable to knock: %s", err)
+	}
+	if !gate.Allows("127.0.0.1") {
+		t.Error("Expected knock to allow its IP")
+	}
+	if gate.Allows("127.0.0.2") {
+		t.Error("Knock shouldn't allow other IPs")
+	}
+}
+
+func TestCloakPreambleIsNoKnock(t *testing.T) {
+	gate, addr := startGate(t)
+	preamble, err := cloak.NewPreamble(testKey)
+	if err != nil {
+		t.Fatalf("Unable to create preamble: %s", err)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	conn.Write(preamble)
+	conn.Close()
+	time.Sleep(KNOCK_SETTLE_TIME)
+	if gate.Allows("127.0.0.1") {
+		t.Error("A cloak preamble for the same key shouldn't open the gate")
+	}
+	if (&cloak.Verifier{PSK: testKey}).Verify(newKnock(t)) == nil {
+		t.Error("A knock shouldn't be a valid cloak preamble for the same key")
+	}
+}
+
+func newKnock(t *testing.T) []byte {
+	knock, err := cloak.NewPreamble(knockKey(testKey))
+	if err != nil {
+		t.Fatalf("Unable to create knock: %s", err)
+	}
+	return knock
+}
+
+func TestKnockExpires(t *testing.T) {
+	gate := &Gate{Key: testKey}
+	gate.init()
+	gate.allowed["127.0.0.1"] = time.Now().Add(-1 * time.Second)
+	if gate.Allows("127.0.0.1") {
+		t.Error("Expired knock shouldn't allow")
+	}
+	if _, found := gate.allowed["127.0.0.1"]; found {
+		t.Error("Expired knock should be forgotten")
+	}
+}
+
+func TestGatedListener(t *testing.T) {
+	gate, addr := startGate(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	gated := gate.Wrap(l)
+	if err := Knock(addr, testKey); err != nil {
+		t.Fatalf("Unable to knock: %s", err)
+	}
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(1 * time.Second)
+		}
+	}()
+	conn, err := gated.Accept()
+	if err != nil {
+		t.Fatalf("Expected connection from knocking IP to be accepted: %s", err)
+	}
+	conn.Close()
+}
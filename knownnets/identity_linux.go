@@ -0,0 +1,67 @@
+package knownnets
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// networkIdentity identifies the current network by the IP and MAC address of
+// the default gateway.
+func networkIdentity() (string, error) {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return "", err
+	}
+	mac, err := macFor(gateway)
+	if err != nil {
+		return "", err
+	}
+	return gateway + "|" + mac, nil
+}
+
+// defaultGateway reads the default gateway's IP from /proc/net/route.
+func defaultGateway() (string, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", fmt.Errorf("Unable to read routing table: %s", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			// Not the default route
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("No default gateway found")
+}
+
+// macFor looks up the MAC address for the given IP in /proc/net/arp.
+func macFor(ip string) (string, error) {
+	file, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return "", fmt.Errorf("Unable to read arp table: %s", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[0] == ip {
+			return fields[3], nil
+		}
+	}
+	return "", fmt.Errorf("No arp entry for gateway %s", ip)
+}
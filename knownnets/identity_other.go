@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package knownnets
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// networkIdentity identifies the current network by the set of networks to
+// which the local (non-loopback) interfaces are attached.
+func networkIdentity() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("Unable to list interface addresses: %s", err)
+	}
+	networks := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		networks = append(networks, ipNet.IP.Mask(ipNet.Mask).String()+"/"+ipNet.Mask.String())
+	}
+	if len(networks) == 0 {
+		return "", fmt.Errorf("Not attached to any network")
+	}
+	sort.Strings(networks)
+	return strings.Join(networks, "|"), nil
+}
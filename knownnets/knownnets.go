@@ -0,0 +1,123 @@
+// package knownnets remembers, per detected network, which server addresses
+// were dialed successfully so that they can be tried first when rejoining
+// that network.
+package knownnets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/getlantern/flashlight/atomicfile"
+)
+
+const (
+	MAX_ADDRS_PER_NETWORK = 10
+)
+
+// Fingerprint returns an opaque identifier for the network to which this
+// machine is currently attached.  The identifier is a hash, so no information
+// about the network itself is persisted.
+func Fingerprint() (string, error) {
+	identity, err := networkIdentity()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(hash[:16]), nil
+}
+
+// Networks tracks the known-good addresses for each network fingerprint and
+// persists them to File.
+type Networks struct {
+	File     string              // file in which to persist known networks
+	networks map[string][]string // known-good addresses by fingerprint, most recently successful first
+	mutex    sync.Mutex
+}
+
+// Load loads previously persisted networks from File.  A missing file is not
+// an error.
+func (networks *Networks) Load() error {
+	networks.mutex.Lock()
+	defer networks.mutex.Unlock()
+	networks.networks = make(map[string][]string)
+	data, err := ioutil.ReadFile(networks.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Unable to read known networks: %s", err)
+	}
+	err = json.Unmarshal(data, &networks.networks)
+	if err != nil {
+		return fmt.Errorf("Unable to parse known networks: %s", err)
+	}
+	return nil
+}
+
+// Order returns the given candidate addresses ordered so that addresses known
+// to have worked on the given network come first, most recently successful
+// first.  Unknown candidates follow in their original order.
+func (networks *Networks) Order(fingerprint string, candidates []string) []string {
+	networks.mutex.Lock()
+	defer networks.mutex.Unlock()
+	ordered := make([]string, 0, len(candidates))
+	for _, known := range networks.networks[fingerprint] {
+		if contains(candidates, known) {
+			ordered = append(ordered, known)
+		}
+	}
+	for _, candidate := range candidates {
+		if !contains(ordered, candidate) {
+			ordered = append(ordered, candidate)
+		}
+	}
+	return ordered
+}
+
+// Remember records that addr worked on the network with the given fingerprint.
+func (networks *Networks) Remember(fingerprint string, addr string) error {
+	networks.mutex.Lock()
+	defer networks.mutex.Unlock()
+	if networks.networks == nil {
+		networks.networks = make(map[string][]string)
+	}
+	known := networks.networks[fingerprint]
+	if len(known) > 0 && known[0] == addr {
+		// Already our first choice, nothing to persist
+		return nil
+	}
+	updated := []string{addr}
+	for _, existing := range known {
+		if existing != addr && len(updated) < MAX_ADDRS_PER_NETWORK {
+			updated = append(updated, existing)
+		}
+	}
+	networks.networks[fingerprint] = updated
+	return networks.save()
+}
+
+func (networks *Networks) save() error {
+	data, err := json.Marshal(networks.networks)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal known networks: %s", err)
+	}
+	err = atomicfile.WriteFile(networks.File, data, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to save known networks: %s", err)
+	}
+	return nil
+}
+
+func contains(list []string, item string) bool {
+	for _, candidate := range list {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package knownnets
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRememberAndOrder(t *testing.T) {
+	file, err := ioutil.TempFile("", "knownnets")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	defer os.Remove(file.Name())
+
+	candidates := []string{"a:443", "b:443", "c:443"}
+	networks := &Networks{File: file.Name()}
+	if err := networks.Load(); err != nil {
+		t.Fatalf("Unable to load from missing file: %s", err)
+	}
+	if ordered := networks.Order("net1", candidates); !reflect.DeepEqual(ordered, candidates) {
+		t.Errorf("Unknown network should keep original order, got %v", ordered)
+	}
+
+	if err := networks.Remember("net1", "c:443"); err != nil {
+		t.Fatalf("Unable to remember: %s", err)
+	}
+	if err := networks.Remember("net2", "b:443"); err != nil {
+		t.Fatalf("Unable to remember: %s", err)
+	}
+
+	// Reload from disk to make sure things were persisted
+	networks = &Networks{File: file.Name()}
+	if err := networks.Load(); err != nil {
+		t.Fatalf("Unable to load: %s", err)
+	}
+	expected := []string{"c:443", "a:443", "b:443"}
+	if ordered := networks.Order("net1", candidates); !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("Wrong order for net1.\nExpected: %v\nGot     : %v", expected, ordered)
+	}
+	expected = []string{"b:443", "a:443", "c:443"}
+	if ordered := networks.Order("net2", candidates); !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("Wrong order for net2.\nExpected: %v\nGot     : %v", expected, ordered)
+	}
+
+	// Addresses that are no longer candidates are ignored
+	expected = []string{"a:443"}
+	if ordered := networks.Order("net1", []string{"a:443"}); !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("Wrong order for reduced candidates.\nExpected: %v\nGot     : %v", expected, ordered)
+	}
+}
@@ -0,0 +1,198 @@
+// package lifecycle starts the subsystems of a process (certificates, stats,
+// listeners and so on) in the order of their dependencies, and stops them in
+// the reverse order on shutdown, giving each a bounded amount of time.
+// Subcommands that only need some subsystems start just those (along with
+// what they depend on).
+package lifecycle
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// DEFAULT_STOP_TIMEOUT is how long a component may take to stop, if no
+	// StopTimeout is given
+	DEFAULT_STOP_TIMEOUT = 5 * time.Second
+)
+
+// Component is a subsystem
+type Component struct {
+	Name      string
+	DependsOn []string     // (optional) names of the components that need to be started first
+	Start     func() error // starts the component, must not block (see Manager.Go for long-running work)
+	Stop      func() error // (optional) stops the component
+}
+
+// Manager starts and stops components
+type Manager struct {
+	StopTimeout time.Duration // (optional) how long each component may take to stop, defaults to DEFAULT_STOP_TIMEOUT
+
+	components map[string]*Component
+	order      []string // names in the order in which components were added
+	started    []*Component
+	stopped    bool
+	done       chan error
+	mutex      sync.Mutex
+}
+
+// Add adds a component.  Components can be added in any order, dependencies
+// are resolved when starting.
+func (manager *Manager) Add(component *Component) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.components == nil {
+		manager.components = make(map[string]*Component)
+	}
+	if _, found := manager.components[component.Name]; !found {
+		manager.order = append(manager.order, component.Name)
+	}
+	manager.components[component.Name] = component
+}
+
+// Start starts the named components and everything they depend on (or all
+// components if none are named), dependencies first.  Components that are
+// already running aren't started again.  If a component fails to start, the
+// components started so far are stopped again.
+func (manager *Manager) Start(names ...string) error {
+	manager.mutex.Lock()
+	if len(names) == 0 {
+		names = manager.order
+	}
+	toStart, err := manager.resolve(names)
+	manager.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, component := range toStart {
+		log.Debugf("Starting %s", component.Name)
+		if err := component.Start(); err != nil {
+			manager.Stop()
+			return fmt.Errorf("Unable to start %s: %s", component.Name, err)
+		}
+		manager.mutex.Lock()
+		manager.started = append(manager.started, component)
+		manager.mutex.Unlock()
+	}
+	return nil
+}
+
+// Go runs long-running work of the named component (e.g. serving a listener)
+// in the background.  Its result can be waited for with Wait, returning
+// without an error means that the work is done (e.g. after draining).
+func (manager *Manager) Go(name string, run func() error) {
+	manager.mutex.Lock()
+	if manager.done == nil {
+		manager.done = make(chan error, 1)
+	}
+	done := manager.done
+	manager.mutex.Unlock()
+	go func() {
+		err := run()
+		if err != nil {
+			err = fmt.Errorf("%s failed: %s", name, err)
+		}
+		select {
+		case done <- err:
+		default:
+			// Someone else finished first
+		}
+	}()
+}
+
+// Wait blocks until work started with Go finishes, and returns its error
+func (manager *Manager) Wait() error {
+	manager.mutex.Lock()
+	if manager.done == nil {
+		manager.done = make(chan error, 1)
+	}
+	done := manager.done
+	manager.mutex.Unlock()
+	return <-done
+}
+
+// Stop stops the started components in the reverse order of starting them.
+// Components that don't stop within the StopTimeout are left behind.  Stop
+// may be called more than once, only the first call stops anything.
+func (manager *Manager) Stop() {
+	manager.mutex.Lock()
+	if manager.stopped {
+		manager.mutex.Unlock()
+		return
+	}
+	manager.stopped = true
+	started := manager.started
+	manager.started = nil
+	timeout := manager.StopTimeout
+	manager.mutex.Unlock()
+	if timeout <= 0 {
+		timeout = DEFAULT_STOP_TIMEOUT
+	}
+
+	for i := len(started) - 1; i >= 0; i-- {
+		component := started[i]
+		if component.Stop == nil {
+			continue
+		}
+		log.Debugf("Stopping %s", component.Name)
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- component.Stop()
+		}()
+		select {
+		case err := <-stopped:
+			if err != nil {
+				log.Errorf("Unable to stop %s: %s", component.Name, err)
+			}
+		case <-time.After(timeout):
+			log.Warnf("%s didn't stop within %s, moving on", component.Name, timeout)
+		}
+	}
+}
+
+// resolve returns the components with the given names and their
+// dependencies in the order in which to start them, leaving out the ones that
+// are already running.  Must be called while holding the mutex.
+func (manager *Manager) resolve(names []string) ([]*Component, error) {
+	running := make(map[string]bool)
+	for _, component := range manager.started {
+		running[component.Name] = true
+	}
+	var ordered []*Component
+	visiting := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if running[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("Components depend on each other in a cycle: %v", append(path, name))
+		}
+		component, found := manager.components[name]
+		if !found {
+			if len(path) > 0 {
+				return fmt.Errorf("Unknown component %s, which %s depends on", name, path[len(path)-1])
+			}
+			return fmt.Errorf("Unknown component %s", name)
+		}
+		visiting[name] = true
+		for _, dependency := range component.DependsOn {
+			if err := visit(dependency, append(path, name)); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		running[name] = true
+		ordered = append(ordered, component)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
@@ -0,0 +1,129 @@
+package lifecycle
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recording adds a component that records starting and stopping in events
+func recording(manager *Manager, events *[]string, name string, dependsOn ...string) {
+	manager.Add(&Component{
+		Name:      name,
+		DependsOn: dependsOn,
+		Start: func() error {
+			*events = append(*events, "start "+name)
+			return nil
+		},
+		Stop: func() error {
+			*events = append(*events, "stop "+name)
+			return nil
+		},
+	})
+}
+
+func TestOrder(t *testing.T) {
+	var events []string
+	manager := &Manager{}
+	recording(manager, &events, "proxy", "certs", "metrics")
+	recording(manager, &events, "debug", "metrics")
+	recording(manager, &events, "certs")
+	recording(manager, &events, "metrics")
+
+	if err := manager.Start("proxy"); err != nil {
+		t.Fatalf("Unable to start: %s", err)
+	}
+	expected := []string{"start certs", "start metrics", "start proxy"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %v, got %v", expected, events)
+	}
+
+	// Running components aren't started again
+	events = nil
+	if err := manager.Start(); err != nil {
+		t.Fatalf("Unable to start: %s", err)
+	}
+	if !reflect.DeepEqual(events, []string{"start debug"}) {
+		t.Errorf("Expected only debug to start, got %v", events)
+	}
+
+	events = nil
+	manager.Stop()
+	manager.Stop()
+	expected = []string{"stop debug", "stop proxy", "stop metrics", "stop certs"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %v, got %v", expected, events)
+	}
+}
+
+func TestFailedStart(t *testing.T) {
+	var events []string
+	manager := &Manager{}
+	recording(manager, &events, "certs")
+	manager.Add(&Component{
+		Name:      "listeners",
+		DependsOn: []string{"certs"},
+		Start: func() error {
+			return fmt.Errorf("address in use")
+		},
+	})
+	err := manager.Start()
+	if err == nil || !strings.Contains(err.Error(), "listeners") {
+		t.Errorf("Expected failure of listeners, got %v", err)
+	}
+	if !reflect.DeepEqual(events, []string{"start certs", "stop certs"}) {
+		t.Errorf("Expected certs to be stopped again, got %v", events)
+	}
+}
+
+func TestBadDependencies(t *testing.T) {
+	manager := &Manager{}
+	noop := func() error { return nil }
+	manager.Add(&Component{Name: "a", DependsOn: []string{"b"}, Start: noop})
+	manager.Add(&Component{Name: "b", DependsOn: []string{"a"}, Start: noop})
+	manager.Add(&Component{Name: "c", DependsOn: []string{"missing"}, Start: noop})
+	if err := manager.Start("a"); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Expected cycle to be detected, got %v", err)
+	}
+	if err := manager.Start("c"); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected unknown dependency to be reported, got %v", err)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	manager := &Manager{StopTimeout: 50 * time.Millisecond}
+	manager.Add(&Component{
+		Name:  "stuck",
+		Start: func() error { return nil },
+		Stop: func() error {
+			time.Sleep(1 * time.Second)
+			return nil
+		},
+	})
+	manager.Start()
+	start := time.Now()
+	manager.Stop()
+	if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Stop should have given up after the timeout, took %s", elapsed)
+	}
+}
+
+func TestWait(t *testing.T) {
+	manager := &Manager{}
+	manager.Go("server", func() error {
+		return fmt.Errorf("listener closed")
+	})
+	if err := manager.Wait(); err == nil || err.Error() != "server failed: listener closed" {
+		t.Errorf("Unexpected result %v", err)
+	}
+
+	manager = &Manager{}
+	manager.Go("server", func() error {
+		return nil
+	})
+	if err := manager.Wait(); err != nil {
+		t.Errorf("Expected work that's done to be no error, got %v", err)
+	}
+}
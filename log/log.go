@@ -1,40 +1,261 @@
-// package log implements logging functions that log errors to stderr and debug
-// messages to stdout
+// package log implements leveled logging.  Debug and info messages go to
+// stdout, warnings and errors to stderr (or all of them to a file, see
+// SetOutput), either as plain lines or (with SetJSON) as one JSON object per
+// line for log pipelines.  The level can be set globally and overridden per
+// module (the package that logs, e.g. proxy or balancer), also while running.
 package log
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Level is the severity of a message
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+)
+
+var (
+	levelNames = []string{"debug", "info", "warn", "error"}
+
+	// stdout and stderr are variables so that tests can capture them
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+
+	config struct {
+		level        Level
+		moduleLevels map[string]Level
+		json         bool
+		out          io.Writer // if set, replaces stdout and stderr
+		mutex        sync.RWMutex
+	}
+)
+
+// entry is a message as written in JSON mode
+type entry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Module  string    `json:"module"`
+	Message string    `json:"msg"`
+}
+
+func (level Level) String() string {
+	if level < LEVEL_DEBUG || level > LEVEL_ERROR {
+		return fmt.Sprintf("level%d", int(level))
+	}
+	return levelNames[level]
+}
+
+// ParseLevel parses the name of a level (debug, info, warn or error)
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level %s, available levels are %v", name, levelNames)
+}
+
+// SetLevel sets the level below which messages are dropped, for modules
+// without a level of their own.  The default is LEVEL_DEBUG.
+func SetLevel(level Level) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	config.level = level
+}
+
+// SetModuleLevel sets the level for a single module (the name of the package
+// that logs, e.g. proxy or main), overriding the global level
+func SetModuleLevel(module string, level Level) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	if config.moduleLevels == nil {
+		config.moduleLevels = make(map[string]Level)
+	}
+	config.moduleLevels[module] = level
+}
+
+// SetLevels replaces the global level and all module levels at once
+func SetLevels(level Level, moduleLevels map[string]Level) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	config.level = level
+	config.moduleLevels = make(map[string]Level, len(moduleLevels))
+	for module, moduleLevel := range moduleLevels {
+		config.moduleLevels[module] = moduleLevel
+	}
+}
+
+// ClearModuleLevel removes the level for a single module, so that it uses the
+// global level again
+func ClearModuleLevel(module string) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	delete(config.moduleLevels, module)
+}
+
+// Levels returns the global level and the levels of modules that have their
+// own, in a form suitable for showing to users, e.g. "info proxy=debug"
+func Levels() string {
+	config.mutex.RLock()
+	defer config.mutex.RUnlock()
+	levels := []string{config.level.String()}
+	var modules []string
+	for module, level := range config.moduleLevels {
+		modules = append(modules, module+"="+level.String())
+	}
+	sort.Strings(modules)
+	return strings.Join(append(levels, modules...), " ")
+}
+
+// SetOutput sends all messages to out (e.g. a log file) instead of stdout and
+// stderr.  A nil out restores stdout and stderr.
+func SetOutput(out io.Writer) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	config.out = out
+}
+
+// SetJSON turns JSON output on or off
+func SetJSON(json bool) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	config.json = json
+}
+
 // Debug logs to stdout
 func Debug(arg interface{}) {
-	fmt.Fprintln(os.Stdout, arg)
+	output(LEVEL_DEBUG, fmt.Sprint(arg))
 }
 
 // Debugf logs to stdout
 func Debugf(message string, args ...interface{}) {
-	fmt.Fprintf(os.Stdout, message+"\n", args...)
+	output(LEVEL_DEBUG, fmt.Sprintf(message, args...))
+}
+
+// Info logs to stdout
+func Info(arg interface{}) {
+	output(LEVEL_INFO, fmt.Sprint(arg))
+}
+
+// Infof logs to stdout
+func Infof(message string, args ...interface{}) {
+	output(LEVEL_INFO, fmt.Sprintf(message, args...))
+}
+
+// Warn logs to stderr
+func Warn(arg interface{}) {
+	output(LEVEL_WARN, fmt.Sprint(arg))
+}
+
+// Warnf logs to stderr
+func Warnf(message string, args ...interface{}) {
+	output(LEVEL_WARN, fmt.Sprintf(message, args...))
 }
 
 // Error logs to stderr
 func Error(arg interface{}) {
-	fmt.Fprintln(os.Stderr, arg)
+	output(LEVEL_ERROR, fmt.Sprint(arg))
 }
 
 // Errorf logs to stderr
 func Errorf(message string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, message+"\n", args...)
+	output(LEVEL_ERROR, fmt.Sprintf(message, args...))
 }
 
-// Fatal logs to stderr and then exits with status 1
+// Fatal logs to stderr (regardless of level) and then exits with status 1
 func Fatal(arg interface{}) {
-	Error(arg)
-	os.Exit(1)
+	fatal(fmt.Sprint(arg))
 }
 
-// Fatalf logs to stderr and then exits with status 1
+// Fatalf logs to stderr (regardless of level) and then exits with status 1
 func Fatalf(message string, args ...interface{}) {
-	Errorf(message, args...)
+	fatal(fmt.Sprintf(message, args...))
+}
+
+func fatal(message string) {
+	write(LEVEL_ERROR, callerModule(), message)
 	os.Exit(1)
 }
+
+// output writes the message if its level is enabled for the calling module.
+// Finding the module is comparatively expensive, so it's only done when
+// needed.
+func output(level Level, message string) {
+	config.mutex.RLock()
+	needModule := config.json || len(config.moduleLevels) > 0
+	enabled := level >= config.level
+	config.mutex.RUnlock()
+	module := ""
+	if needModule {
+		module = callerModule()
+		config.mutex.RLock()
+		if moduleLevel, found := config.moduleLevels[module]; found {
+			enabled = level >= moduleLevel
+		}
+		config.mutex.RUnlock()
+	}
+	if enabled {
+		write(level, module, message)
+	}
+}
+
+func write(level Level, module string, message string) {
+	out := stdout
+	if level >= LEVEL_WARN {
+		out = stderr
+	}
+	config.mutex.RLock()
+	asJSON := config.json
+	if config.out != nil {
+		out = config.out
+	}
+	config.mutex.RUnlock()
+	if !asJSON {
+		fmt.Fprintln(out, message)
+		return
+	}
+	line, err := json.Marshal(&entry{time.Now().UTC(), level.String(), module, message})
+	if err != nil {
+		fmt.Fprintln(out, message)
+		return
+	}
+	out.Write(append(line, '\n'))
+}
+
+// callerModule returns the name of the package whose code called the logging
+// function, e.g. proxy for github.com/getlantern/flashlight/proxy
+func callerModule() string {
+	// Skip callerModule, output (or fatal) and the logging function
+	pc, _, _, ok := runtime.Caller(3)
+	if !ok {
+		return ""
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return ""
+	}
+	return moduleOf(fn.Name())
+}
+
+// moduleOf extracts the package name from a function name like
+// github.com/getlantern/flashlight/proxy.(*Client).ServeHTTP
+func moduleOf(function string) string {
+	module := function[strings.LastIndex(function, "/")+1:]
+	if i := strings.Index(module, "."); i >= 0 {
+		module = module[:i]
+	}
+	return module
+}
@@ -0,0 +1,101 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// capture redirects output for the duration of a test and resets the
+// configuration afterwards
+func capture() (*bytes.Buffer, *bytes.Buffer, func()) {
+	var out, errOut bytes.Buffer
+	stdout, stderr = &out, &errOut
+	return &out, &errOut, func() {
+		stdout, stderr = os.Stdout, os.Stderr
+		SetLevel(LEVEL_DEBUG)
+		SetJSON(false)
+		SetOutput(nil)
+		ClearModuleLevel("log")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	out, errOut, reset := capture()
+	defer reset()
+
+	SetLevel(LEVEL_INFO)
+	Debugf("dropped %d", 1)
+	Infof("kept %d", 2)
+	Warn("warning")
+	if out.String() != "kept 2\n" {
+		t.Errorf("Unexpected stdout %q", out.String())
+	}
+	if errOut.String() != "warning\n" {
+		t.Errorf("Unexpected stderr %q", errOut.String())
+	}
+
+	out.Reset()
+	SetModuleLevel("log", LEVEL_DEBUG)
+	Debug("module override")
+	if out.String() != "module override\n" {
+		t.Errorf("Module level should have let debug message through, got %q", out.String())
+	}
+	if levels := Levels(); levels != "info log=debug" {
+		t.Errorf("Unexpected levels %q", levels)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	out, _, reset := capture()
+	defer reset()
+
+	SetJSON(true)
+	Infof("hello %s", "world")
+	var logged entry
+	if err := json.Unmarshal(out.Bytes(), &logged); err != nil {
+		t.Fatalf("Unable to parse %q: %s", out.String(), err)
+	}
+	if logged.Level != "info" || logged.Module != "log" || logged.Message != "hello world" || logged.Time.IsZero() {
+		t.Errorf("Unexpected entry %+v", logged)
+	}
+	if !strings.HasSuffix(out.String(), "}\n") {
+		t.Errorf("Expected one entry per line, got %q", out.String())
+	}
+}
+
+func TestSetOutput(t *testing.T) {
+	out, errOut, reset := capture()
+	defer reset()
+
+	var file bytes.Buffer
+	SetOutput(&file)
+	Debug("debug")
+	Error("error")
+	if file.String() != "debug\nerror\n" || out.Len() > 0 || errOut.Len() > 0 {
+		t.Errorf("Expected everything in output, got %q (stdout %q, stderr %q)", file.String(), out.String(), errOut.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != LEVEL_WARN {
+		t.Errorf("Expected warn, got %s (%v)", level, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Unknown level should have been rejected")
+	}
+}
+
+func TestModuleOf(t *testing.T) {
+	for function, expected := range map[string]string{
+		"github.com/getlantern/flashlight/proxy.(*Client).ServeHTTP": "proxy",
+		"main.runClientProxy": "main",
+		"github.com/getlantern/flashlight/log.TestModuleOf.func1": "log",
+	} {
+		if module := moduleOf(function); module != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, function, module)
+		}
+	}
+}
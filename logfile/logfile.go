@@ -0,0 +1,188 @@
+// package logfile implements a log file that rotates itself once it grows too
+// big or too old, keeping a limited number of rotated files around, so that
+// long-running servers don't need logrotate and Windows clients (which have no
+// console to log to) get usable log files.
+//
+// Rotated files are named after the file with the time of rotation appended,
+// e.g. flashlight.log.20141010-135536.
+package logfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROTATED_SUFFIX_FORMAT = "20060102-150405"
+)
+
+// Writer is an io.Writer that appends to File, rotating it as necessary
+type Writer struct {
+	File       string        // file to which to write
+	MaxSize    int64         // (optional) rotate before the file grows beyond this many bytes
+	MaxAge     time.Duration // (optional) rotate once the file has been written to for this long
+	MaxBackups int           // (optional) number of rotated files to keep, 0 keeps all of them
+	Retention  time.Duration // (optional) delete rotated files once they are this old
+
+	file   *os.File
+	size   int64
+	opened time.Time
+	mutex  sync.Mutex
+}
+
+// Open opens File for appending, creating it if necessary, and removes
+// rotated files beyond the retention limits
+func (w *Writer) Open() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.prune()
+	return nil
+}
+
+// Write writes to File, rotating it first if it's too big or too old.  If
+// rotating fails, Write keeps appending to the current file.
+func (w *Writer) Write(b []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		return 0, fmt.Errorf("Log file %s is not open", w.File)
+	}
+	if w.needsRotation(len(b)) {
+		if err := w.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file: %s\n", err)
+		}
+	}
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes File
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open log file: %s", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Unable to stat log file: %s", err)
+	}
+	w.file = file
+	w.size = info.Size()
+	w.opened = time.Now()
+	return nil
+}
+
+func (w *Writer) needsRotation(toWrite int) bool {
+	if w.size == 0 {
+		// Rotating an empty file is pointless, even if a single write is
+		// bigger than MaxSize
+		return false
+	}
+	if w.MaxSize > 0 && w.size+int64(toWrite) > w.MaxSize {
+		return true
+	}
+	return w.MaxAge > 0 && time.Now().Sub(w.opened) >= w.MaxAge
+}
+
+// rotate renames File out of the way and starts a new one.  The file is
+// closed before renaming because Windows doesn't allow renaming open files.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("Unable to close log file: %s", err)
+	}
+	rotated := w.rotatedName(time.Now())
+	renameErr := os.Rename(w.File, rotated)
+	if err := w.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("Unable to rename log file: %s", renameErr)
+	}
+	w.prune()
+	return nil
+}
+
+// rotatedName returns a name for a file rotated at the given time that's not
+// taken yet
+func (w *Writer) rotatedName(now time.Time) string {
+	name := w.File + "." + now.Format(ROTATED_SUFFIX_FORMAT)
+	candidate := name
+	for i := 1; ; i++ {
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// prune removes rotated files beyond MaxBackups or older than Retention
+func (w *Writer) prune() {
+	rotated, err := w.Rotated()
+	if err != nil {
+		return
+	}
+	for i, name := range rotated {
+		// rotated is ordered newest first
+		remove := w.MaxBackups > 0 && i >= w.MaxBackups
+		if !remove && w.Retention > 0 {
+			info, err := os.Stat(name)
+			remove = err == nil && time.Now().Sub(info.ModTime()) > w.Retention
+		}
+		if remove {
+			os.Remove(name)
+		}
+	}
+}
+
+// Rotated returns the names of the rotated files, newest first
+func (w *Writer) Rotated() ([]string, error) {
+	dir, base := filepath.Split(w.File)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list rotated log files: %s", err)
+	}
+	var rotated []string
+	prefix := base + "."
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		suffix := name[len(prefix):]
+		if len(suffix) < len(ROTATED_SUFFIX_FORMAT) {
+			continue
+		}
+		if _, err := time.Parse(ROTATED_SUFFIX_FORMAT, suffix[:len(ROTATED_SUFFIX_FORMAT)]); err == nil {
+			rotated = append(rotated, filepath.Join(dir, name))
+		}
+	}
+	// The timestamps sort chronologically, as do the -N suffixes for files
+	// rotated within the same second (up to 9 of them)
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	return rotated, nil
+}
@@ -0,0 +1,103 @@
+package logfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	return dir
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := &Writer{File: filepath.Join(dir, "flashlight.log"), MaxSize: 10, MaxBackups: 2}
+	if err := w.Open(); err != nil {
+		t.Fatalf("Unable to open: %s", err)
+	}
+	defer w.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("Unable to write: %s", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(w.File)
+	if err != nil {
+		t.Fatalf("Unable to read log file: %s", err)
+	}
+	if string(data) != "fourth\n" {
+		t.Errorf("Expected only the last line in the current file, got %q", string(data))
+	}
+	rotated, err := w.Rotated()
+	if err != nil {
+		t.Fatalf("Unable to list rotated files: %s", err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 rotated files to be kept, got %v", rotated)
+	}
+	data, _ = ioutil.ReadFile(rotated[0])
+	if string(data) != "third\n" {
+		t.Errorf("Expected newest rotated file first, got %q", string(data))
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := &Writer{File: filepath.Join(dir, "flashlight.log"), MaxAge: 50 * time.Millisecond}
+	if err := w.Open(); err != nil {
+		t.Fatalf("Unable to open: %s", err)
+	}
+	defer w.Close()
+	w.Write([]byte("old\n"))
+	w.Write([]byte("still young\n"))
+	time.Sleep(100 * time.Millisecond)
+	w.Write([]byte("new\n"))
+
+	rotated, _ := w.Rotated()
+	if len(rotated) != 1 {
+		t.Fatalf("Expected 1 rotated file, got %v", rotated)
+	}
+	data, _ := ioutil.ReadFile(rotated[0])
+	if !strings.HasPrefix(string(data), "old\nstill young\n") {
+		t.Errorf("Unexpected rotated file contents %q", string(data))
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "flashlight.log")
+	stale := file + ".20140101-000000"
+	ioutil.WriteFile(stale, []byte("stale\n"), 0644)
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(stale, old, old)
+	unrelated := file + ".bak"
+	ioutil.WriteFile(unrelated, []byte("keep me\n"), 0644)
+	os.Chtimes(unrelated, old, old)
+
+	w := &Writer{File: file, Retention: 24 * time.Hour}
+	if err := w.Open(); err != nil {
+		t.Fatalf("Unable to open: %s", err)
+	}
+	defer w.Close()
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Rotated file beyond retention should have been removed")
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("Unrelated file should have been kept: %s", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	stdlog "log"
+	"strings"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/logfile"
+)
+
+const (
+	MEGABYTE = 1024 * 1024
+)
+
+// configureLogging applies -loglevel, -logjson and -logfile
+func configureLogging() {
+	log.SetJSON(*logJSON)
+	if err := applyLogLevels(*logLevel); err != nil {
+		log.Fatal(err)
+	}
+	if *logFile != "" {
+		writer := &logfile.Writer{
+			File:       *logFile,
+			MaxSize:    int64(*logMaxSize) * MEGABYTE,
+			MaxAge:     *logMaxAge,
+			MaxBackups: *logKeep,
+			Retention:  *logRetention,
+		}
+		if err := writer.Open(); err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(writer)
+		// Errors logged by the standard library (e.g. by http.Server) belong
+		// in the file too
+		stdlog.SetOutput(writer)
+	}
+}
+
+// applyLogLevels applies a spec like info,proxy=debug: the global level,
+// optionally followed by the levels of individual modules.  Modules that
+// aren't mentioned use the global level, even if they had a level of their
+// own before.
+func applyLogLevels(spec string) error {
+	global := log.LEVEL_DEBUG
+	moduleLevels := make(map[string]log.Level)
+	for _, item := range splitList(spec) {
+		parts := strings.SplitN(item, "=", 2)
+		level, err := log.ParseLevel(parts[len(parts)-1])
+		if err != nil {
+			return err
+		}
+		if len(parts) == 1 {
+			global = level
+		} else if parts[0] == "" {
+			return fmt.Errorf("Missing module in log level %s", item)
+		} else {
+			moduleLevels[parts[0]] = level
+		}
+	}
+	log.SetLevels(global, moduleLevels)
+	return nil
+}
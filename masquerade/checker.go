@@ -0,0 +1,57 @@
+package masquerade
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+// Checker periodically validates every host in a List, taking hosts that fail
+// out of rotation until they work again.  This way a single blocked
+// masquerade doesn't slow down (or take down) the client.
+type Checker struct {
+	List     *List                   // the list whose hosts to check
+	Interval time.Duration           // time between checks
+	Validate func(host string) error // checks whether a host works as a masquerade
+}
+
+// Start starts checking and blocks forever
+func (checker *Checker) Start() {
+	for {
+		time.Sleep(checker.Interval)
+		checker.check()
+	}
+}
+
+func (checker *Checker) check() {
+	hosts := checker.List.AllHosts()
+	ok := validateAll(hosts, checker.Validate)
+	var failing []string
+	for i, host := range hosts {
+		if !ok[i] {
+			failing = append(failing, host)
+		}
+	}
+	checker.List.setFailing(failing)
+}
+
+// validateAll validates the given hosts concurrently, returning whether each
+// one works.
+func validateAll(hosts []string, validate func(host string) error) []bool {
+	ok := make([]bool, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			if err := validate(host); err != nil {
+				log.Debugf("Masquerade %s failed validation: %s", host, err)
+				return
+			}
+			ok[i] = true
+		}(i, host)
+	}
+	wg.Wait()
+	return ok
+}
@@ -0,0 +1,167 @@
+// package masquerade manages the masquerade hosts through which the client
+// reaches the server.
+package masquerade
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+// List is a swappable list of masquerade hosts that tracks how well the
+// current hosts are performing, so that a newly swapped in list can be rolled
+// back if it does worse than its predecessor.  Hosts found failing by a
+// Checker are left out of rotation.
+type List struct {
+	hosts     []string
+	previous  []string
+	failing   map[string]bool
+	successes int
+	failures  int
+
+	// success rate of the previous list at the time it was swapped out
+	previousSuccessRate float64
+	// when the current list was swapped in
+	swapped time.Time
+
+	mutex sync.RWMutex
+}
+
+// NewList creates a List containing the given hosts
+func NewList(hosts []string) *List {
+	return &List{hosts: hosts}
+}
+
+// Hosts returns the current hosts that aren't failing.  If all of them are
+// failing, all of them are returned, since some host has to be tried.
+func (list *List) Hosts() []string {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	if len(list.failing) == 0 {
+		return list.hosts
+	}
+	var working []string
+	for _, host := range list.hosts {
+		if !list.failing[host] {
+			working = append(working, host)
+		}
+	}
+	if len(working) == 0 {
+		return list.hosts
+	}
+	return working
+}
+
+// AllHosts returns the current hosts, including failing ones
+func (list *List) AllHosts() []string {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	return list.hosts
+}
+
+// setFailing records which of the current hosts are failing, logging hosts
+// that are dropped from or restored to rotation
+func (list *List) setFailing(hosts []string) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	failing := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		failing[host] = true
+		if !list.failing[host] {
+			log.Errorf("Masquerade %s stopped working, dropping it from rotation", host)
+		}
+	}
+	for host := range list.failing {
+		if !failing[host] && list.contains(host) {
+			log.Debugf("Masquerade %s works again, returning it to rotation", host)
+		}
+	}
+	list.failing = failing
+}
+
+// contains determines whether host is among the current hosts.  Must be
+// called while holding the mutex.
+func (list *List) contains(host string) bool {
+	for _, candidate := range list.hosts {
+		if candidate == host {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordDial records the outcome of dialing one of the current hosts
+func (list *List) RecordDial(succeeded bool) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	if succeeded {
+		list.successes++
+	} else {
+		list.failures++
+	}
+}
+
+// Swap replaces the current hosts, remembering the old ones for rollback
+func (list *List) Swap(hosts []string) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.previous = list.hosts
+	list.previousSuccessRate = list.successRate()
+	list.hosts = hosts
+	list.swapped = time.Now()
+	list.failing = nil
+	list.successes = 0
+	list.failures = 0
+}
+
+// rollbackIfWorse reverts to the previous hosts if, after at least minDials
+// dials, the current hosts succeed noticeably less often than the previous
+// ones did.  It returns true if it rolled back.
+func (list *List) rollbackIfWorse(minDials int) bool {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	if list.previous == nil || list.successes+list.failures < minDials {
+		return false
+	}
+	if list.successRate() >= list.previousSuccessRate-0.1 {
+		// Good enough, no longer on probation
+		list.previous = nil
+		return false
+	}
+	list.hosts = list.previous
+	list.previous = nil
+	list.failing = nil
+	list.successes = 0
+	list.failures = 0
+	return true
+}
+
+// endProbationAfter keeps the current hosts for good if they were swapped in
+// more than maxProbation ago, even if there weren't enough dials to judge
+// them (e.g. because the client is hardly used).  It returns true if the
+// current hosts are no longer on probation.
+func (list *List) endProbationAfter(maxProbation time.Duration) bool {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	if list.previous != nil && time.Now().Sub(list.swapped) > maxProbation {
+		list.previous = nil
+	}
+	return list.previous == nil
+}
+
+// onProbation indicates whether the current hosts were recently swapped in
+// and haven't yet proven themselves.
+func (list *List) onProbation() bool {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	return list.previous != nil
+}
+
+func (list *List) successRate() float64 {
+	total := list.successes + list.failures
+	if total == 0 {
+		return 1
+	}
+	return float64(list.successes) / float64(total)
+}
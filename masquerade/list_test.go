@@ -0,0 +1,105 @@
+package masquerade
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRollbackIfWorse(t *testing.T) {
+	list := NewList([]string{"old"})
+	for i := 0; i < 10; i++ {
+		list.RecordDial(true)
+	}
+	list.Swap([]string{"new"})
+	if !list.onProbation() {
+		t.Fatal("Newly swapped list should be on probation")
+	}
+	list.RecordDial(false)
+	if list.rollbackIfWorse(5) {
+		t.Fatal("Shouldn't roll back before enough dials")
+	}
+	for i := 0; i < 4; i++ {
+		list.RecordDial(i%2 == 0)
+	}
+	if !list.rollbackIfWorse(5) {
+		t.Fatal("Should have rolled back worse list")
+	}
+	if hosts := list.Hosts(); !reflect.DeepEqual(hosts, []string{"old"}) {
+		t.Errorf("Expected rollback to old hosts, got %v", hosts)
+	}
+	if list.onProbation() {
+		t.Error("Rolled back list shouldn't be on probation")
+	}
+}
+
+func TestKeepBetterList(t *testing.T) {
+	list := NewList([]string{"old"})
+	list.RecordDial(false)
+	list.Swap([]string{"new"})
+	for i := 0; i < 5; i++ {
+		list.RecordDial(true)
+	}
+	if list.rollbackIfWorse(5) {
+		t.Fatal("Shouldn't roll back better list")
+	}
+	if hosts := list.Hosts(); !reflect.DeepEqual(hosts, []string{"new"}) {
+		t.Errorf("Expected to keep new hosts, got %v", hosts)
+	}
+	if list.onProbation() {
+		t.Error("Proven list shouldn't be on probation")
+	}
+}
+
+func TestCheckerDropsFailingHosts(t *testing.T) {
+	list := NewList([]string{"a", "b", "c"})
+	broken := map[string]bool{"b": true}
+	checker := &Checker{
+		List: list,
+		Validate: func(host string) error {
+			if broken[host] {
+				return fmt.Errorf("broken")
+			}
+			return nil
+		},
+	}
+	checker.check()
+	if hosts := list.Hosts(); !reflect.DeepEqual(hosts, []string{"a", "c"}) {
+		t.Errorf("Expected failing host to be dropped, got %v", hosts)
+	}
+	if hosts := list.AllHosts(); !reflect.DeepEqual(hosts, []string{"a", "b", "c"}) {
+		t.Errorf("Expected all hosts to still be checked, got %v", hosts)
+	}
+
+	broken = map[string]bool{"a": true, "b": true, "c": true}
+	checker.check()
+	if hosts := list.Hosts(); !reflect.DeepEqual(hosts, []string{"a", "b", "c"}) {
+		t.Errorf("Expected all hosts when all are failing, got %v", hosts)
+	}
+
+	broken = nil
+	checker.check()
+	if hosts := list.Hosts(); !reflect.DeepEqual(hosts, []string{"a", "b", "c"}) {
+		t.Errorf("Expected recovered hosts to return, got %v", hosts)
+	}
+}
+
+func TestProbationEnds(t *testing.T) {
+	list := NewList([]string{"old"})
+	list.Swap([]string{"new"})
+	list.RecordDial(true)
+	if list.endProbationAfter(time.Hour) {
+		t.Fatal("Probation shouldn't end early")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !list.endProbationAfter(5 * time.Millisecond) {
+		t.Fatal("Probation should end after the maximum")
+	}
+	if list.onProbation() || list.rollbackIfWorse(1) {
+		t.Error("List shouldn't be rolled back once off probation")
+	}
+	if hosts := list.Hosts(); !reflect.DeepEqual(hosts, []string{"new"}) {
+		t.Errorf("Expected to keep new hosts, got %v", hosts)
+	}
+}
@@ -0,0 +1,135 @@
+package masquerade
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	MIN_DIALS_BEFORE_ROLLBACK = 10
+
+	// MAX_PROBATION_INTERVALS is how many refresh intervals a new list stays on
+	// probation at most, after which it's kept even if it wasn't dialed often
+	// enough to be judged
+	MAX_PROBATION_INTERVALS = 3
+)
+
+// Refresher periodically fetches an updated list of masquerade hosts,
+// validates them in the background and swaps them into a List.  Only the
+// masquerades are refreshed, not the rest of the configuration.
+type Refresher struct {
+	URL        string                  // url from which to fetch the list, one host per line
+	Interval   time.Duration           // average time between refreshes
+	Jitter     time.Duration           // maximum random deviation from Interval, so that clients don't all refresh at once
+	List       *List                   // the list to update
+	Validate   func(host string) error // checks whether a host works as a masquerade
+	HTTPClient *http.Client            // (optional) client with which to fetch, defaults to http.DefaultClient
+}
+
+// Start starts refreshing and blocks forever
+func (refresher *Refresher) Start() {
+	for {
+		time.Sleep(refresher.nextWait())
+		if refresher.List.onProbation() {
+			if refresher.List.rollbackIfWorse(MIN_DIALS_BEFORE_ROLLBACK) {
+				log.Errorf("New masquerade list performed worse than the previous one, rolled back")
+				continue
+			}
+			if !refresher.List.endProbationAfter(MAX_PROBATION_INTERVALS * refresher.Interval) {
+				// Not enough data yet, wait for another interval
+				continue
+			}
+		}
+		err := refresher.refresh()
+		if err != nil {
+			log.Errorf("Unable to refresh masquerades: %s", err)
+		}
+	}
+}
+
+// nextWait determines how long to wait until the next refresh
+func (refresher *Refresher) nextWait() time.Duration {
+	wait := refresher.Interval
+	if refresher.Jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(2*refresher.Jitter))) - refresher.Jitter
+	}
+	return wait
+}
+
+func (refresher *Refresher) refresh() error {
+	hosts, err := refresher.fetch()
+	if err != nil {
+		return err
+	}
+	valid := refresher.validate(hosts)
+	if len(valid) == 0 {
+		return fmt.Errorf("None of the %d fetched masquerades validated, keeping current list", len(hosts))
+	}
+	log.Debugf("Swapping in %d of %d fetched masquerades", len(valid), len(hosts))
+	refresher.List.Swap(valid)
+	return nil
+}
+
+// fetch fetches the list of hosts
+func (refresher *Refresher) fetch() ([]string, error) {
+	httpClient := refresher.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Get(refresher.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch masquerades: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response status fetching masquerades: %d", resp.StatusCode)
+	}
+	return parseHosts(resp.Body)
+}
+
+// ReadFile reads a list of hosts in the same format as fetched by the
+// Refresher: one host per line, ignoring blank lines and lines starting with #
+func ReadFile(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open masquerades file: %s", err)
+	}
+	defer file.Close()
+	return parseHosts(file)
+}
+
+func parseHosts(r io.Reader) ([]string, error) {
+	var hosts []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			hosts = append(hosts, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read masquerades: %s", err)
+	}
+	return hosts, nil
+}
+
+// validate validates the given hosts concurrently, returning those that
+// work in their original order.
+func (refresher *Refresher) validate(hosts []string) []string {
+	ok := validateAll(hosts, refresher.Validate)
+	var valid []string
+	for i, host := range hosts {
+		if ok[i] {
+			valid = append(valid, host)
+		}
+	}
+	return valid
+}
@@ -0,0 +1,280 @@
+// package mdns implements a minimal mDNS/DNS-SD responder (RFC 6762/6763)
+// that advertises a single service instance on the LAN.
+package mdns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	TYPE_A   = 1
+	TYPE_PTR = 12
+	TYPE_TXT = 16
+	TYPE_SRV = 33
+	TYPE_ANY = 255
+
+	CLASS_IN          = 1
+	CLASS_CACHE_FLUSH = 0x8000
+
+	TTL = 120
+
+	servicesName = "_services._dns-sd._udp.local."
+)
+
+var (
+	mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+)
+
+// Advertiser advertises a service instance via mDNS
+type Advertiser struct {
+	Instance string   // human readable instance name, e.g. "flashlight on mybox"
+	Service  string   // service type, e.g. "_http-proxy._tcp"
+	Port     int      // port on which the service listens
+	TXT      []string // (optional) TXT record entries, e.g. "pac=http://..."
+	IPs      []net.IP // (optional) IPv4 addresses at which the service is reachable, defaults to all non-loopback IPv4 addresses
+
+	hostName     string
+	serviceName  string
+	instanceName string
+	conn         *net.UDPConn
+}
+
+// Start starts answering mDNS queries and announces the service.
+func (a *Advertiser) Start() error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("Unable to determine hostname: %s", err)
+	}
+	a.hostName = strings.Split(hostname, ".")[0] + ".local."
+	a.serviceName = a.Service + ".local."
+	a.instanceName = a.Instance + "." + a.serviceName
+	if len(a.IPs) == 0 {
+		a.IPs = localIPv4s()
+	}
+
+	a.conn, err = net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for mDNS: %s", err)
+	}
+	log.Debugf("Advertising %s via mDNS", a.instanceName)
+	a.announce()
+	go a.serve()
+	return nil
+}
+
+// announce sends an unsolicited response advertising our records
+func (a *Advertiser) announce() {
+	msg := a.response(0, a.serviceRecords())
+	if _, err := a.conn.WriteToUDP(msg, mdnsAddr); err != nil {
+		log.Errorf("Unable to announce via mDNS: %s", err)
+	}
+}
+
+func (a *Advertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Errorf("Unable to read mDNS query: %s", err)
+			return
+		}
+		id, questions, err := parseQuery(buf[:n])
+		if err != nil {
+			continue
+		}
+		var answers [][]byte
+		for _, q := range questions {
+			answers = append(answers, a.answer(q)...)
+		}
+		if len(answers) == 0 {
+			continue
+		}
+		to := mdnsAddr
+		if from.Port != mdnsAddr.Port {
+			// Legacy unicast query, answer directly
+			to = from
+		} else {
+			id = 0
+		}
+		if _, err := a.conn.WriteToUDP(a.response(id, answers), to); err != nil {
+			log.Errorf("Unable to send mDNS response: %s", err)
+		}
+	}
+}
+
+type question struct {
+	name  string
+	qtype uint16
+}
+
+// answer builds the answers for the given question
+func (a *Advertiser) answer(q question) [][]byte {
+	name := strings.ToLower(q.name)
+	matches := func(target string, qtype uint16) bool {
+		return name == strings.ToLower(target) && (q.qtype == qtype || q.qtype == TYPE_ANY)
+	}
+	switch {
+	case matches(servicesName, TYPE_PTR):
+		return [][]byte{record(servicesName, TYPE_PTR, CLASS_IN, encodeName(a.serviceName))}
+	case matches(a.serviceName, TYPE_PTR):
+		return a.serviceRecords()
+	case matches(a.instanceName, TYPE_SRV), matches(a.instanceName, TYPE_TXT):
+		return a.serviceRecords()[1:]
+	case matches(a.hostName, TYPE_A):
+		return a.addressRecords()
+	}
+	return nil
+}
+
+// serviceRecords returns the PTR, SRV, TXT and A records for our service
+func (a *Advertiser) serviceRecords() [][]byte {
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(a.Port))
+	srv = append(srv, encodeName(a.hostName)...)
+
+	var txt []byte
+	for _, entry := range a.TXT {
+		txt = append(txt, byte(len(entry)))
+		txt = append(txt, entry...)
+	}
+	if len(txt) == 0 {
+		txt = []byte{0}
+	}
+
+	records := [][]byte{
+		record(a.serviceName, TYPE_PTR, CLASS_IN, encodeName(a.instanceName)),
+		record(a.instanceName, TYPE_SRV, CLASS_IN|CLASS_CACHE_FLUSH, srv),
+		record(a.instanceName, TYPE_TXT, CLASS_IN|CLASS_CACHE_FLUSH, txt),
+	}
+	return append(records, a.addressRecords()...)
+}
+
+func (a *Advertiser) addressRecords() [][]byte {
+	var records [][]byte
+	for _, ip := range a.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, record(a.hostName, TYPE_A, CLASS_IN|CLASS_CACHE_FLUSH, ip4))
+		}
+	}
+	return records
+}
+
+// response builds an authoritative response containing the given answers
+func (a *Advertiser) response(id uint16, answers [][]byte) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	for _, answer := range answers {
+		msg = append(msg, answer...)
+	}
+	return msg
+}
+
+func record(name string, rtype uint16, class uint16, rdata []byte) []byte {
+	rec := encodeName(name)
+	fixed := make([]byte, 10)
+	binary.BigEndian.PutUint16(fixed[0:], rtype)
+	binary.BigEndian.PutUint16(fixed[2:], class)
+	binary.BigEndian.PutUint32(fixed[4:], TTL)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+	rec = append(rec, fixed...)
+	return append(rec, rdata...)
+}
+
+// encodeName encodes a fully qualified name as DNS labels.  The first label
+// of instance names may contain dots escaped as "\.", which we don't support,
+// so instance names shouldn't contain dots.
+func encodeName(name string) []byte {
+	var encoded []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+// parseQuery parses the id and questions from a DNS query
+func parseQuery(msg []byte) (id uint16, questions []question, err error) {
+	if len(msg) < 12 {
+		return 0, nil, fmt.Errorf("Message too short")
+	}
+	id = binary.BigEndian.Uint16(msg[0:])
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 != 0 {
+		return 0, nil, fmt.Errorf("Not a query")
+	}
+	count := int(binary.BigEndian.Uint16(msg[4:]))
+	offset := 12
+	for i := 0; i < count; i++ {
+		var name string
+		name, offset, err = decodeName(msg, offset)
+		if err != nil {
+			return
+		}
+		if offset+4 > len(msg) {
+			return 0, nil, fmt.Errorf("Truncated question")
+		}
+		qtype := binary.BigEndian.Uint16(msg[offset:])
+		offset += 4
+		questions = append(questions, question{name, qtype})
+	}
+	return
+}
+
+// decodeName decodes a possibly compressed name starting at offset, returning
+// the name and the offset following it.
+func decodeName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; jumps < 20; {
+		if offset >= len(msg) {
+			return "", 0, fmt.Errorf("Truncated name")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(msg) {
+				return "", 0, fmt.Errorf("Truncated pointer")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, fmt.Errorf("Truncated label")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+	return "", 0, fmt.Errorf("Too many compression pointers")
+}
+
+// localIPv4s returns all non-loopback IPv4 addresses of this machine
+func localIPv4s() []net.IP {
+	var ips []net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
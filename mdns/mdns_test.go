@@ -0,0 +1,166 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// query builds a DNS query for the given questions, all of type qtype
+func query(id uint16, qtype uint16, names ...string) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(names)))
+	for _, name := range names {
+		msg = append(msg, encodeName(name)...)
+		msg = append(msg, byte(qtype>>8), byte(qtype), 0, CLASS_IN)
+	}
+	return msg
+}
+
+func TestParseQuery(t *testing.T) {
+	id, questions, err := parseQuery(query(1234, TYPE_PTR, "_http-proxy._tcp.local.", "mybox.local."))
+	if err != nil {
+		t.Fatalf("Unable to parse query: %s", err)
+	}
+	if id != 1234 || len(questions) != 2 {
+		t.Fatalf("Unexpected id %d and questions %v", id, questions)
+	}
+	if questions[0] != (question{"_http-proxy._tcp.local.", TYPE_PTR}) || questions[1].name != "mybox.local." {
+		t.Errorf("Unexpected questions %v", questions)
+	}
+}
+
+func TestParseCompressedQuery(t *testing.T) {
+	msg := query(0, TYPE_A, "mybox.local.")
+	// A second question for other.local., pointing back at "local" in the first
+	binary.BigEndian.PutUint16(msg[4:], 2)
+	msg = append(msg, 5, 'o', 't', 'h', 'e', 'r', 0xC0, 12+6, 0, TYPE_A, 0, CLASS_IN)
+	_, questions, err := parseQuery(msg)
+	if err != nil {
+		t.Fatalf("Unable to parse query: %s", err)
+	}
+	if len(questions) != 2 || questions[1] != (question{"other.local.", TYPE_A}) {
+		t.Errorf("Unexpected questions %v", questions)
+	}
+}
+
+func TestParseMalformedQuery(t *testing.T) {
+	valid := query(0, TYPE_A, "mybox.local.")
+	response := append([]byte{}, valid...)
+	response[2] = 0x84
+	tooMany := append([]byte{}, valid...)
+	tooMany[5] = 2
+	loop := append(query(0, TYPE_A)[:12], 0xC0, 12, 0, TYPE_A, 0, CLASS_IN)
+	loop[5] = 1
+	longLabel := append(query(0, TYPE_A)[:12], 63, 'a', 'b')
+	longLabel[5] = 1
+	cases := map[string][]byte{
+		"empty":              nil,
+		"short header":       valid[:11],
+		"response":           response,
+		"truncated name":     valid[:15],
+		"truncated question": valid[:len(valid)-1],
+		"missing question":   tooMany,
+		"pointer loop":       loop,
+		"truncated pointer":  append(append([]byte{}, valid[:12]...), 0xC0),
+		"label past the end": longLabel,
+	}
+	for name, msg := range cases {
+		if _, _, err := parseQuery(msg); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func testAdvertiser() *Advertiser {
+	return &Advertiser{
+		Port:         8080,
+		TXT:          []string{"pac=http://192.168.1.10:8080/proxy.pac"},
+		IPs:          []net.IP{net.ParseIP("192.168.1.10"), net.ParseIP("fe80::1")},
+		hostName:     "mybox.local.",
+		serviceName:  "_http-proxy._tcp.local.",
+		instanceName: "flashlight._http-proxy._tcp.local.",
+	}
+}
+
+// parseRecord returns the name, type and rdata of a record
+func parseRecord(t *testing.T, rec []byte) (string, uint16, []byte) {
+	name, offset, err := decodeName(rec, 0)
+	if err != nil {
+		t.Fatalf("Unable to decode record name: %s", err)
+	}
+	rtype := binary.BigEndian.Uint16(rec[offset:])
+	length := int(binary.BigEndian.Uint16(rec[offset+8:]))
+	rdata := rec[offset+10:]
+	if len(rdata) != length {
+		t.Errorf("Record %s has %d bytes of data, claims %d", name, len(rdata), length)
+	}
+	return name, rtype, rdata
+}
+
+func TestAnswer(t *testing.T) {
+	a := testAdvertiser()
+
+	answers := a.answer(question{servicesName, TYPE_PTR})
+	if len(answers) != 1 {
+		t.Fatalf("Expected 1 answer for service enumeration, got %d", len(answers))
+	}
+	if _, _, rdata := parseRecord(t, answers[0]); string(rdata) != string(encodeName(a.serviceName)) {
+		t.Errorf("Expected service enumeration to point to our service")
+	}
+
+	answers = a.answer(question{"_HTTP-PROXY._tcp.local.", TYPE_PTR})
+	expectedTypes := []uint16{TYPE_PTR, TYPE_SRV, TYPE_TXT, TYPE_A}
+	if len(answers) != len(expectedTypes) {
+		t.Fatalf("Expected PTR, SRV, TXT and one A record, got %d records", len(answers))
+	}
+	for i, answer := range answers {
+		if _, rtype, _ := parseRecord(t, answer); rtype != expectedTypes[i] {
+			t.Errorf("Expected record %d to be of type %d, got %d", i, expectedTypes[i], rtype)
+		}
+	}
+	_, _, srv := parseRecord(t, answers[1])
+	if port := binary.BigEndian.Uint16(srv[4:]); port != 8080 {
+		t.Errorf("Expected SRV record for port 8080, got %d", port)
+	}
+	_, _, txt := parseRecord(t, answers[2])
+	if string(txt[1:]) != a.TXT[0] || int(txt[0]) != len(a.TXT[0]) {
+		t.Errorf("Unexpected TXT record %q", txt)
+	}
+
+	if answers := a.answer(question{a.instanceName, TYPE_ANY}); len(answers) != 3 {
+		t.Errorf("Expected SRV, TXT and A records for the instance, got %d", len(answers))
+	}
+	answers = a.answer(question{"mybox.local.", TYPE_A})
+	if len(answers) != 1 {
+		t.Fatalf("Expected 1 A record, got %d", len(answers))
+	}
+	if _, _, ip := parseRecord(t, answers[0]); !net.IP(ip).Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("Unexpected address %v", ip)
+	}
+	if answers := a.answer(question{"otherbox.local.", TYPE_A}); len(answers) != 0 {
+		t.Errorf("Expected no answers for another host, got %d", len(answers))
+	}
+	if answers := a.answer(question{"mybox.local.", TYPE_TXT}); len(answers) != 0 {
+		t.Errorf("Expected no answers for another type, got %d", len(answers))
+	}
+}
+
+func TestResponse(t *testing.T) {
+	a := testAdvertiser()
+	answers := a.answer(question{"mybox.local.", TYPE_A})
+	msg := a.response(1234, answers)
+	if id := binary.BigEndian.Uint16(msg); id != 1234 {
+		t.Errorf("Expected id 1234, got %d", id)
+	}
+	if flags := binary.BigEndian.Uint16(msg[2:]); flags != 0x8400 {
+		t.Errorf("Expected authoritative response, got flags %x", flags)
+	}
+	if count := binary.BigEndian.Uint16(msg[6:]); count != 1 {
+		t.Errorf("Expected 1 answer, got %d", count)
+	}
+	if _, _, err := parseQuery(msg); err == nil {
+		t.Error("Responses shouldn't parse as queries")
+	}
+}
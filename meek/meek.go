@@ -0,0 +1,158 @@
+// package meek implements the server side of meek, the HTTP polling transport
+// used by Tor's meek pluggable transport.  A meek client carries a stream as
+// a series of POSTs through a CDN, each identified by an X-Session-Id header.
+// Each POST's body holds data from the client and its response holds whatever
+// data from the other end became available in the meantime.  This lets a
+// flashlight server act as the reflector's backend for existing meek clients.
+//
+// The protocol is described at https://trac.torproject.org/projects/tor/wiki/doc/meek
+package meek
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	SESSION_ID_HEADER = "X-Session-Id"
+
+	// MAX_PAYLOAD_LENGTH limits the body of each request and response
+	MAX_PAYLOAD_LENGTH = 0x10000
+
+	// TURNAROUND_TIMEOUT is how long to wait for data to send back to the
+	// client before responding
+	TURNAROUND_TIMEOUT = 10 * time.Millisecond
+
+	// MAX_SESSION_STALENESS is how long a session lives without requests
+	MAX_SESSION_STALENESS = 120 * time.Second
+
+	// DIAL_TIMEOUT limits how long it takes to connect a new session
+	DIAL_TIMEOUT = 20 * time.Second
+)
+
+// IsMeek determines whether the request comes from a meek client
+func IsMeek(req *http.Request) bool {
+	return req.Method == "POST" && req.Header.Get(SESSION_ID_HEADER) != ""
+}
+
+// Server connects meek sessions to a fixed target, e.g. a Tor bridge's ORPort
+type Server struct {
+	Target string // address to which each session is connected
+
+	sessions  map[string]*session
+	mutex     sync.Mutex
+	startOnce sync.Once
+}
+
+// session is a meek session along with its connection to the target
+type session struct {
+	conn     net.Conn
+	lastSeen time.Time  // protected by the Server's mutex
+	mutex    sync.Mutex // requests for the same session are handled in turn
+}
+
+func (server *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	server.startOnce.Do(func() {
+		server.sessions = make(map[string]*session)
+		go server.expireSessions()
+	})
+	if !IsMeek(req) {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id := req.Header.Get(SESSION_ID_HEADER)
+	s, err := server.session(id)
+	if err != nil {
+		log.Errorf("Unable to connect meek session to %s: %s", server.Target, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.transact(resp, req); err != nil {
+		log.Debugf("Closing meek session %s: %s", id, err)
+		server.close(id, s)
+		resp.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// session returns the session with the given id, connecting a new one if
+// necessary
+func (server *Server) session(id string) (*session, error) {
+	server.mutex.Lock()
+	s, found := server.sessions[id]
+	if found {
+		s.lastSeen = time.Now()
+	}
+	server.mutex.Unlock()
+	if found {
+		return s, nil
+	}
+	conn, err := net.DialTimeout("tcp", server.Target, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if existing, found := server.sessions[id]; found {
+		// Lost a race with another request for the same new session
+		conn.Close()
+		existing.lastSeen = time.Now()
+		return existing, nil
+	}
+	s = &session{conn: conn, lastSeen: time.Now()}
+	server.sessions[id] = s
+	return s, nil
+}
+
+// transact writes the request's body to the target and responds with what the
+// target sent in the meantime.  Only errors that end the session are
+// returned, in which case nothing has been written to resp yet.
+func (s *session) transact(resp http.ResponseWriter, req *http.Request) error {
+	body := http.MaxBytesReader(resp, req.Body, MAX_PAYLOAD_LENGTH+1)
+	if _, err := io.Copy(s.conn, body); err != nil {
+		return err
+	}
+	buf := make([]byte, MAX_PAYLOAD_LENGTH)
+	s.conn.SetReadDeadline(time.Now().Add(TURNAROUND_TIMEOUT))
+	n, err := s.conn.Read(buf)
+	if err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return err
+		}
+	}
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Write(buf[:n])
+	return nil
+}
+
+func (server *Server) close(id string, s *session) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.sessions[id] == s {
+		delete(server.sessions, id)
+	}
+	s.conn.Close()
+}
+
+// expireSessions periodically closes sessions that haven't seen a request in
+// MAX_SESSION_STALENESS
+func (server *Server) expireSessions() {
+	for {
+		time.Sleep(MAX_SESSION_STALENESS / 2)
+		server.mutex.Lock()
+		for id, s := range server.sessions {
+			if time.Now().Sub(s.lastSeen) > MAX_SESSION_STALENESS {
+				log.Debugf("Expiring meek session %s", id)
+				delete(server.sessions, id)
+				s.conn.Close()
+			}
+		}
+		server.mutex.Unlock()
+	}
+}
@@ -0,0 +1,73 @@
+package meek
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			// Echo
+			go io.Copy(conn, conn)
+		}
+	}()
+	server := httptest.NewServer(&Server{Target: target.Addr().String()})
+	defer server.Close()
+
+	poll := func(session string, data string) string {
+		req, _ := http.NewRequest("POST", server.URL, bytes.NewReader([]byte(data)))
+		req.Header.Set(SESSION_ID_HEADER, session)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unable to poll: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status %d", resp.StatusCode)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// The echo may take a few polls to come back
+	received := poll("a", "hello")
+	for i := 0; i < 10 && len(received) < len("hello"); i++ {
+		time.Sleep(10 * time.Millisecond)
+		received += poll("a", "")
+	}
+	if received != "hello" {
+		t.Errorf("Expected echo, got %q", received)
+	}
+	if received := poll("b", ""); received != "" {
+		t.Errorf("Other session shouldn't see session a's data, got %q", received)
+	}
+}
+
+func TestNotMeek(t *testing.T) {
+	server := &Server{Target: "127.0.0.1:1"}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if IsMeek(req) {
+		t.Error("GET without session id shouldn't be meek")
+	}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request, got %d", rec.Code)
+	}
+}
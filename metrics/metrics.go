@@ -0,0 +1,210 @@
+// package metrics provides a minimal registry of counters, gauges and
+// histograms that can be rendered in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_HISTOGRAM = "histogram"
+)
+
+var (
+	// SIZE_BUCKETS are histogram buckets suitable for sizes in bytes, from 1KB
+	// to 1GB
+	SIZE_BUCKETS = []int64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30}
+
+	// LATENCY_BUCKETS are histogram buckets suitable for latencies in
+	// milliseconds, from 10ms to 10s
+	LATENCY_BUCKETS = []int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+)
+
+// Registry holds a set of named metrics.
+type Registry struct {
+	metrics []*metric
+	byName  map[string]*metric
+	mutex   sync.RWMutex
+}
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value int64
+
+	// only used by histograms
+	buckets []int64 // upper bounds, ascending
+	counts  []int64 // observations per bucket (not cumulative), plus one for +Inf
+	count   int64
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	m *metric
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	m *metric
+}
+
+// Histogram counts observations (e.g. sizes) in buckets.
+type Histogram struct {
+	m *metric
+}
+
+// Counter returns the counter with the given name, creating it if necessary.
+func (registry *Registry) Counter(name string, help string) *Counter {
+	return &Counter{registry.getOrCreate(name, help, TYPE_COUNTER)}
+}
+
+// Gauge returns the gauge with the given name, creating it if necessary.
+func (registry *Registry) Gauge(name string, help string) *Gauge {
+	return &Gauge{registry.getOrCreate(name, help, TYPE_GAUGE)}
+}
+
+// Histogram returns the histogram with the given name, creating it with the
+// given buckets (ascending upper bounds) if necessary.
+func (registry *Registry) Histogram(name string, help string, buckets []int64) *Histogram {
+	m := registry.getOrCreate(name, help, TYPE_HISTOGRAM, buckets...)
+	return &Histogram{m}
+}
+
+func (registry *Registry) getOrCreate(name string, help string, kind string, buckets ...int64) *metric {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registry.byName == nil {
+		registry.byName = make(map[string]*metric)
+	}
+	m, found := registry.byName[name]
+	if found {
+		return m
+	}
+	m = &metric{name: name, help: help, kind: kind}
+	if kind == TYPE_HISTOGRAM {
+		m.buckets = buckets
+		m.counts = make([]int64, len(buckets)+1)
+	}
+	registry.byName[name] = m
+	registry.metrics = append(registry.metrics, m)
+	return m
+}
+
+// WriteText writes all metrics in the registry to the given writer using the
+// Prometheus text exposition format.
+func (registry *Registry) WriteText(w io.Writer) error {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	for _, m := range registry.metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		if err != nil {
+			return err
+		}
+		if m.kind == TYPE_HISTOGRAM {
+			err = m.writeHistogram(w)
+		} else {
+			_, err = fmt.Fprintf(w, "%s %d\n", m.name, atomic.LoadInt64(&m.value))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Values returns a snapshot of the current values of all metrics by name, with
+// histograms reduced to their _count and _sum (e.g. for publishing via expvar)
+func (registry *Registry) Values() map[string]int64 {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	values := make(map[string]int64, len(registry.metrics))
+	for _, m := range registry.metrics {
+		if m.kind == TYPE_HISTOGRAM {
+			values[m.name+"_count"] = atomic.LoadInt64(&m.count)
+			values[m.name+"_sum"] = atomic.LoadInt64(&m.value)
+		} else {
+			values[m.name] = atomic.LoadInt64(&m.value)
+		}
+	}
+	return values
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format, for
+// Prometheus to scrape
+func (registry *Registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := registry.WriteText(resp); err != nil {
+		log.Debugf("Unable to serve metrics to %s: %s", req.RemoteAddr, err)
+	}
+}
+
+// writeHistogram writes the (cumulative) buckets, sum and count of a histogram
+func (m *metric) writeHistogram(w io.Writer) error {
+	cumulative := int64(0)
+	for i, bound := range m.buckets {
+		cumulative += atomic.LoadInt64(&m.counts[i])
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%d\"} %d\n", m.name, bound, cumulative); err != nil {
+			return err
+		}
+	}
+	cumulative += atomic.LoadInt64(&m.counts[len(m.buckets)])
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %d\n%s_count %d\n",
+		m.name, cumulative, m.name, atomic.LoadInt64(&m.value), m.name, atomic.LoadInt64(&m.count))
+	return err
+}
+
+// Add adds the given delta to the counter
+func (counter *Counter) Add(delta int64) {
+	atomic.AddInt64(&counter.m.value, delta)
+}
+
+// Inc increments the counter by 1
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+// Value returns the current value of the counter
+func (counter *Counter) Value() int64 {
+	return atomic.LoadInt64(&counter.m.value)
+}
+
+// Set sets the gauge to the given value
+func (gauge *Gauge) Set(value int64) {
+	atomic.StoreInt64(&gauge.m.value, value)
+}
+
+// Add adds the given delta (which may be negative) to the gauge
+func (gauge *Gauge) Add(delta int64) {
+	atomic.AddInt64(&gauge.m.value, delta)
+}
+
+// Value returns the current value of the gauge
+func (gauge *Gauge) Value() int64 {
+	return atomic.LoadInt64(&gauge.m.value)
+}
+
+// Observe records a single observation
+func (histogram *Histogram) Observe(value int64) {
+	m := histogram.m
+	i := 0
+	for i < len(m.buckets) && value > m.buckets[i] {
+		i++
+	}
+	atomic.AddInt64(&m.counts[i], 1)
+	atomic.AddInt64(&m.value, value)
+	atomic.AddInt64(&m.count, 1)
+}
+
+// Count returns the number of observations so far
+func (histogram *Histogram) Count() int64 {
+	return atomic.LoadInt64(&histogram.m.count)
+}
@@ -0,0 +1,16 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestValues(t *testing.T) {
+	registry := &Registry{}
+	registry.Counter("requests_total", "Requests").Add(5)
+	registry.Gauge("open_connections", "Open connections").Set(2)
+	registry.Histogram("response_bytes", "Response sizes", SIZE_BUCKETS).Observe(2000)
+	values := registry.Values()
+	if len(values) != 4 || values["requests_total"] != 5 || values["open_connections"] != 2 || values["response_bytes_count"] != 1 || values["response_bytes_sum"] != 2000 {
+		t.Errorf("Unexpected values %v", values)
+	}
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+// Pusher periodically pushes the metrics in a Registry to a Prometheus push
+// gateway, for deployments that can't be scraped (e.g. behind NAT).
+type Pusher struct {
+	URL      string        // base url of the push gateway, e.g. http://pushgateway:9091
+	Job      string        // job under which to push metrics
+	Instance string        // (optional) instance under which to push metrics
+	Interval time.Duration // how frequently to push
+	Registry *Registry     // the metrics to push
+}
+
+// Start starts pushing metrics and blocks forever
+func (pusher *Pusher) Start() {
+	for {
+		time.Sleep(pusher.Interval)
+		err := pusher.push()
+		if err != nil {
+			log.Errorf("Error pushing metrics: %s", err)
+		}
+	}
+}
+
+// push PUTs the current metrics to the push gateway, replacing any
+// previously pushed metrics for the same job and instance.
+func (pusher *Pusher) push() error {
+	body := &bytes.Buffer{}
+	err := pusher.Registry.WriteText(body)
+	if err != nil {
+		return fmt.Errorf("Unable to render metrics: %s", err)
+	}
+
+	pushURL := fmt.Sprintf("%s/metrics/job/%s", pusher.URL, url.QueryEscape(pusher.Job))
+	if pusher.Instance != "" {
+		pushURL = fmt.Sprintf("%s/instance/%s", pushURL, url.QueryEscape(pusher.Instance))
+	}
+	req, err := http.NewRequest("PUT", pushURL, body)
+	if err != nil {
+		return fmt.Errorf("Unable to construct push request: %s", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to push metrics to %s: %s", pusher.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 202 {
+		return fmt.Errorf("Unexpected response status pushing metrics: %d", resp.StatusCode)
+	}
+	return nil
+}
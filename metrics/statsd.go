@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// MAX_STATSD_DATAGRAM_SIZE limits the size of the datagrams sent to the
+	// StatsD agent, so that they don't get fragmented
+	MAX_STATSD_DATAGRAM_SIZE = 1432
+)
+
+// StatsD periodically sends the metrics in a Registry to a StatsD agent (or a
+// DogStatsD agent, if there are Tags) over UDP, for pipelines like Datadog or
+// Graphite.  Counters are sent as the increase since the last send, gauges as
+// their current value and histograms as the increase of their count and sum.
+type StatsD struct {
+	Addr     string        // host:port of the agent
+	Prefix   string        // (optional) prefix of metric names, e.g. servers.eu1. for Graphite
+	Tags     []string      // (optional) DogStatsD tags added to every metric, e.g. instance:eu1
+	Interval time.Duration // how frequently to send
+	Registry *Registry     // the metrics to send
+
+	conn net.Conn
+	sent map[string]int64 // last sent values of counters, by name
+}
+
+// Start starts sending metrics and blocks forever
+func (statsd *StatsD) Start() {
+	for {
+		time.Sleep(statsd.Interval)
+		err := statsd.send()
+		if err != nil {
+			log.Errorf("Error sending metrics to statsd: %s", err)
+		}
+	}
+}
+
+// send sends the metrics that changed since the last send
+func (statsd *StatsD) send() error {
+	if statsd.conn == nil {
+		conn, err := net.Dial("udp", statsd.Addr)
+		if err != nil {
+			return fmt.Errorf("Unable to dial %s: %s", statsd.Addr, err)
+		}
+		statsd.conn = conn
+		statsd.sent = make(map[string]int64)
+	}
+	var datagram bytes.Buffer
+	for _, line := range statsd.lines() {
+		if datagram.Len() > 0 && datagram.Len()+1+len(line) > MAX_STATSD_DATAGRAM_SIZE {
+			if _, err := statsd.conn.Write(datagram.Bytes()); err != nil {
+				return err
+			}
+			datagram.Reset()
+		}
+		if datagram.Len() > 0 {
+			datagram.WriteByte('\n')
+		}
+		datagram.WriteString(line)
+	}
+	if datagram.Len() == 0 {
+		return nil
+	}
+	_, err := statsd.conn.Write(datagram.Bytes())
+	return err
+}
+
+// lines renders the metrics as StatsD lines
+func (statsd *StatsD) lines() []string {
+	statsd.Registry.mutex.RLock()
+	defer statsd.Registry.mutex.RUnlock()
+	var lines []string
+	for _, m := range statsd.Registry.metrics {
+		switch m.kind {
+		case TYPE_GAUGE:
+			lines = append(lines, statsd.line(m.name, atomic.LoadInt64(&m.value), "g"))
+		case TYPE_COUNTER:
+			if delta := statsd.delta(m.name, atomic.LoadInt64(&m.value)); delta > 0 {
+				lines = append(lines, statsd.line(m.name, delta, "c"))
+			}
+		case TYPE_HISTOGRAM:
+			if delta := statsd.delta(m.name+"_count", atomic.LoadInt64(&m.count)); delta > 0 {
+				lines = append(lines, statsd.line(m.name+"_count", delta, "c"))
+			}
+			if delta := statsd.delta(m.name+"_sum", atomic.LoadInt64(&m.value)); delta > 0 {
+				lines = append(lines, statsd.line(m.name+"_sum", delta, "c"))
+			}
+		}
+	}
+	return lines
+}
+
+// delta returns the increase of the named value since it was last sent
+func (statsd *StatsD) delta(name string, value int64) int64 {
+	delta := value - statsd.sent[name]
+	statsd.sent[name] = value
+	return delta
+}
+
+func (statsd *StatsD) line(name string, value int64, kind string) string {
+	line := fmt.Sprintf("%s%s:%d|%s", statsd.Prefix, name, value, kind)
+	if len(statsd.Tags) > 0 {
+		line += "|#" + strings.Join(statsd.Tags, ",")
+	}
+	return line
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsD(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer agent.Close()
+
+	registry := &Registry{}
+	bytesSent := registry.Counter("bytes_sent_total", "Bytes sent")
+	registry.Gauge("open_connections", "Open connections").Set(3)
+	registry.Histogram("response_bytes", "Response sizes", SIZE_BUCKETS).Observe(2000)
+	statsd := &StatsD{
+		Addr:     agent.LocalAddr().String(),
+		Prefix:   "fl.",
+		Tags:     []string{"instance:eu1"},
+		Registry: registry,
+	}
+
+	receive := func() []string {
+		if err := statsd.send(); err != nil {
+			t.Fatalf("Unable to send: %s", err)
+		}
+		buf := make([]byte, MAX_STATSD_DATAGRAM_SIZE)
+		agent.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, _, err := agent.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Unable to receive: %s", err)
+		}
+		return strings.Split(string(buf[:n]), "\n")
+	}
+
+	bytesSent.Add(100)
+	expected := []string{
+		"fl.bytes_sent_total:100|c|#instance:eu1",
+		"fl.open_connections:3|g|#instance:eu1",
+		"fl.response_bytes_count:1|c|#instance:eu1",
+		"fl.response_bytes_sum:2000|c|#instance:eu1",
+	}
+	if lines := receive(); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v, got %v", expected, lines)
+	}
+
+	// Counters are sent as deltas, and only if they changed
+	bytesSent.Add(50)
+	expected = []string{
+		"fl.bytes_sent_total:50|c|#instance:eu1",
+		"fl.open_connections:3|g|#instance:eu1",
+	}
+	if lines := receive(); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v, got %v", expected, lines)
+	}
+}
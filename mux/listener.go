@@ -0,0 +1,120 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// PREFACE_TIMEOUT limits how long the Listener waits for the first bytes
+	// of a connection to tell whether it's multiplexed
+	PREFACE_TIMEOUT = 30 * time.Second
+)
+
+// Listener is a net.Listener that accepts both regular and multiplexed
+// connections.  For multiplexed connections, it accepts each of their streams
+// as a separate connection.
+type Listener struct {
+	net.Listener
+
+	startOnce sync.Once
+	accepted  chan net.Conn
+	errors    chan error
+	done      chan struct{}
+	err       error
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() {
+		l.accepted = make(chan net.Conn)
+		l.errors = make(chan error)
+		l.done = make(chan struct{})
+		go l.acceptLoop()
+	})
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case err := <-l.errors:
+		return nil, err
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// acceptLoop accepts connections from the wrapped Listener until it fails
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				l.errors <- err
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+// handle determines whether the given connection is multiplexed and passes
+// on either the connection itself or its streams
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(PREFACE_TIMEOUT))
+	reader := bufio.NewReader(conn)
+	start, err := reader.Peek(len(PREFACE))
+	if err != nil {
+		log.Debugf("Unable to read start of connection from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn = &bufferedConn{conn, reader}
+	if !bytes.Equal(start, []byte(PREFACE)) {
+		l.pass(conn)
+		return
+	}
+
+	reader.Discard(len(PREFACE))
+	session := Server(conn)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			log.Debugf("Session with %s ended: %s", conn.RemoteAddr(), err)
+			return
+		}
+		if !l.pass(stream) {
+			session.Close()
+			return
+		}
+	}
+}
+
+// pass passes on an accepted connection, returning false if the Listener
+// failed in the meantime
+func (l *Listener) pass(conn net.Conn) bool {
+	select {
+	case l.accepted <- conn:
+		return true
+	case <-l.done:
+		conn.Close()
+		return false
+	}
+}
+
+// bufferedConn is a net.Conn whose first bytes were already read into a
+// bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
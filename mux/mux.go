@@ -0,0 +1,292 @@
+// package mux multiplexes many streams over a single connection, so that the
+// client can keep a small number of persistent connections to the server
+// instead of dialing (and handshaking) for every request.  Besides saving
+// round trips, this makes the client's traffic less distinctive, since an
+// observer sees a few long-lived connections rather than a burst of short
+// ones for every page load.
+//
+// Multiplexing sits above TLS (it's carried inside of the connections that
+// the protocol dials), so it only works when the client connects directly to
+// the server.  CDNs terminate TLS and can't pass multiplexed traffic.
+//
+// A client starts a session by sending PREFACE, after which both sides
+// exchange frames consisting of a 1 byte type, a 4 byte stream id and a 2 byte
+// payload length followed by the payload.  Streams are opened by the client
+// only.  Each stream has a receive window of STREAM_WINDOW bytes, which the
+// receiver replenishes with window frames as it reads, so that one slow
+// stream can't hold up the others.
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// PREFACE is sent by the client at the start of a session
+	PREFACE = "FLMUX/1\n"
+
+	// STREAM_WINDOW is how many bytes can be sent on a stream before the
+	// receiver has read them
+	STREAM_WINDOW = 256 * 1024
+
+	// MAX_PAYLOAD limits the size of data frames
+	MAX_PAYLOAD = 16 * 1024
+
+	// KEEPALIVE_INTERVAL is how often both sides ping each other
+	KEEPALIVE_INTERVAL = 30 * time.Second
+
+	// KEEPALIVE_TIMEOUT is how long a session may go without receiving
+	// anything before it's considered dead
+	KEEPALIVE_TIMEOUT = 3 * KEEPALIVE_INTERVAL
+
+	// WRITE_TIMEOUT limits how long writing a single frame may take
+	WRITE_TIMEOUT = 1 * time.Minute
+
+	// ACCEPT_BACKLOG is how many opened streams may wait to be accepted
+	ACCEPT_BACKLOG = 64
+
+	HEADER_LENGTH = 7
+)
+
+const (
+	FRAME_OPEN   = 1 // opens a stream
+	FRAME_DATA   = 2 // carries data for a stream
+	FRAME_WINDOW = 3 // grants the sender more of the stream's window (4 byte increment)
+	FRAME_CLOSE  = 4 // closes a stream
+	FRAME_PING   = 5 // keeps the session alive
+)
+
+// Session is a multiplexed connection
+type Session struct {
+	conn     net.Conn
+	isClient bool
+
+	streams  map[uint32]*Stream
+	nextId   uint32
+	accepted chan *Stream
+	mutex    sync.Mutex
+
+	writeMutex sync.Mutex
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Client starts a session over the given connection, from which streams are
+// opened with Open
+func Client(conn net.Conn) (*Session, error) {
+	conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	if _, err := conn.Write([]byte(PREFACE)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to start session: %s", err)
+	}
+	return newSession(conn, true), nil
+}
+
+// Server starts a session over the given connection (whose PREFACE has
+// already been read), whose streams are accepted with Accept
+func Server(conn net.Conn) *Session {
+	return newSession(conn, false)
+}
+
+func newSession(conn net.Conn, isClient bool) *Session {
+	s := &Session{
+		conn:     conn,
+		isClient: isClient,
+		streams:  make(map[uint32]*Stream),
+		nextId:   1,
+		accepted: make(chan *Stream, ACCEPT_BACKLOG),
+		closed:   make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.keepAlive()
+	return s
+}
+
+// Open opens a new stream
+func (s *Session) Open() (net.Conn, error) {
+	s.mutex.Lock()
+	if s.IsClosed() {
+		s.mutex.Unlock()
+		return nil, s.closedError()
+	}
+	id := s.nextId
+	s.nextId += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mutex.Unlock()
+	if err := s.writeFrame(FRAME_OPEN, id, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the client to open a stream
+func (s *Session) Accept() (net.Conn, error) {
+	select {
+	case stream := <-s.accepted:
+		return stream, nil
+	case <-s.closed:
+		return nil, s.closedError()
+	}
+}
+
+// NumStreams returns the number of open streams
+func (s *Session) NumStreams() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed determines whether the session has been closed, either explicitly
+// or because its connection failed
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the session, resetting all of its streams
+func (s *Session) Close() error {
+	s.fail(fmt.Errorf("Session closed"))
+	return nil
+}
+
+func (s *Session) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *Session) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+// fail closes the session because of the given error
+func (s *Session) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.mutex.Lock()
+		s.err = err
+		s.mutex.Unlock()
+		close(s.closed)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) closedError() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// writeFrame writes a single frame, failing the session if that doesn't work
+func (s *Session) writeFrame(frameType byte, id uint32, payload []byte) error {
+	frame := make([]byte, HEADER_LENGTH+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	copy(frame[HEADER_LENGTH:], payload)
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if s.IsClosed() {
+		return s.closedError()
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	if _, err := s.conn.Write(frame); err != nil {
+		err = fmt.Errorf("Unable to write to session: %s", err)
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop reads frames and dispatches them to their streams until the
+// session fails
+func (s *Session) readLoop() {
+	header := make([]byte, HEADER_LENGTH)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(KEEPALIVE_TIMEOUT))
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.fail(fmt.Errorf("Unable to read from session: %s", err))
+			return
+		}
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:])
+		payload := make([]byte, binary.BigEndian.Uint16(header[5:]))
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.fail(fmt.Errorf("Unable to read from session: %s", err))
+			return
+		}
+		if err := s.handleFrame(frameType, id, payload); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(frameType byte, id uint32, payload []byte) error {
+	if frameType == FRAME_PING {
+		return nil
+	}
+	s.mutex.Lock()
+	stream := s.streams[id]
+	if frameType == FRAME_OPEN {
+		if s.isClient || stream != nil || id%2 != 1 {
+			s.mutex.Unlock()
+			return fmt.Errorf("Unexpected open of stream %d", id)
+		}
+		stream = newStream(s, id)
+		s.streams[id] = stream
+	}
+	s.mutex.Unlock()
+	if stream == nil {
+		// Stream was already closed on both ends, drop whatever's left
+		return nil
+	}
+
+	switch frameType {
+	case FRAME_OPEN:
+		select {
+		case s.accepted <- stream:
+		case <-s.closed:
+		}
+	case FRAME_DATA:
+		return stream.received(payload)
+	case FRAME_WINDOW:
+		if len(payload) != 4 {
+			return fmt.Errorf("Bad window update for stream %d", id)
+		}
+		stream.granted(int(binary.BigEndian.Uint32(payload)))
+	case FRAME_CLOSE:
+		stream.remoteClosed()
+	default:
+		return fmt.Errorf("Unknown frame type %d", frameType)
+	}
+	return nil
+}
+
+// forget removes a stream that's closed on both ends
+func (s *Session) forget(id uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.streams, id)
+}
+
+// keepAlive pings the other side until the session is closed
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(KEEPALIVE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.writeFrame(FRAME_PING, 0, nil) != nil {
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echo accepts connections from l and echoes whatever they send
+func echo(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func TestStreams(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	l := &Listener{Listener: raw}
+	defer l.Close()
+	go echo(l)
+
+	dials := 0
+	pool := &Pool{
+		Size: 2,
+		Dial: func() (net.Conn, error) {
+			dials++
+			return net.Dial("tcp", raw.Addr().String())
+		},
+	}
+	// Bigger than the window, so that flow control kicks in
+	data := bytes.Repeat([]byte("hello "), STREAM_WINDOW/2)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		stream, err := pool.Open()
+		if err != nil {
+			t.Fatalf("Unable to open stream: %s", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stream.Close()
+			go stream.Write(data)
+			echoed := make([]byte, len(data))
+			if _, err := io.ReadFull(stream, echoed); err != nil {
+				t.Errorf("Unable to read echo: %s", err)
+				return
+			}
+			if !bytes.Equal(echoed, data) {
+				t.Error("Echoed data doesn't match")
+			}
+		}()
+	}
+	wg.Wait()
+	if dials != 2 {
+		t.Errorf("Expected streams to share 2 connections, dialed %d", dials)
+	}
+}
+
+func TestRegularConnsPassThrough(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	l := &Listener{Listener: raw}
+	defer l.Close()
+	go echo(l)
+
+	conn, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	defer conn.Close()
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	conn.Write(request)
+	echoed := make([]byte, len(request))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatalf("Unable to read echo: %s", err)
+	}
+	if !bytes.Equal(echoed, request) {
+		t.Errorf("Unexpected echo %q", echoed)
+	}
+}
+
+func TestCloseAndDeadlines(t *testing.T) {
+	session, accepting, err := startPipe()
+	if err != nil {
+		t.Fatalf("Unable to start session: %s", err)
+	}
+
+	stream, _ := session.Open()
+	accepted, err := accepting.Accept()
+	if err != nil {
+		t.Fatalf("Unable to accept: %s", err)
+	}
+	stream.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := stream.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+
+	accepted.Write([]byte("bye"))
+	accepted.Close()
+	stream.SetReadDeadline(time.Time{})
+	if data, err := ioutil.ReadAll(stream); err != nil || string(data) != "bye" {
+		t.Errorf("Expected data followed by EOF, got %q, %v", data, err)
+	}
+	stream.Close()
+	time.Sleep(10 * time.Millisecond)
+	if n := session.NumStreams(); n != 0 {
+		t.Errorf("Closed stream wasn't forgotten, %d streams", n)
+	}
+
+	another, _ := session.Open()
+	accepting.Close()
+	if _, err := another.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("Expected reset when session closes, got %v", err)
+	}
+}
+
+// startPipe starts a session over a net.Pipe, which (being unbuffered) needs
+// the preface to be read while the client sends it
+func startPipe() (*Session, *Session, error) {
+	client, server := net.Pipe()
+	go io.ReadFull(server, make([]byte, len(PREFACE)))
+	session, err := Client(client)
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, Server(server), nil
+}
@@ -0,0 +1,77 @@
+package mux
+
+import (
+	"net"
+	"sync"
+)
+
+// Pool opens streams on a fixed number of persistent sessions, spreading
+// them round-robin and redialing sessions that have failed
+type Pool struct {
+	Dial func() (net.Conn, error) // dials the connection over which a session runs
+	Size int                      // how many sessions to keep
+
+	slots []*slot
+	next  int
+	mutex sync.Mutex
+}
+
+// slot holds one of the Pool's sessions
+type slot struct {
+	session *Session
+	mutex   sync.Mutex
+}
+
+// Open opens a stream on the next of the Pool's sessions, dialing it if
+// necessary
+func (pool *Pool) Open() (net.Conn, error) {
+	pool.mutex.Lock()
+	if pool.slots == nil {
+		size := pool.Size
+		if size < 1 {
+			size = 1
+		}
+		pool.slots = make([]*slot, size)
+		for i := range pool.slots {
+			pool.slots[i] = &slot{}
+		}
+	}
+	s := pool.slots[pool.next%len(pool.slots)]
+	pool.next++
+	pool.mutex.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.session != nil && !s.session.IsClosed() {
+		stream, err := s.session.Open()
+		if err == nil {
+			return stream, nil
+		}
+	}
+	conn, err := pool.Dial()
+	if err != nil {
+		return nil, err
+	}
+	session, err := Client(conn)
+	if err != nil {
+		return nil, err
+	}
+	s.session = session
+	return session.Open()
+}
+
+// NumSessions returns the number of live sessions
+func (pool *Pool) NumSessions() int {
+	pool.mutex.Lock()
+	slots := pool.slots
+	pool.mutex.Unlock()
+	live := 0
+	for _, s := range slots {
+		s.mutex.Lock()
+		if s.session != nil && !s.session.IsClosed() {
+			live++
+		}
+		s.mutex.Unlock()
+	}
+	return live
+}
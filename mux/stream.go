@@ -0,0 +1,228 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is a single stream within a Session, which behaves like a net.Conn
+type Stream struct {
+	session *Session
+	id      uint32
+
+	readable      chan struct{} // signaled when there's something to read or the read deadline changed
+	buffer        bytes.Buffer  // data received but not yet read
+	unacked       int           // bytes read but not yet granted back to the sender
+	readDeadline  time.Time
+	writable      chan struct{} // signaled when there's more window or the write deadline changed
+	window        int           // bytes that may still be sent
+	writeDeadline time.Time
+	closedLocally bool
+	closedRemote  bool
+	mutex         sync.Mutex
+
+	writeMutex sync.Mutex
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		session:  session,
+		id:       id,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		window:   STREAM_WINDOW,
+	}
+}
+
+func (stream *Stream) Read(b []byte) (int, error) {
+	for {
+		stream.mutex.Lock()
+		if stream.closedLocally {
+			stream.mutex.Unlock()
+			return 0, fmt.Errorf("Read on closed stream")
+		}
+		if stream.buffer.Len() > 0 {
+			n, _ := stream.buffer.Read(b)
+			stream.unacked += n
+			var grant int
+			if stream.unacked >= STREAM_WINDOW/2 && !stream.closedRemote {
+				grant = stream.unacked
+				stream.unacked = 0
+			}
+			stream.mutex.Unlock()
+			if grant > 0 {
+				increment := make([]byte, 4)
+				binary.BigEndian.PutUint32(increment, uint32(grant))
+				stream.session.writeFrame(FRAME_WINDOW, stream.id, increment)
+			}
+			return n, nil
+		}
+		if stream.closedRemote {
+			stream.mutex.Unlock()
+			return 0, io.EOF
+		}
+		deadline := stream.readDeadline
+		stream.mutex.Unlock()
+		if err := stream.wait(stream.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (stream *Stream) Write(b []byte) (int, error) {
+	stream.writeMutex.Lock()
+	defer stream.writeMutex.Unlock()
+	written := 0
+	for written < len(b) {
+		stream.mutex.Lock()
+		if stream.closedLocally || stream.closedRemote {
+			stream.mutex.Unlock()
+			return written, fmt.Errorf("Write on closed stream")
+		}
+		n := stream.window
+		deadline := stream.writeDeadline
+		if n > MAX_PAYLOAD {
+			n = MAX_PAYLOAD
+		}
+		if n > len(b)-written {
+			n = len(b) - written
+		}
+		stream.window -= n
+		stream.mutex.Unlock()
+		if n == 0 {
+			if err := stream.wait(stream.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if err := stream.session.writeFrame(FRAME_DATA, stream.id, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes the stream in both directions
+func (stream *Stream) Close() error {
+	stream.mutex.Lock()
+	if stream.closedLocally {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.closedLocally = true
+	done := stream.closedRemote
+	stream.buffer.Reset()
+	stream.mutex.Unlock()
+	signal(stream.readable)
+	signal(stream.writable)
+	if done {
+		stream.session.forget(stream.id)
+	}
+	return stream.session.writeFrame(FRAME_CLOSE, stream.id, nil)
+}
+
+func (stream *Stream) LocalAddr() net.Addr  { return stream.session.LocalAddr() }
+func (stream *Stream) RemoteAddr() net.Addr { return stream.session.RemoteAddr() }
+
+func (stream *Stream) SetDeadline(t time.Time) error {
+	stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+func (stream *Stream) SetReadDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.readDeadline = t
+	stream.mutex.Unlock()
+	signal(stream.readable)
+	return nil
+}
+
+func (stream *Stream) SetWriteDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.writeDeadline = t
+	stream.mutex.Unlock()
+	signal(stream.writable)
+	return nil
+}
+
+// received buffers data that arrived for the stream
+func (stream *Stream) received(data []byte) error {
+	stream.mutex.Lock()
+	if stream.closedLocally {
+		// Nobody's going to read it
+		stream.mutex.Unlock()
+		return nil
+	}
+	if stream.buffer.Len()+stream.unacked+len(data) > STREAM_WINDOW {
+		stream.mutex.Unlock()
+		return fmt.Errorf("Stream %d exceeded its window", stream.id)
+	}
+	stream.buffer.Write(data)
+	stream.mutex.Unlock()
+	signal(stream.readable)
+	return nil
+}
+
+// granted adds to the stream's window
+func (stream *Stream) granted(increment int) {
+	stream.mutex.Lock()
+	stream.window += increment
+	stream.mutex.Unlock()
+	signal(stream.writable)
+}
+
+// remoteClosed handles the other side closing the stream
+func (stream *Stream) remoteClosed() {
+	stream.mutex.Lock()
+	stream.closedRemote = true
+	done := stream.closedLocally
+	stream.mutex.Unlock()
+	signal(stream.readable)
+	signal(stream.writable)
+	if done {
+		stream.session.forget(stream.id)
+	}
+}
+
+// wait waits for the given signal, the deadline or the session to close
+func (stream *Stream) wait(signaled chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return &timeoutError{}
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-signaled:
+		return nil
+	case <-timeout:
+		return &timeoutError{}
+	case <-stream.session.closed:
+		return stream.session.closedError()
+	}
+}
+
+// signal signals the given channel without blocking
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// timeoutError is returned by reads and writes that hit their deadline
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
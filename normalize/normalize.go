@@ -0,0 +1,147 @@
+// package normalize makes requests on the fronted leg look like the requests
+// that a real browser sends to the masquerade site, using header templates
+// that are distributed as signed files.
+//
+// Note - Go's HTTP client writes headers in canonical case and in a fixed
+// order, so only header values (not order or casing) can be normalized.
+package normalize
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+var (
+	checkInterval = 1 * time.Minute
+
+	// Headers that we never set from a template because they change how the
+	// response is encoded, which the tunnel doesn't handle.
+	ignoredHeaders = map[string]bool{
+		"Accept-Encoding": true,
+	}
+)
+
+// Template is the set of headers to send on the fronted leg
+type Template struct {
+	Headers map[string]string `json:"headers"`
+}
+
+// Normalizer applies the headers from a signed Template file to requests
+type Normalizer struct {
+	File      string // template file (JSON), its signature is expected in File + ".sig"
+	PublicKey string // PEM encoded ECDSA public key with which templates are signed
+
+	template *Template
+	modTime  time.Time
+	mutex    sync.RWMutex
+}
+
+// Start loads the template and keeps checking for updates in the background.
+func (normalizer *Normalizer) Start() error {
+	if err := normalizer.load(); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			time.Sleep(checkInterval)
+			if err := normalizer.load(); err != nil {
+				log.Errorf("Unable to reload header template, keeping current one: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Apply sets the template's headers on the given request
+func (normalizer *Normalizer) Apply(req *http.Request) {
+	normalizer.mutex.RLock()
+	template := normalizer.template
+	normalizer.mutex.RUnlock()
+	if template == nil {
+		return
+	}
+	for key, value := range template.Headers {
+		if !ignoredHeaders[http.CanonicalHeaderKey(key)] {
+			req.Header.Set(key, value)
+		}
+	}
+}
+
+// load loads the template if it changed since we last loaded it
+func (normalizer *Normalizer) load() error {
+	info, err := os.Stat(normalizer.File)
+	if err != nil {
+		return fmt.Errorf("Unable to stat header template: %s", err)
+	}
+	if info.ModTime().Equal(normalizer.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(normalizer.File)
+	if err != nil {
+		return fmt.Errorf("Unable to read header template: %s", err)
+	}
+	sig, err := ioutil.ReadFile(normalizer.File + ".sig")
+	if err != nil {
+		return fmt.Errorf("Unable to read header template signature: %s", err)
+	}
+	if err := Verify([]byte(normalizer.PublicKey), data, strings.TrimSpace(string(sig))); err != nil {
+		return err
+	}
+	template := &Template{}
+	if err := json.Unmarshal(data, template); err != nil {
+		return fmt.Errorf("Unable to parse header template: %s", err)
+	}
+	normalizer.mutex.Lock()
+	normalizer.template = template
+	normalizer.modTime = info.ModTime()
+	normalizer.mutex.Unlock()
+	log.Debugf("Loaded header template with %d headers", len(template.Headers))
+	return nil
+}
+
+// Verify verifies that sig (a base64 encoded, ASN.1 ECDSA signature over the
+// SHA-256 of data) was made by the holder of the given PEM encoded public key.
+func Verify(publicKeyPEM []byte, data []byte, sig string) error {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return fmt.Errorf("Unable to decode public key PEM")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("Unable to parse public key: %s", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Public key is not an ECDSA key")
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("Unable to decode signature: %s", err)
+	}
+	var parsed struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(rawSig, &parsed); err != nil {
+		return fmt.Errorf("Unable to parse signature: %s", err)
+	}
+	hash := sha256.Sum256(data)
+	if !ecdsa.Verify(ecKey, hash[:], parsed.R, parsed.S) {
+		return fmt.Errorf("Invalid signature")
+	}
+	return nil
+}
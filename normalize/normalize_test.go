@@ -0,0 +1,45 @@
+package normalize
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Unable to marshal public key: %s", err)
+	}
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	data := []byte(`{"headers": {"User-Agent": "Mozilla/5.0"}}`)
+	hash := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("Unable to sign: %s", err)
+	}
+	rawSig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatalf("Unable to marshal signature: %s", err)
+	}
+	sig := base64.StdEncoding.EncodeToString(rawSig)
+
+	if err := Verify(publicKeyPEM, data, sig); err != nil {
+		t.Errorf("Valid signature failed to verify: %s", err)
+	}
+	if err := Verify(publicKeyPEM, []byte(`{"headers": {}}`), sig); err == nil {
+		t.Error("Signature over different data should not verify")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/notices"
+)
+
+const (
+	NOTICE_USAGE = `Usage:
+  flashlight notice [-noticeexpiry 168h] add <message>  queue a notice for the server's clients
+  flashlight notice list                                list the current notices
+  flashlight notice remove <id>                         remove a notice
+
+Notices are kept in notices.json in the server's configdir.  Clients fetch them
+every 30 minutes and show them in their status.`
+)
+
+// runNotice runs the notice subcommand, which manages the notices that the
+// server (using the same configdir) serves to its clients
+func runNotice() {
+	if len(subcommandArgs) == 0 {
+		noticeUsage()
+	}
+	filename := inConfigDir("notices.json")
+	current, err := notices.ReadFile(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	current = notices.Current(current, time.Now())
+
+	switch subcommandArgs[0] {
+	case "add":
+		if len(subcommandArgs) < 2 {
+			noticeUsage()
+		}
+		notice, err := notices.New(strings.Join(subcommandArgs[1:], " "), *noticeExpiry)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := notices.WriteFile(filename, append(current, notice)); err != nil {
+			log.Fatalf("Unable to save notice: %s", err)
+		}
+		fmt.Printf("Queued notice %s\n", notice.Id)
+	case "list":
+		for _, notice := range current {
+			expires := "never"
+			if !notice.Expires.IsZero() {
+				expires = notice.Expires.Format(time.RFC3339)
+			}
+			fmt.Printf("%s  %s (expires %s)\n", notice.Id, notice.Message, expires)
+		}
+	case "remove":
+		if len(subcommandArgs) != 2 {
+			noticeUsage()
+		}
+		remaining, found := notices.Remove(current, subcommandArgs[1])
+		if !found {
+			log.Fatalf("No notice with id %s", subcommandArgs[1])
+		}
+		if err := notices.WriteFile(filename, remaining); err != nil {
+			log.Fatalf("Unable to save notices: %s", err)
+		}
+	default:
+		noticeUsage()
+	}
+}
+
+func noticeUsage() {
+	fmt.Fprintf(os.Stderr, "%s\n", NOTICE_USAGE)
+	os.Exit(1)
+}
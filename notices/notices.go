@@ -0,0 +1,110 @@
+// package notices holds short notices (e.g. about maintenance windows or new
+// server addresses) that server operators queue for their users.  The server
+// keeps them in a file, from which it serves the current ones to clients,
+// which surface them in their status.
+package notices
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/getlantern/flashlight/atomicfile"
+)
+
+const (
+	// MAX_MESSAGE_LENGTH keeps notices short
+	MAX_MESSAGE_LENGTH = 500
+)
+
+// Notice is a notice to the users of a server
+type Notice struct {
+	Id      string    `json:"id"`
+	Message string    `json:"message"`
+	Posted  time.Time `json:"posted"`
+	Expires time.Time `json:"expires"` // zero if the notice doesn't expire
+}
+
+// New creates a notice with a random id, which expires after the given
+// duration (or never, if it's 0)
+func New(message string, expiresIn time.Duration) (*Notice, error) {
+	if message == "" {
+		return nil, fmt.Errorf("Notice is empty")
+	}
+	if len(message) > MAX_MESSAGE_LENGTH {
+		return nil, fmt.Errorf("Notice is longer than %d characters", MAX_MESSAGE_LENGTH)
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("Unable to generate id: %s", err)
+	}
+	notice := &Notice{
+		Id:      hex.EncodeToString(b),
+		Message: message,
+		Posted:  time.Now().UTC(),
+	}
+	if expiresIn > 0 {
+		notice.Expires = notice.Posted.Add(expiresIn)
+	}
+	return notice, nil
+}
+
+// Expired determines whether the notice has expired at the given time
+func (notice *Notice) Expired(now time.Time) bool {
+	return !notice.Expires.IsZero() && now.After(notice.Expires)
+}
+
+// Current returns the notices that haven't expired at the given time
+func Current(notices []*Notice, now time.Time) []*Notice {
+	var current []*Notice
+	for _, notice := range notices {
+		if !notice.Expired(now) {
+			current = append(current, notice)
+		}
+	}
+	return current
+}
+
+// ReadFile reads the notices from the given file, which may not exist yet
+func ReadFile(filename string) ([]*Notice, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read notices: %s", err)
+	}
+	var notices []*Notice
+	if err := json.Unmarshal(data, &notices); err != nil {
+		return nil, fmt.Errorf("Unable to parse notices in %s: %s", filename, err)
+	}
+	return notices, nil
+}
+
+// WriteFile writes the notices to the given file, dropping expired ones
+func WriteFile(filename string, notices []*Notice) error {
+	data, err := json.MarshalIndent(Current(notices, time.Now()), "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to marshal notices: %s", err)
+	}
+	return atomicfile.WriteFile(filename, data, 0644)
+}
+
+// Remove removes the notice with the given id, returning false if there's no
+// such notice
+func Remove(notices []*Notice, id string) ([]*Notice, bool) {
+	var remaining []*Notice
+	found := false
+	for _, notice := range notices {
+		if notice.Id == id {
+			found = true
+		} else {
+			remaining = append(remaining, notice)
+		}
+	}
+	return remaining, found
+}
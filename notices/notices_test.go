@@ -0,0 +1,66 @@
+package notices
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notices")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "notices.json")
+
+	notices, err := ReadFile(filename)
+	if err != nil || len(notices) != 0 {
+		t.Fatalf("Missing file should mean no notices, got %v: %s", notices, err)
+	}
+	maintenance, err := New("Maintenance on Sunday", time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to create notice: %s", err)
+	}
+	forever, _ := New("New server address: example.com", 0)
+	expired := &Notice{Id: "old", Message: "Old news", Expires: time.Now().Add(-time.Minute)}
+	if err := WriteFile(filename, []*Notice{maintenance, forever, expired}); err != nil {
+		t.Fatalf("Unable to write notices: %s", err)
+	}
+	notices, err = ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Unable to read notices: %s", err)
+	}
+	if len(notices) != 2 || notices[0].Message != maintenance.Message || notices[1].Id != forever.Id {
+		t.Errorf("Expected the unexpired notices, got %v", notices)
+	}
+
+	notices, found := Remove(notices, maintenance.Id)
+	if !found || len(notices) != 1 || notices[0].Id != forever.Id {
+		t.Errorf("Notice not removed, got %v", notices)
+	}
+	if _, found := Remove(notices, "nope"); found {
+		t.Error("Unknown notice shouldn't be found")
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	notice, _ := New("Maintenance on Sunday", time.Hour)
+	if len(Current([]*Notice{notice}, time.Now())) != 1 {
+		t.Error("Notice should be current")
+	}
+	if len(Current([]*Notice{notice}, time.Now().Add(2*time.Hour))) != 0 {
+		t.Error("Notice should have expired")
+	}
+}
+
+func TestTooLong(t *testing.T) {
+	if _, err := New(string(make([]byte, MAX_MESSAGE_LENGTH+1)), 0); err == nil {
+		t.Error("Overly long notice should be refused")
+	}
+	if _, err := New("", 0); err == nil {
+		t.Error("Empty notice should be refused")
+	}
+}
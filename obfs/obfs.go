@@ -0,0 +1,349 @@
+// package obfs obfuscates connections between the client and the server so
+// that, to an observer, they look like uniformly random bytes in randomly
+// sized chunks.  It's modeled on obfs4: there's no plaintext handshake, all
+// framing is encrypted and every frame is padded to a random length, so
+// neither the outer TLS handshake nor the sizes of the TLS records tunneled
+// inside it (the telltale TLS-in-TLS pattern) are visible.
+//
+// Obfuscation sits beneath TLS, so it can be layered under any protocol (see
+// protocol.Config.DialTCP), but only when the client connects directly to
+// the server.  CDNs can't pass obfuscated traffic.
+//
+// A client starts by sending a random nonce, from which both sides derive
+// per-direction keys using the shared key.  After that, each frame consists
+// of a 2 byte length (masked with an AES-CTR keystream) followed by the
+// AES-GCM sealed payload length, payload and padding.
+package obfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	NONCE_LENGTH = 32
+
+	// MAX_FRAME_LENGTH is the largest frame (excluding its masked length),
+	// chosen so that frames fit in a typical TCP segment
+	MAX_FRAME_LENGTH = 1400
+
+	// HANDSHAKE_TIMEOUT is how long the server waits for the client's nonce and
+	// first frame (unless the caller's read deadline comes first)
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+
+	lengthLength = 2
+	tagLength    = 16
+
+	// overhead is what a frame takes beyond its payload and padding: the
+	// sealed payload length and the tag
+	overhead = lengthLength + tagLength
+)
+
+var (
+	clientToServer = []byte("client to server")
+	serverToClient = []byte("server to client")
+)
+
+// Client wraps a connection to the server in obfuscation with the given key
+func Client(conn net.Conn, key []byte) (net.Conn, error) {
+	nonce := make([]byte, NONCE_LENGTH)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	c := &Conn{Conn: conn, key: key, isClient: true}
+	if err := c.init(nonce); err != nil {
+		return nil, err
+	}
+	// The nonce goes out with the first frame
+	c.unsentNonce = nonce
+	c.handshakeOnce.Do(func() {})
+	return c, nil
+}
+
+// Server wraps a connection accepted from a client in obfuscation with the
+// given key.  The client's nonce is read on the first Read or Write.
+func Server(conn net.Conn, key []byte) net.Conn {
+	return &Conn{Conn: conn, key: key}
+}
+
+// Listener is a net.Listener that obfuscates the connections it accepts
+type Listener struct {
+	net.Listener
+	Key []byte // the shared key
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, l.Key), nil
+}
+
+// Conn is an obfuscated net.Conn
+type Conn struct {
+	net.Conn
+	key      []byte
+	isClient bool
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+	unsentNonce   []byte
+
+	writer      *framer
+	writeMutex  sync.Mutex
+	reader      *framer
+	readMutex   sync.Mutex
+	unread      []byte
+	readFrames  int
+	frameBuffer []byte
+
+	readDeadline      time.Time // set by the caller
+	handshakeDeadline time.Time // applies until the server has read the first frame
+	deadlineMutex     sync.Mutex
+}
+
+// framer seals or opens the frames in one direction
+type framer struct {
+	aead       cipher.AEAD
+	lengthMask cipher.Stream
+	counter    uint64
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	for len(c.unread) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	out := c.unsentNonce
+	c.unsentNonce = nil
+	written := 0
+	for written < len(p) {
+		frameLength, err := randomInt(overhead+1, MAX_FRAME_LENGTH)
+		if err != nil {
+			return written, err
+		}
+		payloadLength := frameLength - overhead
+		if payloadLength > len(p)-written {
+			payloadLength = len(p) - written
+		}
+		out = c.writer.seal(out, p[written:written+payloadLength], frameLength)
+		written += payloadLength
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+// handshake reads the client's nonce on the server side
+func (c *Conn) handshake() error {
+	c.handshakeOnce.Do(func() {
+		nonce := make([]byte, NONCE_LENGTH)
+		c.setHandshakeDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+		_, err := io.ReadFull(c.Conn, nonce)
+		if err != nil {
+			c.handshakeErr = fmt.Errorf("Unable to read nonce: %s", err)
+			return
+		}
+		c.handshakeErr = c.init(nonce)
+	})
+	return c.handshakeErr
+}
+
+// init derives the keys for both directions from the nonce
+func (c *Conn) init(nonce []byte) error {
+	var err error
+	outbound, inbound := clientToServer, serverToClient
+	if !c.isClient {
+		outbound, inbound = inbound, outbound
+	}
+	c.writer, err = newFramer(c.key, nonce, outbound)
+	if err != nil {
+		return err
+	}
+	c.reader, err = newFramer(c.key, nonce, inbound)
+	return err
+}
+
+// readFrame reads the next frame, leaving its payload in unread.  If the very
+// first frame can't be authenticated, the connection most likely comes from
+// a probe (or a client with the wrong key), which is kept waiting for a
+// random delay so that the failure can't be timed.
+func (c *Conn) readFrame() error {
+	masked := make([]byte, lengthLength)
+	if _, err := io.ReadFull(c.Conn, masked); err != nil {
+		return err
+	}
+	frameLength := c.reader.unmaskLength(masked)
+	if frameLength < overhead || frameLength > MAX_FRAME_LENGTH {
+		return c.rejected(fmt.Errorf("Invalid frame length %d", frameLength))
+	}
+	if c.frameBuffer == nil {
+		c.frameBuffer = make([]byte, MAX_FRAME_LENGTH)
+	}
+	frame := c.frameBuffer[:frameLength]
+	if _, err := io.ReadFull(c.Conn, frame); err != nil {
+		return err
+	}
+	payload, err := c.reader.open(frame)
+	if err != nil {
+		return c.rejected(err)
+	}
+	c.readFrames += 1
+	c.unread = payload
+	if c.readFrames == 1 && !c.isClient {
+		// Authenticated, back to the caller's deadline
+		c.setHandshakeDeadline(time.Time{})
+	}
+	return nil
+}
+
+// SetDeadline is like net.Conn's, remembering the read deadline so that the
+// handshake doesn't lose it
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline is like net.Conn's, except that the handshake deadline
+// applies until the handshake is done, if it comes first
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.readDeadline = t
+	return c.applyReadDeadline()
+}
+
+func (c *Conn) setHandshakeDeadline(t time.Time) {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.handshakeDeadline = t
+	c.applyReadDeadline()
+}
+
+// applyReadDeadline sets the earlier of the caller's deadline and the
+// handshake deadline on the underlying connection.  Must be called while
+// holding the deadlineMutex.
+func (c *Conn) applyReadDeadline() error {
+	deadline := c.readDeadline
+	if !c.handshakeDeadline.IsZero() && (deadline.IsZero() || c.handshakeDeadline.Before(deadline)) {
+		deadline = c.handshakeDeadline
+	}
+	return c.Conn.SetReadDeadline(deadline)
+}
+
+func (c *Conn) rejected(err error) error {
+	if c.readFrames == 0 && !c.isClient {
+		log.Debugf("Rejecting connection from %s: %s", c.RemoteAddr(), err)
+		delay, _ := rand.Int(rand.Reader, big.NewInt(int64(HANDSHAKE_TIMEOUT)))
+		time.Sleep(time.Duration(delay.Int64()))
+	}
+	c.Conn.Close()
+	return err
+}
+
+func newFramer(key []byte, nonce []byte, direction []byte) (*framer, error) {
+	block, err := aes.NewCipher(deriveKey(key, nonce, direction, "frames"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create cipher: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create GCM: %s", err)
+	}
+	lengthBlock, err := aes.NewCipher(deriveKey(key, nonce, direction, "lengths"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create cipher: %s", err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	return &framer{aead: aead, lengthMask: cipher.NewCTR(lengthBlock, iv)}, nil
+}
+
+// seal appends a frame carrying payload to out, padded so that the sealed
+// frame is frameLength long
+func (f *framer) seal(out []byte, payload []byte, frameLength int) []byte {
+	masked := make([]byte, lengthLength)
+	binary.BigEndian.PutUint16(masked, uint16(frameLength))
+	f.lengthMask.XORKeyStream(masked, masked)
+	out = append(out, masked...)
+
+	plaintext := make([]byte, frameLength-tagLength)
+	binary.BigEndian.PutUint16(plaintext, uint16(len(payload)))
+	copy(plaintext[lengthLength:], payload)
+	return f.aead.Seal(out, f.nextNonce(), plaintext, nil)
+}
+
+func (f *framer) unmaskLength(masked []byte) int {
+	f.lengthMask.XORKeyStream(masked, masked)
+	return int(binary.BigEndian.Uint16(masked))
+}
+
+// open authenticates and decrypts a frame (without its length), returning the
+// payload
+func (f *framer) open(frame []byte) ([]byte, error) {
+	plaintext, err := f.aead.Open(frame[:0], f.nextNonce(), frame, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to authenticate frame: %s", err)
+	}
+	payloadLength := int(binary.BigEndian.Uint16(plaintext))
+	if payloadLength > len(plaintext)-lengthLength {
+		return nil, fmt.Errorf("Invalid payload length %d", payloadLength)
+	}
+	return plaintext[lengthLength : lengthLength+payloadLength], nil
+}
+
+func (f *framer) nextNonce() []byte {
+	nonce := make([]byte, f.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], f.counter)
+	f.counter += 1
+	return nonce
+}
+
+func deriveKey(key []byte, nonce []byte, direction []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(nonce)
+	h.Write(direction)
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+// randomInt returns a random int in [min, max]
+func randomInt(min int, max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min+1)))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to generate random number: %s", err)
+	}
+	return min + int(n.Int64()), nil
+}
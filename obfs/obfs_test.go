@@ -0,0 +1,109 @@
+package obfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	l := &Listener{Listener: raw, Key: []byte("s3cret")}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// Echo
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	obfuscated, err := Client(conn, []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("Unable to obfuscate: %s", err)
+	}
+	defer obfuscated.Close()
+	// Bigger than a frame, so that it's split
+	data := bytes.Repeat([]byte("hello "), 2000)
+	go obfuscated.Write(data)
+	echoed := make([]byte, len(data))
+	if _, err := io.ReadFull(obfuscated, echoed); err != nil {
+		t.Fatalf("Unable to read echo: %s", err)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Error("Echoed data doesn't match")
+	}
+}
+
+func TestFramesHidePayload(t *testing.T) {
+	client, server := net.Pipe()
+	obfuscated, err := Client(client, []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("Unable to obfuscate: %s", err)
+	}
+	go func() {
+		obfuscated.Write([]byte("hello"))
+		client.Close()
+	}()
+	wire, _ := ioutil.ReadAll(server)
+	if bytes.Contains(wire, []byte("hello")) {
+		t.Error("Payload visible on the wire")
+	}
+	if len(wire) < NONCE_LENGTH+lengthLength+overhead+len("hello") {
+		t.Errorf("Frame too short: %d bytes", len(wire))
+	}
+}
+
+func TestWrongKeyRejected(t *testing.T) {
+	client, server := net.Pipe()
+	obfuscated, err := Client(client, []byte("wrong"))
+	if err != nil {
+		t.Fatalf("Unable to obfuscate: %s", err)
+	}
+	go func() {
+		obfuscated.Write([]byte("hello"))
+		// Whatever length the server decodes, it won't wait for more
+		client.Close()
+	}()
+	s := Server(server, []byte("s3cret")).(*Conn)
+	// Don't wait for the anti-probing delay
+	s.readFrames = 1
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := s.Read(make([]byte, 10)); err == nil {
+		t.Error("Frame with wrong key accepted")
+	}
+}
+
+func TestReadDeadlineKept(t *testing.T) {
+	client, server := net.Pipe()
+	obfuscated, err := Client(client, []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("Unable to obfuscate: %s", err)
+	}
+	go obfuscated.Write([]byte("hello"))
+	s := Server(server, []byte("s3cret"))
+	s.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := s.Read(make([]byte, 10)); err != nil {
+		t.Fatalf("Unable to read: %s", err)
+	}
+	// Nothing more is coming, so the caller's deadline has to end this
+	start := time.Now()
+	if _, err := s.Read(make([]byte, 10)); err == nil {
+		t.Error("Expected read to time out")
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 2*time.Second {
+		t.Errorf("Caller's deadline was lost, read took %s", elapsed)
+	}
+}
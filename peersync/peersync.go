@@ -0,0 +1,169 @@
+// package peersync keeps the soft state of a pair of servers, an active server
+// and its warm standby, in sync.  Each server periodically posts its state to
+// its peer, which merges it and answers with its own state, so that whichever
+// server takes over after a failover (e.g. via DNS or a load balancer) knows
+// about guests' usage and used nonces.
+//
+// Messages are signed with a key shared by the pair.  They aren't encrypted,
+// so the servers should sync over a private network.
+package peersync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/flashlight/auth"
+	"github.com/getlantern/flashlight/hotrestart"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	SIGNATURE_HEADER = "X-Flashlight-Sync-Signature"
+	SYNC_PATH        = "/sync"
+
+	DEFAULT_INTERVAL = 10 * time.Second
+
+	// MAX_STATE_BYTES bounds the size of the state accepted from a peer
+	MAX_STATE_BYTES = 256 * 1024 * 1024
+)
+
+// Syncer syncs State with a peer
+type Syncer struct {
+	Addr       string        // (optional) address at which to accept the peer's state, e.g. 10.0.0.1:7000
+	Peer       string        // (optional) host:port of the peer's Addr, to which to post our state
+	Key        []byte        // key shared by both servers, with which messages are signed
+	Interval   time.Duration // (optional) time between syncs, defaults to DEFAULT_INTERVAL
+	State      auth.Stateful // the state to sync
+	HTTPClient *http.Client  // (optional) client with which to post, defaults to http.DefaultClient
+}
+
+// Start starts accepting the peer's state at Addr (if set) and posting our
+// state to Peer (if set).
+func (syncer *Syncer) Start() error {
+	if syncer.Addr != "" {
+		l, err := hotrestart.Listen("tcp", syncer.Addr)
+		if err != nil {
+			return fmt.Errorf("Unable to listen for peer sync at %s: %s", syncer.Addr, err)
+		}
+		log.Debugf("Accepting peer sync at %s", syncer.Addr)
+		mux := http.NewServeMux()
+		mux.Handle(SYNC_PATH, syncer)
+		go func() {
+			if err := http.Serve(l, mux); err != nil {
+				log.Errorf("Unable to serve peer sync: %s", err)
+			}
+		}()
+	}
+	if syncer.Peer != "" {
+		go syncer.syncPeriodically()
+	}
+	return nil
+}
+
+func (syncer *Syncer) syncPeriodically() {
+	interval := syncer.Interval
+	if interval == 0 {
+		interval = DEFAULT_INTERVAL
+	}
+	for {
+		time.Sleep(interval)
+		if err := syncer.sync(); err != nil {
+			log.Errorf("Unable to sync with peer %s: %s", syncer.Peer, err)
+		}
+	}
+}
+
+// sync posts our state to the peer and merges the state it answers with
+func (syncer *Syncer) sync() error {
+	body, err := syncer.export()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "http://"+syncer.Peer+SYNC_PATH, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SIGNATURE_HEADER, syncer.sign(body))
+	httpClient := syncer.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response status: %d", resp.StatusCode)
+	}
+	return syncer.merge(resp.Header.Get(SIGNATURE_HEADER), resp.Body)
+}
+
+// ServeHTTP merges the state posted by the peer and answers with our own
+func (syncer *Syncer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := syncer.merge(req.Header.Get(SIGNATURE_HEADER), req.Body); err != nil {
+		log.Errorf("Rejecting peer sync from %s: %s", req.RemoteAddr, err)
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, err := syncer.export()
+	if err != nil {
+		log.Error(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set(SIGNATURE_HEADER, syncer.sign(body))
+	resp.Write(body)
+}
+
+func (syncer *Syncer) export() ([]byte, error) {
+	state := &auth.State{}
+	syncer.State.AddState(state)
+	body, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to marshal state: %s", err)
+	}
+	return body, nil
+}
+
+// merge verifies the signature of the state read from r and merges it
+func (syncer *Syncer) merge(signature string, r io.Reader) error {
+	body, err := ioutil.ReadAll(io.LimitReader(r, MAX_STATE_BYTES))
+	if err != nil {
+		return fmt.Errorf("Unable to read state: %s", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, syncer.mac(body)) {
+		return fmt.Errorf("Invalid signature")
+	}
+	state := &auth.State{}
+	if err := json.Unmarshal(body, state); err != nil {
+		return fmt.Errorf("Unable to parse state: %s", err)
+	}
+	syncer.State.MergeState(state)
+	return nil
+}
+
+func (syncer *Syncer) sign(body []byte) string {
+	return base64.StdEncoding.EncodeToString(syncer.mac(body))
+}
+
+func (syncer *Syncer) mac(body []byte) []byte {
+	mac := hmac.New(sha256.New, syncer.Key)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,61 @@
+package peersync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/flashlight/auth"
+)
+
+func TestSync(t *testing.T) {
+	key := []byte("s3cret")
+	activeGuests := &auth.GuestAuthority{Key: key}
+	standbyGuests := &auth.GuestAuthority{Key: key}
+	activeGuests.MergeState(&auth.State{GuestUsage: map[string]int64{"friend": 1000, "other": 10}})
+	standbyGuests.MergeState(&auth.State{GuestUsage: map[string]int64{"other": 50}})
+
+	standby := &Syncer{Key: key, State: standbyGuests}
+	server := httptest.NewServer(standby)
+	defer server.Close()
+	active := &Syncer{
+		Peer:  strings.TrimPrefix(server.URL, "http://"),
+		Key:   key,
+		State: activeGuests,
+	}
+	if err := active.sync(); err != nil {
+		t.Fatalf("Unable to sync: %s", err)
+	}
+	for _, guests := range []*auth.GuestAuthority{activeGuests, standbyGuests} {
+		if usage := guests.Usage("friend"); usage != 1000 {
+			t.Errorf("Expected usage of 1000 for friend, got %d", usage)
+		}
+		if usage := guests.Usage("other"); usage != 50 {
+			t.Errorf("Expected larger usage of 50 for other, got %d", usage)
+		}
+	}
+}
+
+func TestRejectWrongKey(t *testing.T) {
+	standbyGuests := &auth.GuestAuthority{}
+	standby := &Syncer{Key: []byte("s3cret"), State: standbyGuests}
+	server := httptest.NewServer(standby)
+	defer server.Close()
+	activeGuests := &auth.GuestAuthority{}
+	activeGuests.MergeState(&auth.State{GuestUsage: map[string]int64{"friend": 1000}})
+	active := &Syncer{
+		Peer:  strings.TrimPrefix(server.URL, "http://"),
+		Key:   []byte("other"),
+		State: activeGuests,
+	}
+	if err := active.sync(); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected sync with wrong key to be forbidden, got %v", err)
+	}
+	if usage := standbyGuests.Usage("friend"); usage != 0 {
+		t.Errorf("State signed with the wrong key should have been ignored, got usage %d", usage)
+	}
+	if resp, err := http.Get(server.URL); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be rejected, got %v: %v", resp, err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/auth"
+	"github.com/getlantern/flashlight/masquerade"
+	"github.com/getlantern/flashlight/normalize"
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/proxy"
+	"github.com/getlantern/flashlight/trace"
+)
+
+// requestBuilder returns the enproxy NewRequest function, which builds the
+// requests that carry traffic to the server (as rewritten by the protocol),
+// normalizing their headers and signing them as configured
+func (app *App) requestBuilder(normalizer *normalize.Normalizer, authScheme auth.Scheme, server func() string, p func() protocol.Protocol) func(host string, method string, body io.Reader) (*http.Request, error) {
+	return func(host string, method string, body io.Reader) (req *http.Request, err error) {
+		traceID := app.tracer.NewID()
+		if host == "" {
+			req, err = http.NewRequest(method, "http://"+server()+"/", body)
+			if err == nil {
+				before := app.tracer.Snap(req)
+				p().RewriteRequest(req)
+				app.tracer.RecordChanges(traceID, trace.STEP_REWRITE, before, req)
+			}
+		} else {
+			req, err = http.NewRequest(method, "http://"+host+"/", body)
+		}
+		if err == nil && normalizer != nil {
+			before := app.tracer.Snap(req)
+			normalizer.Apply(req)
+			app.tracer.RecordChanges(traceID, trace.STEP_NORMALIZE, before, req)
+		}
+		if err == nil && authScheme != nil {
+			before := app.tracer.Snap(req)
+			err = authScheme.Sign(req)
+			app.tracer.RecordChanges(traceID, trace.STEP_SIGN, before, req)
+		}
+		return
+	}
+}
+
+// pinnedConfig builds the config with which to reach the server the way that
+// proxy.UPSTREAM_HEADER chose for a single request.  What the pin leaves out
+// is the same as in the usual config.  Only the configured server and
+// masquerades can be pinned, since requests are signed with our credentials.
+func (app *App) pinnedConfig(pin *proxy.Pin, usual *enproxy.Config, masquerades *masquerade.List, normalizer *normalize.Normalizer, authScheme auth.Scheme) (*enproxy.Config, error) {
+	if pin.Server == "" && pin.Masquerade == "" {
+		return usual, nil
+	}
+	server := app.upstreamServer()
+	if pin.Server != "" && !strings.EqualFold(pin.Server, server) {
+		return nil, fmt.Errorf("Unknown server %s, only %s can be pinned", pin.Server, server)
+	}
+	if pin.Masquerade != "" && !isKnownMasquerade(pin.Masquerade, masquerades) {
+		return nil, fmt.Errorf("Unknown masquerade %s, only masquerades in the list can be pinned", pin.Masquerade)
+	}
+	p, err := protocol.New(*protocolName, &protocol.Config{
+		ServerHost: server,
+		TLSConfig:  app.clientTLSConfig,
+		DialTCP:    app.dialTCP,
+	})
+	if err != nil {
+		return nil, err
+	}
+	dial := usual.DialProxy
+	if pin.Masquerade != "" || len(masquerades.Hosts()) == 0 {
+		// Without masquerades, the usual config dials the configured server
+		addr := fmt.Sprintf("%s:%d", server, *upstreamPort)
+		if pin.Masquerade != "" {
+			addr = fmt.Sprintf("%s:%d", pin.Masquerade, *upstreamPort)
+		}
+		dial = func(dest string) (net.Conn, error) {
+			return p.Dial(addr)
+		}
+	}
+	return &enproxy.Config{
+		DialProxy:  dial,
+		NewRequest: app.requestBuilder(normalizer, authScheme, func() string { return server }, func() protocol.Protocol { return p }),
+	}, nil
+}
+
+// isKnownMasquerade determines whether host is one of the masquerades
+func isKnownMasquerade(host string, masquerades *masquerade.List) bool {
+	for _, known := range masquerades.AllHosts() {
+		if strings.EqualFold(host, known) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+// package probes recognizes synthetic traffic such as load balancer health
+// checks and uptime monitors, so that it can be answered cheaply and kept out
+// of logs, stats and rate limits.
+package probes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	// DEFAULT_RULES recognize common load balancers and uptime monitors, as
+	// well as flashlight's own probes
+	DEFAULT_RULES = []string{
+		"ua:ELB-HealthChecker",
+		"ua:GoogleHC",
+		"ua:kube-probe",
+		"ua:UptimeRobot",
+		"ua:Pingdom",
+		"ua:StatusCake",
+		"ua:flashlight-probe",
+	}
+)
+
+// Matcher matches requests against a set of rules, any of which identifies a
+// request as a probe.
+type Matcher struct {
+	userAgents []string
+	paths      []string
+	headers    []string
+	nets       []*net.IPNet
+}
+
+// NewMatcher builds a Matcher from rules of the form <kind>:<value>, where
+// kind is one of:
+//
+//	ua      the User-Agent contains value
+//	path    the request path equals value
+//	header  the request carries the header named value
+//	cidr    the request comes from the network value
+func NewMatcher(rules []string) (*Matcher, error) {
+	matcher := &Matcher{}
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Probe rule must look like <kind>:<value>, got: %s", rule)
+		}
+		value := parts[1]
+		switch parts[0] {
+		case "ua":
+			matcher.userAgents = append(matcher.userAgents, strings.ToLower(value))
+		case "path":
+			matcher.paths = append(matcher.paths, value)
+		case "header":
+			matcher.headers = append(matcher.headers, http.CanonicalHeaderKey(value))
+		case "cidr":
+			_, ipNet, err := net.ParseCIDR(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CIDR in probe rule %s: %s", rule, err)
+			}
+			matcher.nets = append(matcher.nets, ipNet)
+		default:
+			return nil, fmt.Errorf("Unknown kind of probe rule: %s", rule)
+		}
+	}
+	return matcher, nil
+}
+
+// IsProbe determines whether the request is a probe
+func (matcher *Matcher) IsProbe(req *http.Request) bool {
+	if matcher == nil {
+		return false
+	}
+	userAgent := strings.ToLower(req.UserAgent())
+	for _, ua := range matcher.userAgents {
+		if strings.Contains(userAgent, ua) {
+			return true
+		}
+	}
+	for _, path := range matcher.paths {
+		if req.URL.Path == path {
+			return true
+		}
+	}
+	for _, header := range matcher.headers {
+		if req.Header.Get(header) != "" {
+			return true
+		}
+	}
+	if len(matcher.nets) > 0 {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		for _, ipNet := range matcher.nets {
+			if ip != nil && ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
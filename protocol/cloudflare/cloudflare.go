@@ -0,0 +1,102 @@
+// package cloudflare implements the Protocol for fronting through CloudFlare
+// (and CDNs that behave like it, e.g. Fastly).
+package cloudflare
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/tls"
+)
+
+const (
+	PROTOCOL_NAME = "cloudflare"
+
+	DEFAULT_HANDSHAKE_TIMEOUT = 20 * time.Second
+)
+
+var (
+	// injectedHeaders are added to responses by CloudFlare
+	injectedHeaders = []string{"Cf-Ray", "Cf-Cache-Status"}
+)
+
+func init() {
+	protocol.Register(PROTOCOL_NAME, func(config *protocol.Config) protocol.Protocol {
+		return &Protocol{
+			ServerHost: config.ServerHost,
+			TLSConfig:  config.TLSConfig,
+			DialTCP:    config.DialTCP,
+		}
+	})
+}
+
+// Protocol reaches the server at ServerHost by connecting to a masquerade
+// (any site served by the CDN) without sending SNI, and then naming the
+// server in the Host header.
+type Protocol struct {
+	ServerHost string             // FQDN of the flashlight server, as known to the CDN
+	TLSConfig  func() *tls.Config // builds the TLS configuration with which to dial the CDN
+	Dialer     *net.Dialer        // (optional) dialer with which to dial the CDN
+	// (optional) dials the TCP connection to the CDN instead of Dialer, e.g.
+	// to use cached DNS answers
+	DialTCP func(addr string) (net.Conn, error)
+}
+
+func (p *Protocol) Dial(addr string) (net.Conn, error) {
+	dialer := p.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: DEFAULT_HANDSHAKE_TIMEOUT}
+	}
+	var conn net.Conn
+	var err error
+	if p.DialTCP != nil {
+		conn, err = p.DialTCP(addr)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := p.TLSConfig()
+	// Note - we need to suppress the sending of the ServerName in the client
+	// handshake to make host-spoofing work with Fastly.  If the client Hello
+	// includes a server name, Fastly checks to make sure that this matches the
+	// Host header in the HTTP request and if they don't match, it returns a
+	// 400 Bad Request error.
+	tlsConfig.SuppressServerNameInClientHandshake = true
+	if tlsConfig.ServerName == "" {
+		// The certificate is still verified against the host we dialed, even
+		// if DialTCP connected to a (cached) IP
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		tlsConfig.ServerName = host
+	}
+	timeout := dialer.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_HANDSHAKE_TIMEOUT
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	conn.SetDeadline(time.Now().Add(timeout))
+	err = tlsConn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (p *Protocol) RewriteRequest(req *http.Request) {
+	req.Host = p.ServerHost
+	req.URL.Host = p.ServerHost
+}
+
+func (p *Protocol) RewriteResponse(resp *http.Response) {
+	for _, header := range injectedHeaders {
+		resp.Header.Del(header)
+	}
+}
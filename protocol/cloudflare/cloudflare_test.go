@@ -0,0 +1,20 @@
+package cloudflare
+
+import (
+	"testing"
+
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/protocol/conformance"
+	"github.com/getlantern/tls"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, conformance.CLOUDFLARE, func(setup *conformance.Setup) protocol.Protocol {
+		return &Protocol{
+			ServerHost: setup.ServerHost,
+			TLSConfig: func() *tls.Config {
+				return &tls.Config{RootCAs: setup.RootCAs}
+			},
+		}
+	})
+}
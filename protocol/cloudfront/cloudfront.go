@@ -0,0 +1,110 @@
+// package cloudfront implements the Protocol for fronting through Amazon
+// CloudFront.
+package cloudfront
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/tls"
+)
+
+const (
+	PROTOCOL_NAME = "cloudfront"
+
+	DEFAULT_HANDSHAKE_TIMEOUT = 20 * time.Second
+)
+
+var (
+	// injectedHeaders are added to responses by CloudFront
+	injectedHeaders = []string{"X-Amz-Cf-Id", "X-Amz-Cf-Pop", "X-Cache", "Via"}
+)
+
+func init() {
+	protocol.Register(PROTOCOL_NAME, func(config *protocol.Config) protocol.Protocol {
+		return &Protocol{
+			ServerHost: config.ServerHost,
+			TLSConfig:  config.TLSConfig,
+			DialTCP:    config.DialTCP,
+		}
+	})
+}
+
+// Protocol reaches the server at ServerHost (the server's CloudFront
+// distribution, e.g. d111111abcdef8.cloudfront.net) by connecting to a
+// masquerade (any site served by CloudFront) and naming the distribution in
+// the Host header.
+//
+// Unlike CloudFlare, CloudFront requires SNI and uses it to pick the
+// certificate, so the handshake has to name the masquerade rather than omit
+// the server name.  The Host header is then used to route the request to the
+// distribution.
+type Protocol struct {
+	ServerHost  string             // FQDN of the server's CloudFront distribution
+	TLSConfig   func() *tls.Config // builds the TLS configuration with which to dial the CDN
+	FrontDomain string             // (optional) domain to send as SNI and to verify the certificate against, defaults to the host being dialed
+	Dialer      *net.Dialer        // (optional) dialer with which to dial the CDN
+	// (optional) dials the TCP connection to the CDN instead of Dialer, e.g.
+	// to use cached DNS answers
+	DialTCP func(addr string) (net.Conn, error)
+}
+
+func (p *Protocol) Dial(addr string) (net.Conn, error) {
+	dialer := p.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: DEFAULT_HANDSHAKE_TIMEOUT}
+	}
+	var conn net.Conn
+	var err error
+	if p.DialTCP != nil {
+		conn, err = p.DialTCP(addr)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := p.TLSConfig()
+	// CloudFront rejects handshakes without SNI, so make sure that the front
+	// domain is sent even if the caller's config suppresses it.
+	tlsConfig.SuppressServerNameInClientHandshake = false
+	tlsConfig.ServerName = p.frontDomain(addr)
+	timeout := dialer.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_HANDSHAKE_TIMEOUT
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	conn.SetDeadline(time.Now().Add(timeout))
+	err = tlsConn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// frontDomain determines the domain to send as SNI when dialing addr
+func (p *Protocol) frontDomain(addr string) string {
+	if p.FrontDomain != "" {
+		return p.FrontDomain
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (p *Protocol) RewriteRequest(req *http.Request) {
+	req.Host = p.ServerHost
+	req.URL.Host = p.ServerHost
+}
+
+func (p *Protocol) RewriteResponse(resp *http.Response) {
+	for _, header := range injectedHeaders {
+		resp.Header.Del(header)
+	}
+}
@@ -0,0 +1,21 @@
+package cloudfront
+
+import (
+	"testing"
+
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/protocol/conformance"
+	"github.com/getlantern/tls"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, conformance.CLOUDFRONT, func(setup *conformance.Setup) protocol.Protocol {
+		return &Protocol{
+			ServerHost:  setup.ServerHost,
+			FrontDomain: setup.FrontDomain,
+			TLSConfig: func() *tls.Config {
+				return &tls.Config{RootCAs: setup.RootCAs}
+			},
+		}
+	})
+}
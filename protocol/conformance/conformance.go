@@ -0,0 +1,337 @@
+// package conformance checks Protocol implementations against a mock CDN that
+// emulates the behaviors of real CDNs that matter for fronting: how SNI and the
+// Host header are used for routing, limits on the size of request headers,
+// buffering of responses and headers added to responses.
+//
+// A Protocol's tests typically look like:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, conformance.CLOUDFLARE, func(setup *conformance.Setup) protocol.Protocol {
+//			return &Protocol{ServerHost: setup.ServerHost, ...}
+//		})
+//	}
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/protocol"
+)
+
+const (
+	SNI_ANY    = "any"    // the CDN ignores SNI
+	SNI_ABSENT = "absent" // the CDN rejects requests whose SNI doesn't match the Host header, so SNI must be omitted
+	SNI_FRONT  = "front"  // the CDN requires SNI to name the front domain
+
+	FRONT_DOMAIN = "front.example.com"
+	SERVER_HOST  = "server.example.com"
+
+	STREAM_CHUNKS     = 10
+	STREAM_CHUNK_SIZE = 1024
+)
+
+var (
+	// CLOUDFLARE behaves like CloudFlare and Fastly
+	CLOUDFLARE = &Behavior{
+		Name:            "CloudFlare",
+		SNI:             SNI_ABSENT,
+		MaxHeaderBytes:  16 * 1024,
+		InjectedHeaders: map[string]string{"Cf-Ray": "1234567890abcdef-SJC"},
+	}
+
+	// CLOUDFRONT behaves like Amazon CloudFront
+	CLOUDFRONT = &Behavior{
+		Name:            "CloudFront",
+		SNI:             SNI_FRONT,
+		MaxHeaderBytes:  10 * 1024,
+		BufferResponses: true,
+		InjectedHeaders: map[string]string{"X-Amz-Cf-Id": "abcdef==", "X-Cache": "Miss from cloudfront"},
+	}
+)
+
+// Behavior describes the quirks of a CDN emulated by the mock CDN
+type Behavior struct {
+	Name            string
+	SNI             string            // how the CDN treats SNI, one of the SNI_ constants
+	MaxHeaderBytes  int               // requests with larger headers are rejected, 0 means unlimited
+	BufferResponses bool              // if true, the CDN only forwards responses once they're complete
+	InjectedHeaders map[string]string // headers the CDN adds to responses
+}
+
+// Setup tells the Protocol under test how to reach the mock CDN
+type Setup struct {
+	CDNAddr     string         // ip:port of the mock CDN's edge
+	FrontDomain string         // domain for which the mock CDN presents its certificate
+	ServerHost  string         // host to which the mock CDN routes requests for the server
+	RootCAs     *x509.CertPool // pool containing the mock CDN's (self-signed) certificate
+}
+
+// Run checks the Protocol created by newProtocol against a mock CDN with the
+// given behavior.
+func Run(t *testing.T, behavior *Behavior, newProtocol func(setup *Setup) protocol.Protocol) {
+	cdn, setup, err := startMockCDN(behavior)
+	if err != nil {
+		t.Fatalf("Unable to start mock %s: %s", behavior.Name, err)
+	}
+	defer cdn.Close()
+	p := newProtocol(setup)
+
+	checkRouting(t, behavior, p, setup)
+	checkRequestBody(t, behavior, p, setup)
+	checkHeaderSize(t, behavior, p, setup)
+	checkStreaming(t, behavior, p, setup)
+	checkInjectedHeaders(t, behavior, p, setup)
+}
+
+// checkRouting checks that requests reach the server
+func checkRouting(t *testing.T, behavior *Behavior, p protocol.Protocol, setup *Setup) {
+	resp, body, err := roundTrip(p, setup, "GET", "/host", nil, nil)
+	if err != nil {
+		t.Errorf("%s routing: %s", behavior.Name, err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != setup.ServerHost {
+		t.Errorf("%s routing: expected 200 from %s, got %d: %s", behavior.Name, setup.ServerHost, resp.StatusCode, body)
+	}
+}
+
+// checkRequestBody checks that request bodies (which carry the tunneled data)
+// arrive intact
+func checkRequestBody(t *testing.T, behavior *Behavior, p protocol.Protocol, setup *Setup) {
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	resp, body, err := roundTrip(p, setup, "POST", "/echo", nil, data)
+	if err != nil {
+		t.Errorf("%s request body: %s", behavior.Name, err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("%s request body: expected %d bytes echoed with 200, got %d bytes with %d", behavior.Name, len(data), len(body), resp.StatusCode)
+	}
+}
+
+// checkHeaderSize checks that requests carrying typical browser headers stay
+// within the CDN's header size limit once rewritten
+func checkHeaderSize(t *testing.T, behavior *Behavior, p protocol.Protocol, setup *Setup) {
+	headers := http.Header{
+		"User-Agent":      {"Mozilla/5.0 (Windows NT 6.1; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/37.0.2062.120 Safari/537.36"},
+		"Accept":          {"text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8"},
+		"Accept-Language": {"en-US,en;q=0.8"},
+		"Cookie":          {strings.Repeat("a", 4096)},
+	}
+	resp, body, err := roundTrip(p, setup, "GET", "/host", headers, nil)
+	if err != nil {
+		t.Errorf("%s header size: %s", behavior.Name, err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("%s header size: request with typical headers rejected with %d: %s", behavior.Name, resp.StatusCode, body)
+	}
+}
+
+// checkStreaming checks that responses that are streamed in chunks arrive
+// completely
+func checkStreaming(t *testing.T, behavior *Behavior, p protocol.Protocol, setup *Setup) {
+	resp, body, err := roundTrip(p, setup, "GET", "/stream", nil, nil)
+	if err != nil {
+		t.Errorf("%s streaming: %s", behavior.Name, err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK || len(body) != STREAM_CHUNKS*STREAM_CHUNK_SIZE {
+		t.Errorf("%s streaming: expected %d bytes with 200, got %d bytes with %d", behavior.Name, STREAM_CHUNKS*STREAM_CHUNK_SIZE, len(body), resp.StatusCode)
+	}
+}
+
+// checkInjectedHeaders checks that headers added by the CDN are removed
+func checkInjectedHeaders(t *testing.T, behavior *Behavior, p protocol.Protocol, setup *Setup) {
+	resp, _, err := roundTrip(p, setup, "GET", "/host", nil, nil)
+	if err != nil {
+		t.Errorf("%s injected headers: %s", behavior.Name, err)
+		return
+	}
+	for header := range behavior.InjectedHeaders {
+		if resp.Header.Get(header) != "" {
+			t.Errorf("%s injected headers: %s not removed from response", behavior.Name, header)
+		}
+	}
+}
+
+// roundTrip sends a request through the mock CDN using the Protocol, the same
+// way that the client sends its requests to the server
+func roundTrip(p protocol.Protocol, setup *Setup, method string, path string, headers http.Header, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, "http://placeholder"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+	p.RewriteRequest(req)
+	conn, err := p.Dial(setup.CDNAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := req.Write(conn); err != nil {
+		return nil, nil, fmt.Errorf("Unable to write request: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read response: %s", err)
+	}
+	defer resp.Body.Close()
+	p.RewriteResponse(resp)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read response body: %s", err)
+	}
+	return resp, respBody, nil
+}
+
+// mockCDN routes requests to the origin (standing in for the flashlight
+// server) while enforcing its Behavior
+type mockCDN struct {
+	behavior *Behavior
+	origin   http.Handler
+}
+
+func startMockCDN(behavior *Behavior) (*httptest.Server, *Setup, error) {
+	cert, pool, err := generateCert(FRONT_DOMAIN)
+	if err != nil {
+		return nil, nil, err
+	}
+	cdn := &mockCDN{behavior, http.HandlerFunc(serveOrigin)}
+	server := httptest.NewUnstartedServer(cdn)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	setup := &Setup{
+		CDNAddr:     server.Listener.Addr().String(),
+		FrontDomain: FRONT_DOMAIN,
+		ServerHost:  SERVER_HOST,
+		RootCAs:     pool,
+	}
+	return server, setup, nil
+}
+
+func (cdn *mockCDN) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	host := strings.Split(req.Host, ":")[0]
+	sni := req.TLS.ServerName
+	switch cdn.behavior.SNI {
+	case SNI_ABSENT:
+		if sni != "" && sni != host {
+			http.Error(resp, fmt.Sprintf("SNI %s doesn't match Host %s", sni, host), http.StatusBadRequest)
+			return
+		}
+	case SNI_FRONT:
+		if sni != FRONT_DOMAIN {
+			http.Error(resp, fmt.Sprintf("SNI %s doesn't match certificate", sni), http.StatusMisdirectedRequest)
+			return
+		}
+	}
+	if cdn.behavior.MaxHeaderBytes > 0 && headerBytes(req) > cdn.behavior.MaxHeaderBytes {
+		http.Error(resp, "Request header too large", http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+	if host != SERVER_HOST {
+		http.Error(resp, fmt.Sprintf("Unknown host %s", host), http.StatusNotFound)
+		return
+	}
+	for key, value := range cdn.behavior.InjectedHeaders {
+		resp.Header().Set(key, value)
+	}
+	if !cdn.behavior.BufferResponses {
+		cdn.origin.ServeHTTP(resp, req)
+		return
+	}
+	recorder := httptest.NewRecorder()
+	cdn.origin.ServeHTTP(recorder, req)
+	for key, values := range recorder.HeaderMap {
+		resp.Header()[key] = values
+	}
+	resp.WriteHeader(recorder.Code)
+	resp.Write(recorder.Body.Bytes())
+}
+
+// serveOrigin stands in for the flashlight server
+func serveOrigin(resp http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/host":
+		resp.Write([]byte(strings.Split(req.Host, ":")[0]))
+	case "/echo":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp.Write(body)
+	case "/stream":
+		chunk := bytes.Repeat([]byte("x"), STREAM_CHUNK_SIZE)
+		for i := 0; i < STREAM_CHUNKS; i++ {
+			resp.Write(chunk)
+			if flusher, ok := resp.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+	default:
+		http.NotFound(resp, req)
+	}
+}
+
+// headerBytes approximates the size of the request's headers on the wire
+func headerBytes(req *http.Request) int {
+	size := len(req.Method) + len(req.RequestURI) + len("Host: ") + len(req.Host) + 16
+	for key, values := range req.Header {
+		for _, value := range values {
+			size += len(key) + len(value) + 4
+		}
+	}
+	return size
+}
+
+// generateCert generates a self-signed certificate for the given domain and
+// 127.0.0.1
+func generateCert(domain string) (tls.Certificate, *x509.CertPool, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: domain},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{domain},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool, nil
+}
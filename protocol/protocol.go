@@ -0,0 +1,82 @@
+// package protocol defines the pluggable part of how flashlight clients reach
+// their server through a CDN (domain fronting).  Each CDN has its own quirks
+// regarding SNI, Host headers and which headers it adds to responses, which
+// are encapsulated by an implementation of Protocol.
+//
+// Implementations register themselves under a name (see Register), so that
+// they can be selected at runtime without main knowing about each of them.
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/getlantern/tls"
+)
+
+var (
+	factories      = make(map[string]Factory)
+	factoriesMutex sync.RWMutex
+)
+
+// Protocol encapsulates the CDN-specific parts of reaching the server
+type Protocol interface {
+	// Dial dials (and performs the TLS handshake with) the CDN edge at the
+	// given address.
+	Dial(addr string) (net.Conn, error)
+
+	// RewriteRequest prepares a request to the server so that the CDN routes
+	// it to the server.
+	RewriteRequest(req *http.Request)
+
+	// RewriteResponse undoes changes that the CDN made to the server's
+	// response.
+	RewriteResponse(resp *http.Response)
+}
+
+// Config is what a Factory needs to know to build a Protocol
+type Config struct {
+	ServerHost string                              // FQDN of the flashlight server, as known to the CDN
+	TLSConfig  func() *tls.Config                  // builds the TLS configuration with which to dial the CDN
+	DialTCP    func(addr string) (net.Conn, error) // (optional) dials the TCP connection to the CDN, on top of which the Protocol does TLS
+}
+
+// Factory builds a Protocol
+type Factory func(config *Config) Protocol
+
+// Register registers the Factory for the Protocol with the given name.
+// Implementations call this from an init function.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	if _, exists := factories[name]; exists {
+		panic(fmt.Sprintf("Protocol %s registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// New builds the Protocol with the given name
+func New(name string, config *Config) (Protocol, error) {
+	factoriesMutex.RLock()
+	factory, found := factories[name]
+	factoriesMutex.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("Unknown protocol %s, available protocols are %v", name, Names())
+	}
+	return factory(config), nil
+}
+
+// Names returns the names of all registered protocols, sorted
+func Names() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/accesslog"
+)
+
+const (
+	// ENPROXY_DEST_HEADER is the header in which enproxy clients send the
+	// destination address
+	ENPROXY_DEST_HEADER = "X-Enproxy-Dest-Addr"
+
+	// COUNTRY_HEADER is the header in which CloudFlare tells us the country of
+	// the client
+	COUNTRY_HEADER = "CF-IPCountry"
+)
+
+// loggingAccess wraps the given handler, recording each request in the
+// AccessLog once it's been handled
+func (server *Server) loggingAccess(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &accessRecorder{ResponseWriter: resp}
+		handler.ServeHTTP(recorder, req)
+
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
+		}
+		server.AccessLog.Record(&accesslog.Entry{
+			Time:      start,
+			ClientIP:  clientIP,
+			Country:   req.Header.Get(COUNTRY_HEADER),
+			Method:    req.Method,
+			Host:      destinationOf(req),
+			Proto:     req.Proto,
+			Status:    recorder.statusCode(),
+			Bytes:     atomic.LoadInt64(&recorder.bytes),
+			Duration:  time.Now().Sub(start),
+			Referer:   req.Referer(),
+			UserAgent: req.UserAgent(),
+		})
+	})
+}
+
+// destinationOf returns the destination that the request is for, or the
+// requested host for requests to the server itself
+func destinationOf(req *http.Request) string {
+	if dest := req.Header.Get(DEST_HEADER); dest != "" {
+		return dest
+	}
+	if dest := req.Header.Get(ENPROXY_DEST_HEADER); dest != "" {
+		return dest
+	}
+	return req.Host
+}
+
+// accessRecorder is an http.ResponseWriter that keeps track of the status and
+// the bytes sent, including on hijacked connections (for WebSocket streams).
+type accessRecorder struct {
+	http.ResponseWriter
+	status int32
+	bytes  int64
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	atomic.CompareAndSwapInt32(&r.status, 0, int32(status))
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(b []byte) (int, error) {
+	atomic.CompareAndSwapInt32(&r.status, 0, http.StatusOK)
+	n, err := r.ResponseWriter.Write(b)
+	atomic.AddInt64(&r.bytes, int64(n))
+	return n, err
+}
+
+func (r *accessRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn = &accessRecordingConn{conn, r}
+	return conn, bufio.NewReadWriter(rw.Reader, bufio.NewWriter(conn)), nil
+}
+
+// statusCode returns the recorded status, 200 if nothing was written
+func (r *accessRecorder) statusCode() int {
+	if status := atomic.LoadInt32(&r.status); status != 0 {
+		return int(status)
+	}
+	return http.StatusOK
+}
+
+// accessRecordingConn is a hijacked net.Conn that counts the bytes written
+// to it, and takes the status from the raw response written to it first.
+type accessRecordingConn struct {
+	net.Conn
+	recorder *accessRecorder
+}
+
+func (conn *accessRecordingConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&conn.recorder.status) == 0 {
+		// e.g. "HTTP/1.1 101 Switching Protocols"
+		if len(b) >= 12 && string(b[:5]) == "HTTP/" {
+			if status, err := strconv.Atoi(string(b[9:12])); err == nil {
+				atomic.CompareAndSwapInt32(&conn.recorder.status, 0, int32(status))
+			}
+		}
+	}
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.recorder.bytes, int64(n))
+	return n, err
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/fairshare"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	drainCheckInterval = 100 * time.Millisecond
+)
+
+// ServerStatus is a snapshot of a running server's state
+type ServerStatus struct {
+	Addr          string    `json:"addr"`
+	Started       time.Time `json:"started"`
+	ActiveConns   int64     `json:"activeConns"`   // open connections from clients
+	BytesReceived int64     `json:"bytesReceived"` // from clients
+	BytesSent     int64     `json:"bytesSent"`     // to clients
+	CertExpires   time.Time `json:"certExpires"`
+	CertDaysLeft  int       `json:"certDaysLeft"`
+	Draining      bool      `json:"draining"`
+
+	Clients []*fairshare.FlowStatus `json:"clients,omitempty"` // throughput of each client, if sharing fairly
+}
+
+// Status returns the current status of the running server
+func (server *Server) Status() *ServerStatus {
+	status := &ServerStatus{
+		Addr:          server.Addr,
+		Started:       server.started,
+		ActiveConns:   atomic.LoadInt64(&server.activeConns),
+		BytesReceived: atomic.LoadInt64(&server.bytesReceived),
+		BytesSent:     atomic.LoadInt64(&server.bytesSent),
+		Draining:      server.isDraining(),
+	}
+	if server.FairShare != nil {
+		status.Clients = server.FairShare.Status()
+	}
+	if server.CertContext.certs != nil {
+		if cert := server.CertContext.certs.current(); cert != nil {
+			status.CertExpires = cert.NotAfter
+			status.CertDaysLeft = int(cert.NotAfter.Sub(time.Now()).Hours() / 24)
+		}
+	}
+	return status
+}
+
+// RotateCert replaces the server's certificate without restarting.  External
+// certificates are reloaded from their files (e.g. after being renewed),
+// self-signed ones are generated anew with the same key.  Clients that pinned
+// the previous self-signed certificate (rather than the key) need the new one.
+func (server *Server) RotateCert() error {
+	ctx := server.CertContext
+	if ctx.certs == nil {
+		return fmt.Errorf("Server is not running")
+	}
+	if !ctx.External {
+		if err := ctx.generateServerCert(server.certHost(), server.CertHosts...); err != nil {
+			return fmt.Errorf("Unable to generate server cert: %s", err)
+		}
+	}
+	if err := ctx.certs.load(); err != nil {
+		return err
+	}
+	log.Infof("Rotated server cert, now valid until %s", ctx.certs.current().NotAfter)
+	return nil
+}
+
+// Drain starts gracefully stopping the server: it stops accepting connections
+// right away, and waits for the open ones to finish in the background, for at
+// most the given timeout.  Run returns (without an error) once the server is
+// drained.
+func (server *Server) Drain(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&server.draining, 0, 1) {
+		return fmt.Errorf("Server is already draining")
+	}
+	log.Infof("Draining, %d connections open", atomic.LoadInt64(&server.activeConns))
+	server.drainMutex.Lock()
+	for _, httpServer := range server.httpServers {
+		// Don't keep idle connections around
+		httpServer.SetKeepAlivesEnabled(false)
+	}
+	for _, l := range server.listeners {
+		l.Close()
+	}
+	server.drainMutex.Unlock()
+	go server.awaitDrained(timeout)
+	return nil
+}
+
+// awaitDrained waits until no connections are open anymore (or the timeout
+// passed) and lets Run return
+func (server *Server) awaitDrained(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&server.activeConns) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainCheckInterval)
+	}
+	remaining := atomic.LoadInt64(&server.activeConns)
+	if remaining > 0 {
+		log.Warnf("Gave up on draining %d connections after %s", remaining, timeout)
+	} else {
+		log.Info("Drained")
+	}
+	if server.drained != nil {
+		close(server.drained)
+	}
+}
+
+func (server *Server) isDraining() bool {
+	return atomic.LoadInt32(&server.draining) == 1
+}
+
+// servingWith remembers an http.Server, so that Drain can stop keep-alives
+func (server *Server) servingWith(httpServer *http.Server) {
+	server.drainMutex.Lock()
+	defer server.drainMutex.Unlock()
+	server.httpServers = append(server.httpServers, httpServer)
+}
+
+// trackingConns wraps the given listener, keeping count of the open
+// connections and remembering it so that Drain can close it
+func (server *Server) trackingConns(l net.Listener) net.Listener {
+	server.drainMutex.Lock()
+	defer server.drainMutex.Unlock()
+	server.listeners = append(server.listeners, l)
+	return &trackedListener{l, &server.activeConns}
+}
+
+type trackedListener struct {
+	net.Listener
+	active *int64
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(l.active, 1)
+	return &trackedConn{Conn: conn, active: l.active}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	active    *int64
+	closeOnce sync.Once
+}
+
+func (conn *trackedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		atomic.AddInt64(conn.active, -1)
+	})
+	return conn.Conn.Close()
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/getlantern/flashlight/bootstrap"
+	"github.com/getlantern/flashlight/log"
+)
+
+// servingBootstrap wraps the given handler, serving the bootstrap bundles in
+// the BootstrapDir.  It goes outside of auth.Handler, since clients that are
+// bootstrapping don't have credentials yet (bundles are sealed, so only those
+// with the code can use them).  Requests for bundles that don't exist are
+// passed on like any other request.
+func (server *Server) servingBootstrap(handler http.Handler) http.Handler {
+	if server.BootstrapDir == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" || !strings.HasPrefix(req.URL.Path, bootstrap.BOOTSTRAP_PATH) {
+			handler.ServeHTTP(resp, req)
+			return
+		}
+		id := strings.TrimPrefix(req.URL.Path, bootstrap.BOOTSTRAP_PATH)
+		if strings.ContainsAny(id, "/\\.") {
+			handler.ServeHTTP(resp, req)
+			return
+		}
+		sealed, err := ioutil.ReadFile(filepath.Join(server.BootstrapDir, id))
+		if err != nil {
+			handler.ServeHTTP(resp, req)
+			return
+		}
+		log.Debugf("Serving bootstrap bundle %s to %s", id, req.RemoteAddr)
+		resp.Header().Set("Content-Type", "application/octet-stream")
+		resp.Write(sealed)
+	})
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+var (
+	certHealthCheckInterval = 1 * time.Hour
+)
+
+// CertHealth summarizes the health of a certificate and its key
+type CertHealth struct {
+	DaysUntilExpiry int
+	KeyType         string
+	KeyBits         int
+}
+
+// CheckCertHealth determines the health of the given certificate, logging a
+// warning if it expires within warnDays (or has already expired).
+func CheckCertHealth(name string, cert *x509.Certificate, warnDays int) *CertHealth {
+	health := &CertHealth{
+		DaysUntilExpiry: int(cert.NotAfter.Sub(time.Now()).Hours() / 24),
+	}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		health.KeyType = "RSA"
+		health.KeyBits = key.N.BitLen()
+	case *ecdsa.PublicKey:
+		health.KeyType = "ECDSA"
+		health.KeyBits = key.Params().BitSize
+	default:
+		health.KeyType = "unknown"
+	}
+	if health.DaysUntilExpiry < 0 {
+		log.Warnf("%s expired on %s", name, cert.NotAfter)
+	} else if health.DaysUntilExpiry < warnDays {
+		log.Warnf("%s expires in %d days (on %s)", name, health.DaysUntilExpiry, cert.NotAfter)
+	}
+	return health
+}
+
+// monitorCertHealth periodically checks the health of the server certificate,
+// updating metrics (if enabled) and logging warnings as expiry approaches.
+func (server *Server) monitorCertHealth() {
+	for {
+		cert := server.CertContext.certs.current()
+		health := CheckCertHealth("Server certificate "+server.CertContext.ServerCertFile, cert, server.CertWarnDays)
+		if server.Metrics != nil {
+			server.Metrics.Gauge("flashlight_server_cert_expiry_days", "Days until the server certificate expires").Set(int64(health.DaysUntilExpiry))
+			server.Metrics.Gauge("flashlight_server_key_bits", "Size of the server's key in bits").Set(int64(health.KeyBits))
+		}
+		time.Sleep(certHealthCheckInterval)
+	}
+}
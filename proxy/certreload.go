@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+var (
+	certReloadCheckInterval = 1 * time.Minute
+)
+
+// certLoader holds the server's current certificate, loaded from its cert and
+// key files.  Once watching, it reloads them whenever they change on disk or
+// the process receives SIGHUP, so that externally managed certificates can be
+// renewed without restarting the server.
+type certLoader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	leaf     *x509.Certificate
+	modTime  time.Time
+	mutex    sync.RWMutex
+}
+
+// load (re)loads the certificate and key.  The cert file may contain
+// intermediate certificates following the leaf.
+func (loader *certLoader) load() error {
+	modTime := loader.latestModTime()
+	cert, err := tls.LoadX509KeyPair(loader.certFile, loader.keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load server cert: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Unable to parse server cert: %s", err)
+	}
+	loader.mutex.Lock()
+	defer loader.mutex.Unlock()
+	loader.cert = &cert
+	loader.leaf = leaf
+	loader.modTime = modTime
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate
+func (loader *certLoader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loader.mutex.RLock()
+	defer loader.mutex.RUnlock()
+	return loader.cert, nil
+}
+
+// current returns the currently loaded leaf certificate
+func (loader *certLoader) current() *x509.Certificate {
+	loader.mutex.RLock()
+	defer loader.mutex.RUnlock()
+	return loader.leaf
+}
+
+// watch reloads the certificate on SIGHUP and whenever the files' modification
+// times change.  If reloading fails (e.g. because only one of the files has
+// been replaced so far), the previous certificate stays in use.
+func (loader *certLoader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(certReloadCheckInterval)
+	for {
+		select {
+		case <-hup:
+			log.Info("Received SIGHUP, reloading server cert")
+		case <-ticker.C:
+			loader.mutex.RLock()
+			unchanged := !loader.latestModTime().After(loader.modTime)
+			loader.mutex.RUnlock()
+			if unchanged {
+				continue
+			}
+			log.Debugf("%s changed, reloading server cert", loader.certFile)
+		}
+		if err := loader.load(); err != nil {
+			log.Errorf("Continuing with previous server cert: %s", err)
+		}
+	}
+}
+
+// latestModTime returns the later of the cert and key files' modification
+// times
+func (loader *certLoader) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{loader.certFile, loader.keyFile} {
+		info, err := os.Stat(file)
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
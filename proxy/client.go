@@ -1,13 +1,23 @@
 package proxy
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"sync"
 	"time"
 
 	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/auth"
+	"github.com/getlantern/flashlight/balancer"
+	"github.com/getlantern/flashlight/diskcache"
+	"github.com/getlantern/flashlight/hosthistory"
+	"github.com/getlantern/flashlight/hostmatch"
 	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/metrics"
+	"github.com/getlantern/flashlight/probes"
+	"github.com/getlantern/flashlight/script"
 )
 
 const (
@@ -20,28 +30,161 @@ type Client struct {
 	ProxyConfig
 
 	EnproxyConfig *enproxy.Config
+	Transport     string // (optional) how to carry traffic to the server, TRANSPORT_ENPROXY (default) or TRANSPORT_WEBSOCKET
+
+	MaxRetries   int           // (optional) how many times to retry failed requests that are safe to replay
+	StallTimeout time.Duration // (optional) abort upstream responses that stop flowing for this long
+	MaxResponse  int64         // (optional) refuse (with a 502) or cut off plaintext responses bigger than this many bytes
+
+	SplitParts     int               // (optional) download large plaintext responses using up to this many parallel range requests
+	SplitThreshold int64             // (optional) only split responses of at least this many bytes
+	Metrics        *metrics.Registry // optional registry of metrics
+
+	LocalHosts              *hostmatch.List // (optional) additional hosts (e.g. corp.example.com) that are reached directly instead of through the tunnel
+	TunnelLocalDestinations bool            // if true, requests to localhost and the LAN are tunneled like everything else
+	DisableBypass           bool            // if true, neither the quick bypass nor route overrides can send traffic directly, so that traffic never silently leaves the tunnel
+	DisableDumping          bool            // if true, dumping requests to a host can't be turned on at runtime, so that their contents never end up in the log
+
+	PlaintextPolicy  string          // (optional) what to do with plaintext HTTP requests, one of PLAINTEXT_ALLOW (default), PLAINTEXT_BLOCK or PLAINTEXT_UPGRADE
+	PlaintextAllowed *hostmatch.List // (optional) sites exempted from the PlaintextPolicy
+
+	AllowedClientNets []*net.IPNet // (optional) networks from which clients may connect, defaults to loopback and private networks
+	DeniedClientNets  []*net.IPNet // (optional) networks from which clients may not connect, even if otherwise allowed
+	DeviceRateLimit   int64        // (optional) maximum bytes per second per device in each direction
+
+	ProbeMatcher *probes.Matcher // (optional) recognizes monitoring requests, which are excluded from device accounting, rate limits and logs
+
+	MaxIdleConns     int           // (optional) maximum number of idle browser connections to keep open
+	IdleTimeout      time.Duration // (optional) close browser connections that are idle for longer than this
+	AcceptThrottleAt int           // (optional) slow down accepting new connections when more than this many are open
+
+	Forwards  []*Forward // (optional) local ports forwarded through the tunnel to fixed destinations
+	SocksAddr string     // (optional) address at which to also accept SOCKS5 connections
+
+	Prefetch bool // if true, hosts referenced by proxied HTML pages or hinted at by Link headers are resolved or preconnected while the page loads
+	Coalesce bool // if true, identical plaintext requests for cacheable resources that are in flight at the same time share a single upstream fetch
+
+	HeaderAudit string // (optional) whether to check that the client leaves the SECURITY_HEADERS of plaintext responses alone, HEADER_AUDIT_OFF (default), HEADER_AUDIT_LOG or HEADER_AUDIT_RESTORE
+
+	Credentials          auth.Renewable // (optional) credentials with which the client authenticates, renewed with the server before they expire
+	OnCredentialsRenewed func(string)   // (optional) called with the renewed credentials, e.g. to save them
+
+	RouteCache *diskcache.Cache   // (optional) cache in which route overrides are persisted across restarts
+	Balancer   *balancer.Balancer // (optional) balancer with which DialProxy picks the server's address, whose per-address health is included in the status
+	Script     *script.Script     // (optional) user script whose hooks decide routes (after overrides and bypass) and transform the headers of plaintext requests
+
+	MediaHosts *hostmatch.List // (optional) video and audio hosts whose traffic is piped with bigger buffers, flushed less often and never rewritten
+
+	History *hosthistory.History // (optional) history of reaching each host directly, in which LocalHosts that keep failing directly are tunneled instead
+
+	// (optional) builds the config with which to reach the server the way
+	// that UPSTREAM_HEADER chose, enabling the header
+	PinnedConfig func(pin *Pin) (*enproxy.Config, error)
 
 	reverseProxy *httputil.ReverseProxy
+	directProxy  *httputil.ReverseProxy
+	mediaProxy   *httputil.ReverseProxy
+
+	bypass           bool               // if true, all requests go direct
+	overrides        map[string]string  // per-host (or per-pattern) route overrides
+	overridePatterns []*overridePattern // compiled wildcard and regex overrides, in order of precedence
+	routingMutex     sync.RWMutex
+
+	devices      map[string]*Device // usage by device ip
+	devicesMutex sync.Mutex
+
+	upstream    upstreamState
+	dumping     dumpSettings
+	prefetched  prefetchState
+	notices     noticeState
+	headerAudit headerAuditState
+
+	instruments *clientInstruments // nil without Metrics
 }
 
 func (client *Client) Run() error {
+	client.instrument()
+	client.trackUpstream()
+	client.restoreRouteOverrides()
+	client.SetDumpHeaders(client.ShouldDumpHeaders)
 	client.buildReverseProxy()
+	client.buildDirectProxy()
+	client.buildMediaProxy()
+	go client.fetchNoticesPeriodically()
+	if client.Credentials != nil {
+		go client.renewCredentialsPeriodically()
+	}
+	if err := client.startForwarding(); err != nil {
+		return err
+	}
+	if client.SocksAddr != "" {
+		if err := client.serveSOCKS(); err != nil {
+			return err
+		}
+	}
 
+	tracker := newConnTracker(client.MaxIdleConns, client.IdleTimeout, client.Metrics)
 	httpServer := &http.Server{
 		Addr:         client.Addr,
 		ReadTimeout:  client.ReadTimeout,
 		WriteTimeout: client.WriteTimeout,
 		Handler:      client,
+		ConnState:    tracker.onStateChange,
 	}
 
-	log.Debugf("About to start client (http) proxy at %s", client.Addr)
-	return httpServer.ListenAndServe()
+	l, err := net.Listen("tcp", client.Addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen at %s: %s", client.Addr, err)
+	}
+	log.Infof("About to start client (http) proxy at %s", client.Addr)
+	return httpServer.Serve(&throttledListener{l, tracker, client.AcceptThrottleAt})
 }
 
 func (client *Client) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	log.Debugf("Handling request for: %s", req.RequestURI)
-	if req.Method == CONNECT {
-		client.EnproxyConfig.Intercept(resp, req)
+	if !client.clientAllowed(req.RemoteAddr) {
+		log.Errorf("Rejecting request from disallowed client %s", req.RemoteAddr)
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if isPACRequest(req) {
+		client.servePAC(resp, req)
+		return
+	}
+	if !client.ProbeMatcher.IsProbe(req) {
+		// Account for (and rate limit) real traffic only
+		if client.instruments != nil {
+			client.instruments.requests.Inc()
+		}
+		device := client.device(req.RemoteAddr)
+		resp = &deviceResponseWriter{resp, device}
+		if req.Body != nil {
+			req.Body = &deviceReader{req.Body, device}
+		}
+		log.Debugf("Handling request for: %s", req.RequestURI)
+	}
+	if req.Header.Get(UPSTREAM_HEADER) != "" {
+		client.servePinned(resp, req)
+		return
+	}
+	if req.Method == CONNECT && client.shouldSniff(req.Host) {
+		// Route on the hostname from the ClientHello rather than the IP
+		client.connectSniffed(resp, req)
+	} else if client.shouldGoDirect(req.Host) {
+		client.serveDirect(resp, req)
+	} else if client.refusesPlaintext(req) {
+		client.servePlaintextRefusal(resp, req)
+	} else if req.Method == CONNECT {
+		if client.dumpLevel(req.Host) != DUMP_OFF {
+			// Only the CONNECT itself is visible, the rest is encrypted
+			dumpHeaders("CONNECT to "+req.Host, &req.Header)
+		}
+		if client.transport() == TRANSPORT_ENPROXY && !client.hasPreconnected(req.Host) && !client.isMedia(req.Host) {
+			client.EnproxyConfig.Intercept(resp, req)
+		} else {
+			client.connectUpstream(resp, req)
+		}
+	} else if client.isMedia(req.Host) {
+		client.mediaProxy.ServeHTTP(resp, req)
 	} else {
 		client.reverseProxy.ServeHTTP(resp, req)
 	}
@@ -52,11 +195,10 @@ func (client *Client) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 func (client *Client) buildReverseProxy() {
 	client.reverseProxy = &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			// do nothing
+			client.Script.TransformHeaders(req)
 		},
-		Transport: withDumpHeaders(
-			client.ShouldDumpHeaders,
-			&http.Transport{
+		Transport: client.withDumping(client.withSecurityHeaderAudit(client.withPrefetching(withCoalescing(client.Coalesce, client.Metrics,
+			withResponseLimit(client.MaxResponse, client.Metrics, withSplitting(client.SplitParts, client.SplitThreshold, client.Metrics, withRetries(client.MaxRetries, withStallWatchdog(client.StallTimeout, client.Metrics, client.withSecurityHeaderSnapshot(&http.Transport{
 				// We disable keepalives because some servers pretend to support
 				// keep-alives but close their connections immediately, which
 				// causes an error inside ReverseProxy.  This is not an issue
@@ -65,44 +207,19 @@ func (client *Client) buildReverseProxy() {
 				// know to do.
 				// See https://code.google.com/p/go/issues/detail?id=4677
 				DisableKeepAlives: true,
+				// Responses whose headers don't arrive in time are treated
+				// like stalls (and retried if safe)
+				ResponseHeaderTimeout: client.StallTimeout,
 				Dial: func(network, addr string) (net.Conn, error) {
-					conn := &enproxy.Conn{
-						Addr:   addr,
-						Config: client.EnproxyConfig,
-					}
-					err := conn.Connect()
+					conn, err := client.dialUpstream(addr)
 					if err != nil {
-						return nil, err
+						return nil, &dialError{err}
 					}
 					return conn, nil
 				},
-			}),
+			}))))))))),
 		// Set a FlushInterval to prevent overly aggressive buffering of
 		// responses, which helps keep memory usage down
-		FlushInterval: 250 * time.Millisecond,
-	}
-}
-
-// withDumpHeaders creates a RoundTripper that uses the supplied RoundTripper
-// and that dumps headers (if dumpHeaders is true).
-func withDumpHeaders(dumpHeaders bool, rt http.RoundTripper) http.RoundTripper {
-	if !dumpHeaders {
-		return rt
-	}
-	return &headerDumpingRoundTripper{rt}
-}
-
-// headerDumpingRoundTripper is an http.RoundTripper that wraps another
-// http.RoundTripper and dumps response headers to the log.
-type headerDumpingRoundTripper struct {
-	orig http.RoundTripper
-}
-
-func (rt *headerDumpingRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	dumpHeaders("Request", &req.Header)
-	resp, err = rt.orig.RoundTrip(req)
-	if err == nil {
-		dumpHeaders("Response", &resp.Header)
+		FlushInterval: REVERSE_PROXY_FLUSH_INTERVAL,
 	}
-	return
 }
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/flashlight/metrics"
+)
+
+const (
+	// MAX_COALESCED_BYTES limits the size of responses that are shared
+	// between coalesced requests, all of which is buffered until the last of
+	// them has been read
+	MAX_COALESCED_BYTES = 8 << 20
+)
+
+// withCoalescing creates a RoundTripper that uses the supplied RoundTripper
+// and that coalesces identical requests for cacheable resources that are in
+// flight at the same time (e.g. from several tabs, or several devices sharing
+// the client on a LAN) into a single upstream fetch, whose response is fanned
+// out to all of them.
+func withCoalescing(coalesce bool, registry *metrics.Registry, rt http.RoundTripper) http.RoundTripper {
+	if !coalesce {
+		return rt
+	}
+	coalescer := &coalescingRoundTripper{orig: rt, calls: make(map[string]*coalescedCall)}
+	if registry != nil {
+		coalescer.coalesced = registry.Counter("flashlight_coalesced_requests_total", "Requests answered with the response to an identical request that was already in flight")
+	}
+	return coalescer
+}
+
+// coalescingRoundTripper is an http.RoundTripper that wraps another
+// http.RoundTripper and coalesces identical in-flight requests.
+type coalescingRoundTripper struct {
+	orig      http.RoundTripper
+	calls     map[string]*coalescedCall
+	mutex     sync.Mutex
+	coalesced *metrics.Counter
+}
+
+// coalescedCall is an upstream fetch that identical requests can join
+type coalescedCall struct {
+	done chan struct{} // closed once the response headers (or an error) arrived
+	resp *http.Response
+	body *sharedBody // nil if the response can't be shared
+}
+
+func (rt *coalescingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !coalescable(req) {
+		return rt.orig.RoundTrip(req)
+	}
+	key := coalescingKey(req)
+	rt.mutex.Lock()
+	call, inFlight := rt.calls[key]
+	if !inFlight {
+		call = &coalescedCall{done: make(chan struct{})}
+		rt.calls[key] = call
+	}
+	rt.mutex.Unlock()
+
+	if inFlight {
+		<-call.done
+		if call.body != nil {
+			if body := call.body.newReader(); body != nil {
+				if rt.coalesced != nil {
+					rt.coalesced.Inc()
+				}
+				return copyResponse(call.resp, req, body), nil
+			}
+		}
+		// Couldn't share, so fetch it ourselves
+		return rt.orig.RoundTrip(req)
+	}
+
+	resp, err := rt.orig.RoundTrip(req)
+	if err == nil && shareable(resp) {
+		call.resp = resp
+		call.body = newSharedBody(resp.Body, func() { rt.forget(key, call) })
+		resp.Body = call.body.newReader()
+	} else {
+		rt.forget(key, call)
+	}
+	close(call.done)
+	return resp, err
+}
+
+// forget makes sure that later requests don't join the given call
+func (rt *coalescingRoundTripper) forget(key string, call *coalescedCall) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	if rt.calls[key] == call {
+		delete(rt.calls, key)
+	}
+}
+
+// coalescable determines whether the request is for something that's likely
+// the same no matter who asks for it
+func coalescable(req *http.Request) bool {
+	return req.Method == "GET" &&
+		req.Header.Get("Range") == "" &&
+		req.Header.Get("Authorization") == "" &&
+		req.Header.Get("Cookie") == "" &&
+		!strings.Contains(req.Header.Get("Cache-Control"), "no-cache") &&
+		req.Header.Get("Pragma") != "no-cache"
+}
+
+// coalescingKey identifies requests that get the same response, including the
+// headers on which responses commonly vary
+func coalescingKey(req *http.Request) string {
+	return fmt.Sprintf("%s %s %s %s", req.Host, req.URL.RequestURI(), req.Header.Get("Accept-Encoding"), req.Header.Get("Accept"))
+}
+
+// shareable determines whether the response may be handed to other requests
+func shareable(resp *http.Response) bool {
+	cacheControl := resp.Header.Get("Cache-Control")
+	return resp.StatusCode == http.StatusOK &&
+		resp.ContentLength >= 0 && resp.ContentLength <= MAX_COALESCED_BYTES &&
+		resp.Header.Get("Set-Cookie") == "" &&
+		resp.Header.Get("Vary") != "*" &&
+		!strings.Contains(cacheControl, "private") &&
+		!strings.Contains(cacheControl, "no-store")
+}
+
+// copyResponse copies the response (but not its body) for the given request
+func copyResponse(orig *http.Response, req *http.Request, body io.ReadCloser) *http.Response {
+	header := make(http.Header, len(orig.Header))
+	for name, values := range orig.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	return &http.Response{
+		Status:        orig.Status,
+		StatusCode:    orig.StatusCode,
+		Proto:         orig.Proto,
+		ProtoMajor:    orig.ProtoMajor,
+		ProtoMinor:    orig.ProtoMinor,
+		Header:        header,
+		Body:          body,
+		ContentLength: orig.ContentLength,
+		Request:       req,
+	}
+}
+
+// sharedBody reads a response body once and hands it to any number of
+// readers, each of which reads it from the beginning.  Once all readers are
+// closed, the upstream body is closed too.
+type sharedBody struct {
+	orig    io.ReadCloser
+	onDone  func()
+	buf     []byte
+	err     error // set once reading upstream stopped, io.EOF if it completed
+	readers int
+	closed  bool
+	mutex   sync.Mutex
+	cond    *sync.Cond
+}
+
+func newSharedBody(orig io.ReadCloser, onDone func()) *sharedBody {
+	body := &sharedBody{orig: orig, onDone: onDone}
+	body.cond = sync.NewCond(&body.mutex)
+	go body.fill()
+	return body
+}
+
+// fill reads the upstream body into the buffer
+func (body *sharedBody) fill() {
+	b := make([]byte, 32*1024)
+	for {
+		n, err := body.orig.Read(b)
+		body.mutex.Lock()
+		body.buf = append(body.buf, b[:n]...)
+		if err == nil && len(body.buf) > MAX_COALESCED_BYTES {
+			err = fmt.Errorf("Response longer than its Content-Length")
+		}
+		if err == nil && body.closed {
+			err = io.ErrClosedPipe
+		}
+		if err != nil {
+			body.err = err
+		}
+		body.cond.Broadcast()
+		body.mutex.Unlock()
+		if err != nil {
+			body.orig.Close()
+			body.onDone()
+			return
+		}
+	}
+}
+
+// newReader returns a new reader for the body, or nil if all previous readers
+// already gave up on it
+func (body *sharedBody) newReader() io.ReadCloser {
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	if body.closed {
+		return nil
+	}
+	body.readers += 1
+	return &sharedBodyReader{body: body}
+}
+
+func (body *sharedBody) release() {
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	body.readers -= 1
+	if body.readers == 0 && body.err == nil {
+		// Nobody's interested anymore, stop reading upstream
+		body.closed = true
+		body.orig.Close()
+	}
+}
+
+// sharedBodyReader reads a sharedBody from the beginning
+type sharedBodyReader struct {
+	body   *sharedBody
+	offset int
+	closed bool
+}
+
+func (r *sharedBodyReader) Read(p []byte) (int, error) {
+	body := r.body
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	for r.offset == len(body.buf) && body.err == nil {
+		body.cond.Wait()
+	}
+	if r.offset < len(body.buf) {
+		n := copy(p, body.buf[r.offset:])
+		r.offset += n
+		return n, nil
+	}
+	return 0, body.err
+}
+
+func (r *sharedBodyReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.body.release()
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingRoundTripper answers every request with the same body once
+// released, counting the round trips
+type blockingRoundTripper struct {
+	release    chan bool
+	roundTrips int32
+	header     http.Header
+}
+
+func (rt *blockingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&rt.roundTrips, 1)
+	<-rt.release
+	body := "hello coalesced world"
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        rt.header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+func fetchConcurrently(t *testing.T, rt http.RoundTripper, orig *blockingRoundTripper, count int, withCookie bool) []string {
+	bodies := make([]string, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://www.example.com/logo.png", nil)
+			if withCookie {
+				req.Header.Set("Cookie", "session=1")
+			}
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Errorf("Unable to round trip: %s", err)
+				return
+			}
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			bodies[i] = string(data)
+		}(i)
+	}
+	// Give all of them a chance to get in flight before letting them through
+	for atomic.LoadInt32(&orig.roundTrips) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(orig.release)
+	wg.Wait()
+	return bodies
+}
+
+func TestCoalescing(t *testing.T) {
+	orig := &blockingRoundTripper{release: make(chan bool), header: http.Header{}}
+	rt := withCoalescing(true, nil, orig)
+	for _, body := range fetchConcurrently(t, rt, orig, 5, false) {
+		if body != "hello coalesced world" {
+			t.Errorf("Unexpected body: %q", body)
+		}
+	}
+	if roundTrips := atomic.LoadInt32(&orig.roundTrips); roundTrips >= 5 {
+		t.Errorf("Expected requests to be coalesced, got %d round trips", roundTrips)
+	}
+}
+
+func TestNoCoalescingWithCookies(t *testing.T) {
+	orig := &blockingRoundTripper{release: make(chan bool), header: http.Header{}}
+	rt := withCoalescing(true, nil, orig)
+	fetchConcurrently(t, rt, orig, 3, true)
+	if roundTrips := atomic.LoadInt32(&orig.roundTrips); roundTrips != 3 {
+		t.Errorf("Requests with cookies shouldn't be coalesced, got %d round trips", roundTrips)
+	}
+}
+
+func TestNoSharingPrivateResponses(t *testing.T) {
+	orig := &blockingRoundTripper{release: make(chan bool), header: http.Header{"Cache-Control": []string{"private"}}}
+	rt := withCoalescing(true, nil, orig)
+	fetchConcurrently(t, rt, orig, 3, false)
+	if roundTrips := atomic.LoadInt32(&orig.roundTrips); roundTrips != 3 {
+		t.Errorf("Private responses shouldn't be shared, got %d round trips", roundTrips)
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countingConn is a net.Conn that counts the bytes read and written and
+// reports them (along with the connection's duration) once it is closed.
+type countingConn struct {
+	net.Conn
+	start     time.Time
+	bytesRead int64
+	written   int64
+	onClose   func(conn *countingConn)
+	closeOnce sync.Once
+}
+
+func newCountingConn(conn net.Conn, onClose func(conn *countingConn)) *countingConn {
+	return &countingConn{
+		Conn:    conn,
+		start:   time.Now(),
+		onClose: onClose,
+	}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytesRead, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.onClose(c)
+	})
+	return err
+}
+
+// BytesRead returns the number of bytes read so far
+func (c *countingConn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.bytesRead)
+}
+
+// BytesWritten returns the number of bytes written so far
+func (c *countingConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// Duration returns how long the connection has been open
+func (c *countingConn) Duration() time.Duration {
+	return time.Now().Sub(c.start)
+}
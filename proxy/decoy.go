@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// decoyHandler builds the handler that serves the Decoy to requests without
+// valid credentials (e.g. from censors' scanners), so that the server looks
+// like an ordinary website.  It returns nil if there's no Decoy.
+func (server *Server) decoyHandler() (http.Handler, error) {
+	if server.Decoy == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(server.Decoy, "http://") || strings.HasPrefix(server.Decoy, "https://") {
+		origin, err := url.Parse(server.Decoy)
+		if err != nil || origin.Host == "" {
+			return nil, fmt.Errorf("Invalid decoy URL %s", server.Decoy)
+		}
+		decoy := httputil.NewSingleHostReverseProxy(origin)
+		direct := decoy.Director
+		decoy.Director = func(req *http.Request) {
+			direct(req)
+			// Origins generally only serve their own hostname
+			req.Host = origin.Host
+		}
+		return decoy, nil
+	}
+	info, err := os.Stat(server.Decoy)
+	if err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("Decoy %s is neither a directory nor an http(s) URL", server.Decoy)
+	}
+	return http.FileServer(http.Dir(server.Decoy)), nil
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/flashlight/auth"
+)
+
+func TestDecoy(t *testing.T) {
+	proxied := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("proxied"))
+	})
+	get := func(decoy string, token string) string {
+		handler, err := (&Server{Decoy: decoy}).decoyHandler()
+		if err != nil {
+			t.Fatalf("Unable to build decoy: %s", err)
+		}
+		req, _ := http.NewRequest("GET", "https://203.0.113.1/", nil)
+		req.Header.Set(auth.AUTH_HEADER, token)
+		rec := httptest.NewRecorder()
+		auth.HandlerWithDecoy(&auth.Token{Token: "s3cret"}, proxied, handler).ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	dir, err := ioutil.TempDir("", "decoy")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("my blog"), 0644)
+	if body := get(dir, "wrong"); body != "my blog" {
+		t.Errorf("Expected static decoy, got %q", body)
+	}
+	if body := get(dir, "s3cret"); body != "proxied" {
+		t.Errorf("Authenticated request got %q", body)
+	}
+
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(auth.AUTH_HEADER) != "" {
+			t.Error("Credentials leaked to decoy origin")
+		}
+		resp.Write([]byte("origin " + req.Host))
+	}))
+	defer origin.Close()
+	if body, expected := get(origin.URL, "wrong"), "origin "+origin.Listener.Addr().String(); body != expected {
+		t.Errorf("Expected %q from decoy origin, got %q", expected, body)
+	}
+
+	if _, err := (&Server{Decoy: filepath.Join(dir, "missing")}).decoyHandler(); err == nil {
+		t.Error("Missing decoy directory should have failed")
+	}
+}
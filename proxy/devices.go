@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/metrics"
+)
+
+// Device tracks the usage of the client proxy by a single device on the LAN,
+// identified by its IP address.  Devices aren't told apart by MAC address,
+// which isn't visible beyond the local link, so devices that share an IP
+// (e.g. behind another NAT) share a Device.
+type Device struct {
+	IP        string    `json:"ip"`
+	BytesUp   int64     `json:"bytesUp"`
+	BytesDown int64     `json:"bytesDown"`
+	LastSeen  time.Time `json:"lastSeen"`
+
+	up          *rateLimiter
+	down        *rateLimiter
+	upCounter   *metrics.Counter // (optional) counts bytes up from all devices
+	downCounter *metrics.Counter // (optional) counts bytes down to all devices
+}
+
+// Devices returns a snapshot of the usage of all devices that have used the
+// client.
+func (client *Client) Devices() []*Device {
+	client.devicesMutex.Lock()
+	defer client.devicesMutex.Unlock()
+	devices := make([]*Device, 0, len(client.devices))
+	for _, device := range client.devices {
+		devices = append(devices, &Device{
+			IP:        device.IP,
+			BytesUp:   atomic.LoadInt64(&device.BytesUp),
+			BytesDown: atomic.LoadInt64(&device.BytesDown),
+			LastSeen:  device.LastSeen,
+		})
+	}
+	return devices
+}
+
+// device gets (or creates) the Device for the given remote address
+func (client *Client) device(remoteAddr string) *Device {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	client.devicesMutex.Lock()
+	defer client.devicesMutex.Unlock()
+	if client.devices == nil {
+		client.devices = make(map[string]*Device)
+	}
+	device, found := client.devices[ip]
+	if !found {
+		device = &Device{
+			IP:   ip,
+			up:   newRateLimiter(client.DeviceRateLimit),
+			down: newRateLimiter(client.DeviceRateLimit),
+		}
+		if client.instruments != nil {
+			device.upCounter = client.instruments.bytesUp
+			device.downCounter = client.instruments.bytesDown
+		}
+		client.devices[ip] = device
+	}
+	device.LastSeen = time.Now()
+	return device
+}
+
+func (device *Device) onBytesUp(n int) {
+	atomic.AddInt64(&device.BytesUp, int64(n))
+	if device.upCounter != nil {
+		device.upCounter.Add(int64(n))
+	}
+	device.up.wait(n)
+}
+
+func (device *Device) onBytesDown(n int) {
+	atomic.AddInt64(&device.BytesDown, int64(n))
+	if device.downCounter != nil {
+		device.downCounter.Add(int64(n))
+	}
+	device.down.wait(n)
+}
+
+// deviceResponseWriter is an http.ResponseWriter that accounts for the bytes
+// sent to a device, including on hijacked connections.
+type deviceResponseWriter struct {
+	http.ResponseWriter
+	device *Device
+}
+
+func (w *deviceResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.device.onBytesDown(n)
+	return n, err
+}
+
+func (w *deviceResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *deviceResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Reads go through the hijacked reader, which may hold bytes that the
+	// device already sent
+	conn = &deviceConn{Conn: conn, device: w.device, reader: rw.Reader}
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// deviceReader is an io.ReadCloser that accounts for bytes received from a
+// device.
+type deviceReader struct {
+	io.ReadCloser
+	device *Device
+}
+
+func (r *deviceReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.device.onBytesUp(n)
+	return n, err
+}
+
+// deviceConn is a net.Conn that accounts for bytes exchanged with a device.
+type deviceConn struct {
+	net.Conn
+	device *Device
+	reader io.Reader // (optional) what to read from instead of the Conn
+}
+
+func (c *deviceConn) Read(b []byte) (int, error) {
+	reader := c.reader
+	if reader == nil {
+		reader = c.Conn
+	}
+	n, err := reader.Read(b)
+	c.device.onBytesUp(n)
+	return n, err
+}
+
+func (c *deviceConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.device.onBytesDown(n)
+	return n, err
+}
+
+// rateLimiter is a simple token bucket limiting throughput to a number of
+// bytes per second.  A nil rateLimiter doesn't limit.
+type rateLimiter struct {
+	rate      float64
+	allowance float64
+	last      time.Time
+	mutex     sync.Mutex
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:      float64(bytesPerSecond),
+		allowance: float64(bytesPerSecond),
+		last:      time.Now(),
+	}
+}
+
+// wait blocks until n more bytes can be transferred without exceeding the
+// rate.
+func (limiter *rateLimiter) wait(n int) {
+	if limiter == nil || n <= 0 {
+		return
+	}
+	limiter.mutex.Lock()
+	now := time.Now()
+	limiter.allowance += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.allowance > limiter.rate {
+		limiter.allowance = limiter.rate
+	}
+	limiter.last = now
+	limiter.allowance -= float64(n)
+	var delay time.Duration
+	if limiter.allowance < 0 {
+		delay = time.Duration(-limiter.allowance / limiter.rate * float64(time.Second))
+	}
+	limiter.mutex.Unlock()
+	time.Sleep(delay)
+}
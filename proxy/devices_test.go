@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0) != nil {
+		t.Error("Expected no limiter without a rate")
+	}
+	limiter := newRateLimiter(10000)
+	start := time.Now()
+	limiter.wait(10000)
+	if elapsed := time.Now().Sub(start); elapsed > 50*time.Millisecond {
+		t.Errorf("A full bucket shouldn't have to wait, waited %s", elapsed)
+	}
+	limiter.wait(2000)
+	if elapsed := time.Now().Sub(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected to wait about 200ms once the bucket is empty, waited %s", elapsed)
+	}
+}
+
+func TestDeviceAccounting(t *testing.T) {
+	client := &Client{}
+	device := client.device("192.168.1.10:50000")
+	if client.device("192.168.1.10:50001") != device {
+		t.Error("Expected connections from the same IP to share a Device")
+	}
+	if client.device("192.168.1.11:50000") == device {
+		t.Error("Expected another IP to get its own Device")
+	}
+
+	body := &deviceReader{ioutil.NopCloser(strings.NewReader("request")), device}
+	ioutil.ReadAll(body)
+	rec := httptest.NewRecorder()
+	(&deviceResponseWriter{rec, device}).Write([]byte("response!"))
+
+	for _, snapshot := range client.Devices() {
+		if snapshot.IP != "192.168.1.10" {
+			continue
+		}
+		if snapshot.BytesUp != 7 || snapshot.BytesDown != 9 {
+			t.Errorf("Expected 7 bytes up and 9 down, got %d and %d", snapshot.BytesUp, snapshot.BytesDown)
+		}
+		return
+	}
+	t.Error("Device missing from snapshot")
+}
+
+func TestHijackedDeviceAccounting(t *testing.T) {
+	device := &Device{IP: "127.0.0.1"}
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		conn, rw, err := (&deviceResponseWriter{resp, device}).Hijack()
+		if err != nil {
+			t.Errorf("Unable to hijack: %s", err)
+			return
+		}
+		defer conn.Close()
+		// Sent along with the request, so already buffered when hijacking
+		greeting := make([]byte, 5)
+		if _, err := io.ReadFull(rw, greeting); err != nil || string(greeting) != "hello" {
+			t.Errorf("Expected hello, got %q %v", greeting, err)
+		}
+		rw.WriteString("world")
+		rw.Flush()
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\nhello"))
+	reply, _ := ioutil.ReadAll(conn)
+	if string(reply) != "world" {
+		t.Errorf("Expected world, got %q", reply)
+	}
+	if up, down := atomic.LoadInt64(&device.BytesUp), atomic.LoadInt64(&device.BytesDown); up != 5 || down != 5 {
+		t.Errorf("Expected 5 bytes up and down, got %d and %d", up, down)
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/hosthistory"
+	"github.com/getlantern/flashlight/hostmatch"
+	"github.com/getlantern/flashlight/log"
+)
+
+var (
+	// Networks that are never proxied when addressed by IP
+	localNetworks = parseCIDRs(
+		"127.0.0.0/8",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"169.254.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	)
+
+	// Hosts that are never proxied
+	localHosts = hostmatch.MustParse("localhost", "local")
+)
+
+// isLocal determines whether the given host (which may include a port) is on
+// the local machine or LAN and should therefore be reached directly rather
+// than through the tunnel.  Hostnames are never resolved, so that checking
+// doesn't leak DNS lookups.
+func (client *Client) isLocal(host string) bool {
+	if client.TunnelLocalDestinations {
+		return false
+	}
+	host = normalizeHost(host)
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		for _, network := range localNetworks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return localHosts.Matches(host) || client.LocalHosts.Matches(host)
+}
+
+// directKeepsFailing determines whether host is one of the LocalHosts and the
+// History shows that reaching it directly mostly fails (e.g. a site that was
+// listed to save bandwidth but is blocked on the current network), in which
+// case it's tunneled instead.  Loopback and LAN destinations always go
+// direct.
+func (client *Client) directKeepsFailing(host string) bool {
+	return client.LocalHosts.Matches(host) && client.History.IsFailing(host, hosthistory.ROUTE_DIRECT)
+}
+
+// dialDirect dials addr directly, recording the outcome in the History
+func (client *Client) dialDirect(addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	client.History.Record(normalizeHost(addr), hosthistory.ROUTE_DIRECT, time.Now().Sub(start), err)
+	return conn, err
+}
+
+// serveDirect handles the request by going directly to the destination,
+// without rewriting or tunneling.
+func (client *Client) serveDirect(resp http.ResponseWriter, req *http.Request) {
+	log.Debugf("Handling request for %s directly", req.Host)
+	if req.Method == CONNECT {
+		client.connectDirect(resp, req)
+	} else {
+		client.directProxy.ServeHTTP(resp, req)
+	}
+}
+
+// connectDirect handles a CONNECT request by dialing the destination directly
+// and piping data between it and the browser.
+func (client *Client) connectDirect(resp http.ResponseWriter, req *http.Request) {
+	destConn, err := client.dialDirect(req.Host)
+	if err != nil {
+		log.Errorf("Unable to dial %s directly: %s", req.Host, err)
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		log.Error("Unable to hijack connection for direct CONNECT")
+		resp.WriteHeader(http.StatusInternalServerError)
+		destConn.Close()
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("Unable to hijack connection for direct CONNECT: %s", err)
+		destConn.Close()
+		return
+	}
+	clientConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	pipe(clientConn, destConn)
+}
+
+// buildDirectProxy builds the httputil.ReverseProxy used by the client for
+// requests that go directly to their destination.
+func (client *Client) buildDirectProxy() {
+	client.directProxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			client.Script.TransformHeaders(req)
+		},
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			Dial: func(network, addr string) (net.Conn, error) {
+				return client.dialDirect(addr)
+			},
+		},
+		FlushInterval: REVERSE_PROXY_FLUSH_INTERVAL,
+	}
+}
+
+// pipe copies data in both directions between the given connections until
+// either side is done, then closes both.
+func pipe(a net.Conn, b net.Conn) {
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- true
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- true
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/getlantern/flashlight/hostmatch"
+)
+
+func TestIsLocal(t *testing.T) {
+	client := &Client{LocalHosts: hostmatch.MustParse("intranet.example.com")}
+	cases := map[string]bool{
+		"127.0.0.1":                     true,
+		"127.1.2.3:8080":                true,
+		"10.1.2.3":                      true,
+		"172.16.0.1:443":                true,
+		"172.31.255.255":                true,
+		"172.32.0.1":                    false,
+		"192.168.1.1:80":                true,
+		"169.254.169.254":               true,
+		"8.8.8.8":                       false,
+		"[::1]:8080":                    true,
+		"[::1]":                         true,
+		"::ffff:192.168.1.1":            true,
+		"[fd00::1]:443":                 true,
+		"[fe80::1]":                     true,
+		"[2001:db8::1]:443":             false,
+		"localhost":                     true,
+		"localhost.:8080":               true,
+		"LOCALHOST":                     true,
+		"printer.local":                 true,
+		"intranet.example.com":          true,
+		"wiki.intranet.example.com:443": true,
+		"www.example.com":               false,
+		"localhost.example.com":         false,
+	}
+	for host, expected := range cases {
+		if client.isLocal(host) != expected {
+			t.Errorf("Expected isLocal(%s) to be %v", host, expected)
+		}
+	}
+
+	client.TunnelLocalDestinations = true
+	if client.isLocal("127.0.0.1") || client.isLocal("localhost") {
+		t.Error("Nothing should be local when tunneling local destinations")
+	}
+}
+
+func TestOnlyLocalClientsAllowedByDefault(t *testing.T) {
+	client := &Client{}
+	for _, addr := range []string{"127.0.0.1:50000", "192.168.1.10:50000", "[::1]:50000", "[fe80::1]:50000"} {
+		if !client.clientAllowed(addr) {
+			t.Errorf("Expected %s to be allowed", addr)
+		}
+	}
+	for _, addr := range []string{"8.8.8.8:50000", "[2001:db8::1]:50000", "garbage"} {
+		if client.clientAllowed(addr) {
+			t.Errorf("Expected %s to be refused", addr)
+		}
+	}
+}
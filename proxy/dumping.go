@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	DUMP_OFF     = ""        // don't dump anything
+	DUMP_HEADERS = "headers" // dump request and response headers
+	DUMP_BODIES  = "bodies"  // dump headers and the beginning of request and response bodies
+
+	// MAX_DUMPED_BODY limits how much of each body is dumped
+	MAX_DUMPED_BODY = 4096
+)
+
+// dumpSettings are the per-host dump levels, which can be changed at runtime
+type dumpSettings struct {
+	all    bool // whether to dump headers for all hosts, initialized from ShouldDumpHeaders
+	levels map[string]string
+	mutex  sync.RWMutex
+}
+
+// SetDumpHeaders turns dumping headers for all hosts on or off at runtime
+func (client *Client) SetDumpHeaders(dump bool) {
+	client.dumping.mutex.Lock()
+	defer client.dumping.mutex.Unlock()
+	client.dumping.all = dump
+}
+
+// SetDumpLevel sets the dump level (one of DUMP_OFF, DUMP_HEADERS or
+// DUMP_BODIES) for requests to the given host.  This allows debugging a
+// single site without enabling ShouldDumpHeaders for everything.  Turning
+// dumping on fails if DisableDumping is set.
+func (client *Client) SetDumpLevel(host string, level string) error {
+	if level != DUMP_OFF && level != DUMP_HEADERS && level != DUMP_BODIES {
+		return fmt.Errorf("Unknown dump level: %s", level)
+	}
+	if level != DUMP_OFF && client.DisableDumping {
+		return fmt.Errorf("Dumping is disabled")
+	}
+	host = normalizeHost(host)
+	client.dumping.mutex.Lock()
+	defer client.dumping.mutex.Unlock()
+	if level == DUMP_OFF {
+		delete(client.dumping.levels, host)
+		return nil
+	}
+	if client.dumping.levels == nil {
+		client.dumping.levels = make(map[string]string)
+	}
+	client.dumping.levels[host] = level
+	log.Debugf("Dumping %s for %s", level, host)
+	return nil
+}
+
+// DumpLevels returns a copy of the per-host dump levels
+func (client *Client) DumpLevels() map[string]string {
+	client.dumping.mutex.RLock()
+	defer client.dumping.mutex.RUnlock()
+	levels := make(map[string]string, len(client.dumping.levels))
+	for host, level := range client.dumping.levels {
+		levels[host] = level
+	}
+	return levels
+}
+
+// dumpLevel determines the dump level for requests to the given host
+func (client *Client) dumpLevel(host string) string {
+	client.dumping.mutex.RLock()
+	level, found := client.dumping.levels[normalizeHost(host)]
+	all := client.dumping.all
+	client.dumping.mutex.RUnlock()
+	if found {
+		return level
+	}
+	if all {
+		return DUMP_HEADERS
+	}
+	return DUMP_OFF
+}
+
+// withDumping creates a RoundTripper that uses the supplied RoundTripper and
+// dumps requests and responses according to their host's dump level.
+func (client *Client) withDumping(rt http.RoundTripper) http.RoundTripper {
+	return &dumpingRoundTripper{rt, client}
+}
+
+// dumpingRoundTripper is an http.RoundTripper that wraps another
+// http.RoundTripper and dumps requests and responses to the log.
+type dumpingRoundTripper struct {
+	orig   http.RoundTripper
+	client *Client
+}
+
+func (rt *dumpingRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	level := rt.client.dumpLevel(req.Host)
+	if level == DUMP_OFF {
+		return rt.orig.RoundTrip(req)
+	}
+	dumpHeaders("Request", &req.Header)
+	if level == DUMP_BODIES && req.Body != nil {
+		req.Body = &dumpingBody{ReadCloser: req.Body, category: "Request to " + req.Host}
+	}
+	resp, err = rt.orig.RoundTrip(req)
+	if err == nil {
+		dumpHeaders("Response", &resp.Header)
+		if level == DUMP_BODIES {
+			resp.Body = &dumpingBody{ReadCloser: resp.Body, category: "Response from " + req.Host}
+		}
+	}
+	return
+}
+
+// dumpingBody captures the beginning of a body as it's read and dumps it once
+// the body is closed
+type dumpingBody struct {
+	io.ReadCloser
+	category string
+	captured []byte
+	total    int64
+}
+
+func (b *dumpingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if remaining := MAX_DUMPED_BODY - len(b.captured); remaining > 0 {
+		if remaining > n {
+			remaining = n
+		}
+		b.captured = append(b.captured, p[:remaining]...)
+	}
+	b.total += int64(n)
+	return n, err
+}
+
+func (b *dumpingBody) Close() error {
+	log.Debugf("%s Body (%d bytes, showing up to %d)\n%s\n%q\n%s\n\n", b.category, b.total, MAX_DUMPED_BODY, HR, b.captured, HR)
+	return b.ReadCloser.Close()
+}
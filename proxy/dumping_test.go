@@ -0,0 +1,17 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestNoDumpingWhenDisabled(t *testing.T) {
+	client := &Client{DisableDumping: true}
+	for _, level := range []string{DUMP_HEADERS, DUMP_BODIES} {
+		if err := client.SetDumpLevel("www.example.com", level); err == nil {
+			t.Errorf("Expected dumping %s to fail", level)
+		}
+	}
+	if err := client.SetDumpLevel("www.example.com", DUMP_OFF); err != nil {
+		t.Errorf("Unable to turn dumping off: %s", err)
+	}
+}
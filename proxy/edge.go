@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// FORWARDED_FOR_HEADER is the header in which edges pass on the address
+	// of the client, with the address they received the request from last
+	FORWARDED_FOR_HEADER = "X-Forwarded-For"
+)
+
+// checkPlainListener makes sure that a PlainAddr can be served safely
+func (server *Server) checkPlainListener() error {
+	if server.PlainAddr == "" {
+		return nil
+	}
+	if len(server.EdgeNetworks) == 0 {
+		return fmt.Errorf("Serving plain HTTP at %s requires EdgeNetworks, otherwise anyone could connect without TLS", server.PlainAddr)
+	}
+	if server.ClientCAs != nil {
+		return fmt.Errorf("Serving plain HTTP at %s would bypass ClientCAs, since edges can't pass on client certificates", server.PlainAddr)
+	}
+	return nil
+}
+
+// servePlain serves the handler of the given http.Server with plain HTTP on
+// the given listener at PlainAddr, for CDNs that terminate TLS at the edge
+// and forward requests over HTTP (or a private network).  Only connections
+// from EdgeNetworks are accepted.
+func (server *Server) servePlain(l net.Listener, httpServer *http.Server) error {
+	log.Infof("About to start server (http, edges only) proxy at %s", server.PlainAddr)
+	l = &edgeListener{server.trackingConns(l), server.EdgeNetworks}
+	if server.Metrics != nil {
+		l = server.countingConns(l)
+	}
+	plainServer := &http.Server{
+		Handler:      fromEdge(httpServer.Handler),
+		ReadTimeout:  httpServer.ReadTimeout,
+		WriteTimeout: httpServer.WriteTimeout,
+	}
+	server.servingWith(plainServer)
+	return plainServer.Serve(l)
+}
+
+// fromEdge wraps the given handler, replacing the RemoteAddr of requests (the
+// edge's address) with the client's as forwarded by the edge, so that stats,
+// devices and the access log see actual clients.  Connections only come from
+// trusted edges, so the header can be trusted too.
+func fromEdge(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		forwardedFor := strings.Split(req.Header.Get(FORWARDED_FOR_HEADER), ",")
+		// The edge appends the address it received the request from
+		clientIP := strings.TrimSpace(forwardedFor[len(forwardedFor)-1])
+		if net.ParseIP(clientIP) != nil {
+			req.RemoteAddr = net.JoinHostPort(clientIP, "0")
+		}
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// edgeListener is a net.Listener that closes connections from outside of the
+// given networks as soon as they are accepted
+type edgeListener struct {
+	net.Listener
+	networks []*net.IPNet
+}
+
+func (l *edgeListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.isEdge(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Debugf("Refusing plain HTTP connection from %s, which is not an edge", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+func (l *edgeListener) isEdge(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && containsIP(l.networks, tcpAddr.IP)
+}
+
+// containsIP determines whether ip is in any of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEdgeListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	_, edges, _ := net.ParseCIDR("10.0.0.0/8")
+	edgeL := &edgeListener{l, []*net.IPNet{edges}}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := edgeL.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection from outside of the edge networks should have been closed")
+	}
+	select {
+	case <-accepted:
+		t.Error("Connection from outside of the edge networks shouldn't have been accepted")
+	default:
+	}
+}
+
+func TestFromEdge(t *testing.T) {
+	var remoteAddr string
+	handler := fromEdge(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		remoteAddr = req.RemoteAddr
+	}))
+	req, _ := http.NewRequest("GET", "http://203.0.113.1/", nil)
+	req.RemoteAddr = "10.1.2.3:5555"
+	req.Header.Set(FORWARDED_FOR_HEADER, "198.51.100.1, 198.51.100.2")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if remoteAddr != "198.51.100.2:0" {
+		t.Errorf("Expected the address appended by the edge, got %s", remoteAddr)
+	}
+
+	req.Header.Del(FORWARDED_FOR_HEADER)
+	req.RemoteAddr = "10.1.2.3:5555"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if remoteAddr != "10.1.2.3:5555" {
+		t.Errorf("Expected the edge's address without header, got %s", remoteAddr)
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// dialViaEgressProxy connects to addr through the server's EgressProxy using
+// an HTTP CONNECT, authenticating with the proxy URL's credentials (if any).
+// Since enproxy relays raw streams, plain HTTP destinations are CONNECTed to
+// just like HTTPS ones.
+func (server *Server) dialViaEgressProxy(addr string) (net.Conn, error) {
+	proxyURL := server.EgressProxy
+	proxyAddr := proxyURL.Host
+	if _, _, err := net.SplitHostPort(proxyAddr); err != nil {
+		proxyAddr = net.JoinHostPort(proxyAddr, "80")
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial egress proxy at %s: %s", proxyAddr, err)
+	}
+	req := &http.Request{
+		Method: CONNECT,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to send CONNECT to egress proxy: %s", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to read CONNECT response from egress proxy: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Egress proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	// The reader may already hold data that the destination sent right after
+	// the proxy's response
+	return &bufferedConn{conn, reader}, nil
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/flashlight/auth"
+	"github.com/getlantern/flashlight/fairshare"
+)
+
+// sharingFairly wraps the given handler, holding what's sent to each client to
+// its share of the FairShare.  Clients are told apart by their credentials if
+// the Authenticator can (e.g. guest tokens) and by IP otherwise.  Behind a CDN
+// that connects over TLS, only requests from EdgeNetworks are attributed to
+// the client IP that the edge forwards, without EdgeNetworks all clients
+// without credentials share the flow of the edge that they come through.
+func (server *Server) sharingFairly(handler http.Handler) http.Handler {
+	if server.FairShare == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		id, class := server.classify(req)
+		w := &fairResponseWriter{ResponseWriter: resp, flow: server.FairShare.Flow(id, class)}
+		handler.ServeHTTP(w, req)
+		if !w.hijacked {
+			// Hijacked connections release the flow once they're closed
+			w.flow.Release()
+		}
+	})
+}
+
+// classify determines which client sent the request and its class
+func (server *Server) classify(req *http.Request) (string, string) {
+	if classifier, ok := server.Authenticator.(auth.Classifier); ok {
+		if id, class := classifier.Classify(req); id != "" {
+			return id, class
+		}
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if forwarded := server.forwardedClientIP(ip, req); forwarded != "" {
+		ip = forwarded
+	}
+	return ip, auth.CLASS_MEMBER
+}
+
+// forwardedClientIP returns the client IP that the edge forwarded, if the
+// request comes from one of the EdgeNetworks
+func (server *Server) forwardedClientIP(peer string, req *http.Request) string {
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil || !containsIP(server.EdgeNetworks, peerIP) {
+		return ""
+	}
+	forwardedFor := strings.Split(req.Header.Get(FORWARDED_FOR_HEADER), ",")
+	clientIP := strings.TrimSpace(forwardedFor[len(forwardedFor)-1])
+	if net.ParseIP(clientIP) == nil {
+		return ""
+	}
+	return clientIP
+}
+
+// fairResponseWriter is an http.ResponseWriter that holds what's written to
+// it to the flow's share, including on hijacked connections
+type fairResponseWriter struct {
+	http.ResponseWriter
+	flow     *fairshare.Flow
+	hijacked bool
+}
+
+func (w *fairResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.flow.Wait(n)
+	return n, err
+}
+
+func (w *fairResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *fairResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	conn = &fairConn{Conn: conn, flow: w.flow}
+	return conn, bufio.NewReadWriter(rw.Reader, bufio.NewWriter(conn)), nil
+}
+
+// fairConn is a net.Conn that holds what's written to it to the flow's share,
+// releasing the flow once closed
+type fairConn struct {
+	net.Conn
+	flow        *fairshare.Flow
+	releaseOnce sync.Once
+}
+
+func (c *fairConn) Close() error {
+	c.releaseOnce.Do(c.flow.Release)
+	return c.Conn.Close()
+}
+
+func (c *fairConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.flow.Wait(n)
+	return n, err
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClassifyBehindEdge(t *testing.T) {
+	_, edges, _ := net.ParseCIDR("203.0.113.0/24")
+	server := &Server{EdgeNetworks: []*net.IPNet{edges}}
+	req, _ := http.NewRequest("GET", "http://fl.example.com/", nil)
+	req.Header.Set(FORWARDED_FOR_HEADER, "10.0.0.1, 198.51.100.7")
+
+	req.RemoteAddr = "203.0.113.5:443"
+	if id, _ := server.classify(req); id != "198.51.100.7" {
+		t.Errorf("Expected request from an edge to be attributed to the forwarded client, got %s", id)
+	}
+	req.RemoteAddr = "192.0.2.9:443"
+	if id, _ := server.classify(req); id != "192.0.2.9" {
+		t.Errorf("Expected forwarded address from elsewhere to be ignored, got %s", id)
+	}
+}
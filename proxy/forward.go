@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+// Forward forwards connections to a local address through the tunnel to a
+// fixed destination, like ssh's -L.  This makes a single blocked TCP service
+// reachable by programs that can't be configured to use a proxy.
+type Forward struct {
+	LocalAddr   string // address on which to listen, e.g. localhost:2222
+	Destination string // host:port to which to forward connections, e.g. example.com:22
+}
+
+// startForwarding starts listening for each of the client's Forwards
+func (client *Client) startForwarding() error {
+	for _, forward := range client.Forwards {
+		l, err := net.Listen("tcp", forward.LocalAddr)
+		if err != nil {
+			return fmt.Errorf("Unable to listen at %s for forwarding to %s: %s", forward.LocalAddr, forward.Destination, err)
+		}
+		log.Debugf("Forwarding %s to %s", forward.LocalAddr, forward.Destination)
+		go client.forward(l, forward)
+	}
+	return nil
+}
+
+func (client *Client) forward(l net.Listener, forward *Forward) {
+	for {
+		local, err := l.Accept()
+		if err != nil {
+			log.Errorf("Unable to accept connection for forwarding to %s: %s", forward.Destination, err)
+			return
+		}
+		if !client.clientAllowed(local.RemoteAddr().String()) {
+			log.Errorf("Rejecting forwarded connection from disallowed client %s", local.RemoteAddr())
+			local.Close()
+			continue
+		}
+		go func() {
+			remote, err := client.dialUpstream(forward.Destination)
+			if err != nil {
+				log.Errorf("Unable to connect to %s through tunnel: %s", forward.Destination, err)
+				local.Close()
+				return
+			}
+			pipe(local, remote)
+		}()
+	}
+}
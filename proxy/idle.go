@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/metrics"
+)
+
+const (
+	MAX_ACCEPT_DELAY = 1 * time.Second
+)
+
+var (
+	idleReapInterval = 10 * time.Second
+)
+
+// connTracker tracks the connections from browsers to the client proxy.
+// Browsers open many speculative connections that mostly sit idle, so the
+// tracker caps how many idle connections are kept around (closing the oldest
+// first), closes connections that stay idle for too long and lets the
+// listener slow down accepting when lots of connections are open.
+type connTracker struct {
+	maxIdle     int
+	idleTimeout time.Duration
+	open        int
+	idle        map[net.Conn]time.Time
+	mutex       sync.Mutex
+	openGauge   *metrics.Gauge
+	idleGauge   *metrics.Gauge
+}
+
+func newConnTracker(maxIdle int, idleTimeout time.Duration, registry *metrics.Registry) *connTracker {
+	tracker := &connTracker{
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		idle:        make(map[net.Conn]time.Time),
+	}
+	if registry != nil {
+		tracker.openGauge = registry.Gauge("flashlight_client_open_connections", "Open connections from browsers")
+		tracker.idleGauge = registry.Gauge("flashlight_client_idle_connections", "Idle connections from browsers")
+	}
+	if idleTimeout > 0 {
+		go tracker.reapIdle()
+	}
+	return tracker
+}
+
+// onStateChange is used as the http.Server's ConnState hook
+func (tracker *connTracker) onStateChange(conn net.Conn, state http.ConnState) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	switch state {
+	case http.StateNew:
+		tracker.open++
+	case http.StateActive:
+		delete(tracker.idle, conn)
+	case http.StateIdle:
+		tracker.idle[conn] = time.Now()
+		if tracker.maxIdle > 0 && len(tracker.idle) > tracker.maxIdle {
+			tracker.closeOldestIdle()
+		}
+	case http.StateHijacked, http.StateClosed:
+		tracker.open--
+		delete(tracker.idle, conn)
+	}
+	tracker.updateGauges()
+}
+
+// closeOldestIdle closes the connection that has been idle the longest.  Must
+// be called while holding the mutex.
+func (tracker *connTracker) closeOldestIdle() {
+	var oldest net.Conn
+	var oldestTime time.Time
+	for conn, since := range tracker.idle {
+		if oldest == nil || since.Before(oldestTime) {
+			oldest, oldestTime = conn, since
+		}
+	}
+	delete(tracker.idle, oldest)
+	oldest.Close()
+}
+
+func (tracker *connTracker) reapIdle() {
+	for {
+		time.Sleep(idleReapInterval)
+		cutoff := time.Now().Add(-1 * tracker.idleTimeout)
+		tracker.mutex.Lock()
+		reaped := 0
+		for conn, since := range tracker.idle {
+			if since.Before(cutoff) {
+				delete(tracker.idle, conn)
+				conn.Close()
+				reaped++
+			}
+		}
+		tracker.updateGauges()
+		tracker.mutex.Unlock()
+		if reaped > 0 {
+			log.Debugf("Closed %d idle browser connections", reaped)
+		}
+	}
+}
+
+func (tracker *connTracker) updateGauges() {
+	if tracker.openGauge != nil {
+		tracker.openGauge.Set(int64(tracker.open))
+		tracker.idleGauge.Set(int64(len(tracker.idle)))
+	}
+}
+
+func (tracker *connTracker) openConns() int {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.open
+}
+
+// throttledListener is a net.Listener that delays accepting new connections
+// when more than throttleAt connections are already open, increasingly so the
+// more connections are open.
+type throttledListener struct {
+	net.Listener
+	tracker    *connTracker
+	throttleAt int
+}
+
+func (l *throttledListener) Accept() (net.Conn, error) {
+	if l.throttleAt > 0 {
+		open := l.tracker.openConns()
+		if open > l.throttleAt {
+			delay := time.Duration(open-l.throttleAt) * time.Millisecond
+			if delay > MAX_ACCEPT_DELAY {
+				delay = MAX_ACCEPT_DELAY
+			}
+			time.Sleep(delay)
+		}
+	}
+	return l.Listener.Accept()
+}
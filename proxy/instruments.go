@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/metrics"
+)
+
+// clientInstruments are the metrics that the client collects about its own
+// traffic and its connection to the server
+type clientInstruments struct {
+	requests         *metrics.Counter
+	bytesUp          *metrics.Counter
+	bytesDown        *metrics.Counter
+	connected        *metrics.Gauge
+	healthyUpstreams *metrics.Gauge
+	dialErrors       *metrics.Counter
+	dialDurations    *metrics.Histogram
+}
+
+// instrument sets up the client's instruments, if it has a Metrics registry
+func (client *Client) instrument() {
+	if client.Metrics == nil {
+		return
+	}
+	registry := client.Metrics
+	client.instruments = &clientInstruments{
+		requests:         registry.Counter("flashlight_client_requests_total", "Requests (including CONNECTs) received from browsers"),
+		bytesUp:          registry.Counter("flashlight_client_bytes_up_total", "Bytes received from browsers"),
+		bytesDown:        registry.Counter("flashlight_client_bytes_down_total", "Bytes sent to browsers"),
+		connected:        registry.Gauge("flashlight_upstream_connected", "1 if the last attempt to reach the server succeeded, 0 otherwise"),
+		healthyUpstreams: registry.Gauge("flashlight_upstreams_healthy", "Addresses at which the server can be reached that are currently healthy"),
+		dialErrors:       registry.Counter("flashlight_upstream_dial_errors_total", "Failed attempts to reach the server"),
+		dialDurations:    registry.Histogram("flashlight_upstream_dial_milliseconds", "Time taken to reach the server, including the TLS handshake", metrics.LATENCY_BUCKETS),
+	}
+}
+
+// recordDial records the outcome of an attempt to reach the server
+func (client *Client) recordDial(start time.Time, err error) {
+	instruments := client.instruments
+	if err != nil {
+		instruments.dialErrors.Inc()
+		instruments.connected.Set(0)
+	} else {
+		instruments.dialDurations.Observe(int64(time.Now().Sub(start) / time.Millisecond))
+		instruments.connected.Set(1)
+	}
+	if client.Balancer != nil {
+		healthy := 0
+		for _, upstream := range client.Balancer.Status() {
+			if upstream.Healthy {
+				healthy++
+			}
+		}
+		instruments.healthyUpstreams.Set(int64(healthy))
+	}
+}
+
+// countingRequests wraps the given handler, counting the requests received
+// from clients
+func (server *Server) countingRequests(handler http.Handler) http.Handler {
+	requests := server.Metrics.Counter("flashlight_requests_total", "Requests received from clients, including probes and requests without valid credentials")
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests.Inc()
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// countingConns wraps the given listener, keeping track of the open
+// connections in a gauge
+func (server *Server) countingConns(l net.Listener) net.Listener {
+	return &countedListener{l, server.Metrics.Gauge("flashlight_server_open_connections", "Open connections from clients")}
+}
+
+type countedListener struct {
+	net.Listener
+	open *metrics.Gauge
+}
+
+func (l *countedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.open.Add(1)
+	return &countedConn{Conn: conn, open: l.open}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	open      *metrics.Gauge
+	closeOnce sync.Once
+}
+
+func (conn *countedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.open.Add(-1)
+	})
+	return conn.Conn.Close()
+}
+
+// timingHandshakes wraps the given TLS listener, recording how long the
+// handshakes of its connections take and how many fail
+func (server *Server) timingHandshakes(l net.Listener) net.Listener {
+	return &handshakeTimingListener{
+		Listener:  l,
+		durations: server.Metrics.Histogram("flashlight_tls_handshake_milliseconds", "Time taken by TLS handshakes with clients", metrics.LATENCY_BUCKETS),
+		failures:  server.Metrics.Counter("flashlight_tls_handshake_failures_total", "TLS handshakes with clients that failed"),
+	}
+}
+
+type handshakeTimingListener struct {
+	net.Listener
+	durations *metrics.Histogram
+	failures  *metrics.Counter
+}
+
+func (l *handshakeTimingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return conn, nil
+	}
+	return &handshakeTimingConn{Conn: tlsConn, listener: l}, nil
+}
+
+// handshakeTimingConn performs the handshake on the first Read (which is
+// when it would happen anyway) and times it
+type handshakeTimingConn struct {
+	*tls.Conn
+	listener      *handshakeTimingListener
+	handshakeOnce sync.Once
+}
+
+func (conn *handshakeTimingConn) Read(b []byte) (int, error) {
+	conn.handshakeOnce.Do(func() {
+		start := time.Now()
+		if err := conn.Conn.Handshake(); err != nil {
+			conn.listener.failures.Inc()
+			return
+		}
+		conn.listener.durations.Observe(int64(time.Now().Sub(start) / time.Millisecond))
+	})
+	return conn.Conn.Read(b)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	PAC_PATH = "/proxy.pac"
+)
+
+// clientAllowed checks whether the given remote address is allowed to use the
+// client proxy.  DeniedClientNets take precedence.  If no AllowedClientNets
+// were configured, only loopback and private network addresses are allowed,
+// so that a client listening beyond localhost doesn't become an open proxy.
+func (client *Client) clientAllowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range client.DeniedClientNets {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	allowed := client.AllowedClientNets
+	if len(allowed) == 0 {
+		allowed = localNetworks
+	}
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPACRequest determines whether the request is for our PAC file (as opposed
+// to being a proxied request).
+func isPACRequest(req *http.Request) bool {
+	return req.Method == "GET" && req.URL.Host == "" && req.URL.Path == PAC_PATH
+}
+
+// servePAC serves a proxy auto-config file pointing at the address through
+// which the requester reached us, which lets LAN devices configure themselves
+// from the URL advertised via mDNS.
+func (client *Client) servePAC(resp http.ResponseWriter, req *http.Request) {
+	log.Debugf("Serving PAC file to %s", req.RemoteAddr)
+	resp.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprintf(resp, "function FindProxyForURL(url, host) {\n  return \"PROXY %s\";\n}\n", req.Host)
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/flashlight/cloak"
+	"github.com/getlantern/flashlight/hotrestart"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/mux"
+	"github.com/getlantern/flashlight/obfs"
+)
+
+// listenAddrs returns the addresses on which the server listens.  Addr may
+// contain a comma-separated list of addresses, e.g. "0.0.0.0:443,[::]:443".
+func (server *Server) listenAddrs() []string {
+	var addrs []string
+	for _, addr := range strings.Split(server.Addr, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// listenNetwork determines the network on which to listen for the given
+// address.  Literal IPv4 and IPv6 addresses are bound to tcp4 and tcp6
+// respectively, so that (for example) [::]:443 only accepts IPv6 and doesn't
+// behave differently depending on the platform's dual-stack defaults.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// serveTLS serves the given http.Server with TLS on all of the server's
+// listen addresses (and without TLS at PlainAddr, if set), returning as soon
+// as any of them fails.
+func (server *Server) serveTLS(httpServer *http.Server) error {
+	httpServer.TLSConfig.GetCertificate = server.CertContext.certs.getCertificate
+	if server.CertContext.External {
+		go server.CertContext.certs.watch()
+	}
+
+	addrs := server.listenAddrs()
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		network := listenNetwork(addr)
+		l, err := hotrestart.Listen(network, addr)
+		if err != nil {
+			for _, previous := range listeners {
+				previous.Close()
+			}
+			return fmt.Errorf("Unable to listen at %s: %s", addr, err)
+		}
+		log.Infof("About to start server (https) proxy at %s (%s)", addr, network)
+		if server.Metrics != nil {
+			l = server.countingConns(l)
+		}
+		if server.KnockGate != nil {
+			l = server.KnockGate.Wrap(l)
+		}
+		l = server.trackingConns(l)
+		if server.ObfsKey != nil {
+			l = &obfs.Listener{Listener: l, Key: server.ObfsKey}
+		}
+		if server.CloakPSK != nil {
+			l = &cloak.Listener{Listener: l, PSK: server.CloakPSK, Decoy: server.CloakDecoy}
+		}
+		listeners = append(listeners, l)
+	}
+	var plainListener net.Listener
+	if server.PlainAddr != "" {
+		var err error
+		plainListener, err = hotrestart.Listen(listenNetwork(server.PlainAddr), server.PlainAddr)
+		if err != nil {
+			for _, previous := range listeners {
+				previous.Close()
+			}
+			return fmt.Errorf("Unable to listen at %s: %s", server.PlainAddr, err)
+		}
+	}
+
+	server.servingWith(httpServer)
+	errors := make(chan error, 2*len(listeners)+1)
+	for _, l := range listeners {
+		if len(server.SNIRoutes) > 0 {
+			var decoyed net.Listener
+			l, decoyed = server.routingBySNI(l)
+			if server.routesToDecoy() {
+				go func() {
+					errors <- server.serveDecoyTLS(decoyed, httpServer)
+				}()
+			}
+		}
+		go func(l net.Listener) {
+			tlsListener := tls.NewListener(l, httpServer.TLSConfig)
+			if server.Metrics != nil {
+				tlsListener = server.timingHandshakes(tlsListener)
+			}
+			// Clients may multiplex their requests over a few connections
+			errors <- httpServer.Serve(&mux.Listener{Listener: tlsListener})
+		}(l)
+	}
+	if plainListener != nil {
+		go func() {
+			errors <- server.servePlain(plainListener, httpServer)
+		}()
+	}
+	// Everything is listening, so a process that we're replacing can stop
+	hotrestart.Ready()
+	err := <-errors
+	if server.isDraining() {
+		// Closing the listeners stopped serving, wait for the connections
+		<-server.drained
+		return nil
+	}
+	return err
+}
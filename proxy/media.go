@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+const (
+	// MEDIA_FLUSH_INTERVAL is how often responses from media hosts are flushed
+	// to the browser.  Players buffer ahead anyway, so fewer and bigger writes
+	// cost nothing and save overhead.
+	MEDIA_FLUSH_INTERVAL = 1 * time.Second
+
+	// MEDIA_BUFFER_SIZE is the size of the buffers with which tunnels to media
+	// hosts are piped
+	MEDIA_BUFFER_SIZE = 256 * 1024
+)
+
+// isMedia determines whether host is one of the MediaHosts, whose traffic is
+// handled with the media profile
+func (client *Client) isMedia(host string) bool {
+	return client.MediaHosts.Matches(normalizeHost(host))
+}
+
+// buildMediaProxy builds the httputil.ReverseProxy used for plaintext
+// requests to media hosts.  Unlike the regular reverse proxy, it leaves
+// responses alone (no prefetching, coalescing, response limit or splitting,
+// which would get in the way of range requests and long streams) and flushes
+// less often.  Dumping, retries and the stall watchdog still apply.
+func (client *Client) buildMediaProxy() {
+	client.mediaProxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			client.Script.TransformHeaders(req)
+		},
+		Transport: client.withDumping(withRetries(client.MaxRetries, withStallWatchdog(client.StallTimeout, client.Metrics, &http.Transport{
+			// See buildReverseProxy
+			DisableKeepAlives:     true,
+			ResponseHeaderTimeout: client.StallTimeout,
+			Dial: func(network, addr string) (net.Conn, error) {
+				conn, err := client.dialUpstream(addr)
+				if err != nil {
+					return nil, &dialError{err}
+				}
+				return conn, nil
+			},
+		}))),
+		FlushInterval: MEDIA_FLUSH_INTERVAL,
+	}
+}
+
+// pipeBuffered is like pipe, but copies using buffers of the given size
+func pipeBuffered(a net.Conn, b net.Conn, size int) {
+	// Hide ReadFrom and WriteTo so that io.CopyBuffer actually uses the
+	// buffer instead of copying in small chunks
+	copyBuffered := func(dst net.Conn, src net.Conn) {
+		io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, size))
+	}
+	done := make(chan bool, 2)
+	go func() {
+		copyBuffered(a, b)
+		done <- true
+	}()
+	go func() {
+		copyBuffered(b, a)
+		done <- true
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/notices"
+)
+
+const (
+	// NOTICES_HEADER marks requests from the client for the server's notices
+	NOTICES_HEADER = "X-Flashlight-Notices"
+
+	// NOTICES_INTERVAL is how often the client fetches the server's notices
+	NOTICES_INTERVAL = 30 * time.Minute
+)
+
+// noticeState holds the notices last fetched from the server
+type noticeState struct {
+	current []*notices.Notice
+	mutex   sync.RWMutex
+}
+
+// servingNotices wraps the given handler, answering requests for notices with
+// the current notices from the NoticesFile.  It goes inside of auth.Handler,
+// so that only authenticated clients get to see them.
+func (server *Server) servingNotices(handler http.Handler) http.Handler {
+	if server.NoticesFile == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(NOTICES_HEADER) == "" {
+			handler.ServeHTTP(resp, req)
+			return
+		}
+		all, err := notices.ReadFile(server.NoticesFile)
+		if err != nil {
+			log.Errorf("Unable to serve notices: %s", err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		current := notices.Current(all, time.Now())
+		if current == nil {
+			current = []*notices.Notice{}
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(current)
+	})
+}
+
+// fetchNoticesPeriodically fetches the server's notices every
+// NOTICES_INTERVAL
+func (client *Client) fetchNoticesPeriodically() {
+	for {
+		if err := client.fetchNotices(); err != nil {
+			log.Debugf("Unable to fetch notices: %s", err)
+		}
+		time.Sleep(NOTICES_INTERVAL)
+	}
+}
+
+// fetchNotices fetches the server's notices, logging the ones that weren't
+// seen before
+func (client *Client) fetchNotices() error {
+	var current []*notices.Notice
+	err := client.askServer(NOTICES_HEADER, func(body io.Reader) error {
+		if err := json.NewDecoder(body).Decode(&current); err != nil {
+			return fmt.Errorf("Unable to parse notices: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	client.notices.mutex.Lock()
+	defer client.notices.mutex.Unlock()
+	seen := make(map[string]bool, len(client.notices.current))
+	for _, notice := range client.notices.current {
+		seen[notice.Id] = true
+	}
+	for _, notice := range current {
+		if !seen[notice.Id] {
+			log.Debugf("Notice from the server: %s", notice.Message)
+		}
+	}
+	client.notices.current = current
+	return nil
+}
+
+// Notices returns the notices last fetched from the server
+func (client *Client) Notices() []*notices.Notice {
+	client.notices.mutex.RLock()
+	defer client.notices.mutex.RUnlock()
+	return client.notices.current
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// UPSTREAM_HEADER forces a single request through a chosen route, for
+	// A/B debugging of sites that break through some routes but not others,
+	// e.g.
+	//
+	//   X-Flashlight-Upstream: masquerade=cdn.example.org, transport=websocket
+	//
+	// It's only honored for requests from localhost that don't come from a web
+	// page (which browsers mark with an Origin header), and never forwarded.
+	UPSTREAM_HEADER = "X-Flashlight-Upstream"
+)
+
+// Pin is the route that UPSTREAM_HEADER chose.  Empty fields are chosen the
+// usual way.
+type Pin struct {
+	Server     string // FQDN of the server
+	Masquerade string // host at which to reach the server
+	Transport  string // one of TRANSPORTS
+}
+
+// ParsePin parses the value of UPSTREAM_HEADER, a comma-separated list of
+// server=, masquerade= and transport= settings
+func ParsePin(value string) (*Pin, error) {
+	pin := &Pin{}
+	for _, setting := range strings.Split(value, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid setting %s, expected name=value", setting)
+		}
+		name, value := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+		switch name {
+		case "server":
+			pin.Server = value
+		case "masquerade":
+			pin.Masquerade = value
+		case "transport":
+			pin.Transport = value
+			if !contains(TRANSPORTS, value) {
+				return nil, fmt.Errorf("Unknown transport %s, available transports are %v", value, TRANSPORTS)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown setting %s, expected server, masquerade or transport", name)
+		}
+	}
+	return pin, nil
+}
+
+// servePinned serves a request carrying UPSTREAM_HEADER through the route
+// that it chose, bypassing the usual routing (overrides, bypass, scripts and
+// retries) so that only the route differs between attempts
+func (client *Client) servePinned(resp http.ResponseWriter, req *http.Request) {
+	value := req.Header.Get(UPSTREAM_HEADER)
+	req.Header.Del(UPSTREAM_HEADER)
+	if !isLoopback(req.RemoteAddr) {
+		log.Errorf("Refusing %s from %s, which isn't on localhost", UPSTREAM_HEADER, req.RemoteAddr)
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if origin := req.Header.Get("Origin"); origin != "" {
+		// Any page that the browser loads through us is also on localhost
+		log.Errorf("Refusing %s from web page at %s", UPSTREAM_HEADER, origin)
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if client.PinnedConfig == nil {
+		http.Error(resp, UPSTREAM_HEADER+" is not supported here", http.StatusNotImplemented)
+		return
+	}
+	pin, err := ParsePin(value)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config, err := client.PinnedConfig(pin)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	transport := pin.Transport
+	if transport == "" {
+		transport = client.transport()
+	}
+	log.Debugf("Pinning request for %s to %+v", req.Host, pin)
+	dial := func(addr string) (net.Conn, error) {
+		if transport == TRANSPORT_WEBSOCKET {
+			return dialWebSocketWith(config, addr)
+		}
+		conn := &enproxy.Conn{
+			Addr:   addr,
+			Config: config,
+		}
+		if err := conn.Connect(); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	if req.Method == CONNECT {
+		remote, err := dial(req.Host)
+		if err != nil {
+			log.Errorf("Unable to connect to %s through pinned route: %s", req.Host, err)
+			resp.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		client.pipeConnect(resp, req, remote)
+		return
+	}
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {},
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			Dial: func(network, addr string) (net.Conn, error) {
+				return dial(addr)
+			},
+		},
+		FlushInterval: REVERSE_PROXY_FLUSH_INTERVAL,
+	}
+	reverseProxy.ServeHTTP(resp, req)
+}
+
+// isLoopback determines whether the given remote address is on localhost
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func contains(list []string, item string) bool {
+	for _, candidate := range list {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/enproxy"
+)
+
+func TestParsePin(t *testing.T) {
+	pin, err := ParsePin("server=fl.example.com, Masquerade=cdn.example.org,transport=websocket")
+	if err != nil {
+		t.Fatalf("Unable to parse pin: %s", err)
+	}
+	expected := Pin{Server: "fl.example.com", Masquerade: "cdn.example.org", Transport: TRANSPORT_WEBSOCKET}
+	if *pin != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *pin)
+	}
+	for _, invalid := range []string{"masquerade", "transport=pigeon", "route=direct", "server="} {
+		if _, err := ParsePin(invalid); err == nil {
+			t.Errorf("Expected %s to be refused", invalid)
+		}
+	}
+}
+
+func TestPinnedOnlyFromLocalhost(t *testing.T) {
+	client := &Client{}
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req.Header.Set(UPSTREAM_HEADER, "transport=websocket")
+	req.RemoteAddr = "192.168.1.20:51000"
+	rec := httptest.NewRecorder()
+	client.servePinned(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected request from the LAN to be refused, got %d", rec.Code)
+	}
+	if req.Header.Get(UPSTREAM_HEADER) != "" {
+		t.Error("Header should have been stripped")
+	}
+
+	req.Header.Set(UPSTREAM_HEADER, "transport=pigeon")
+	req.RemoteAddr = "127.0.0.1:51000"
+	rec = httptest.NewRecorder()
+	client.PinnedConfig = func(pin *Pin) (*enproxy.Config, error) { return nil, nil }
+	client.servePinned(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid pin to be refused, got %d", rec.Code)
+	}
+}
+
+func TestPinnedNotFromWebPages(t *testing.T) {
+	client := &Client{PinnedConfig: func(pin *Pin) (*enproxy.Config, error) { return nil, nil }}
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req.Header.Set(UPSTREAM_HEADER, "masquerade=evil.example.com")
+	req.Header.Set("Origin", "http://evil.example.com")
+	req.RemoteAddr = "127.0.0.1:51000"
+	rec := httptest.NewRecorder()
+	client.servePinned(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected request from a web page to be refused, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/metrics"
+)
+
+const (
+	// PREFETCH_SCAN_BYTES limits how much of each page is scanned for
+	// referenced hosts.  Most of the hosts a page loads from are referenced
+	// in its head, so there's little point in scanning further.
+	PREFETCH_SCAN_BYTES = 64 * 1024
+
+	// MAX_PREFETCHES_PER_PAGE limits how many hosts are prefetched per page
+	MAX_PREFETCHES_PER_PAGE = 10
+
+	// MAX_PRECONNECTED limits how many preconnected tunnels are kept open
+	MAX_PRECONNECTED = 32
+
+	// PRECONNECT_TTL is how long a preconnected tunnel is kept open waiting
+	// for the browser to use it
+	PRECONNECT_TTL = 10 * time.Second
+
+	// prefetchOverlap is how much of the end of each chunk is scanned again
+	// along with the next one, so that references split across reads are
+	// found
+	prefetchOverlap = 512
+)
+
+var (
+	referencedHostPattern = regexp.MustCompile(`(?i)(?:src|href)\s*=\s*["']?(?:(https?):)?//([a-z0-9.-]+(?::[0-9]+)?)`)
+
+	// linkPattern matches the entries of Link headers, e.g.
+	// <https://cdn.example.com>; rel=preconnect
+	linkPattern = regexp.MustCompile(`<([^>]*)>([^<]*)`)
+	relPattern  = regexp.MustCompile(`(?i);\s*rel\s*=\s*"?([^";,]*)`)
+
+	// hintRelations are the relations of Link header entries with which
+	// sites tell browsers which hosts they're about to need
+	hintRelations = map[string]bool{
+		"preconnect":    true,
+		"dns-prefetch":  true,
+		"preload":       true,
+		"modulepreload": true,
+		"prefetch":      true,
+	}
+)
+
+// prefetchState holds the tunnels that were opened ahead of time to hosts
+// referenced by proxied pages
+type prefetchState struct {
+	conns    map[string]net.Conn // preconnected tunnels by address
+	mutex    sync.Mutex
+	prefetch *metrics.Counter
+	used     *metrics.Counter
+}
+
+// withPrefetching creates a RoundTripper that uses the supplied RoundTripper
+// and that scans HTML responses for the third-party hosts they reference, and
+// all responses for hosts hinted at by their Link headers (which arrive before
+// the page itself).  While the browser is still loading the page, hosts that
+// are reached directly are resolved and tunnels to the others are opened, so
+// that the round trips to the server (and the server's DNS lookup) are out of
+// the way by the time the browser asks for them.
+func (client *Client) withPrefetching(rt http.RoundTripper) http.RoundTripper {
+	if !client.Prefetch {
+		return rt
+	}
+	if client.Metrics != nil {
+		client.prefetched.prefetch = client.Metrics.Counter("flashlight_prefetches_total", "Hosts referenced by proxied pages that were resolved or preconnected ahead of time")
+		client.prefetched.used = client.Metrics.Counter("flashlight_preconnects_used_total", "Preconnected tunnels that were used before they expired")
+	}
+	return &prefetchingRoundTripper{rt, client}
+}
+
+// prefetchingRoundTripper is an http.RoundTripper that wraps another
+// http.RoundTripper and prefetches the hosts referenced by HTML responses.
+type prefetchingRoundTripper struct {
+	orig   http.RoundTripper
+	client *Client
+}
+
+func (rt *prefetchingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.orig.RoundTrip(req)
+	if err != nil || req.Method != "GET" {
+		return resp, err
+	}
+	rt.client.prefetchHinted(resp.Header["Link"], normalizeHost(req.Host))
+	if !isHTML(resp) {
+		return resp, nil
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" && encoding != "gzip" {
+		return resp, nil
+	}
+	pr, pw := io.Pipe()
+	resp.Body = &teeBody{ReadCloser: resp.Body, pw: pw}
+	go rt.client.scanForPrefetch(pr, encoding == "gzip", normalizeHost(req.Host))
+	return resp, nil
+}
+
+// isHTML determines whether the response is a page worth scanning
+func isHTML(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html")
+}
+
+// teeBody copies what's read from the body to a pipe, which is read by the
+// scanner.  Once the scanner is done (or fails), the body is read as usual.
+type teeBody struct {
+	io.ReadCloser
+	pw *io.PipeWriter
+}
+
+func (body *teeBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	if n > 0 && body.pw != nil {
+		if _, werr := body.pw.Write(p[:n]); werr != nil {
+			body.pw = nil
+		}
+	}
+	if err != nil && body.pw != nil {
+		body.pw.Close()
+		body.pw = nil
+	}
+	return n, err
+}
+
+func (body *teeBody) Close() error {
+	if body.pw != nil {
+		body.pw.Close()
+		body.pw = nil
+	}
+	return body.ReadCloser.Close()
+}
+
+// scanForPrefetch reads the beginning of a page from pr and prefetches the
+// hosts it references other than the page's own host
+func (client *Client) scanForPrefetch(pr *io.PipeReader, gzipped bool, pageHost string) {
+	// Stop the tee once we're done so that it doesn't block the browser
+	defer pr.Close()
+	var r io.Reader = pr
+	if gzipped {
+		gz, err := gzip.NewReader(pr)
+		if err != nil {
+			return
+		}
+		r = gz
+	}
+	r = io.LimitReader(r, PREFETCH_SCAN_BYTES)
+
+	seen := map[string]bool{pageHost: true}
+	prefetched := 0
+	buf := make([]byte, 0, prefetchOverlap+32*1024)
+	for prefetched < MAX_PREFETCHES_PER_PAGE {
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		for _, addr := range scanHosts(buf, err != nil) {
+			host := normalizeHost(addr)
+			if seen[host] || prefetched == MAX_PREFETCHES_PER_PAGE {
+				continue
+			}
+			seen[host] = true
+			prefetched += 1
+			go client.prefetch(addr)
+		}
+		if err != nil {
+			return
+		}
+		if len(buf) > prefetchOverlap {
+			buf = append(buf[:0], buf[len(buf)-prefetchOverlap:]...)
+		}
+	}
+}
+
+// scanHosts finds the addresses (host:port) referenced by src and href
+// attributes in buf.  Unless complete, references that run up to the end of
+// buf might be cut off and are skipped (they'll be found along with the next
+// read).
+func scanHosts(buf []byte, complete bool) []string {
+	var addrs []string
+	for _, m := range referencedHostPattern.FindAllSubmatchIndex(buf, -1) {
+		if !complete && m[1] == len(buf) {
+			continue
+		}
+		scheme := ""
+		if m[2] >= 0 {
+			scheme = strings.ToLower(string(buf[m[2]:m[3]]))
+		}
+		host := strings.ToLower(string(buf[m[4]:m[5]]))
+		if strings.Trim(host, ".-") == "" {
+			continue
+		}
+		addrs = append(addrs, withDefaultPort(scheme, host))
+	}
+	return addrs
+}
+
+// prefetchHinted prefetches the hosts other than the page's own host that the
+// given Link header values hint at
+func (client *Client) prefetchHinted(links []string, pageHost string) {
+	seen := map[string]bool{pageHost: true}
+	prefetched := 0
+	for _, addr := range hintedHosts(links) {
+		host := normalizeHost(addr)
+		if seen[host] || prefetched == MAX_PREFETCHES_PER_PAGE {
+			continue
+		}
+		seen[host] = true
+		prefetched += 1
+		go client.prefetch(addr)
+	}
+}
+
+// hintedHosts finds the addresses (host:port) of the Link header entries
+// with one of the hintRelations.  Relative links are skipped.
+func hintedHosts(links []string) []string {
+	var addrs []string
+	for _, link := range links {
+		for _, m := range linkPattern.FindAllStringSubmatch(link, -1) {
+			rel := relPattern.FindStringSubmatch(m[2])
+			if rel == nil || !isHint(rel[1]) {
+				continue
+			}
+			u, err := url.Parse(strings.TrimSpace(m[1]))
+			if err != nil || u.Host == "" || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+				continue
+			}
+			addrs = append(addrs, withDefaultPort(u.Scheme, strings.ToLower(u.Host)))
+		}
+	}
+	return addrs
+}
+
+// isHint determines whether any of the space-separated relations is one of the
+// hintRelations
+func isHint(rels string) bool {
+	for _, rel := range strings.Fields(strings.ToLower(rels)) {
+		if hintRelations[rel] {
+			return true
+		}
+	}
+	return false
+}
+
+// withDefaultPort adds the default port of the scheme to host if it has none.
+// References without a scheme on plaintext pages are plaintext too.
+func withDefaultPort(scheme string, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// prefetch resolves the given address if it's reached directly, and otherwise
+// opens a tunnel to it that's handed to the next dial to that address
+func (client *Client) prefetch(addr string) {
+	if client.prefetched.prefetch != nil {
+		client.prefetched.prefetch.Inc()
+	}
+	if client.shouldGoDirect(addr) {
+		host, _, _ := net.SplitHostPort(addr)
+		net.LookupHost(host)
+		return
+	}
+	client.preconnect(addr)
+}
+
+// preconnect opens a tunnel to addr unless one is already waiting
+func (client *Client) preconnect(addr string) {
+	state := &client.prefetched
+	state.mutex.Lock()
+	if state.conns == nil {
+		state.conns = make(map[string]net.Conn)
+	}
+	_, exists := state.conns[addr]
+	if exists || len(state.conns) >= MAX_PRECONNECTED {
+		state.mutex.Unlock()
+		return
+	}
+	// Reserve the slot while dialing
+	state.conns[addr] = nil
+	state.mutex.Unlock()
+
+	conn, err := client.dialUpstream(addr)
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if err != nil {
+		log.Debugf("Unable to preconnect to %s: %s", addr, err)
+		delete(state.conns, addr)
+		return
+	}
+	log.Debugf("Preconnected to %s", addr)
+	state.conns[addr] = conn
+	time.AfterFunc(PRECONNECT_TTL, func() {
+		state.mutex.Lock()
+		defer state.mutex.Unlock()
+		if state.conns[addr] == conn {
+			delete(state.conns, addr)
+			conn.Close()
+		}
+	})
+}
+
+// hasPreconnected determines whether a preconnected tunnel to addr is waiting
+func (client *Client) hasPreconnected(addr string) bool {
+	state := &client.prefetched
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.conns[addr] != nil
+}
+
+// takePreconnected returns the preconnected tunnel to addr, if any
+func (client *Client) takePreconnected(addr string) net.Conn {
+	state := &client.prefetched
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	conn := state.conns[addr]
+	if conn == nil {
+		return nil
+	}
+	delete(state.conns, addr)
+	if state.used != nil {
+		state.used.Inc()
+	}
+	return conn
+}
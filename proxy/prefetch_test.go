@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScanHosts(t *testing.T) {
+	page := []byte(`<html><head>
+<script src="https://cdn.example.com/app.js"></script>
+<link rel="stylesheet" HREF='http://Fonts.Example.org:8080/css'>
+<img src=//img.example.net/logo.png>
+<a href="/relative">relative links are skipped</a>
+<a href="https://`)
+	expected := []string{"cdn.example.com:443", "fonts.example.org:8080", "img.example.net:80"}
+	if addrs := scanHosts(page, true); !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Expected %v, got %v", expected, addrs)
+	}
+}
+
+func TestScanHostsCutOff(t *testing.T) {
+	page := []byte(`<script src="https://cdn.exa`)
+	if addrs := scanHosts(page, false); len(addrs) != 0 {
+		t.Errorf("Reference that might be cut off should be skipped, got %v", addrs)
+	}
+	if addrs := scanHosts(page, true); !reflect.DeepEqual(addrs, []string{"cdn.exa:443"}) {
+		t.Errorf("Reference at the end of a complete page should be found, got %v", addrs)
+	}
+}
+
+func TestHintedHosts(t *testing.T) {
+	links := []string{
+		`<https://CDN.example.com>; rel=preconnect, </style.css>; rel=preload; as=style`,
+		`<//fonts.example.org:8080/font.woff2>; rel="preload prefetch"; crossorigin`,
+		`<https://api.example.net/>; rel=dns-prefetch`,
+		`<https://example.com/page2>; rel=next, <ftp://files.example.com/>; rel=prefetch`,
+	}
+	expected := []string{"cdn.example.com:443", "fonts.example.org:8080", "api.example.net:443"}
+	if addrs := hintedHosts(links); !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Expected %v, got %v", expected, addrs)
+	}
+}
@@ -99,6 +99,8 @@ func TestCloudFlare(t *testing.T) {
 			ReadTimeout:  0, // don't timeout
 			WriteTimeout: 0,
 		},
+		// Our mock servers are local, but we want to test the tunnel
+		TunnelLocalDestinations: true,
 		EnproxyConfig: &enproxy.Config{
 			DialProxy: func(addr string) (net.Conn, error) {
 				return tls.Dial("tcp", CF_ADDR, &tls.Config{
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/getlantern/flashlight/auth"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// RENEW_RETRY_INTERVAL is how long to wait before retrying a failed
+	// renewal of the client's credentials
+	RENEW_RETRY_INTERVAL = 1 * time.Minute
+
+	// MAX_CREDENTIALS_LENGTH limits the size of renewed credentials
+	MAX_CREDENTIALS_LENGTH = 4096
+)
+
+// renewCredentialsPeriodically renews the client's Credentials with the
+// server whenever they're due, for as long as they can be renewed
+func (client *Client) renewCredentialsPeriodically() {
+	for {
+		renewAt := client.Credentials.RenewAt()
+		if renewAt.IsZero() {
+			return
+		}
+		time.Sleep(renewAt.Sub(time.Now()))
+		if err := client.renewCredentials(); err != nil {
+			log.Errorf("Unable to renew credentials, will retry: %s", err)
+			time.Sleep(RENEW_RETRY_INTERVAL)
+		}
+	}
+}
+
+// renewCredentials asks the server for replacement credentials and switches
+// to them
+func (client *Client) renewCredentials() error {
+	var credentials string
+	err := client.askServer(auth.RENEW_HEADER, func(body io.Reader) error {
+		data, err := ioutil.ReadAll(io.LimitReader(body, MAX_CREDENTIALS_LENGTH))
+		credentials = string(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := client.Credentials.Renewed(credentials); err != nil {
+		return fmt.Errorf("Unable to use renewed credentials: %s", err)
+	}
+	log.Debugf("Renewed credentials, next renewal at %s", client.Credentials.RenewAt())
+	if client.OnCredentialsRenewed != nil {
+		client.OnCredentialsRenewed(credentials)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// MAX_REPLAYABLE_BODY is the biggest request body that's kept around in
+	// order to retry the request
+	MAX_REPLAYABLE_BODY = 1024 * 1024
+)
+
+var (
+	idempotentMethods = map[string]bool{
+		"GET":     true,
+		"HEAD":    true,
+		"OPTIONS": true,
+		"TRACE":   true,
+		"PUT":     true,
+		"DELETE":  true,
+	}
+)
+
+// dialError marks errors that occurred while dialing the upstream, which
+// guarantees that no part of the request was sent.
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string {
+	return e.err.Error()
+}
+
+// withRetries creates a RoundTripper that uses the supplied RoundTripper and
+// that retries failed requests up to maxRetries times, but only if doing so
+// can't cause a request to be executed twice against the origin.
+func withRetries(maxRetries int, rt http.RoundTripper) http.RoundTripper {
+	if maxRetries <= 0 {
+		return rt
+	}
+	return &retryingRoundTripper{orig: rt, maxRetries: maxRetries}
+}
+
+// retryingRoundTripper is an http.RoundTripper that wraps another
+// http.RoundTripper and retries requests that are safe to replay.
+type retryingRoundTripper struct {
+	orig       http.RoundTripper
+	maxRetries int
+}
+
+func (rt *retryingRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	body, replayable := bufferBody(req)
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err = rt.orig.RoundTrip(req)
+		if err == nil || attempt >= rt.maxRetries || !replayable || !safeToRetry(req, err) {
+			return
+		}
+		log.Debugf("Retrying %s %s after error: %s", req.Method, req.URL, err)
+	}
+}
+
+// bufferBody reads the body of the request (if any) so that it can be sent
+// again.  Only bodies of idempotent requests are read, and only if they
+// declare a length of at most MAX_REPLAYABLE_BODY, so that other uploads
+// (including chunked ones) stream through as before.  Requests whose body
+// isn't buffered aren't replayable.
+func bufferBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.ContentLength == 0 {
+		return nil, true
+	}
+	if !idempotentMethods[req.Method] || req.ContentLength < 0 || req.ContentLength > MAX_REPLAYABLE_BODY {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		// Send what we've read, followed by the rest
+		req.Body = &multiReadCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body.Close()
+	return body, true
+}
+
+// multiReadCloser reads from Reader and closes Closer
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// safeToRetry determines whether a request that failed with the given error
+// can be retried without risking duplicate execution at the origin (provided
+// its body could be kept for replaying).  A request is safe to retry if it
+// never left the client (dial failure) or if its method is idempotent.
+//
+// Non-idempotent requests that did reach the server are never retried, even
+// if they carry an Idempotency-Key header: the server relays opaque enproxy
+// streams and can't deduplicate them, and nothing guarantees that the origin
+// honors the header.
+func safeToRetry(req *http.Request, err error) bool {
+	if _, ok := err.(*dialError); ok {
+		return true
+	}
+	return idempotentMethods[req.Method]
+}
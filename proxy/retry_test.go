@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// flakyRoundTripper fails the first failures requests, recording the bodies
+// of all requests it sees
+type flakyRoundTripper struct {
+	failures  int
+	dialFails bool // if set, fails as if the upstream couldn't be reached
+	bodies    []string
+	readers   []io.ReadCloser
+}
+
+func (rt *flakyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	rt.readers = append(rt.readers, req.Body)
+	if req.Body != nil {
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+	}
+	rt.bodies = append(rt.bodies, body)
+	if len(rt.bodies) <= rt.failures {
+		if rt.dialFails {
+			return nil, &dialError{fmt.Errorf("Connection refused")}
+		}
+		return nil, fmt.Errorf("Connection reset")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func post(body string, key string) *http.Request {
+	req, _ := http.NewRequest("POST", "http://example.com/charge", bytes.NewBufferString(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	return req
+}
+
+func TestPostNotRetried(t *testing.T) {
+	for _, key := range []string{"", "abc"} {
+		upstream := &flakyRoundTripper{failures: 1}
+		req := post("amount=5", key)
+		body := req.Body
+		if _, err := withRetries(2, upstream).RoundTrip(req); err == nil {
+			t.Errorf("Expected POST with key %q to fail without retrying", key)
+		}
+		if len(upstream.bodies) != 1 {
+			t.Errorf("Expected 1 attempt with key %q, got %d", key, len(upstream.bodies))
+		}
+		if upstream.readers[0] != body {
+			t.Errorf("Expected body of POST with key %q to be streamed, not buffered", key)
+		}
+	}
+}
+
+func TestPostRetriedAfterDialError(t *testing.T) {
+	upstream := &flakyRoundTripper{failures: 1, dialFails: true}
+	req, _ := http.NewRequest("POST", "http://example.com/ping", nil)
+	if _, err := withRetries(1, upstream).RoundTrip(req); err != nil {
+		t.Errorf("Expected POST without body to be retried after dial error: %s", err)
+	}
+
+	upstream = &flakyRoundTripper{failures: 1, dialFails: true}
+	if _, err := withRetries(1, upstream).RoundTrip(post("amount=5", "")); err == nil {
+		t.Error("Expected POST with body not to be retried, its body isn't kept")
+	}
+}
+
+func TestPutBodyReplayed(t *testing.T) {
+	upstream := &flakyRoundTripper{failures: 1}
+	req, _ := http.NewRequest("PUT", "http://example.com/doc", bytes.NewBufferString("contents"))
+	if _, err := withRetries(1, upstream).RoundTrip(req); err != nil {
+		t.Fatalf("Expected PUT to be retried: %s", err)
+	}
+	if len(upstream.bodies) != 2 || upstream.bodies[1] != "contents" {
+		t.Errorf("Unexpected attempts %q", upstream.bodies)
+	}
+}
+
+func TestLargeOrChunkedBodyNotReplayed(t *testing.T) {
+	for _, length := range []int64{MAX_REPLAYABLE_BODY + 1, -1} {
+		upstream := &flakyRoundTripper{failures: 1}
+		body := strings.Repeat("x", MAX_REPLAYABLE_BODY+1)
+		req, _ := http.NewRequest("PUT", "http://example.com/doc", bytes.NewBufferString(body))
+		req.ContentLength = length
+		reader := req.Body
+		if _, err := withRetries(2, upstream).RoundTrip(req); err == nil {
+			t.Errorf("Expected request with body of length %d to fail without retrying", length)
+		}
+		if len(upstream.bodies) != 1 || upstream.bodies[0] != body || upstream.readers[0] != reader {
+			t.Errorf("Expected the body of length %d to be streamed once, got %d attempts", length, len(upstream.bodies))
+		}
+	}
+}
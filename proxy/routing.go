@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/balancer"
+	"github.com/getlantern/flashlight/hostmatch"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/notices"
+)
+
+const (
+	ROUTE_DIRECT = "direct" // go directly to the destination
+	ROUTE_PROXY  = "proxy"  // go through the tunnel
+
+	ROUTE_CACHE_PREFIX = "route:" // prefix of route overrides in the RouteCache
+)
+
+// ClientStatus summarizes the runtime state of a Client
+type ClientStatus struct {
+	Addr         string                     `json:"addr"`
+	Connected    bool                       `json:"connected"`    // whether the last attempt to reach the server succeeded
+	Transport    string                     `json:"transport"`    // how traffic is carried to the server
+	Upstream     string                     `json:"upstream"`     // address (server or masquerade) at which the server was last reached
+	LastDial     time.Time                  `json:"lastDial"`     // when the client last tried to reach the server
+	BytesUp      int64                      `json:"bytesUp"`      // total bytes sent by all devices
+	BytesDown    int64                      `json:"bytesDown"`    // total bytes received by all devices
+	RecentErrors []*RecentError             `json:"recentErrors"` // the most recent errors reaching the server
+	Upstreams    []*balancer.UpstreamStatus `json:"upstreams"`    // health of each address at which the server can be reached
+	Notices      []*notices.Notice          `json:"notices"`      // notices from the server's operators
+	Bypass       bool                       `json:"bypass"`
+	Overrides    map[string]string          `json:"overrides"`
+	Dumping      map[string]string          `json:"dumping"` // per-host dump levels
+	Devices      []*Device                  `json:"devices"`
+
+	HeaderAlterations []*HeaderAlteration `json:"headerAlterations"` // the most recent alterations of security headers found by the audit
+}
+
+// SetBypass turns the quick bypass on or off.  While bypass is on, all
+// requests go directly to their destination.  Turning it on fails if
+// DisableBypass is set.
+func (client *Client) SetBypass(bypass bool) error {
+	if bypass && client.DisableBypass {
+		return fmt.Errorf("The quick bypass is disabled")
+	}
+	client.routingMutex.Lock()
+	defer client.routingMutex.Unlock()
+	client.bypass = bypass
+	return nil
+}
+
+// overridePattern is a compiled wildcard or regex route override
+type overridePattern struct {
+	pattern string
+	list    *hostmatch.List
+}
+
+// specificity ranks how specific a pattern is: wildcards by their number of
+// labels (*.cdn.example.com beats *.example.com), regexes below all wildcards
+func (p *overridePattern) specificity() int {
+	if strings.HasPrefix(p.pattern, "*.") {
+		return strings.Count(p.pattern, ".")
+	}
+	return 0
+}
+
+// byPrecedence sorts overridePatterns most specific first, and patterns that
+// are equally specific by the patterns themselves, so that which of several
+// matching overrides wins doesn't depend on the order they were set in
+type byPrecedence []*overridePattern
+
+func (p byPrecedence) Len() int      { return len(p) }
+func (p byPrecedence) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPrecedence) Less(i, j int) bool {
+	si, sj := p[i].specificity(), p[j].specificity()
+	if si != sj {
+		return si > sj
+	}
+	return p[i].pattern < p[j].pattern
+}
+
+// SetRouteOverride overrides the route for the given host, which must be
+// ROUTE_DIRECT, ROUTE_PROXY or "" (to remove the override).  The host may also
+// be a wildcard or regex pattern (see hostmatch), in which case the override
+// applies to all matching hosts that don't have an override of their own.  Of
+// several matching patterns, the most specific wins (see byPrecedence).
+// Overriding the route to ROUTE_DIRECT fails if DisableBypass is set.
+func (client *Client) SetRouteOverride(host string, route string) error {
+	host, err := client.setRouteOverride(host, route)
+	if err != nil {
+		return err
+	}
+	client.persistRouteOverride(host, route)
+	return nil
+}
+
+// setRouteOverride sets the route override without persisting it, returning
+// the (normalized) host or pattern
+func (client *Client) setRouteOverride(host string, route string) (string, error) {
+	if route != "" && route != ROUTE_DIRECT && route != ROUTE_PROXY {
+		return "", fmt.Errorf("Unknown route: %s", route)
+	}
+	if route == ROUTE_DIRECT && client.DisableBypass {
+		return "", fmt.Errorf("Routing directly is disabled")
+	}
+	var pattern *hostmatch.List
+	if hostmatch.IsPattern(host) {
+		var err error
+		if pattern, err = hostmatch.Parse(host); err != nil {
+			return "", err
+		}
+	} else {
+		host = normalizeHost(host)
+	}
+	client.routingMutex.Lock()
+	defer client.routingMutex.Unlock()
+	if client.overrides == nil {
+		client.overrides = make(map[string]string)
+	}
+	if route == "" {
+		delete(client.overrides, host)
+		client.removeOverridePattern(host)
+	} else {
+		client.overrides[host] = route
+		if pattern != nil {
+			client.removeOverridePattern(host)
+			client.overridePatterns = append(client.overridePatterns, &overridePattern{host, pattern})
+			sort.Sort(byPrecedence(client.overridePatterns))
+		}
+	}
+	return host, nil
+}
+
+// removeOverridePattern removes the compiled override for the given pattern,
+// if any.  The routingMutex must be held.
+func (client *Client) removeOverridePattern(pattern string) {
+	for i, p := range client.overridePatterns {
+		if p.pattern == pattern {
+			client.overridePatterns = append(client.overridePatterns[:i], client.overridePatterns[i+1:]...)
+			return
+		}
+	}
+}
+
+// persistRouteOverride saves (or removes) the route override for host in the
+// RouteCache, if there is one
+func (client *Client) persistRouteOverride(host string, route string) {
+	if client.RouteCache == nil {
+		return
+	}
+	var err error
+	if route == "" {
+		err = client.RouteCache.Delete(ROUTE_CACHE_PREFIX + host)
+	} else {
+		err = client.RouteCache.Set(ROUTE_CACHE_PREFIX+host, route, 0)
+	}
+	if err != nil {
+		log.Errorf("Unable to persist route override for %s: %s", host, err)
+	}
+}
+
+// restoreRouteOverrides restores the route overrides persisted in the
+// RouteCache by a previous run
+func (client *Client) restoreRouteOverrides() {
+	if client.RouteCache == nil {
+		return
+	}
+	for _, key := range client.RouteCache.Keys(ROUTE_CACHE_PREFIX) {
+		var route string
+		if !client.RouteCache.Get(key, &route) {
+			continue
+		}
+		host := strings.TrimPrefix(key, ROUTE_CACHE_PREFIX)
+		if _, err := client.setRouteOverride(host, route); err != nil {
+			log.Errorf("Unable to restore route override for %s: %s", host, err)
+		}
+	}
+}
+
+// Status returns a snapshot of the client's runtime state
+func (client *Client) Status() *ClientStatus {
+	client.routingMutex.RLock()
+	defer client.routingMutex.RUnlock()
+	status := &ClientStatus{
+		Addr:      client.Addr,
+		Bypass:    client.bypass,
+		Overrides: make(map[string]string, len(client.overrides)),
+	}
+	for host, route := range client.overrides {
+		status.Overrides[host] = route
+	}
+	status.Devices = client.Devices()
+	for _, device := range status.Devices {
+		status.BytesUp += device.BytesUp
+		status.BytesDown += device.BytesDown
+	}
+	client.upstream.fillStatus(status)
+	status.Upstreams = client.Balancer.Status()
+	status.Dumping = client.DumpLevels()
+	status.Notices = client.Notices()
+	status.HeaderAlterations = client.HeaderAlterations()
+	return status
+}
+
+// shouldGoDirect determines whether requests to the given host should bypass
+// the tunnel.  Per-host overrides win, followed by the quick bypass, the
+// script and finally the automatic handling of local destinations.
+func (client *Client) shouldGoDirect(host string) bool {
+	host = normalizeHost(host)
+	client.routingMutex.RLock()
+	route, overridden := client.overrides[host]
+	if !overridden {
+		for _, p := range client.overridePatterns {
+			if p.list.Matches(host) {
+				route, overridden = client.overrides[p.pattern], true
+				break
+			}
+		}
+	}
+	bypass := client.bypass
+	client.routingMutex.RUnlock()
+	if overridden {
+		return route == ROUTE_DIRECT
+	}
+	if bypass {
+		return true
+	}
+	switch client.Script.Route(host) {
+	case ROUTE_DIRECT:
+		return true
+	case ROUTE_PROXY:
+		return false
+	}
+	return client.isLocal(host) && !client.directKeepsFailing(host)
+}
+
+// normalizeHost strips the port from the given host and lowercases it
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
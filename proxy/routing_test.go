@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestNothingDirectWithBypassDisabled(t *testing.T) {
+	client := &Client{DisableBypass: true}
+	if err := client.SetBypass(true); err == nil {
+		t.Error("Expected turning on the bypass to fail")
+	}
+	for _, host := range []string{"www.example.com", "*.example.com"} {
+		if err := client.SetRouteOverride(host, ROUTE_DIRECT); err == nil {
+			t.Errorf("Expected overriding %s to go directly to fail", host)
+		}
+	}
+	if err := client.SetRouteOverride("www.example.com", ROUTE_PROXY); err != nil {
+		t.Errorf("Unable to override route to go through the tunnel: %s", err)
+	}
+	if client.shouldGoDirect("www.example.com") {
+		t.Error("Expected www.example.com to go through the tunnel")
+	}
+}
+
+func TestOverlappingOverridePatterns(t *testing.T) {
+	overrides := [][2]string{
+		{"/.*example\\.com/", ROUTE_PROXY},
+		{"*.example.com", ROUTE_PROXY},
+		{"*.cdn.example.com", ROUTE_DIRECT},
+		{"/^img[0-9]+\\..*/", ROUTE_DIRECT},
+		{"www.cdn.example.com", ROUTE_PROXY},
+	}
+	cases := map[string]bool{
+		"img1.cdn.example.com": true,  // *.cdn.example.com beats *.example.com and both regexes
+		"www.cdn.example.com":  false, // the host's own override beats all patterns
+		"img1.example.com":     false, // *.example.com beats the regexes
+		"img1.example.org":     true,
+		"example.com":          false,
+	}
+	// Whichever order the overrides are set in
+	for _, reverse := range []bool{false, true} {
+		client := &Client{}
+		for i := range overrides {
+			o := overrides[i]
+			if reverse {
+				o = overrides[len(overrides)-1-i]
+			}
+			if err := client.SetRouteOverride(o[0], o[1]); err != nil {
+				t.Fatalf("Unable to override route for %s: %s", o[0], err)
+			}
+		}
+		for host, direct := range cases {
+			if client.shouldGoDirect(host) != direct {
+				t.Errorf("Expected shouldGoDirect(%s) to be %v (reverse: %v)", host, direct, reverse)
+			}
+		}
+	}
+
+	client := &Client{}
+	client.SetRouteOverride("*.cdn.example.com", ROUTE_DIRECT)
+	client.SetRouteOverride("*.example.com", ROUTE_PROXY)
+	client.SetRouteOverride("*.cdn.example.com", "")
+	if client.shouldGoDirect("img1.cdn.example.com") {
+		t.Error("Expected the next most specific pattern to apply once an override is removed")
+	}
+}
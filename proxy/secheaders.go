@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/metrics"
+)
+
+const (
+	HEADER_AUDIT_OFF     = ""        // security headers aren't checked
+	HEADER_AUDIT_LOG     = "log"     // alterations of security headers are logged and shown in the status
+	HEADER_AUDIT_RESTORE = "restore" // like HEADER_AUDIT_LOG, and the original headers are put back
+
+	// ORIGINAL_HEADERS_HEADER carries the security headers that a response had
+	// when it came out of the tunnel through the client's own rewriting, which
+	// removes it again before the response reaches the browser
+	ORIGINAL_HEADERS_HEADER = "X-Flashlight-Original-Security-Headers"
+
+	MAX_RECENT_ALTERATIONS = 20
+)
+
+var (
+	// SECURITY_HEADERS are the response headers that the audit verifies
+	SECURITY_HEADERS = []string{
+		"Strict-Transport-Security",
+		"Content-Security-Policy",
+		"Content-Security-Policy-Report-Only",
+		"X-Frame-Options",
+	}
+)
+
+// HeaderAlteration is a change to one of the SECURITY_HEADERS of a response
+// between the tunnel and the browser
+type HeaderAlteration struct {
+	Time     time.Time `json:"time"`
+	URL      string    `json:"url"`
+	Header   string    `json:"header"`
+	Original []string  `json:"original"` // empty if the header was added
+	Altered  []string  `json:"altered"`  // empty if the header was removed
+	Restored bool      `json:"restored"`
+}
+
+// headerAuditState keeps the most recent alterations for the status
+type headerAuditState struct {
+	recent      []*HeaderAlteration
+	alterations *metrics.Counter
+	mutex       sync.Mutex
+}
+
+// withSecurityHeaderSnapshot creates a RoundTripper that uses the supplied
+// RoundTripper and, if HeaderAudit is on, records the SECURITY_HEADERS of
+// each response in ORIGINAL_HEADERS_HEADER.  It goes right around the
+// transport that reaches the server, so that everything the client does to
+// responses afterwards (prefetching, coalescing, splitting, retries, size
+// limits) is covered by withSecurityHeaderAudit.
+func (client *Client) withSecurityHeaderSnapshot(rt http.RoundTripper) http.RoundTripper {
+	if client.HeaderAudit == HEADER_AUDIT_OFF {
+		return rt
+	}
+	return &securityHeaderSnapshot{rt}
+}
+
+// securityHeaderSnapshot is an http.RoundTripper that wraps another
+// http.RoundTripper and records the SECURITY_HEADERS of its responses
+type securityHeaderSnapshot struct {
+	orig http.RoundTripper
+}
+
+func (rt *securityHeaderSnapshot) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.orig.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	originals := []string{}
+	for _, name := range SECURITY_HEADERS {
+		for _, value := range resp.Header[name] {
+			originals = append(originals, name+": "+value)
+		}
+	}
+	// Present even if empty, so that the audit can tell that there were none
+	// to begin with
+	resp.Header[ORIGINAL_HEADERS_HEADER] = originals
+	return resp, nil
+}
+
+// withSecurityHeaderAudit creates a RoundTripper that uses the supplied
+// RoundTripper and, if HeaderAudit is on, compares the SECURITY_HEADERS of
+// each response with the ones recorded by withSecurityHeaderSnapshot,
+// recording (and with HEADER_AUDIT_RESTORE undoing) any alteration.
+// Responses that the client made up itself (e.g. refusals of oversized
+// responses) carry no snapshot and aren't audited.
+func (client *Client) withSecurityHeaderAudit(rt http.RoundTripper) http.RoundTripper {
+	if client.HeaderAudit == HEADER_AUDIT_OFF {
+		return rt
+	}
+	if client.Metrics != nil {
+		client.headerAudit.alterations = client.Metrics.Counter("flashlight_security_header_alterations_total", "Security headers of responses that were altered between the tunnel and the browser")
+	}
+	return &securityHeaderAudit{rt, client.HeaderAudit == HEADER_AUDIT_RESTORE, &client.headerAudit}
+}
+
+// securityHeaderAudit is an http.RoundTripper that wraps another
+// http.RoundTripper and checks the SECURITY_HEADERS of its responses against
+// their snapshot
+type securityHeaderAudit struct {
+	orig    http.RoundTripper
+	restore bool
+	state   *headerAuditState
+}
+
+func (rt *securityHeaderAudit) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.orig.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, found := resp.Header[ORIGINAL_HEADERS_HEADER]
+	if !found {
+		return resp, nil
+	}
+	delete(resp.Header, ORIGINAL_HEADERS_HEADER)
+	originals := parseHeaderSnapshot(snapshot)
+	for _, name := range SECURITY_HEADERS {
+		original, altered := originals[name], resp.Header[name]
+		if len(original) == 0 && len(altered) == 0 || reflect.DeepEqual(original, altered) {
+			continue
+		}
+		alteration := &HeaderAlteration{
+			Time:     time.Now(),
+			URL:      req.URL.String(),
+			Header:   name,
+			Original: original,
+			Altered:  altered,
+			Restored: rt.restore,
+		}
+		if rt.restore {
+			if len(original) == 0 {
+				resp.Header.Del(name)
+			} else {
+				resp.Header[name] = original
+			}
+		}
+		rt.state.record(alteration)
+	}
+	return resp, nil
+}
+
+// parseHeaderSnapshot parses the values of ORIGINAL_HEADERS_HEADER
+func parseHeaderSnapshot(snapshot []string) http.Header {
+	header := make(http.Header)
+	for _, item := range snapshot {
+		parts := strings.SplitN(item, ": ", 2)
+		if len(parts) == 2 {
+			header[parts[0]] = append(header[parts[0]], parts[1])
+		}
+	}
+	return header
+}
+
+func (state *headerAuditState) record(alteration *HeaderAlteration) {
+	log.Warnf("%s of %s was altered from %v to %v (restored: %v)", alteration.Header, alteration.URL, alteration.Original, alteration.Altered, alteration.Restored)
+	if state.alterations != nil {
+		state.alterations.Inc()
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.recent = append(state.recent, alteration)
+	if len(state.recent) > MAX_RECENT_ALTERATIONS {
+		state.recent = state.recent[len(state.recent)-MAX_RECENT_ALTERATIONS:]
+	}
+}
+
+// HeaderAlterations returns the most recent alterations of security headers
+// found by the audit
+func (client *Client) HeaderAlterations() []*HeaderAlteration {
+	state := &client.headerAudit
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return append([]*HeaderAlteration{}, state.recent...)
+}
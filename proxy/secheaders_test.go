@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// staticRoundTripper answers every request with a copy of the same headers
+type staticRoundTripper struct {
+	header http.Header
+}
+
+func (rt *staticRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := make(http.Header)
+	for name, values := range rt.header {
+		header[name] = append([]string{}, values...)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+// tamperingRoundTripper alters the headers of the responses that it passes on
+type tamperingRoundTripper struct {
+	orig   http.RoundTripper
+	tamper func(header http.Header)
+}
+
+func (rt *tamperingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.orig.RoundTrip(req)
+	if err == nil {
+		rt.tamper(resp.Header)
+	}
+	return resp, err
+}
+
+func auditedRoundTrip(t *testing.T, client *Client, tamper func(header http.Header)) http.Header {
+	upstream := &staticRoundTripper{http.Header{
+		"Strict-Transport-Security": []string{"max-age=31536000"},
+		"X-Frame-Options":           []string{"DENY"},
+		"Content-Type":              []string{"text/html"},
+	}}
+	rt := client.withSecurityHeaderAudit(&tamperingRoundTripper{client.withSecurityHeaderSnapshot(upstream), tamper})
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unable to round trip: %s", err)
+	}
+	if _, found := resp.Header[ORIGINAL_HEADERS_HEADER]; found {
+		t.Errorf("%s should be removed before the response reaches the browser", ORIGINAL_HEADERS_HEADER)
+	}
+	return resp.Header
+}
+
+func TestSecurityHeadersUntouched(t *testing.T) {
+	client := &Client{HeaderAudit: HEADER_AUDIT_LOG}
+	auditedRoundTrip(t, client, func(header http.Header) {
+		header.Del("Content-Type")
+	})
+	if alterations := client.HeaderAlterations(); len(alterations) != 0 {
+		t.Errorf("Expected no alterations, got %v", alterations)
+	}
+}
+
+func TestSecurityHeaderAlterationsLogged(t *testing.T) {
+	client := &Client{HeaderAudit: HEADER_AUDIT_LOG}
+	header := auditedRoundTrip(t, client, func(header http.Header) {
+		header.Del("Strict-Transport-Security")
+		header.Set("Content-Security-Policy", "default-src *")
+	})
+	if header.Get("Strict-Transport-Security") != "" || header.Get("Content-Security-Policy") == "" {
+		t.Errorf("Headers shouldn't be restored when only logging, got %v", header)
+	}
+	alterations := client.HeaderAlterations()
+	if len(alterations) != 2 {
+		t.Fatalf("Expected 2 alterations, got %d", len(alterations))
+	}
+	if alterations[0].Header != "Strict-Transport-Security" || alterations[0].Original[0] != "max-age=31536000" || len(alterations[0].Altered) != 0 {
+		t.Errorf("Unexpected alteration %+v", alterations[0])
+	}
+	if alterations[1].Header != "Content-Security-Policy" || len(alterations[1].Original) != 0 || alterations[1].Restored {
+		t.Errorf("Unexpected alteration %+v", alterations[1])
+	}
+}
+
+func TestSecurityHeadersRestored(t *testing.T) {
+	client := &Client{HeaderAudit: HEADER_AUDIT_RESTORE}
+	header := auditedRoundTrip(t, client, func(header http.Header) {
+		header.Set("X-Frame-Options", "ALLOWALL")
+		header.Set("Content-Security-Policy", "default-src *")
+	})
+	if header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("Expected X-Frame-Options to be restored, got %s", header.Get("X-Frame-Options"))
+	}
+	if header.Get("Content-Security-Policy") != "" {
+		t.Errorf("Expected added Content-Security-Policy to be removed, got %s", header.Get("Content-Security-Policy"))
+	}
+	if alterations := client.HeaderAlterations(); len(alterations) != 2 || !alterations[0].Restored {
+		t.Errorf("Expected 2 restored alterations, got %v", alterations)
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/getlantern/flashlight/metrics"
+	"github.com/getlantern/tls"
+)
+
+const (
+	// DEFAULT_TLS_SESSIONS_TO_CACHE bounds the client's session cache to a few
+	// MB, since each session holds the server's certificate chain (typically a
+	// few KB)
+	DEFAULT_TLS_SESSIONS_TO_CACHE = 1000
+)
+
+// sessionCache is an LRU tls.ClientSessionCache that counts its hits, misses
+// and evictions, so that it's possible to tell whether sessions are actually
+// being resumed and whether the cache is big enough.
+type sessionCache struct {
+	capacity  int
+	entries   map[string]*list.Element
+	lru       *list.List // most recently used first
+	mutex     sync.Mutex
+	hits      *metrics.Counter
+	misses    *metrics.Counter
+	evictions *metrics.Counter
+	size      *metrics.Gauge
+}
+
+type sessionCacheEntry struct {
+	key     string
+	session *tls.ClientSessionState
+}
+
+// NewSessionCache creates a tls.ClientSessionCache holding up to capacity
+// sessions (DEFAULT_TLS_SESSIONS_TO_CACHE if capacity is 0).  Its hits,
+// misses, evictions and size are tracked in the given registry (if not nil).
+func NewSessionCache(capacity int, registry *metrics.Registry) tls.ClientSessionCache {
+	if capacity <= 0 {
+		capacity = DEFAULT_TLS_SESSIONS_TO_CACHE
+	}
+	cache := &sessionCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	if registry != nil {
+		cache.hits = registry.Counter("flashlight_tls_session_cache_hits_total", "TLS handshakes that found a session to resume")
+		cache.misses = registry.Counter("flashlight_tls_session_cache_misses_total", "TLS handshakes that found no session to resume")
+		cache.evictions = registry.Counter("flashlight_tls_session_cache_evictions_total", "TLS sessions evicted to make room for newer ones")
+		cache.size = registry.Gauge("flashlight_tls_session_cache_size", "TLS sessions in the cache")
+	}
+	return cache
+}
+
+func (cache *sessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	elem, found := cache.entries[key]
+	if !found {
+		if cache.misses != nil {
+			cache.misses.Inc()
+		}
+		return nil, false
+	}
+	if cache.hits != nil {
+		cache.hits.Inc()
+	}
+	cache.lru.MoveToFront(elem)
+	return elem.Value.(*sessionCacheEntry).session, true
+}
+
+func (cache *sessionCache) Put(key string, session *tls.ClientSessionState) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if elem, found := cache.entries[key]; found {
+		if session == nil {
+			// A nil session removes the entry (e.g. after failed resumption)
+			cache.lru.Remove(elem)
+			delete(cache.entries, key)
+		} else {
+			elem.Value.(*sessionCacheEntry).session = session
+			cache.lru.MoveToFront(elem)
+		}
+		cache.updateSize()
+		return
+	}
+	if session == nil {
+		return
+	}
+	cache.entries[key] = cache.lru.PushFront(&sessionCacheEntry{key, session})
+	for cache.lru.Len() > cache.capacity {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*sessionCacheEntry).key)
+		if cache.evictions != nil {
+			cache.evictions.Inc()
+		}
+	}
+	cache.updateSize()
+}
+
+// updateSize updates the size gauge.  Must be called while holding the mutex.
+func (cache *sessionCache) updateSize() {
+	if cache.size != nil {
+		cache.size.Set(int64(cache.lru.Len()))
+	}
+}
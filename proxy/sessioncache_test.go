@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/getlantern/flashlight/metrics"
+	"github.com/getlantern/tls"
+)
+
+func TestSessionCache(t *testing.T) {
+	registry := &metrics.Registry{}
+	cache := NewSessionCache(2, registry)
+	cache.Put("a", &tls.ClientSessionState{})
+	cache.Put("b", &tls.ClientSessionState{})
+	if _, found := cache.Get("a"); !found {
+		t.Fatal("Expected to find a")
+	}
+	// b is now the least recently used and gets evicted
+	cache.Put("c", &tls.ClientSessionState{})
+	if _, found := cache.Get("b"); found {
+		t.Error("Expected b to have been evicted")
+	}
+	cache.Put("a", nil)
+	if _, found := cache.Get("a"); found {
+		t.Error("Expected a to have been removed")
+	}
+
+	out := &bytes.Buffer{}
+	registry.WriteText(out)
+	for _, expected := range []string{
+		"flashlight_tls_session_cache_hits_total 1\n",
+		"flashlight_tls_session_cache_misses_total 2\n",
+		"flashlight_tls_session_cache_evictions_total 1\n",
+		"flashlight_tls_session_cache_size 1\n",
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(expected)) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, out)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/metrics"
+)
+
+// withResponseLimit creates a RoundTripper that uses the supplied RoundTripper,
+// records the size of response bodies in the given registry (if not nil) and
+// refuses responses bigger than maxBytes (if positive).
+func withResponseLimit(maxBytes int64, registry *metrics.Registry, rt http.RoundTripper) http.RoundTripper {
+	if maxBytes <= 0 && registry == nil {
+		return rt
+	}
+	limiter := &responseLimiter{orig: rt, maxBytes: maxBytes}
+	if registry != nil {
+		limiter.sizes = registry.Histogram("flashlight_response_bytes", "Size of proxied response bodies", metrics.SIZE_BUCKETS)
+		limiter.oversized = registry.Counter("flashlight_oversized_responses_total", "Responses refused or cut off for exceeding the maximum response size")
+	}
+	return limiter
+}
+
+// responseLimiter is an http.RoundTripper that wraps another http.RoundTripper
+// and accounts for (and limits) the size of its responses.
+type responseLimiter struct {
+	orig      http.RoundTripper
+	maxBytes  int64
+	sizes     *metrics.Histogram
+	oversized *metrics.Counter
+}
+
+func (rt *responseLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.orig.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if rt.maxBytes > 0 && resp.ContentLength > rt.maxBytes {
+		// We know up front that it's too big, so tell the browser how to get
+		// it anyway
+		resp.Body.Close()
+		rt.countOversized()
+		log.Debugf("Refusing %d byte response for %s", resp.ContentLength, req.URL)
+		return rt.tooLarge(req, resp), nil
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, url: req.URL.String(), limiter: rt}
+	return resp, nil
+}
+
+// tooLarge builds the 502 returned in place of an oversized response
+func (rt *responseLimiter) tooLarge(req *http.Request, orig *http.Response) *http.Response {
+	guidance := fmt.Sprintf("The response for %s is %d bytes, which exceeds this proxy's limit of %d bytes.\n", req.URL, orig.ContentLength, rt.maxBytes)
+	if orig.Header.Get("Accept-Ranges") == "bytes" {
+		guidance += fmt.Sprintf("The site supports range requests, so it can still be downloaded in pieces of up to %d bytes (e.g. with a download manager).\n", rt.maxBytes)
+	}
+	return &http.Response{
+		Status:        "502 Bad Gateway",
+		StatusCode:    http.StatusBadGateway,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(bytes.NewBufferString(guidance)),
+		ContentLength: int64(len(guidance)),
+		Request:       req,
+	}
+}
+
+func (rt *responseLimiter) countOversized() {
+	if rt.oversized != nil {
+		rt.oversized.Inc()
+	}
+}
+
+// limitedBody is a response body that records its size once closed and that
+// fails once more than the limiter's maxBytes have been read.  This catches
+// responses whose size isn't known up front.
+type limitedBody struct {
+	io.ReadCloser
+	url      string
+	limiter  *responseLimiter
+	read     int64
+	recorded int32
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.read += int64(n)
+	if body.limiter.maxBytes > 0 && body.read > body.limiter.maxBytes {
+		body.limiter.countOversized()
+		return n, fmt.Errorf("Response for %s exceeded the maximum response size of %d bytes", body.url, body.limiter.maxBytes)
+	}
+	return n, err
+}
+
+func (body *limitedBody) Close() error {
+	if body.limiter.sizes != nil && atomic.CompareAndSwapInt32(&body.recorded, 0, 1) {
+		body.limiter.sizes.Observe(body.read)
+	}
+	return body.ReadCloser.Close()
+}
+
+// cappedConn is a connection to a destination from which at most remaining
+// bytes may be read.  This keeps a server from being used as a bulk download
+// relay, even for traffic (like HTTPS) that it can't look into.
+type cappedConn struct {
+	net.Conn
+	addr      string
+	remaining int64
+}
+
+func (c *cappedConn) Read(b []byte) (int, error) {
+	if atomic.LoadInt64(&c.remaining) <= 0 {
+		log.Debugf("Closing connection to %s, which exceeded the maximum response size", c.addr)
+		c.Conn.Close()
+		return 0, fmt.Errorf("Connection to %s exceeded the maximum response size", c.addr)
+	}
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.remaining, -int64(n))
+	return n, err
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	// SNIFFED_PORT is the port of destinations addressed by IP for which the
+	// client peeks at the TLS ClientHello to learn the hostname.  Other ports
+	// may carry protocols in which the server speaks first, where peeking
+	// would stall until sniffTimeout.
+	SNIFFED_PORT = "443"
+
+	tlsRecordHeaderLen = 5
+	tlsMaxRecordLen    = 16 * 1024
+	tlsRecordHandshake = 0x16
+	tlsClientHello     = 0x01
+	tlsExtServerName   = 0x00
+	tlsServerNameHost  = 0x00
+	sniffTimeout       = 5 * time.Second
+)
+
+// shouldSniff determines whether the hostname for a connection to addr should
+// be taken from the TLS ClientHello, i.e. whether addr is an IP address on
+// SNIFFED_PORT.  Such connections typically come from applications that
+// resolved the name themselves, which leaves nothing for the hostname routing
+// rules to match.
+func (client *Client) shouldSniff(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	return err == nil && port == SNIFFED_PORT && net.ParseIP(host) != nil && !client.isLocal(addr)
+}
+
+// routeSniffed routes a connection to addr (an IP address) according to the
+// hostname in its ClientHello, falling back to addr itself if there is none.
+// The connection is tunneled or dialed directly to addr either way, only the
+// routing decision (and logging) uses the hostname.  Nothing is decrypted.
+func (client *Client) routeSniffed(conn net.Conn, addr string) {
+	conn, sni := peekSNI(conn)
+	host := addr
+	if sni != "" {
+		log.Debugf("Routing connection to %s as %s (from SNI)", addr, sni)
+		host = sni
+		if client.dumpLevel(sni) != DUMP_OFF {
+			log.Debugf("Connection to %s (%s), contents are encrypted", sni, addr)
+		}
+	}
+	var dest net.Conn
+	var err error
+	if client.shouldGoDirect(host) {
+		log.Debugf("Handling connection to %s directly", host)
+		dest, err = net.DialTimeout("tcp", addr, dialTimeout)
+	} else {
+		dest, err = client.dialUpstream(addr)
+	}
+	if err != nil {
+		log.Errorf("Unable to connect to %s (%s): %s", host, addr, err)
+		conn.Close()
+		return
+	}
+	pipe(conn, dest)
+}
+
+// connectSniffed handles a CONNECT request to an IP address by accepting it
+// right away, so that the browser sends its ClientHello, and then routing it
+// with routeSniffed.
+func (client *Client) connectSniffed(resp http.ResponseWriter, req *http.Request) {
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		log.Error("Unable to hijack connection for CONNECT")
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("Unable to hijack connection for CONNECT: %s", err)
+		return
+	}
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		clientConn.Close()
+		return
+	}
+	client.routeSniffed(clientConn, req.Host)
+}
+
+// peekSNI reads the server name from the TLS ClientHello at the start of
+// conn without consuming it.  It returns a connection from which the peeked
+// data can be read again, and "" if the connection doesn't start with a
+// ClientHello naming a server (within sniffTimeout).
+func peekSNI(conn net.Conn) (net.Conn, string) {
+	reader := bufio.NewReaderSize(conn, tlsRecordHeaderLen+tlsMaxRecordLen)
+	buffered := &bufferedConn{conn, reader}
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	header, err := reader.Peek(tlsRecordHeaderLen)
+	if err != nil || header[0] != tlsRecordHandshake {
+		return buffered, ""
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > tlsMaxRecordLen {
+		return buffered, ""
+	}
+	record, err := reader.Peek(tlsRecordHeaderLen + length)
+	if err != nil {
+		return buffered, ""
+	}
+	sni, err := parseSNI(record[tlsRecordHeaderLen:])
+	if err != nil {
+		log.Debugf("Unable to read SNI from ClientHello: %s", err)
+	}
+	return buffered, sni
+}
+
+// parseSNI extracts the server name from the handshake message in the first
+// record of a TLS connection, which must be a ClientHello.  A ClientHello
+// without a server name yields "".
+func parseSNI(data []byte) (string, error) {
+	r := &tlsReader{data: data}
+	if r.readByte() != tlsClientHello {
+		return "", fmt.Errorf("Not a ClientHello")
+	}
+	r.data = r.readBytes(r.readUint24())
+	r.skip(2 + 32)              // client_version and random
+	r.skip(int(r.readByte()))   // session_id
+	r.skip(int(r.readUint16())) // cipher_suites
+	r.skip(int(r.readByte()))   // compression_methods
+	if r.err == nil && len(r.data) == 0 {
+		// No extensions
+		return "", nil
+	}
+	extensions := &tlsReader{data: r.readBytes(int(r.readUint16()))}
+	for r.err == nil && extensions.err == nil && len(extensions.data) > 0 {
+		extType := extensions.readUint16()
+		extData := extensions.readBytes(int(extensions.readUint16()))
+		if extType != tlsExtServerName {
+			continue
+		}
+		names := &tlsReader{data: extData}
+		names.data = names.readBytes(int(names.readUint16()))
+		for names.err == nil && len(names.data) > 0 {
+			nameType := names.readByte()
+			name := names.readBytes(int(names.readUint16()))
+			if names.err == nil && nameType == tlsServerNameHost {
+				return string(name), nil
+			}
+		}
+		return "", names.err
+	}
+	if r.err != nil {
+		return "", r.err
+	}
+	return "", extensions.err
+}
+
+// tlsReader reads the big-endian fields of a TLS handshake message.  Reading
+// past the end sets err and yields zeros from then on.
+type tlsReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tlsReader) readBytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = fmt.Errorf("Truncated ClientHello")
+		r.data = nil
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) skip(n int) {
+	r.readBytes(n)
+}
+
+func (r *tlsReader) readByte() byte {
+	if b := r.readBytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tlsReader) readUint16() uint16 {
+	if b := r.readBytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *tlsReader) readUint24() int {
+	if b := r.readBytes(3); b != nil {
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	}
+	return 0
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestPeekSNI(t *testing.T) {
+	for _, serverName := range []string{"www.example.com", ""} {
+		client, server := net.Pipe()
+		go func() {
+			// The handshake can't complete, all we need is the ClientHello
+			tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		}()
+		conn, sni := peekSNI(server)
+		if sni != serverName {
+			t.Errorf("Expected SNI %q, got %q", serverName, sni)
+		}
+		header := make([]byte, tlsRecordHeaderLen)
+		if _, err := conn.Read(header); err != nil || header[0] != tlsRecordHandshake {
+			t.Errorf("Peeked ClientHello should still be readable, got %v: %s", header, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestPeekSNINotTLS(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		client.Close()
+	}()
+	conn, sni := peekSNI(server)
+	if sni != "" {
+		t.Errorf("Expected no SNI for plaintext, got %q", sni)
+	}
+	data, _ := ioutil.ReadAll(conn)
+	if string(data) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("Peeked data should still be readable, got %q", data)
+	}
+}
+
+func TestParseSNITruncated(t *testing.T) {
+	if _, err := parseSNI([]byte{tlsClientHello, 0, 0, 10, 3, 3}); err == nil {
+		t.Error("Truncated ClientHello should have been rejected")
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/hostmatch"
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	SNI_ROUTE_PROXY = "proxy" // serve flashlight as usual
+	SNI_ROUTE_DECOY = "decoy" // serve only the Decoy
+	SNI_ROUTE_ANY   = "*"     // host that matches every connection, including those without SNI
+)
+
+// SNIRoute routes TLS connections whose SNI matches Hosts to Target, which is
+// SNI_ROUTE_PROXY, SNI_ROUTE_DECOY or the host:port of another service to
+// which the connections are passed through untouched (TLS and all).
+type SNIRoute struct {
+	Hosts  *hostmatch.List // nil matches every connection
+	Target string
+}
+
+// ParseSNIRoutes parses a comma-separated list of routes like
+// "proxy.example.com=proxy,www.example.com=127.0.0.1:8443,*=decoy".  The
+// first route that matches a connection wins.
+func ParseSNIRoutes(spec string) ([]*SNIRoute, error) {
+	var routes []*SNIRoute
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid SNI route %s, expected host=target", pair)
+		}
+		route := &SNIRoute{Target: strings.TrimSpace(parts[1])}
+		if route.Target != SNI_ROUTE_PROXY && route.Target != SNI_ROUTE_DECOY {
+			if _, _, err := net.SplitHostPort(route.Target); err != nil {
+				return nil, fmt.Errorf("Invalid target in SNI route %s, expected %s, %s or host:port", pair, SNI_ROUTE_PROXY, SNI_ROUTE_DECOY)
+			}
+		}
+		if host := strings.TrimSpace(parts[0]); host != SNI_ROUTE_ANY {
+			hosts, err := hostmatch.Parse(host)
+			if err != nil {
+				return nil, err
+			}
+			route.Hosts = hosts
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// sniTarget returns the target for a connection with the given SNI (which may
+// be ""), defaulting to SNI_ROUTE_PROXY if no route matches
+func (server *Server) sniTarget(sni string) string {
+	for _, route := range server.SNIRoutes {
+		if route.Hosts == nil || (sni != "" && route.Hosts.Matches(sni)) {
+			return route.Target
+		}
+	}
+	return SNI_ROUTE_PROXY
+}
+
+// routesToDecoy indicates whether any of the SNIRoutes has SNI_ROUTE_DECOY
+// as its target
+func (server *Server) routesToDecoy() bool {
+	for _, route := range server.SNIRoutes {
+		if route.Target == SNI_ROUTE_DECOY {
+			return true
+		}
+	}
+	return false
+}
+
+// routingBySNI wraps the given listener so that it only returns connections
+// routed to SNI_ROUTE_PROXY.  Connections routed to SNI_ROUTE_DECOY are
+// returned by the second listener instead, and the rest are passed through to
+// their targets.
+func (server *Server) routingBySNI(l net.Listener) (net.Listener, net.Listener) {
+	router := &sniRouter{
+		Listener: l,
+		proxied:  newRoutedListener(l),
+		decoyed:  newRoutedListener(l),
+	}
+	go router.route(server.sniTarget)
+	return router.proxied, router.decoyed
+}
+
+// sniRouter accepts connections and hands them to the routedListener for
+// their target
+type sniRouter struct {
+	net.Listener
+	proxied *routedListener
+	decoyed *routedListener
+}
+
+func (router *sniRouter) route(target func(string) string) {
+	for {
+		conn, err := router.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			router.proxied.fail(err)
+			router.decoyed.fail(err)
+			return
+		}
+		// Peeking may take a while, don't hold up other connections
+		go func() {
+			conn, sni := peekSNI(conn)
+			switch t := target(sni); t {
+			case SNI_ROUTE_PROXY:
+				router.proxied.deliver(conn)
+			case SNI_ROUTE_DECOY:
+				log.Debugf("Serving decoy to %s (SNI %q)", conn.RemoteAddr(), sni)
+				router.decoyed.deliver(conn)
+			default:
+				passThrough(conn, t)
+			}
+		}()
+	}
+}
+
+// passThrough pipes conn to the given address, for connections meant for
+// another service sharing our port
+func passThrough(conn net.Conn, addr string) {
+	dest, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		log.Errorf("Unable to pass connection from %s through to %s: %s", conn.RemoteAddr(), addr, err)
+		conn.Close()
+		return
+	}
+	pipe(conn, dest)
+}
+
+// routedListener is a net.Listener that returns the connections delivered to
+// it by an sniRouter.  Closing it closes the underlying listener.
+type routedListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan bool
+	err   error
+	once  sync.Once
+}
+
+func newRoutedListener(l net.Listener) *routedListener {
+	return &routedListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		done:     make(chan bool),
+	}
+}
+
+func (l *routedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *routedListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *routedListener) fail(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+// serveDecoyTLS serves the Decoy with TLS on the given listener, for
+// connections routed to SNI_ROUTE_DECOY
+func (server *Server) serveDecoyTLS(l net.Listener, httpServer *http.Server) error {
+	decoy, err := server.decoyHandler()
+	if err != nil {
+		return err
+	}
+	decoyServer := &http.Server{
+		Handler:      decoy,
+		ReadTimeout:  httpServer.ReadTimeout,
+		WriteTimeout: httpServer.WriteTimeout,
+		// Same certificates and ciphers, but no client certificates required
+		TLSConfig: &tls.Config{
+			GetCertificate:           httpServer.TLSConfig.GetCertificate,
+			PreferServerCipherSuites: httpServer.TLSConfig.PreferServerCipherSuites,
+			MinVersion:               httpServer.TLSConfig.MinVersion,
+			CipherSuites:             httpServer.TLSConfig.CipherSuites,
+		},
+	}
+	return decoyServer.Serve(tls.NewListener(l, decoyServer.TLSConfig))
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/getlantern/flashlight/hostmatch"
+)
+
+func TestParseSNIRoutes(t *testing.T) {
+	routes, err := ParseSNIRoutes("proxy.example.com=proxy, *.example.com=127.0.0.1:8443,*=decoy")
+	if err != nil {
+		t.Fatalf("Unable to parse routes: %s", err)
+	}
+	server := &Server{SNIRoutes: routes}
+	expected := map[string]string{
+		"proxy.example.com": SNI_ROUTE_PROXY,
+		"www.example.com":   "127.0.0.1:8443",
+		"other.com":         SNI_ROUTE_DECOY,
+		"":                  SNI_ROUTE_DECOY,
+	}
+	for sni, target := range expected {
+		if actual := server.sniTarget(sni); actual != target {
+			t.Errorf("Expected %q to be routed to %s, got %s", sni, target, actual)
+		}
+	}
+	if target := (&Server{SNIRoutes: routes[:1]}).sniTarget("other.com"); target != SNI_ROUTE_PROXY {
+		t.Errorf("Unmatched connections should be proxied, got %s", target)
+	}
+
+	for _, invalid := range []string{"example.com", "example.com=", "example.com=elsewhere", "ex*ample.com=proxy"} {
+		if _, err := ParseSNIRoutes(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestSNIRouting(t *testing.T) {
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer other.Close()
+	go func() {
+		conn, err := other.Accept()
+		if err == nil {
+			conn.Write([]byte("other service"))
+			conn.Close()
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	server := &Server{SNIRoutes: []*SNIRoute{{Hosts: hostmatch.MustParse("www.example.com"), Target: other.Addr().String()}}}
+	proxied, _ := server.routingBySNI(l)
+	defer proxied.Close()
+
+	hello := func(serverName string) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Unable to dial: %s", err)
+		}
+		conn.Write(clientHello(serverName))
+		return conn
+	}
+
+	passed := hello("www.example.com")
+	defer passed.Close()
+	if data, _ := ioutil.ReadAll(passed); string(data) != "other service" {
+		t.Errorf("Expected connection to be passed through, got %q", data)
+	}
+
+	hello("proxy.example.com").Close()
+	conn, err := proxied.Accept()
+	if err != nil {
+		t.Fatalf("Expected connection to be proxied: %s", err)
+	}
+	conn.Close()
+}
+
+// clientHello returns the first record of a TLS handshake for serverName
+func clientHello(serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		// The handshake can't complete, all we need is the ClientHello
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+	conn, _ := peekSNI(server)
+	record := make([]byte, tlsRecordHeaderLen+tlsMaxRecordLen)
+	n, _ := conn.Read(record)
+	return record[:n]
+}
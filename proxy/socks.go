@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	SOCKS_VERSION = 5
+
+	socksNoAuth           = 0x00
+	socksNoAcceptableAuth = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksCommandNotSupported = 0x07
+	socksAddrNotSupported    = 0x08
+
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// serveSOCKS accepts SOCKS5 connections at SocksAddr, tunneling them (or going
+// direct) just like CONNECT requests to the HTTP proxy.  Only the CONNECT
+// command without authentication is supported, which is what applications
+// that can't use an HTTP proxy need.
+func (client *Client) serveSOCKS() error {
+	l, err := net.Listen("tcp", client.SocksAddr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for SOCKS at %s: %s", client.SocksAddr, err)
+	}
+	log.Infof("About to start client (SOCKS5) proxy at %s", client.SocksAddr)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Errorf("Unable to accept SOCKS connection: %s", err)
+				return
+			}
+			go client.handleSOCKS(conn)
+		}
+	}()
+	return nil
+}
+
+func (client *Client) handleSOCKS(conn net.Conn) {
+	if !client.clientAllowed(conn.RemoteAddr().String()) {
+		log.Errorf("Rejecting SOCKS connection from disallowed client %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	addr, err := socksHandshake(conn)
+	if err != nil {
+		log.Debugf("SOCKS handshake with %s failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	if client.shouldSniff(addr) {
+		// Accept right away so that the client sends its ClientHello, from
+		// which routeSniffed learns the hostname
+		if err := socksReply(conn, socksSucceeded); err != nil {
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		client.routeSniffed(conn, addr)
+		return
+	}
+
+	var dest net.Conn
+	if client.shouldGoDirect(addr) {
+		log.Debugf("Handling SOCKS connection to %s directly", addr)
+		dest, err = client.dialDirect(addr)
+	} else {
+		log.Debugf("Handling SOCKS connection to %s", addr)
+		dest, err = client.dialUpstream(addr)
+	}
+	if err != nil {
+		log.Errorf("Unable to connect to %s for SOCKS client: %s", addr, err)
+		socksReply(conn, socksGeneralFailure)
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		conn.Close()
+		dest.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	pipe(conn, dest)
+}
+
+// socksHandshake negotiates the (lack of) authentication and reads the
+// CONNECT request, returning the requested host:port.
+func socksHandshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != SOCKS_VERSION {
+		return "", fmt.Errorf("Unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptableAuth)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{SOCKS_VERSION, method}); err != nil {
+		return "", err
+	}
+	if method != socksNoAuth {
+		return "", fmt.Errorf("Client doesn't support connecting without authentication")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != socksCmdConnect {
+		socksReply(conn, socksCommandNotSupported)
+		return "", fmt.Errorf("Unsupported SOCKS command %d", request[1])
+	}
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAddrNotSupported)
+		return "", fmt.Errorf("Unsupported SOCKS address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply replies to a CONNECT request.  The bound address is always
+// reported as 0.0.0.0:0, since it's meaningless for a tunneled connection.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{SOCKS_VERSION, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// scriptedConn is a net.Conn that reads the given input and records what's
+// written to it
+type scriptedConn struct {
+	net.Conn
+	input  *bytes.Reader
+	output bytes.Buffer
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	return c.input.Read(b)
+}
+
+func (c *scriptedConn) Write(b []byte) (int, error) {
+	return c.output.Write(b)
+}
+
+func TestSOCKSHandshake(t *testing.T) {
+	greeting := []byte{SOCKS_VERSION, 1, socksNoAuth}
+	accepted := []byte{SOCKS_VERSION, socksNoAuth}
+	connect := func(addr ...byte) []byte {
+		return append(append(append([]byte{}, greeting...), SOCKS_VERSION, socksCmdConnect, 0), addr...)
+	}
+	cases := []struct {
+		name   string
+		input  []byte
+		addr   string // empty if the handshake should fail
+		output []byte
+	}{
+		{"IPv4", connect(socksAddrIPv4, 10, 0, 0, 1, 0x01, 0xbb), "10.0.0.1:443", accepted},
+		{"IPv6", connect(append(append([]byte{socksAddrIPv6}, net.ParseIP("2001:db8::1")...), 0, 80)...), "[2001:db8::1]:80", accepted},
+		{"domain", connect(append(append([]byte{socksAddrDomain, 11}, "example.com"...), 0, 80)...), "example.com:80", accepted},
+		{"several methods", append([]byte{SOCKS_VERSION, 2, 0x02, socksNoAuth}, connect(socksAddrIPv4, 10, 0, 0, 1, 0, 80)[3:]...), "10.0.0.1:80", accepted},
+		{"SOCKS4", []byte{4, 1, 0, 80, 10, 0, 0, 1, 0}, "", nil},
+		{"no acceptable auth", []byte{SOCKS_VERSION, 1, 0x02}, "", []byte{SOCKS_VERSION, socksNoAcceptableAuth}},
+		{"unsupported command", append(append([]byte{}, greeting...), SOCKS_VERSION, 0x02, 0, socksAddrIPv4, 10, 0, 0, 1, 0, 80),
+			"", append(append([]byte{}, accepted...), SOCKS_VERSION, socksCommandNotSupported, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0)},
+		{"unsupported address type", connect(0x05, 10, 0, 0, 1, 0, 80),
+			"", append(append([]byte{}, accepted...), SOCKS_VERSION, socksAddrNotSupported, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0)},
+		{"truncated greeting", []byte{SOCKS_VERSION}, "", nil},
+		{"truncated methods", []byte{SOCKS_VERSION, 2, socksNoAuth}, "", nil},
+		{"truncated request", append(append([]byte{}, greeting...), SOCKS_VERSION, socksCmdConnect), "", accepted},
+		{"truncated IPv6", connect(socksAddrIPv6, 0x20, 0x01), "", accepted},
+		{"truncated domain", connect(socksAddrDomain, 11, 'e', 'x'), "", accepted},
+		{"truncated port", connect(socksAddrIPv4, 10, 0, 0, 1, 0), "", accepted},
+	}
+	for _, c := range cases {
+		conn := &scriptedConn{input: bytes.NewReader(c.input)}
+		addr, err := socksHandshake(conn)
+		if c.addr == "" && err == nil {
+			t.Errorf("%s: expected handshake to fail, got %s", c.name, addr)
+		} else if c.addr != "" && (err != nil || addr != c.addr) {
+			t.Errorf("%s: expected %s, got %s %v", c.name, c.addr, addr, err)
+		}
+		if !bytes.Equal(conn.output.Bytes(), c.output) {
+			t.Errorf("%s: expected to reply %v, replied %v", c.name, c.output, conn.output.Bytes())
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/metrics"
+)
+
+const (
+	// SPLIT_CHUNK_SIZE is the size of the ranges into which split downloads are
+	// divided.  At most one chunk per parallel request is buffered at a time.
+	SPLIT_CHUNK_SIZE = 2 << 20
+)
+
+// withSplitting creates a RoundTripper that uses the supplied RoundTripper and
+// that downloads large responses (at least threshold bytes) using up to parts
+// parallel range requests, each of which goes over its own tunnel connection.
+// Over high-latency fronted paths, a single stream rarely uses all of the
+// available bandwidth.
+func withSplitting(parts int, threshold int64, registry *metrics.Registry, rt http.RoundTripper) http.RoundTripper {
+	if parts <= 1 {
+		return rt
+	}
+	splitter := &splittingRoundTripper{orig: rt, parts: parts, threshold: threshold}
+	if registry != nil {
+		splitter.splits = registry.Counter("flashlight_split_downloads_total", "Downloads split into parallel range requests")
+	}
+	return splitter
+}
+
+// splittingRoundTripper is an http.RoundTripper that wraps another
+// http.RoundTripper and splits large downloads into parallel range requests.
+type splittingRoundTripper struct {
+	orig      http.RoundTripper
+	parts     int
+	threshold int64
+	splits    *metrics.Counter
+}
+
+func (rt *splittingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || req.Header.Get("Range") != "" {
+		return rt.orig.RoundTrip(req)
+	}
+	resp, err := rt.orig.RoundTrip(req)
+	if err != nil || !rt.splittable(resp) {
+		return resp, err
+	}
+	if rt.splits != nil {
+		rt.splits.Inc()
+	}
+	log.Debugf("Splitting %d byte download of %s into %d parallel requests", resp.ContentLength, req.URL, rt.parts)
+	resp.Body = newSplitBody(rt, req, resp)
+	return resp, nil
+}
+
+// splittable determines whether the response can be fetched in ranges, which
+// requires knowing its length and the origin supporting range requests on the
+// identical (unencoded) representation.
+func (rt *splittingRoundTripper) splittable(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK &&
+		resp.ContentLength >= rt.threshold &&
+		resp.ContentLength > SPLIT_CHUNK_SIZE &&
+		resp.Header.Get("Accept-Ranges") == "bytes" &&
+		resp.Header.Get("Content-Encoding") == ""
+}
+
+// chunk is the result of fetching one range of a split download
+type chunk struct {
+	data []byte
+	err  error
+}
+
+// splitBody is the body of a split download.  The first chunk is read from the
+// original response, the remaining chunks are fetched in parallel (a limited
+// number at a time) and handed to the reader in order.
+type splitBody struct {
+	rt        *splittingRoundTripper
+	req       *http.Request
+	validator string // ETag or Last-Modified, sent as If-Range so that we notice if the resource changes midway
+	length    int64
+	first     io.ReadCloser
+	current   io.Reader
+	next      int
+	chunks    []chan *chunk
+	slots     chan bool
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func newSplitBody(rt *splittingRoundTripper, req *http.Request, resp *http.Response) *splitBody {
+	numChunks := int((resp.ContentLength + SPLIT_CHUNK_SIZE - 1) / SPLIT_CHUNK_SIZE)
+	body := &splitBody{
+		rt:      rt,
+		req:     req,
+		length:  resp.ContentLength,
+		first:   resp.Body,
+		current: io.LimitReader(resp.Body, SPLIT_CHUNK_SIZE),
+		next:    1,
+		chunks:  make([]chan *chunk, numChunks),
+		slots:   make(chan bool, rt.parts-1),
+		closed:  make(chan bool),
+	}
+	// If-Range only works with strong validators, a weak ETag would get the
+	// whole resource in response to every range request
+	if etag := resp.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+		body.validator = etag
+	}
+	if body.validator == "" {
+		body.validator = resp.Header.Get("Last-Modified")
+	}
+	for i := range body.chunks {
+		body.chunks[i] = make(chan *chunk, 1)
+	}
+	go body.fetchAll()
+	return body
+}
+
+// fetchAll fetches all but the first chunk, keeping at most parts-1 chunks in
+// flight (or buffered) at a time
+func (body *splitBody) fetchAll() {
+	for i := 1; i < len(body.chunks); i++ {
+		select {
+		case body.slots <- true:
+			go func(i int) {
+				data, err := body.fetch(i)
+				body.chunks[i] <- &chunk{data, err}
+			}(i)
+		case <-body.closed:
+			return
+		}
+	}
+}
+
+// fetch fetches the i'th chunk using a range request
+func (body *splitBody) fetch(i int) ([]byte, error) {
+	start := int64(i) * SPLIT_CHUNK_SIZE
+	end := start + SPLIT_CHUNK_SIZE
+	if end > body.length {
+		end = body.length
+	}
+	req := &http.Request{
+		Method:     body.req.Method,
+		URL:        body.req.URL,
+		Proto:      body.req.Proto,
+		ProtoMajor: body.req.ProtoMajor,
+		ProtoMinor: body.req.ProtoMinor,
+		Header:     make(http.Header),
+		Host:       body.req.Host,
+	}
+	for key, values := range body.req.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if body.validator != "" {
+		req.Header.Set("If-Range", body.validator)
+	}
+	resp, err := body.rt.orig.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch bytes %d-%d of %s: %s", start, end-1, req.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("Unexpected response status fetching bytes %d-%d of %s: %d", start, end-1, req.URL, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, end-start))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read bytes %d-%d of %s: %s", start, end-1, req.URL, err)
+	}
+	if int64(len(data)) != end-start {
+		return nil, fmt.Errorf("Got %d instead of %d bytes fetching bytes %d-%d of %s", len(data), end-start, start, end-1, req.URL)
+	}
+	return data, nil
+}
+
+func (body *splitBody) Read(p []byte) (int, error) {
+	for {
+		n, err := body.current.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if body.first != nil {
+			// Done with the original response
+			body.first.Close()
+			body.first = nil
+		} else {
+			// Done with a fetched chunk, make room for the next one
+			<-body.slots
+		}
+		if body.next >= len(body.chunks) {
+			return 0, io.EOF
+		}
+		var c *chunk
+		select {
+		case c = <-body.chunks[body.next]:
+		case <-body.closed:
+			return 0, io.ErrClosedPipe
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		body.current = bytes.NewReader(c.data)
+		body.next++
+	}
+}
+
+func (body *splitBody) Close() error {
+	body.closeOnce.Do(func() {
+		close(body.closed)
+		if body.first != nil {
+			body.first.Close()
+		}
+	})
+	return nil
+}
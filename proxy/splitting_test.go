@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// splitContent is big enough to be split into 4 chunks, the last one short
+var splitContent = func() []byte {
+	b := make([]byte, 3*SPLIT_CHUNK_SIZE+1234)
+	rand.Read(b)
+	return b
+}()
+
+var lastModified = time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// serveSplitContent serves splitContent with support for ranges, letting
+// ranged calls to the given function change the response first
+func serveSplitContent(etag string, ranged func(resp http.ResponseWriter, req *http.Request) bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Range") != "" && ranged != nil && ranged(resp, req) {
+			return
+		}
+		resp.Header().Set("Accept-Ranges", "bytes")
+		if etag != "" {
+			resp.Header().Set("ETag", etag)
+		}
+		http.ServeContent(resp, req, "", lastModified, bytes.NewReader(splitContent))
+	}))
+}
+
+func splitGet(t *testing.T, url string) *http.Response {
+	rt := withSplitting(3, 0, nil, &http.Transport{})
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unable to get: %s", err)
+	}
+	if _, ok := resp.Body.(*splitBody); !ok {
+		t.Fatal("Expected download to be split")
+	}
+	return resp
+}
+
+func TestSplitInOrder(t *testing.T) {
+	var ranges int32
+	server := serveSplitContent(`"v1"`, func(resp http.ResponseWriter, req *http.Request) bool {
+		if req.Header.Get("If-Range") != `"v1"` {
+			t.Errorf("Expected If-Range with the ETag, got %s", req.Header.Get("If-Range"))
+		}
+		// Earlier chunks take longer, so that they arrive out of order
+		n := atomic.AddInt32(&ranges, 1)
+		time.Sleep(time.Duration(4-n) * 20 * time.Millisecond)
+		return false
+	})
+	defer server.Close()
+
+	resp := splitGet(t, server.URL)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unable to read body: %s", err)
+	}
+	if !bytes.Equal(body, splitContent) {
+		t.Errorf("Body differs from content, got %d of %d bytes", len(body), len(splitContent))
+	}
+	if ranges != 3 {
+		t.Errorf("Expected 3 range requests, got %d", ranges)
+	}
+}
+
+func TestSplitWithWeakETag(t *testing.T) {
+	server := serveSplitContent(`W/"v1"`, func(resp http.ResponseWriter, req *http.Request) bool {
+		if ifRange := req.Header.Get("If-Range"); strings.HasPrefix(ifRange, "W/") {
+			t.Errorf("Weak ETag shouldn't be used for If-Range")
+		}
+		return false
+	})
+	defer server.Close()
+
+	resp := splitGet(t, server.URL)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || !bytes.Equal(body, splitContent) {
+		t.Errorf("Expected content, got %d bytes and %v", len(body), err)
+	}
+}
+
+func TestSplitRangesIgnored(t *testing.T) {
+	server := serveSplitContent(`"v1"`, func(resp http.ResponseWriter, req *http.Request) bool {
+		// The whole thing again, as if the resource changed
+		resp.Header().Set("Content-Length", "0")
+		resp.WriteHeader(http.StatusOK)
+		return true
+	})
+	defer server.Close()
+
+	resp := splitGet(t, server.URL)
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Error("Expected error when the origin answers a range request with a 200")
+	}
+}
+
+func TestSplitShortRange(t *testing.T) {
+	server := serveSplitContent(`"v1"`, func(resp http.ResponseWriter, req *http.Request) bool {
+		resp.Header().Set("Content-Range", "bytes 0-9/10")
+		resp.WriteHeader(http.StatusPartialContent)
+		resp.Write(splitContent[:10])
+		return true
+	})
+	defer server.Close()
+
+	resp := splitGet(t, server.URL)
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Error("Expected error when a range comes back short")
+	}
+}
+
+func TestSplitClosedDuringFetch(t *testing.T) {
+	release := make(chan bool)
+	server := serveSplitContent(`"v1"`, func(resp http.ResponseWriter, req *http.Request) bool {
+		<-release
+		return false
+	})
+	defer server.Close()
+	defer close(release)
+
+	resp := splitGet(t, server.URL)
+	if _, err := io.ReadFull(resp.Body, make([]byte, SPLIT_CHUNK_SIZE)); err != nil {
+		t.Fatalf("Unable to read first chunk: %s", err)
+	}
+	resp.Body.Close()
+	read := make(chan error, 1)
+	go func() {
+		_, err := resp.Body.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != io.ErrClosedPipe {
+			t.Errorf("Expected closed pipe, got %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("Read after Close waited for the fetch")
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+const (
+	PLAINTEXT_ALLOW   = ""        // plaintext HTTP is proxied normally
+	PLAINTEXT_BLOCK   = "block"   // plaintext HTTP is refused with an explanatory page
+	PLAINTEXT_UPGRADE = "upgrade" // plaintext HTTP is redirected to HTTPS where possible, refused otherwise
+)
+
+// blockedPage is shown in place of blocked plaintext requests
+const blockedPage = `<html>
+<head><title>Plain HTTP blocked</title></head>
+<body>
+<h1>Plain HTTP blocked</h1>
+<p>The request to <b>%s</b> was not sent because it uses unencrypted HTTP,
+which would let the proxy server see its contents.  Your flashlight client is
+configured to only allow encrypted (HTTPS) traffic.</p>
+<p>If you trust this site and want to allow it anyway, add it to the
+plaintext exceptions (-plaintextallowed).</p>
+</body>
+</html>
+`
+
+// refusesPlaintext determines whether the client's plaintext policy applies to
+// the given (non-CONNECT) request.
+func (client *Client) refusesPlaintext(req *http.Request) bool {
+	if client.PlaintextPolicy == PLAINTEXT_ALLOW || req.Method == CONNECT {
+		return false
+	}
+	return !client.PlaintextAllowed.Matches(normalizeHost(req.Host))
+}
+
+// servePlaintextRefusal upgrades or blocks a plaintext request
+func (client *Client) servePlaintextRefusal(resp http.ResponseWriter, req *http.Request) {
+	if client.PlaintextPolicy == PLAINTEXT_UPGRADE && (req.Method == "GET" || req.Method == "HEAD") {
+		target := *req.URL
+		target.Scheme = "https"
+		target.Host = normalizeHost(req.Host)
+		log.Debugf("Upgrading plaintext request to %s", target.String())
+		// Temporary, so that browsers don't remember the upgrade once the
+		// policy is changed or the site stops supporting HTTPS
+		http.Redirect(resp, req, target.String(), http.StatusTemporaryRedirect)
+		return
+	}
+	log.Debugf("Blocking plaintext request to %s", req.Host)
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(resp, blockedPage, html.EscapeString(req.Host))
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/flashlight/hostmatch"
+)
+
+func TestPlaintextAllowedByDefault(t *testing.T) {
+	client := &Client{}
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	if client.refusesPlaintext(req) {
+		t.Error("Plaintext shouldn't be refused without a policy")
+	}
+}
+
+func TestPlaintextExceptions(t *testing.T) {
+	client := &Client{PlaintextPolicy: PLAINTEXT_BLOCK, PlaintextAllowed: hostmatch.MustParse("example.com")}
+	req, _ := http.NewRequest("GET", "http://www.example.com:80/", nil)
+	if client.refusesPlaintext(req) {
+		t.Error("Plaintext to an allowed site shouldn't be refused")
+	}
+	req, _ = http.NewRequest("GET", "http://www.example.org/", nil)
+	if !client.refusesPlaintext(req) {
+		t.Error("Plaintext to another site should be refused")
+	}
+	req, _ = http.NewRequest(CONNECT, "http://www.example.org:443", nil)
+	if client.refusesPlaintext(req) {
+		t.Error("CONNECT shouldn't be refused")
+	}
+}
+
+func TestPlaintextBlocked(t *testing.T) {
+	client := &Client{PlaintextPolicy: PLAINTEXT_BLOCK}
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	rec := httptest.NewRecorder()
+	client.servePlaintextRefusal(rec, req)
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Location") != "" {
+		t.Errorf("Expected block, got %d to %s", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestPlaintextUpgraded(t *testing.T) {
+	client := &Client{PlaintextPolicy: PLAINTEXT_UPGRADE}
+	req, _ := http.NewRequest("GET", "http://www.example.com:80/path?q=1", nil)
+	rec := httptest.NewRecorder()
+	client.servePlaintextRefusal(rec, req)
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Errorf("Expected temporary redirect, got %d", rec.Code)
+	}
+	if location := rec.Header().Get("Location"); location != "https://www.example.com/path?q=1" {
+		t.Errorf("Unexpected redirect to %s", location)
+	}
+
+	// Only GET and HEAD are upgraded
+	req, _ = http.NewRequest("POST", "http://www.example.com/form", nil)
+	rec = httptest.NewRecorder()
+	client.servePlaintextRefusal(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected POST to be blocked, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/websocket"
+)
+
+const (
+	// TRANSPORT_WEBSOCKET identifies the WebSocket transport, which carries
+	// each proxied connection as a stream of WebSocket messages over its own
+	// connection to the server.  CDNs like CloudFlare pass WebSockets
+	// through, and this avoids enproxy's per-request overhead.
+	TRANSPORT_WEBSOCKET = "websocket"
+
+	// DEST_HEADER tells the server where to connect a WebSocket stream to
+	DEST_HEADER = "X-Flashlight-Dest"
+)
+
+var (
+	TRANSPORTS = []string{TRANSPORT_ENPROXY, TRANSPORT_WEBSOCKET}
+)
+
+// transport returns the client's transport, defaulting to TRANSPORT_ENPROXY
+func (client *Client) transport() string {
+	if client.Transport == "" {
+		return TRANSPORT_ENPROXY
+	}
+	return client.Transport
+}
+
+// dialUpstream connects to addr through the server using the client's
+// transport
+func (client *Client) dialUpstream(addr string) (net.Conn, error) {
+	if conn := client.takePreconnected(addr); conn != nil {
+		return conn, nil
+	}
+	if client.transport() == TRANSPORT_WEBSOCKET {
+		return client.dialWebSocket(addr)
+	}
+	conn := &enproxy.Conn{
+		Addr:   addr,
+		Config: client.EnproxyConfig,
+	}
+	if err := conn.Connect(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialWebSocket dials the server the same way that enproxy does (so that the
+// request goes through the CDN and is authenticated) and upgrades the
+// connection to a WebSocket stream to addr.
+func (client *Client) dialWebSocket(addr string) (net.Conn, error) {
+	return dialWebSocketWith(client.EnproxyConfig, addr)
+}
+
+// dialWebSocketWith is dialWebSocket using the given config
+func dialWebSocketWith(config *enproxy.Config, addr string) (net.Conn, error) {
+	conn, err := config.DialProxy(addr)
+	if err != nil {
+		return nil, err
+	}
+	req, err := config.NewRequest("", "GET", nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to build WebSocket request: %s", err)
+	}
+	req.Header.Set(DEST_HEADER, addr)
+	ws, err := websocket.Handshake(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return websocket.NewStream(ws), nil
+}
+
+// askServer sends a request marked with the given header to the server
+// itself, reaching it the same way that enproxy does (so that the request
+// goes through the CDN and is authenticated), and hands the body of a
+// successful response to handle.
+func (client *Client) askServer(header string, handle func(body io.Reader) error) error {
+	conn, err := client.EnproxyConfig.DialProxy("")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req, err := client.EnproxyConfig.NewRequest("", "GET", nil)
+	if err != nil {
+		return fmt.Errorf("Unable to build request: %s", err)
+	}
+	req.Header.Set(header, "1")
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("Unable to send request: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("Unable to read response: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response status: %d", resp.StatusCode)
+	}
+	return handle(resp.Body)
+}
+
+// connectUpstream handles a CONNECT request with a transport other than
+// enproxy (which intercepts CONNECTs itself), or one to a destination for
+// which a tunnel was preconnected or that's a media host, by dialing the destination through the
+// server and piping data between it and the browser.
+func (client *Client) connectUpstream(resp http.ResponseWriter, req *http.Request) {
+	remote, err := client.dialUpstream(req.Host)
+	if err != nil {
+		log.Errorf("Unable to connect to %s through tunnel: %s", req.Host, err)
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	client.pipeConnect(resp, req, remote)
+}
+
+// pipeConnect answers the CONNECT request and pipes data between the browser
+// and remote
+func (client *Client) pipeConnect(resp http.ResponseWriter, req *http.Request, remote net.Conn) {
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		log.Error("Unable to hijack connection for CONNECT")
+		resp.WriteHeader(http.StatusInternalServerError)
+		remote.Close()
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("Unable to hijack connection for CONNECT: %s", err)
+		remote.Close()
+		return
+	}
+	clientConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	if client.isMedia(req.Host) {
+		pipeBuffered(clientConn, remote, MEDIA_BUFFER_SIZE)
+	} else {
+		pipe(clientConn, remote)
+	}
+}
+
+// isWebSocketStream determines whether the request asks the server for a
+// WebSocket stream to a destination
+func isWebSocketStream(req *http.Request) bool {
+	return req.Header.Get(DEST_HEADER) != "" && strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// acceptingWebSockets wraps the given handler (the enproxy Proxy), handling
+// requests for WebSocket streams itself
+func (server *Server) acceptingWebSockets(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !isWebSocketStream(req) {
+			handler.ServeHTTP(resp, req)
+			return
+		}
+		server.serveWebSocket(resp, req)
+	})
+}
+
+// serveWebSocket connects a WebSocket stream to its destination
+func (server *Server) serveWebSocket(resp http.ResponseWriter, req *http.Request) {
+	addr := req.Header.Get(DEST_HEADER)
+	dest, err := server.dialDestination(addr)
+	if err != nil {
+		log.Debugf("Unable to dial %s for WebSocket stream: %s", addr, err)
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	ws, err := websocket.Upgrade(resp, req)
+	if err != nil {
+		log.Errorf("Unable to upgrade to WebSocket stream: %s", err)
+		dest.Close()
+		return
+	}
+	var stream net.Conn = websocket.NewStream(ws)
+	if server.onBytesReceived != nil {
+		ip := strings.Split(req.RemoteAddr, ":")[0]
+		stream = &reportingConn{stream, ip, server.onBytesReceived, server.onBytesSent}
+	}
+	pipe(stream, dest)
+}
+
+// reportingConn reports the bytes received from and sent to a client the same
+// way that the enproxy Proxy does
+type reportingConn struct {
+	net.Conn
+	ip              string
+	onBytesReceived func(ip string, bytes int64)
+	onBytesSent     func(ip string, bytes int64)
+}
+
+func (c *reportingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.onBytesReceived(c.ip, int64(n))
+	return n, err
+}
+
+func (c *reportingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.onBytesSent(c.ip, int64(n))
+	return n, err
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// TRANSPORT_ENPROXY identifies the enproxy transport (HTTP request/response
+	// pairs over TLS) in the ClientStatus
+	TRANSPORT_ENPROXY = "enproxy"
+
+	MAX_RECENT_ERRORS = 20
+)
+
+// RecentError is an error encountered by the client
+type RecentError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// upstreamState tracks the client's connection to the server
+type upstreamState struct {
+	connected    bool
+	transport    string
+	upstream     string
+	lastDial     time.Time
+	recentErrors []*RecentError
+	mutex        sync.Mutex
+}
+
+// trackUpstream wraps the EnproxyConfig's DialProxy so that the outcome of
+// each dial is reflected in the client's status.
+func (client *Client) trackUpstream() {
+	client.upstream.transport = client.transport()
+	dial := client.EnproxyConfig.DialProxy
+	client.EnproxyConfig.DialProxy = func(addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(addr)
+		client.upstream.onDial(conn, err)
+		if client.instruments != nil {
+			client.recordDial(start, err)
+		}
+		return conn, err
+	}
+}
+
+func (state *upstreamState) onDial(conn net.Conn, err error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.lastDial = time.Now()
+	state.connected = err == nil
+	if err != nil {
+		state.recordError(err)
+	} else {
+		state.upstream = conn.RemoteAddr().String()
+	}
+}
+
+// recordError records an error, keeping only the most recent ones.  Must be
+// called while holding the mutex.
+func (state *upstreamState) recordError(err error) {
+	state.recentErrors = append(state.recentErrors, &RecentError{time.Now(), err.Error()})
+	if len(state.recentErrors) > MAX_RECENT_ERRORS {
+		state.recentErrors = state.recentErrors[len(state.recentErrors)-MAX_RECENT_ERRORS:]
+	}
+}
+
+// fillStatus adds the upstream state to the given status
+func (state *upstreamState) fillStatus(status *ClientStatus) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	status.Connected = state.connected
+	status.Transport = state.transport
+	status.Upstream = state.upstream
+	status.LastDial = state.lastDial
+	status.RecentErrors = append([]*RecentError{}, state.recentErrors...)
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/metrics"
+)
+
+// withStallWatchdog creates a RoundTripper that uses the supplied RoundTripper
+// and that aborts responses whose bodies stop flowing for longer than
+// stallTimeout.  Stalls are counted in the given registry (if not nil).
+func withStallWatchdog(stallTimeout time.Duration, registry *metrics.Registry, rt http.RoundTripper) http.RoundTripper {
+	if stallTimeout <= 0 {
+		return rt
+	}
+	watchdog := &stallWatchdog{orig: rt, stallTimeout: stallTimeout}
+	if registry != nil {
+		watchdog.stalls = registry.Counter("flashlight_upstream_stalls_total", "Upstream responses aborted because their body stalled")
+	}
+	return watchdog
+}
+
+// stallWatchdog is an http.RoundTripper that wraps another http.RoundTripper
+// and watches response bodies for stalls.
+type stallWatchdog struct {
+	orig         http.RoundTripper
+	stallTimeout time.Duration
+	stalls       *metrics.Counter
+}
+
+func (rt *stallWatchdog) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.orig.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body := &watchedBody{
+		ReadCloser: resp.Body,
+		url:        req.URL.String(),
+		watchdog:   rt,
+	}
+	body.timer = time.AfterFunc(rt.stallTimeout, body.onStall)
+	resp.Body = body
+	return resp, nil
+}
+
+// watchedBody is a response body that gets aborted if no data is read from it
+// within the stall timeout.
+type watchedBody struct {
+	io.ReadCloser
+	url      string
+	watchdog *stallWatchdog
+	timer    *time.Timer
+	stalled  int32
+}
+
+func (body *watchedBody) Read(p []byte) (n int, err error) {
+	n, err = body.ReadCloser.Read(p)
+	if atomic.LoadInt32(&body.stalled) == 1 {
+		return n, fmt.Errorf("Upstream response for %s stalled for more than %s", body.url, body.watchdog.stallTimeout)
+	}
+	if err != nil {
+		body.timer.Stop()
+	} else if n > 0 {
+		body.timer.Reset(body.watchdog.stallTimeout)
+	}
+	return
+}
+
+func (body *watchedBody) Close() error {
+	body.timer.Stop()
+	return body.ReadCloser.Close()
+}
+
+func (body *watchedBody) onStall() {
+	atomic.StoreInt32(&body.stalled, 1)
+	log.Errorf("Aborting upstream response for %s, no data for %s", body.url, body.watchdog.stallTimeout)
+	if body.watchdog.stalls != nil {
+		body.watchdog.stalls.Inc()
+	}
+	body.ReadCloser.Close()
+}
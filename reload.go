@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/getlantern/flashlight/configfile"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/masquerade"
+	"github.com/getlantern/flashlight/protocol"
+	"github.com/getlantern/flashlight/proxy"
+)
+
+var (
+	// RELOADABLE_FLAGS are the flags whose changes a reload applies to the
+	// running client
+	RELOADABLE_FLAGS = []string{"server", "masquerade", "dumpheaders", "loglevel"}
+
+	// SERVER_RELOADABLE_FLAGS are the RELOADABLE_FLAGS that apply to servers
+	SERVER_RELOADABLE_FLAGS = []string{"loglevel"}
+
+	// explicitFlags are the flags given on the command line, which keep
+	// overriding the config file on reload
+	explicitFlags = make(map[string]bool)
+)
+
+// upstreamServer returns the (current) FQDN of the flashlight server
+func (app *App) upstreamServer() string {
+	app.upstreamMutex.RLock()
+	defer app.upstreamMutex.RUnlock()
+	return app.upstreamHost
+}
+
+// setUpstreamServer switches to another server, which new connections use
+func (app *App) setUpstreamServer(host string) {
+	app.upstreamMutex.Lock()
+	defer app.upstreamMutex.Unlock()
+	app.upstreamHost = host
+	app.protocol = nil
+}
+
+// activeProtocol returns the protocol selected with -protocol, configured for
+// the current server
+func (app *App) activeProtocol() protocol.Protocol {
+	app.upstreamMutex.RLock()
+	p := app.protocol
+	app.upstreamMutex.RUnlock()
+	if p != nil {
+		return p
+	}
+	app.upstreamMutex.Lock()
+	defer app.upstreamMutex.Unlock()
+	if app.protocol == nil {
+		var err error
+		app.protocol, err = protocol.New(*protocolName, &protocol.Config{
+			ServerHost: app.upstreamHost,
+			TLSConfig:  app.clientTLSConfig,
+			DialTCP:    app.dialTCP,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return app.protocol
+}
+
+// reloader re-reads the config file and applies changes to the running client
+// (or server, which only has SERVER_RELOADABLE_FLAGS)
+type reloader struct {
+	app         *App
+	client      *proxy.Client    // nil for servers
+	masquerades *masquerade.List // nil for servers
+	mutex       sync.Mutex
+}
+
+// watchForReload reloads the config file whenever the process receives SIGHUP
+func (r *reloader) watchForReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for _ = range hup {
+			log.Info("Received SIGHUP, reloading config")
+			if err := r.reload(); err != nil {
+				log.Errorf("Unable to reload config: %s", err)
+			}
+		}
+	}()
+}
+
+// reload re-reads the config file and applies changes to RELOADABLE_FLAGS.
+// Connections that are already open keep going to wherever they were going,
+// new ones use the new settings.  Other settings require a restart.
+func (r *reloader) reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if *configFile == "" {
+		return fmt.Errorf("Not running with a config file, nothing to reload")
+	}
+	values, err := configfile.Load(*configFile)
+	if err != nil {
+		return err
+	}
+	for _, name := range r.reloadable() {
+		value, found := values[name]
+		if !found || explicitFlags[name] {
+			continue
+		}
+		if err := r.apply(name, value); err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, err)
+		}
+	}
+	for name, value := range values {
+		f := flag.Lookup(name)
+		if f == nil {
+			log.Errorf("Ignoring unknown setting %s in config file", name)
+		} else if !explicitFlags[name] && !contains(r.reloadable(), name) && f.Value.String() != value {
+			log.Errorf("Ignoring change of %s in config file, which requires a restart", name)
+		}
+	}
+	return nil
+}
+
+func (r *reloader) apply(name string, value string) error {
+	current := flag.Lookup(name).Value.String()
+	if value == current {
+		return nil
+	}
+	log.Debugf("Reloading %s: %s -> %s", name, current, value)
+	switch name {
+	case "server":
+		r.app.setUpstreamServer(value)
+		return flag.Set(name, value)
+	case "masquerade":
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+		hosts, err := configuredMasquerades()
+		if err != nil {
+			return err
+		}
+		if *cloakPSK == "" {
+			r.masquerades.Swap(hosts)
+		}
+	case "dumpheaders":
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+		r.client.SetDumpHeaders(*dumpheaders)
+	case "loglevel":
+		if err := applyLogLevels(value); err != nil {
+			return err
+		}
+		return flag.Set(name, value)
+	}
+	return nil
+}
+
+// reloadable returns the flags that a reload applies
+func (r *reloader) reloadable() []string {
+	if r.client == nil {
+		return SERVER_RELOADABLE_FLAGS
+	}
+	return RELOADABLE_FLAGS
+}
+
+func contains(list []string, item string) bool {
+	for _, candidate := range list {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/getlantern/flashlight/hotrestart"
+	"github.com/getlantern/flashlight/log"
+)
+
+// restart replaces the server with a new process running the same command
+// (e.g. after the binary was upgraded).  The new process inherits the
+// listening sockets, so that no connection is refused in the meantime, and
+// this one finishes the connections it has, for at most restartdrain, and
+// exits.
+func (app *App) restart() error {
+	if app.server == nil {
+		return fmt.Errorf("Only servers can be restarted")
+	}
+	process, err := hotrestart.Spawn()
+	if err != nil {
+		return fmt.Errorf("Unable to restart: %s", err)
+	}
+	log.Infof("Process %d took over, draining", process.Pid)
+	hotrestart.CloseAll()
+	return app.server.Drain(*restartDrain)
+}
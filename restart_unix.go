@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+// watchForRestart restarts the server whenever the process receives SIGUSR2
+func (app *App) watchForRestart() {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for _ = range usr2 {
+			log.Info("Received SIGUSR2, restarting")
+			if err := app.restart(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,6 @@
+package main
+
+// watchForRestart does nothing, Windows has neither SIGUSR2 nor inheritable
+// listening sockets
+func (app *App) watchForRestart() {
+}
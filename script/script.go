@@ -0,0 +1,208 @@
+// package script runs hooks from a user-provided JavaScript (ES5) file, for
+// routing decisions and header transforms that the declarative settings
+// (-localhosts, route overrides, etc.) can't express.  A script defines any of:
+//
+//	function route(host) {
+//	  // return "direct", "proxy" or nothing (the default routing)
+//	}
+//
+//	function headers(method, url, headers) {
+//	  // headers maps names to values, add, change or delete them (or return
+//	  // a new object)
+//	}
+//
+// Scripts are sandboxed: the interpreter has no access to files, the network
+// or the rest of flashlight, only to log(message).  Each call is limited to
+// Timeout, and hooks that fail or time out are logged and treated as if they
+// had returned nothing.
+//
+// Hooks run concurrently, each call on one of a pool of copies of the
+// interpreter taken after the top level ran.  Hooks therefore shouldn't rely
+// on state that they change between calls.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/robertkrimen/otto"
+)
+
+const (
+	// DEFAULT_TIMEOUT is how long a hook may run if no Timeout is given
+	DEFAULT_TIMEOUT = 50 * time.Millisecond
+
+	// IDLE_VMS is how many idle copies of the interpreter are kept around
+	IDLE_VMS = 16
+)
+
+var (
+	errTimeout = errors.New("Script timed out")
+)
+
+// Script is a loaded script
+type Script struct {
+	Timeout time.Duration // (optional) how long each call may run, defaults to DEFAULT_TIMEOUT
+
+	name      string
+	template  *otto.Otto      // the interpreter after running the top level, only copied
+	copyMutex sync.Mutex      // copying reads the template's runtime
+	idle      chan *otto.Otto // copies that aren't in use
+}
+
+// Load loads the script in the given file
+func Load(filename string) (*Script, error) {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read script: %s", err)
+	}
+	return Parse(filename, string(source))
+}
+
+// Parse parses the given source, running its top level (which typically
+// just defines the hooks)
+func Parse(name string, source string) (*Script, error) {
+	script := &Script{name: name, template: otto.New(), idle: make(chan *otto.Otto, IDLE_VMS)}
+	script.template.Set("log", func(call otto.FunctionCall) otto.Value {
+		log.Debugf("%s: %s", name, call.Argument(0).String())
+		return otto.UndefinedValue()
+	})
+	compiled, err := script.template.Compile(name, source)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse script %s: %s", name, err)
+	}
+	err = script.runOn(script.template, func(vm *otto.Otto) error {
+		_, err := vm.Run(compiled)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to run script %s: %s", name, err)
+	}
+	return script, nil
+}
+
+// Route calls the route hook for the given host, returning what it returned
+// or "" if there's no hook or it failed
+func (script *Script) Route(host string) string {
+	if script == nil {
+		return ""
+	}
+	var route string
+	err := script.run(func(vm *otto.Otto) error {
+		hook, err := vm.Get("route")
+		if err != nil || !hook.IsFunction() {
+			return err
+		}
+		result, err := hook.Call(otto.UndefinedValue(), host)
+		if err == nil && result.IsString() {
+			route = result.String()
+		}
+		return err
+	})
+	if err != nil {
+		log.Errorf("Error in route hook of %s for %s: %s", script.name, host, err)
+		return ""
+	}
+	return route
+}
+
+// TransformHeaders calls the headers hook for the given request, applying
+// the changes that it made to the headers.  Multiple values of a header are
+// passed to the hook joined by commas.
+func (script *Script) TransformHeaders(req *http.Request) {
+	if script == nil {
+		return
+	}
+	err := script.run(func(vm *otto.Otto) error {
+		hook, err := vm.Get("headers")
+		if err != nil || !hook.IsFunction() {
+			return err
+		}
+		headers, err := vm.Object("({})")
+		if err != nil {
+			return err
+		}
+		for name, values := range req.Header {
+			headers.Set(name, strings.Join(values, ", "))
+		}
+		result, err := hook.Call(otto.UndefinedValue(), req.Method, req.URL.String(), headers)
+		if err != nil {
+			return err
+		}
+		if result.IsObject() {
+			headers = result.Object()
+		}
+		transformed := make(http.Header)
+		for _, name := range headers.Keys() {
+			value, err := headers.Get(name)
+			if err != nil {
+				return err
+			}
+			if value.IsDefined() {
+				transformed.Set(name, value.String())
+			}
+		}
+		req.Header = transformed
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Error in headers hook of %s for %s: %s", script.name, req.URL, err)
+	}
+}
+
+// run runs f with an interpreter from the pool (or a new copy of the
+// template if none is idle), interrupting it after the Timeout
+func (script *Script) run(f func(vm *otto.Otto) error) error {
+	var vm *otto.Otto
+	select {
+	case vm = <-script.idle:
+	default:
+		script.copyMutex.Lock()
+		vm = script.template.Copy()
+		script.copyMutex.Unlock()
+	}
+	err := script.runOn(vm, f)
+	if err == errTimeout {
+		// Interrupted somewhere in the middle, don't trust it again
+		return err
+	}
+	select {
+	case script.idle <- vm:
+	default:
+		// Enough idle already
+	}
+	return err
+}
+
+// runOn runs f with the given interpreter, interrupting it after the Timeout
+func (script *Script) runOn(vm *otto.Otto, f func(vm *otto.Otto) error) (err error) {
+	timeout := script.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	// A new channel for every call, so that an interrupt that fires just as a
+	// call finishes can't hit the next one
+	interrupt := make(chan func(), 1)
+	vm.Interrupt = interrupt
+	timer := time.AfterFunc(timeout, func() {
+		interrupt <- func() {
+			panic(errTimeout)
+		}
+	})
+	defer timer.Stop()
+	defer func() {
+		if caught := recover(); caught != nil {
+			if caught != errTimeout {
+				panic(caught)
+			}
+			err = errTimeout
+		}
+	}()
+	return f(vm)
+}
@@ -0,0 +1,94 @@
+package script
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testScript = `
+function route(host) {
+  if (/\.corp\.example\.com$/.test(host)) {
+    return "direct";
+  }
+  if (host === "loop.example.com") {
+    while (true) {}
+  }
+}
+
+function headers(method, url, headers) {
+  delete headers["X-Tracking"];
+  headers["X-Method"] = method;
+}
+`
+
+func TestRoute(t *testing.T) {
+	script, err := Parse("test.js", testScript)
+	if err != nil {
+		t.Fatalf("Unable to parse script: %s", err)
+	}
+	if route := script.Route("wiki.corp.example.com"); route != "direct" {
+		t.Errorf("Expected direct, got %q", route)
+	}
+	if route := script.Route("www.example.com"); route != "" {
+		t.Errorf("Expected default route, got %q", route)
+	}
+
+	script.Timeout = 10 * time.Millisecond
+	start := time.Now()
+	if route := script.Route("loop.example.com"); route != "" {
+		t.Errorf("Expected default route for script that times out, got %q", route)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 1*time.Second {
+		t.Errorf("Script wasn't interrupted, ran for %s", elapsed)
+	}
+	if route := script.Route("wiki.corp.example.com"); route != "direct" {
+		t.Errorf("Script should still work after a timeout, got %q", route)
+	}
+}
+
+func TestConcurrentHooks(t *testing.T) {
+	script, err := Parse("test.js", testScript)
+	if err != nil {
+		t.Fatalf("Unable to parse script: %s", err)
+	}
+	script.Timeout = 2 * time.Second
+	looping := make(chan string)
+	go func() {
+		looping <- script.Route("loop.example.com")
+	}()
+	// Give the looping hook time to start
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if route := script.Route("wiki.corp.example.com"); route != "direct" {
+		t.Errorf("Expected direct, got %q", route)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 1*time.Second {
+		t.Errorf("Hook waited for another one to finish, took %s", elapsed)
+	}
+	<-looping
+}
+
+func TestTransformHeaders(t *testing.T) {
+	script, err := Parse("test.js", testScript)
+	if err != nil {
+		t.Fatalf("Unable to parse script: %s", err)
+	}
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req.Header.Set("X-Tracking", "1234")
+	req.Header.Add("Accept", "text/html")
+	req.Header.Add("Accept", "*/*")
+	script.TransformHeaders(req)
+	if req.Header.Get("X-Tracking") != "" || req.Header.Get("X-Method") != "GET" || req.Header.Get("Accept") != "text/html, */*" {
+		t.Errorf("Unexpected headers %v", req.Header)
+	}
+}
+
+func TestInvalidScript(t *testing.T) {
+	if _, err := Parse("invalid.js", "function route(host {"); err == nil {
+		t.Error("Expected error for invalid script")
+	}
+	if _, err := Parse("forever.js", "while (true) {}"); err == nil {
+		t.Error("Expected error for script whose top level doesn't finish")
+	}
+}
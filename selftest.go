@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/atomicfile"
+	"github.com/getlantern/flashlight/hotrestart"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/keyman"
+)
+
+const (
+	// SELF_TEST_DIAL_TIMEOUT limits how long the outbound connectivity
+	// self-test waits for a connection
+	SELF_TEST_DIAL_TIMEOUT = 5 * time.Second
+
+	// SELF_TEST_OUTBOUND_ADDR is dialed by servers to check that they can
+	// reach the internet
+	SELF_TEST_OUTBOUND_ADDR = "www.google.com:443"
+)
+
+var (
+	// earliestSaneTime is before this version of flashlight was built, so a
+	// clock that's earlier than this is certainly wrong
+	earliestSaneTime = time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// selfTest is a check run on startup that catches a common misconfiguration
+// before it shows up as a confusing error at runtime
+type selfTest struct {
+	name  string
+	fix   string // what to do if the check fails
+	check func() error
+}
+
+// runSelfTests runs the self-tests, logging what failed and how to fix it.
+// With -strictstart, any failure keeps flashlight from starting.
+func (app *App) runSelfTests() {
+	tests := app.selfTests()
+	failed := 0
+	for _, test := range tests {
+		if err := test.check(); err != nil {
+			failed++
+			log.Errorf("Self-test %s failed: %s\n  To fix: %s", test.name, err, test.fix)
+		}
+	}
+	switch {
+	case failed == 0:
+		log.Debugf("All %d self-tests passed", len(tests))
+	case *strictStart:
+		log.Fatalf("%d of %d self-tests failed, not starting because of -strictstart", failed, len(tests))
+	default:
+		log.Errorf("%d of %d self-tests failed, starting anyway (use -strictstart to refuse)", failed, len(tests))
+	}
+}
+
+// selfTests returns the self-tests that apply to the current configuration
+func (app *App) selfTests() []*selfTest {
+	tests := []*selfTest{
+		{
+			name:  "configdir",
+			fix:   fmt.Sprintf("make %s writable by this user, or choose another directory with -configdir", *configDir),
+			check: checkConfigDirWritable,
+		},
+		{
+			name:  "clock",
+			fix:   "set the system clock to the correct time (e.g. enable NTP), certificates can't be verified otherwise",
+			check: checkClock,
+		},
+	}
+	for _, addr := range app.listenAddrs() {
+		tests = append(tests, &selfTest{
+			name:  "bind " + addr,
+			fix:   "stop whatever is already listening there (perhaps another flashlight) or choose a different -addr, ports below 1024 may require extra privileges",
+			check: checkBind(addr),
+		})
+	}
+	if app.isClient() {
+		if *rootCA != "" {
+			tests = append(tests, &selfTest{
+				name:  "rootca",
+				fix:   "ask the server's operator for its current certificate (genconfig prints it) and pass it with -rootca",
+				check: checkRootCA,
+			})
+		}
+		if *clientCertFile != "" && *clientKeyFile != "" {
+			tests = append(tests, &selfTest{
+				name:  "clientcert",
+				fix:   "ask the server's operator for a new client certificate and make sure that -clientkey holds its private key",
+				check: checkClientCert,
+			})
+		}
+		tests = append(tests, &selfTest{
+			name:  "outbound",
+			fix:   "check the network connection and firewall, and that -server and -serverport (or the masquerades) are right",
+			check: app.checkServerReachable,
+		})
+	} else {
+		if *certFile != "" && *keyFile != "" {
+			tests = append(tests, &selfTest{
+				name:  "certfile",
+				fix:   "renew the certificate in -certfile and make sure that -keyfile holds its private key",
+				check: checkServerCert,
+			})
+		}
+		tests = append(tests, &selfTest{
+			name:  "outbound",
+			fix:   "check the server's network connection, firewall and DNS (and -egressproxy, if set), clients can only reach what the server can",
+			check: checkOutbound,
+		})
+	}
+	return tests
+}
+
+// checkConfigDirWritable checks that files can be written to the configdir
+func checkConfigDirWritable() error {
+	testFile := inConfigDir(".writetest")
+	if err := atomicfile.WriteFile(testFile, []byte("test"), 0600); err != nil {
+		return err
+	}
+	return os.Remove(testFile)
+}
+
+func checkClock() error {
+	if now := time.Now(); now.Before(earliestSaneTime) {
+		return fmt.Errorf("System clock says it's %s, which can't be right", now.Format(time.RFC1123))
+	}
+	return nil
+}
+
+// listenAddrs returns the addresses at which we're going to listen
+func (app *App) listenAddrs() []string {
+	addrs := splitList(*addr)
+	if app.isClient() && *socksAddr != "" {
+		addrs = append(addrs, *socksAddr)
+	}
+	return addrs
+}
+
+// checkBind returns a check that we can listen at the given address.  An
+// address whose socket was inherited from the process that we're replacing is
+// still in use by it, but fine.
+func checkBind(addr string) func() error {
+	return func() error {
+		if hotrestart.Inherited(addr) {
+			return nil
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("Unable to listen at %s: %s", addr, err)
+		}
+		return l.Close()
+	}
+}
+
+func checkRootCA() error {
+	cert, err := keyman.LoadCertificateFromPEMBytes([]byte(*rootCA))
+	if err != nil {
+		return fmt.Errorf("Unable to load root ca cert: %s", err)
+	}
+	return checkValidity("Pinned root CA", cert.X509())
+}
+
+func checkServerCert() error {
+	return checkKeyPair("Server certificate", *certFile, *keyFile)
+}
+
+func checkClientCert() error {
+	return checkKeyPair("Client certificate", *clientCertFile, *clientKeyFile)
+}
+
+// checkKeyPair checks that the given certificate and key match and that the
+// certificate is currently valid
+func checkKeyPair(name string, certFile string, keyFile string) error {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load %s and %s: %s", certFile, keyFile, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Unable to parse %s: %s", certFile, err)
+	}
+	return checkValidity(name+" "+certFile, cert)
+}
+
+// checkValidity checks that the given certificate is currently valid,
+// pointing out a wrong clock if that's the likely cause
+func checkValidity(name string, cert *x509.Certificate) error {
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("%s isn't valid until %s, is the system clock (%s) behind?", name, cert.NotBefore, now.Format(time.RFC1123))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("%s expired on %s", name, cert.NotAfter)
+	}
+	return nil
+}
+
+// checkServerReachable checks that at least one of the addresses at which the
+// client reaches the server accepts connections
+func (app *App) checkServerReachable() error {
+	masquerades, err := configuredMasquerades()
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, addr := range app.addressesForServer(masquerades) {
+		if *knockKey != "" && len(masquerades) == 0 {
+			// The server's port stays closed until we knock, so just make
+			// sure that its name resolves
+			host, _, _ := net.SplitHostPort(addr)
+			if _, err := net.LookupHost(host); err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			return nil
+		}
+		conn, err := net.DialTimeout("tcp", addr, SELF_TEST_DIAL_TIMEOUT)
+		if err == nil {
+			return conn.Close()
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("Unable to reach the server: %s", strings.Join(errs, "; "))
+}
+
+// checkUpstreamDialable checks that the running client can reach the server
+// the way that it does for requests, i.e. through the active protocol and a
+// masquerade (if there are any), including the TLS handshake
+func (app *App) checkUpstreamDialable() error {
+	conn, err := app.client.EnproxyConfig.DialProxy("")
+	if err != nil {
+		return fmt.Errorf("Unable to reach the server: %s", err)
+	}
+	return conn.Close()
+}
+
+// checkOutbound checks that the server can connect to the internet (through
+// the egress proxy, if there is one)
+func checkOutbound() error {
+	addr := SELF_TEST_OUTBOUND_ADDR
+	if egress := parseEgressProxy(); egress != nil {
+		addr = egress.Host
+	}
+	conn, err := net.DialTimeout("tcp", addr, SELF_TEST_DIAL_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to %s: %s", addr, err)
+	}
+	return conn.Close()
+}
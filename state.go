@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/getlantern/flashlight/atomicfile"
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/statearchive"
+)
+
+const (
+	// PASSPHRASE_ENV is the environment variable from which export-state and
+	// import-state read the archive's passphrase, prompting for it if unset
+	PASSPHRASE_ENV = "FLASHLIGHT_STATE_PASSPHRASE"
+
+	STATE_USAGE = `Usage:
+  flashlight export-state [-configdir dir] <archive>
+  flashlight import-state [-configdir dir] <archive>
+
+The passphrase is read from $` + PASSPHRASE_ENV + ` or prompted for.`
+)
+
+var (
+	// STATE_DIRS are directories in the configdir whose files are part of
+	// the operational state, in addition to CONFIG_FILES
+	STATE_DIRS = []string{"statspool"}
+)
+
+// exportState writes the keys, certificates and learned caches in the
+// configdir to an encrypted archive.  Guest usage is only kept in memory, so
+// it isn't exported (see -syncpeer for keeping it across failovers).
+func exportState() {
+	filename := stateArchiveArg()
+	var files []*statearchive.File
+	for _, name := range stateFiles() {
+		path := inConfigDir(name)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Unable to read %s: %s", path, err)
+		}
+		files = append(files, &statearchive.File{Name: filepath.ToSlash(name), Mode: info.Mode().Perm(), Data: data})
+	}
+	if len(files) == 0 {
+		log.Fatalf("No state found in %s", *configDir)
+	}
+	out, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatalf("Unable to create archive: %s", err)
+	}
+	defer out.Close()
+	if err := statearchive.Write(out, files, readPassphrase(true)); err != nil {
+		os.Remove(filename)
+		log.Fatal(err)
+	}
+	for _, file := range files {
+		fmt.Printf("Exported %s\n", file.Name)
+	}
+}
+
+// importState restores the files from an archive written by exportState into
+// the configdir with their original permissions.  It refuses to overwrite
+// existing files, so that importing can't clobber another installation's
+// keys.
+func importState() {
+	filename := stateArchiveArg()
+	in, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("Unable to open archive: %s", err)
+	}
+	defer in.Close()
+	files, err := statearchive.Read(in, readPassphrase(false))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, file := range files {
+		if !isStateFile(file.Name) {
+			log.Fatalf("Archive contains unexpected file %s", file.Name)
+		}
+		if _, err := os.Stat(inConfigDir(filepath.FromSlash(file.Name))); err == nil {
+			log.Fatalf("%s already exists in %s, remove it first to import", file.Name, *configDir)
+		}
+	}
+	for _, file := range files {
+		path := inConfigDir(filepath.FromSlash(file.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			log.Fatalf("Unable to create directory for %s: %s", path, err)
+		}
+		if err := atomicfile.WriteFile(path, file.Data, file.Mode.Perm()); err != nil {
+			log.Fatalf("Unable to write %s: %s", path, err)
+		}
+		fmt.Printf("Imported %s\n", file.Name)
+	}
+}
+
+// stateFiles lists the files in the configdir that make up the operational
+// state, relative to the configdir
+func stateFiles() []string {
+	names := append([]string{}, CONFIG_FILES...)
+	for _, dir := range STATE_DIRS {
+		infos, err := ioutil.ReadDir(inConfigDir(dir))
+		if err != nil {
+			continue
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				names = append(names, filepath.Join(dir, info.Name()))
+			}
+		}
+	}
+	return names
+}
+
+// isStateFile determines whether the archived file name belongs to the
+// operational state, so that a crafted archive can't write elsewhere
+func isStateFile(name string) bool {
+	for _, file := range CONFIG_FILES {
+		if name == file {
+			return true
+		}
+	}
+	for _, dir := range STATE_DIRS {
+		if path.Dir(name) == dir && path.Base(name) != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func stateArchiveArg() string {
+	if len(subcommandArgs) != 1 {
+		fmt.Fprintf(os.Stderr, "%s\n", STATE_USAGE)
+		os.Exit(1)
+	}
+	return subcommandArgs[0]
+}
+
+// readPassphrase reads the passphrase from PASSPHRASE_ENV or stdin, asking
+// for it twice when creating an archive
+func readPassphrase(confirm bool) string {
+	if passphrase := os.Getenv(PASSPHRASE_ENV); passphrase != "" {
+		return passphrase
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	prompt := func(text string) string {
+		fmt.Fprint(os.Stderr, text)
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatalf("Unable to read passphrase: %s", err)
+		}
+		return strings.TrimRight(line, "\r\n")
+	}
+	passphrase := prompt("Passphrase: ")
+	if passphrase == "" {
+		log.Fatal("Passphrase must not be empty")
+	}
+	if confirm && prompt("Repeat passphrase: ") != passphrase {
+		log.Fatal("Passphrases don't match")
+	}
+	return passphrase
+}
@@ -0,0 +1,134 @@
+// package statearchive reads and writes passphrase-encrypted archives of
+// files, used to move flashlight's operational state (keys, certificates and
+// learned caches) between machines.
+//
+// An archive consists of MAGIC, a random salt, a random nonce and the JSON
+// encoded files sealed with AES-256-GCM, using a key derived from the
+// passphrase and salt with PBKDF2-HMAC-SHA256.
+package statearchive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	MAGIC = "FLSTATE1"
+
+	SALT_LEN          = 16
+	KEY_LEN           = 32
+	PBKDF2_ITERATIONS = 100000
+)
+
+// File is a file in an archive
+type File struct {
+	Name string      `json:"name"` // path relative to the directory from which the file was archived
+	Mode os.FileMode `json:"mode"` // permissions
+	Data []byte      `json:"data"`
+}
+
+// Write writes an archive of the given files, encrypted with passphrase
+func Write(w io.Writer, files []*File, passphrase string) error {
+	plaintext, err := json.Marshal(files)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal files: %s", err)
+	}
+	salt := make([]byte, SALT_LEN)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("Unable to generate salt: %s", err)
+	}
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	header := append(append([]byte(MAGIC), salt...), nonce...)
+	// The header is authenticated along with the files
+	sealed := gcm.Seal(nil, nonce, plaintext, header)
+	if _, err := w.Write(append(header, sealed...)); err != nil {
+		return fmt.Errorf("Unable to write archive: %s", err)
+	}
+	return nil
+}
+
+// Read reads the files from an archive encrypted with passphrase
+func Read(r io.Reader, passphrase string) ([]*File, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read archive: %s", err)
+	}
+	if !bytes.HasPrefix(data, []byte(MAGIC)) {
+		return nil, fmt.Errorf("Not a flashlight state archive")
+	}
+	if len(data) < len(MAGIC)+SALT_LEN {
+		return nil, fmt.Errorf("Truncated archive")
+	}
+	salt := data[len(MAGIC) : len(MAGIC)+SALT_LEN]
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	headerLen := len(MAGIC) + SALT_LEN + gcm.NonceSize()
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("Truncated archive")
+	}
+	nonce := data[len(MAGIC)+SALT_LEN : headerLen]
+	plaintext, err := gcm.Open(nil, nonce, data[headerLen:], data[:headerLen])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt archive, wrong passphrase?")
+	}
+	var files []*File
+	if err := json.Unmarshal(plaintext, &files); err != nil {
+		return nil, fmt.Errorf("Unable to parse archive: %s", err)
+	}
+	return files, nil
+}
+
+func newGCM(passphrase string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2([]byte(passphrase), salt, PBKDF2_ITERATIONS, KEY_LEN))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create cipher: %s", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create cipher: %s", err)
+	}
+	return gcm, nil
+}
+
+// pbkdf2 derives a key of keyLen bytes from the password and salt using
+// PBKDF2 with HMAC-SHA256 (RFC 2898)
+func pbkdf2(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
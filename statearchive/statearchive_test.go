@@ -0,0 +1,46 @@
+package statearchive
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	files := []*File{
+		{Name: "proxypk.pem", Mode: 0600, Data: []byte("secret key")},
+		{Name: "statspool/1.json", Mode: 0644, Data: []byte("{}")},
+	}
+	archive := &bytes.Buffer{}
+	if err := Write(archive, files, "correct horse"); err != nil {
+		t.Fatalf("Unable to write archive: %s", err)
+	}
+	if bytes.Contains(archive.Bytes(), []byte("secret key")) {
+		t.Error("Archive should be encrypted")
+	}
+	read, err := Read(bytes.NewReader(archive.Bytes()), "correct horse")
+	if err != nil {
+		t.Fatalf("Unable to read archive: %s", err)
+	}
+	if !reflect.DeepEqual(read, files) {
+		t.Errorf("Expected %v, got %v", files, read)
+	}
+	if _, err := Read(bytes.NewReader(archive.Bytes()), "wrong"); err == nil {
+		t.Error("Reading with the wrong passphrase should fail")
+	}
+	tampered := archive.Bytes()
+	tampered[len(MAGIC)] ^= 1
+	if _, err := Read(bytes.NewReader(tampered), "correct horse"); err == nil {
+		t.Error("Reading a tampered archive should fail")
+	}
+}
+
+func TestPBKDF2(t *testing.T) {
+	// Test vector from RFC 7914, section 11
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if hex.EncodeToString(key) != expected {
+		t.Errorf("Unexpected key %x", key)
+	}
+}
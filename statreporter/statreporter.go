@@ -4,22 +4,44 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/getlantern/flashlight/atomicfile"
 	"github.com/getlantern/flashlight/log"
 )
 
 const (
 	STATSHUB_URL_TEMPLATE = "https://pure-journey-3547.herokuapp.com/stats/%s"
 	REPORT_STATS_INTERVAL = 20 * time.Second
+
+	// MAX_SPOOLED_REPORTS limits the spool to about a day's worth of reports,
+	// beyond which the oldest are dropped
+	MAX_SPOOLED_REPORTS = 4320
 )
 
 type Reporter struct {
-	InstanceId string // (optional) instanceid under which to report statistics
-	Country    string // (optional) country under which to report statistics
-	bytesGiven int64  // tracks bytes given
+	InstanceId  string // (optional) instanceid under which to report statistics
+	Country     string // (optional) country under which to report statistics
+	URLTemplate string // (optional) statshub URL, with %s standing in for the instanceid.  Defaults to STATSHUB_URL_TEMPLATE.
+	SpoolDir    string // (optional) directory in which to keep reports that couldn't be posted until statshub is reachable again
+	bytesGiven  int64  // tracks bytes given
+}
+
+// Report is a single report to statshub.  Its Id identifies the reporting
+// interval, so statshub can discard reports it has already received (e.g.
+// when a post succeeded but the response was lost and the report was spooled
+// anyway).
+type Report struct {
+	Id         string            `json:"id"`
+	Dims       map[string]string `json:"dims"`
+	Increments map[string]int64  `json:"increments"`
 }
 
 // OnBytesGiven registers the fact that bytes were given (sent or received)
@@ -34,32 +56,48 @@ func (reporter *Reporter) Start() {
 		waitTime := nextInterval.Sub(time.Now())
 		time.Sleep(waitTime)
 		bytesGiven := atomic.SwapInt64(&reporter.bytesGiven, 0)
-		err := reporter.postStats(bytesGiven)
-		if err != nil {
-			log.Errorf("Error on posting stats: %s", err)
-		} else {
-			log.Debugf("Reported %d bytesGiven to statshub", bytesGiven)
-		}
+		reporter.report(nextInterval, bytesGiven)
+	}
+}
+
+// report posts the stats for the given interval, spooling them if that fails
+// and flushing previously spooled reports if it succeeds.
+func (reporter *Reporter) report(interval time.Time, bytesGiven int64) {
+	report := reporter.newReport(interval, bytesGiven)
+	err := reporter.postStats(report)
+	if err != nil {
+		log.Errorf("Error on posting stats: %s", err)
+		reporter.spool(interval, report)
+		return
 	}
+	log.Debugf("Reported %d bytesGiven to statshub", bytesGiven)
+	reporter.flushSpool()
 }
 
-func (reporter *Reporter) postStats(bytesGiven int64) error {
-	report := map[string]interface{}{
-		"dims": map[string]string{
+func (reporter *Reporter) newReport(interval time.Time, bytesGiven int64) *Report {
+	return &Report{
+		Id: fmt.Sprintf("%s-%d", reporter.InstanceId, interval.Unix()),
+		Dims: map[string]string{
 			"country": reporter.Country,
 		},
-		"increments": map[string]int64{
+		Increments: map[string]int64{
 			"bytesGiven":             bytesGiven,
 			"bytesGivenByFlashlight": bytesGiven,
 		},
 	}
+}
 
+func (reporter *Reporter) postStats(report *Report) error {
 	jsonBytes, err := json.Marshal(report)
 	if err != nil {
 		return fmt.Errorf("Unable to marshal json for stats: %s", err)
 	}
 
-	url := fmt.Sprintf(STATSHUB_URL_TEMPLATE, reporter.InstanceId)
+	urlTemplate := reporter.URLTemplate
+	if urlTemplate == "" {
+		urlTemplate = STATSHUB_URL_TEMPLATE
+	}
+	url := fmt.Sprintf(urlTemplate, reporter.InstanceId)
 	resp, err := http.Post(url, "application/json", bytes.NewReader(jsonBytes))
 	if err != nil {
 		return fmt.Errorf("Unable to post stats to statshub: %s", err)
@@ -70,3 +108,74 @@ func (reporter *Reporter) postStats(bytesGiven int64) error {
 	}
 	return nil
 }
+
+// spool saves a report that couldn't be posted.  Reports are named after their
+// interval, so each interval is spooled at most once.
+func (reporter *Reporter) spool(interval time.Time, report *Report) {
+	if reporter.SpoolDir == "" {
+		return
+	}
+	if err := os.MkdirAll(reporter.SpoolDir, 0700); err != nil {
+		log.Errorf("Unable to create stats spool: %s", err)
+		return
+	}
+	jsonBytes, err := json.Marshal(report)
+	if err != nil {
+		log.Errorf("Unable to marshal json for spooled stats: %s", err)
+		return
+	}
+	filename := filepath.Join(reporter.SpoolDir, fmt.Sprintf("%d.json", interval.Unix()))
+	if err := atomicfile.WriteFile(filename, jsonBytes, 0600); err != nil {
+		log.Errorf("Unable to spool stats: %s", err)
+		return
+	}
+	spooled := reporter.spooled()
+	for len(spooled) > MAX_SPOOLED_REPORTS {
+		log.Errorf("Stats spool full, dropping %s", spooled[0])
+		os.Remove(spooled[0])
+		spooled = spooled[1:]
+	}
+}
+
+// flushSpool posts spooled reports, oldest first, stopping at the first
+// failure.
+func (reporter *Reporter) flushSpool() {
+	for _, filename := range reporter.spooled() {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.Errorf("Unable to read spooled stats: %s", err)
+			return
+		}
+		report := &Report{}
+		if err := json.Unmarshal(data, report); err != nil {
+			log.Errorf("Dropping corrupt spooled stats %s: %s", filename, err)
+			os.Remove(filename)
+			continue
+		}
+		if err := reporter.postStats(report); err != nil {
+			log.Errorf("Unable to post spooled stats, will retry later: %s", err)
+			return
+		}
+		os.Remove(filename)
+		log.Debugf("Reported spooled stats %s", report.Id)
+	}
+}
+
+// spooled lists the spooled reports, oldest first
+func (reporter *Reporter) spooled() []string {
+	if reporter.SpoolDir == "" {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(reporter.SpoolDir)
+	if err != nil {
+		return nil
+	}
+	var filenames []string
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".json") {
+			filenames = append(filenames, filepath.Join(reporter.SpoolDir, info.Name()))
+		}
+	}
+	sort.Strings(filenames)
+	return filenames
+}
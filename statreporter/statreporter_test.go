@@ -0,0 +1,60 @@
+package statreporter
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/flashlight/statreporter/statshubtest"
+)
+
+func TestSpoolingDuringOutage(t *testing.T) {
+	hub := statshubtest.Start()
+	defer hub.Close()
+	spoolDir, err := ioutil.TempDir("", "statspool")
+	if err != nil {
+		t.Fatalf("Unable to create spool dir: %s", err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	reporter := &Reporter{
+		InstanceId:  "test",
+		Country:     "xx",
+		URLTemplate: hub.URLTemplate,
+		SpoolDir:    spoolDir,
+	}
+	start := time.Now().Truncate(REPORT_STATS_INTERVAL)
+	interval := func(i int) time.Time {
+		return start.Add(time.Duration(i) * REPORT_STATS_INTERVAL)
+	}
+
+	reporter.report(interval(0), 10)
+	hub.SetDown(true)
+	reporter.report(interval(1), 20)
+	reporter.report(interval(2), 30)
+	if total := hub.Total("test", "bytesGiven"); total != 10 {
+		t.Errorf("Expected 10 bytes reported during outage, got %d", total)
+	}
+	if spooled := len(reporter.spooled()); spooled != 2 {
+		t.Errorf("Expected 2 spooled reports, got %d", spooled)
+	}
+
+	hub.SetDown(false)
+	reporter.report(interval(3), 40)
+	if total := hub.Total("test", "bytesGiven"); total != 100 {
+		t.Errorf("Expected all 100 bytes reported after outage, got %d", total)
+	}
+	if spooled := len(reporter.spooled()); spooled != 0 {
+		t.Errorf("Expected empty spool, got %d reports", spooled)
+	}
+
+	// Resending an interval that was already received must not double count
+	reporter.postStats(reporter.newReport(interval(3), 40))
+	if total := hub.Total("test", "bytesGiven"); total != 100 {
+		t.Errorf("Duplicate report counted, total is %d", total)
+	}
+	if hub.Duplicates() != 1 {
+		t.Errorf("Expected 1 duplicate, got %d", hub.Duplicates())
+	}
+}
@@ -0,0 +1,99 @@
+// package statshubtest provides a mock statshub for testing stats reporting
+// without reaching the real statshub.
+package statshubtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Statshub is a mock statshub.  Like the real one, it accepts reports posted
+// to /stats/<instanceid>, but it also discards duplicate reports and can
+// simulate outages.
+type Statshub struct {
+	// URLTemplate is the URL to use for the Reporter's URLTemplate
+	URLTemplate string
+
+	server     *httptest.Server
+	down       bool
+	seen       map[string]bool
+	totals     map[string]map[string]int64 // increments by instanceid
+	duplicates int
+	mutex      sync.Mutex
+}
+
+// Start starts a mock statshub
+func Start() *Statshub {
+	hub := &Statshub{
+		seen:   make(map[string]bool),
+		totals: make(map[string]map[string]int64),
+	}
+	hub.server = httptest.NewServer(http.HandlerFunc(hub.serve))
+	hub.URLTemplate = hub.server.URL + "/stats/%s"
+	return hub
+}
+
+// Close stops the mock statshub
+func (hub *Statshub) Close() {
+	hub.server.Close()
+}
+
+// SetDown simulates an outage (responding with 503s) while down is true
+func (hub *Statshub) SetDown(down bool) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.down = down
+}
+
+// Total returns the total reported for the given instance and increment
+func (hub *Statshub) Total(instanceId string, key string) int64 {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	return hub.totals[instanceId][key]
+}
+
+// Duplicates returns the number of duplicate reports discarded
+func (hub *Statshub) Duplicates() int {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	return hub.duplicates
+}
+
+func (hub *Statshub) serve(resp http.ResponseWriter, req *http.Request) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.down {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if req.Method != "POST" || !strings.HasPrefix(req.URL.Path, "/stats/") {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	instanceId := strings.TrimPrefix(req.URL.Path, "/stats/")
+	report := &struct {
+		Id         string           `json:"id"`
+		Increments map[string]int64 `json:"increments"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(report); err != nil {
+		http.Error(resp, fmt.Sprintf("Unable to decode report: %s", err), http.StatusBadRequest)
+		return
+	}
+	if report.Id != "" && hub.seen[report.Id] {
+		hub.duplicates++
+		return
+	}
+	hub.seen[report.Id] = true
+	totals := hub.totals[instanceId]
+	if totals == nil {
+		totals = make(map[string]int64)
+		hub.totals[instanceId] = totals
+	}
+	for key, increment := range report.Increments {
+		totals[key] += increment
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"sync"
 
 	"github.com/getlantern/eventsource"
+	"github.com/getlantern/flashlight/hotrestart"
 	"github.com/getlantern/flashlight/log"
 )
 
@@ -38,10 +39,13 @@ func (server *Server) ListenAndServe() error {
 	server.clients = make(map[int]*Client)
 	server.peers = make(map[string]*Peer)
 	httpServer := &http.Server{
-		Addr:    server.Addr,
 		Handler: eventsource.Handler(server.onNewClient),
 	}
-	return httpServer.ListenAndServe()
+	l, err := hotrestart.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	return httpServer.Serve(l)
 }
 
 func (server *Server) addClient(conn *eventsource.Conn) *Client {
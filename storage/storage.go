@@ -0,0 +1,124 @@
+// package storage abstracts where servers persist their state (e.g. guest
+// usage), so that features don't each invent their own file format and
+// operators can plug in other backends later.  Values are JSON-encodable and
+// may expire.
+//
+// A Store is opened from a spec, "memory" for state that's lost on restart
+// or "file:<path>" for a JSON file (see package diskcache).
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/diskcache"
+)
+
+// Store is a key/value store of JSON-encodable values
+type Store interface {
+	// Get decodes the value for key into value, returning false if there's
+	// no (unexpired) value
+	Get(key string, value interface{}) bool
+
+	// Set sets the value for key, which expires after ttl (or never, if ttl
+	// is 0)
+	Set(key string, value interface{}, ttl time.Duration) error
+
+	// Delete removes the value for key
+	Delete(key string) error
+
+	// Keys returns the (unexpired) keys starting with prefix, sorted
+	Keys(prefix string) []string
+}
+
+// Open opens the Store described by spec
+func Open(spec string) (Store, error) {
+	switch {
+	case spec == "memory":
+		return &Memory{}, nil
+	case strings.HasPrefix(spec, "file:") && len(spec) > len("file:"):
+		cache := &diskcache.Cache{File: strings.TrimPrefix(spec, "file:")}
+		if err := cache.Load(); err != nil {
+			return nil, err
+		}
+		return cache, nil
+	default:
+		return nil, fmt.Errorf("Unknown store %s, expected memory or file:<path>", spec)
+	}
+}
+
+// Memory is a Store that keeps values in memory only.  Values are stored
+// encoded, so that callers can't modify them behind the Store's back.
+type Memory struct {
+	values  map[string][]byte
+	expires map[string]time.Time
+	mutex   sync.Mutex
+}
+
+func (m *Memory) Get(key string, value interface{}) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, found := m.values[key]
+	if !found || m.expired(key, time.Now()) {
+		return false
+	}
+	return json.Unmarshal(data, value) == nil
+}
+
+func (m *Memory) Set(key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal value for %s: %s", key, err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.values == nil {
+		m.values = make(map[string][]byte)
+		m.expires = make(map[string]time.Time)
+	}
+	m.values[key] = data
+	if ttl > 0 {
+		m.expires[key] = time.Now().Add(ttl)
+	} else {
+		delete(m.expires, key)
+	}
+	return nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.values, key)
+	delete(m.expires, key)
+	return nil
+}
+
+func (m *Memory) Keys(prefix string) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	var keys []string
+	for key := range m.values {
+		if m.expired(key, now) {
+			delete(m.values, key)
+			delete(m.expires, key)
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expired determines whether the value for key has expired.  Must be called
+// while holding the mutex.
+func (m *Memory) expired(key string, now time.Time) bool {
+	expires, found := m.expires[key]
+	return found && now.After(expires)
+}
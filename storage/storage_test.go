@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, store Store) {
+	if err := store.Set("guest/a", map[string]int64{"bytes": 5}, 0); err != nil {
+		t.Fatalf("Unable to set: %s", err)
+	}
+	store.Set("guest/b", 7, time.Hour)
+	store.Set("other", "x", 0)
+	store.Set("guest/expired", 1, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	value := map[string]int64{}
+	if !store.Get("guest/a", &value) || value["bytes"] != 5 {
+		t.Errorf("Unexpected value %v", value)
+	}
+	var expired int
+	if store.Get("guest/expired", &expired) {
+		t.Error("Expired value returned")
+	}
+	if keys := store.Keys("guest/"); !reflect.DeepEqual(keys, []string{"guest/a", "guest/b"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	if err := store.Delete("guest/a"); err != nil {
+		t.Fatalf("Unable to delete: %s", err)
+	}
+	if store.Get("guest/a", &value) {
+		t.Error("Deleted value returned")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	store, err := Open("memory")
+	if err != nil {
+		t.Fatalf("Unable to open store: %s", err)
+	}
+	testStore(t, store)
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	spec := "file:" + filepath.Join(dir, "state.json")
+	store, err := Open(spec)
+	if err != nil {
+		t.Fatalf("Unable to open store: %s", err)
+	}
+	testStore(t, store)
+
+	reopened, err := Open(spec)
+	if err != nil {
+		t.Fatalf("Unable to reopen store: %s", err)
+	}
+	var b int
+	if !reopened.Get("guest/b", &b) || b != 7 {
+		t.Errorf("Value not persisted, got %d", b)
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	for _, spec := range []string{"", "file:", "redis://localhost"} {
+		if _, err := Open(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
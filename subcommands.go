@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/flashlight/log"
+)
+
+var (
+	// commonFlags are accepted by both the client and server subcommands
+	commonFlags = []string{"help", "config", "hardened", "tlsstrict", "allowroot", "addr", "server", "configdir", "certwarndays", "auth", "cloak", "obfskey", "knockkey", "knockport", "probes", "maxresponse", "dumpheaders", "pushgateway", "pushinterval", "metricsaddr", "statsd", "statsdprefix", "dogstatsd", "instanceid", "strictstart", "loglevel", "logjson", "logfile", "logmaxsize", "logmaxage", "logkeep", "logretention", "debugaddr", "adminaddr", "admintoken", "cpuprofile", "memprofile", "parentpid"}
+
+	// clientFlags are accepted only by the client subcommand
+	clientFlags = []string{"guest", "protocol", "transport", "serverport", "masquerade", "rootca", "retries", "companionaddr", "companiontoken", "dashboardaddr", "localhosts", "localdomains", "stalltimeout", "tlssessioncache", "mdns", "allowedclients", "deniedclients", "devicelimit", "masqueradefile", "masqueradeurl", "masqueraderefresh", "masqueradecheck", "headertemplate", "headertemplatekey", "maxidleconns", "idletimeout", "throttleat", "plaintext", "plaintextallowed", "split", "splitthreshold", "forward", "socksaddr", "prefetch", "coalesce", "muxconns", "clientcert", "clientkey", "bootstrap", "dnscachettl", "balance", "balanceweights", "allowbypass", "allowdumping", "controlsocket", "script", "scripttimeout", "mediahosts", "historyhalflife", "tracefile", "tracelevel", "headeraudit"}
+
+	// serverFlags are accepted only by the server subcommand
+	serverFlags = []string{"advertise", "guestkey", "cloakdecoy", "certhosts", "certfile", "keyfile", "statsaddr", "statshub", "country", "auditlog", "auditcheck", "accesslog", "accesslogformat", "accesslogprivacy", "egressproxy", "syncaddr", "syncpeer", "synckey", "syncinterval", "meektarget", "serverstore", "clientca", "flowcollector", "flowsample", "decoy", "sniroutes", "plainaddr", "edgecidrs", "authwebhook", "authwebhookttl", "authfailopen", "fairshare", "fairshareweights", "restartdrain"}
+
+	// subcommands maps each subcommand to a description and the flags it
+	// accepts
+	subcommands = map[string]struct {
+		description string
+		flags       []string
+	}{
+		"client":       {"run the client proxy", concat(commonFlags, clientFlags)},
+		"server":       {"run the server proxy", concat(commonFlags, serverFlags)},
+		"diagnose":     {"check whether the client can reach the server", []string{"help", "server", "serverport", "masquerade", "rootca", "clientcert", "clientkey", "configdir", "auth", "protocol", "cloak", "obfskey", "knockkey", "knockport"}},
+		"genconfig":    {"generate the server's certificate and print the matching client command line", []string{"help", "addr", "server", "serverport", "advertise", "certhosts", "configdir", "auth"}},
+		"guest":        {"mint a link granting time-limited (and optionally capped) guest access to a server", []string{"help", "server", "serverport", "masquerade", "rootca", "guestkey", "guestvalid", "guestcap", "guestrotate"}},
+		"status":       {"show the status of the running client", []string{"help", "configdir", "json"}},
+		"bypass":       {"control how the running client routes requests (see below)", []string{"help", "configdir"}},
+		"reload":       {"reload the running client's config file (like sending it SIGHUP)", []string{"help", "configdir"}},
+		"dump":         {"dump requests to a single host to the running client's log (see below)", []string{"help", "configdir"}},
+		"loglevel":     {"show or change the running client's log levels (see below)", []string{"help", "configdir"}},
+		"export-state": {"write the keys, certificates and learned caches in the configdir to an encrypted archive", []string{"help", "configdir"}},
+		"import-state": {"restore the state from an archive written by export-state into the configdir", []string{"help", "configdir"}},
+		"notice":       {"queue, list or remove notices shown to the server's clients in their status (see below)", []string{"help", "configdir", "noticeexpiry"}},
+		"bootstrap":    {"create a short code (for SMS or reading out) from which clients fetch their config file", []string{"help", "configdir", "server", "serverport", "bootstrapconfig", "bootstrapat"}},
+	}
+
+	// subcommand is the subcommand being run, empty when invoked with legacy
+	// flags only
+	subcommand string
+
+	// subcommandArgs are the positional arguments following the subcommand's
+	// flags
+	subcommandArgs []string
+)
+
+// parseSubcommand parses the flags for the subcommand given as the first
+// argument.  Subcommands share the global flag variables, but each only
+// accepts the flags relevant to it.
+func parseSubcommand(args []string) {
+	subcommand = args[0]
+	spec, found := subcommands[subcommand]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown subcommand: %s\n\n", subcommand)
+		printSubcommands()
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("flashlight "+subcommand, flag.ExitOnError)
+	for _, name := range spec.flags {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of flashlight %s (%s):\n", subcommand, spec.description)
+		fs.PrintDefaults()
+		if subcommand == "bypass" || subcommand == "dump" || subcommand == "loglevel" {
+			fmt.Fprintf(os.Stderr, "\n%s\n", COMMAND_USAGE)
+		}
+		if subcommand == "export-state" || subcommand == "import-state" {
+			fmt.Fprintf(os.Stderr, "\n%s\n", STATE_USAGE)
+		}
+		if subcommand == "notice" {
+			fmt.Fprintf(os.Stderr, "\n%s\n", NOTICE_USAGE)
+		}
+	}
+	fs.Parse(args[1:])
+	subcommandArgs = fs.Args()
+	applyConfigFile(fs)
+	applyBootstrap(fs)
+	applyHardening()
+	applyGuestLink()
+	if *help {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	switch subcommand {
+	case "client", "server":
+		flag.Set("role", subcommand)
+		if onlyCheckingAuditLog() {
+			return
+		}
+		if *addr == "" || *upstreamHost == "" {
+			fmt.Fprintf(os.Stderr, "addr and server are required\n\n")
+			fs.Usage()
+			os.Exit(1)
+		}
+	case "guest":
+		if *guestKey == "" || *upstreamHost == "" {
+			fmt.Fprintf(os.Stderr, "server and guestkey are required\n\n")
+			fs.Usage()
+			os.Exit(1)
+		}
+	case "bootstrap":
+		if *bootstrapConfig == "" || (*upstreamHost == "" && *bootstrapAt == "") {
+			fmt.Fprintf(os.Stderr, "bootstrapconfig and server (or bootstrapat) are required\n\n")
+			fs.Usage()
+			os.Exit(1)
+		}
+	case "diagnose", "genconfig":
+		if *upstreamHost == "" {
+			fmt.Fprintf(os.Stderr, "server is required\n\n")
+			fs.Usage()
+			os.Exit(1)
+		}
+	}
+}
+
+// warnAboutLegacyFlags warns that running without a subcommand is deprecated
+func warnAboutLegacyFlags() {
+	log.Errorf("DEPRECATED: running flashlight with -role is deprecated and will stop working in the next release, use 'flashlight %s' instead", *role)
+}
+
+// printSubcommands prints the available subcommands
+func printSubcommands() {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: flashlight <subcommand> [flags]\n\nSubcommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, subcommands[name].description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'flashlight <subcommand> -help' for the flags accepted by each subcommand.\n")
+}
+
+// isSubcommand determines whether the given argument names a subcommand
+// rather than being a (legacy) flag
+func isSubcommand(arg string) bool {
+	return !strings.HasPrefix(arg, "-")
+}
+
+func concat(lists ...[]string) []string {
+	var result []string
+	for _, list := range lists {
+		result = append(result, list...)
+	}
+	return result
+}
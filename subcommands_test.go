@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// resetFlags puts our flags back to their defaults
+func resetFlags() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, "test.") {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	for name := range explicitFlags {
+		delete(explicitFlags, name)
+	}
+}
+
+func TestSubcommandSetsRole(t *testing.T) {
+	defer resetFlags()
+	for _, expected := range []string{"client", "server"} {
+		parseSubcommand([]string{expected, "-addr", "127.0.0.1:0", "-server", "fl.example.com"})
+		if *role != expected {
+			t.Errorf("Expected %s subcommand to run as %s, got %s", expected, expected, *role)
+		}
+	}
+}
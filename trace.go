@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+
+	"github.com/getlantern/flashlight/log"
+	"github.com/getlantern/flashlight/trace"
+)
+
+// openTracerIfNecessary opens the trace file given with -tracefile.  It
+// returns nil (which traces nothing) if tracing is off.
+func openTracerIfNecessary() *trace.Tracer {
+	if *traceFile == "" {
+		return nil
+	}
+	tracer := &trace.Tracer{
+		File:  *traceFile,
+		Level: *traceLevel,
+	}
+	if err := tracer.Open(); err != nil {
+		log.Fatal(err)
+	}
+	log.Debugf("Tracing how the server is reached to %s", *traceFile)
+	return tracer
+}
+
+// traceDial records the outcome of dialing the server at addr for dest,
+// including the IP that was actually dialed (which can differ from what addr
+// resolves to now because of the DNS cache)
+func (app *App) traceDial(id string, dest string, addr string, conn net.Conn, err error) {
+	if app.tracer == nil {
+		return
+	}
+	event := &trace.Event{
+		ID:         id,
+		Step:       trace.STEP_DIAL,
+		Dest:       dest,
+		Masquerade: addr,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	} else if remote := conn.RemoteAddr(); remote != nil {
+		event.IP = remote.String()
+	}
+	app.tracer.Record(event)
+}
@@ -0,0 +1,179 @@
+// package trace records the decisions that the client makes on the way to the
+// server (how requests are rewritten for the protocol, which masquerade is
+// chosen and which IP is dialed) as JSON lines, so that it can be seen why a
+// particular site misbehaves when fronted without adding printfs.
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LEVEL_DECISIONS = "decisions" // hosts, masquerades and IPs, plus the names of injected headers
+	LEVEL_HEADERS   = "headers"   // like LEVEL_DECISIONS, plus the values of injected headers
+
+	STEP_REWRITE    = "rewrite"    // the protocol rewrote the request
+	STEP_NORMALIZE  = "normalize"  // headers were normalized (see -headertemplate)
+	STEP_SIGN       = "sign"       // the request was signed for authentication
+	STEP_MASQUERADE = "masquerade" // an address at which to reach the server was chosen
+	STEP_DIAL       = "dial"       // the chosen address was dialed
+)
+
+var (
+	LEVELS = []string{LEVEL_DECISIONS, LEVEL_HEADERS}
+)
+
+// Event is a single step.  Steps that belong to the same request (or dial)
+// share an ID.
+type Event struct {
+	Time          time.Time         `json:"time"`
+	ID            string            `json:"id"`
+	Step          string            `json:"step"`
+	Dest          string            `json:"dest,omitempty"`          // destination for which the server is dialed, if known
+	Host          string            `json:"host,omitempty"`          // host before the step
+	RewrittenHost string            `json:"rewrittenHost,omitempty"` // host after the step, if it changed
+	Headers       map[string]string `json:"headers,omitempty"`       // headers added or changed by the step (values only with LEVEL_HEADERS)
+	Masquerade    string            `json:"masquerade,omitempty"`    // address chosen to reach the server
+	IP            string            `json:"ip,omitempty"`            // address actually dialed
+	Error         string            `json:"error,omitempty"`
+}
+
+// Tracer appends Events to a file.  A nil Tracer traces nothing, so that
+// callers don't need to check whether tracing is enabled.
+type Tracer struct {
+	File  string // file to which to append events
+	Level string // (optional) one of LEVELS, defaults to LEVEL_DECISIONS
+
+	file   *os.File
+	prefix string
+	nextID uint64
+	mutex  sync.Mutex
+}
+
+// Open checks the settings and opens the trace file for appending
+func (tracer *Tracer) Open() error {
+	if !contains(LEVELS, tracer.level()) {
+		return fmt.Errorf("Unknown trace level %s, available levels are %v", tracer.Level, LEVELS)
+	}
+	var err error
+	tracer.file, err = os.OpenFile(tracer.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open trace file: %s", err)
+	}
+	// Distinguish the IDs of different runs appending to the same file
+	tracer.prefix = fmt.Sprintf("%x", time.Now().Unix())
+	return nil
+}
+
+// Close closes the trace file
+func (tracer *Tracer) Close() error {
+	if tracer == nil || tracer.file == nil {
+		return nil
+	}
+	return tracer.file.Close()
+}
+
+// NewID returns a new correlation ID for the steps of a request or dial
+func (tracer *Tracer) NewID() string {
+	if tracer == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s-%d", tracer.prefix, atomic.AddUint64(&tracer.nextID, 1))
+}
+
+// Record appends the given event, stamping it with the current time if it
+// has none
+func (tracer *Tracer) Record(event *Event) {
+	if tracer == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	tracer.file.Write(append(data, '\n'))
+}
+
+// Snapshot captures the host and headers of req before a step, for
+// RecordChanges
+type Snapshot struct {
+	Host   string
+	Header http.Header
+}
+
+// Snap captures req's host and headers.  It returns nil if tracer is nil.
+func (tracer *Tracer) Snap(req *http.Request) *Snapshot {
+	if tracer == nil {
+		return nil
+	}
+	header := make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	return &Snapshot{Host: req.Host, Header: header}
+}
+
+// RecordChanges records the step with the given id, during which req changed
+// from before
+func (tracer *Tracer) RecordChanges(id string, step string, before *Snapshot, req *http.Request) {
+	if tracer == nil {
+		return
+	}
+	event := &Event{
+		ID:      id,
+		Step:    step,
+		Host:    before.Host,
+		Headers: tracer.changedHeaders(before.Header, req.Header),
+	}
+	if req.Host != before.Host {
+		event.RewrittenHost = req.Host
+	}
+	tracer.Record(event)
+}
+
+// changedHeaders returns the headers in after that aren't in before (or have
+// different values), with their values only at LEVEL_HEADERS
+func (tracer *Tracer) changedHeaders(before http.Header, after http.Header) map[string]string {
+	var changed map[string]string
+	for name, values := range after {
+		if fmt.Sprint(before[name]) == fmt.Sprint(values) {
+			continue
+		}
+		if changed == nil {
+			changed = make(map[string]string)
+		}
+		if tracer.level() == LEVEL_HEADERS {
+			changed[name] = after.Get(name)
+		} else {
+			changed[name] = ""
+		}
+	}
+	return changed
+}
+
+func (tracer *Tracer) level() string {
+	if tracer.Level == "" {
+		return LEVEL_DECISIONS
+	}
+	return tracer.Level
+}
+
+func contains(list []string, item string) bool {
+	for _, candidate := range list {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordChanges(t *testing.T) {
+	for _, level := range LEVELS {
+		dir, err := ioutil.TempDir("", "trace")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		tracer := &Tracer{File: filepath.Join(dir, "trace.json"), Level: level}
+		if err := tracer.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		req.Header.Set("Accept", "*/*")
+		id := tracer.NewID()
+		before := tracer.Snap(req)
+		req.Host = "fl.example.org"
+		req.Header.Set("X-Injected", "secret")
+		tracer.RecordChanges(id, STEP_REWRITE, before, req)
+		tracer.Record(&Event{ID: tracer.NewID(), Step: STEP_DIAL, IP: "192.0.2.1:443"})
+		tracer.Close()
+
+		events := readEvents(t, tracer.File)
+		if len(events) != 2 {
+			t.Fatalf("Expected 2 events at level %s, got %d", level, len(events))
+		}
+		rewrite := events[0]
+		if rewrite.ID != id || rewrite.Step != STEP_REWRITE || rewrite.Time.IsZero() {
+			t.Errorf("Unexpected rewrite event %+v", rewrite)
+		}
+		if rewrite.Host != "www.example.com" || rewrite.RewrittenHost != "fl.example.org" {
+			t.Errorf("Expected rewrite from www.example.com to fl.example.org, got %s to %s", rewrite.Host, rewrite.RewrittenHost)
+		}
+		if len(rewrite.Headers) != 1 {
+			t.Errorf("Expected only the injected header, got %v", rewrite.Headers)
+		}
+		value, found := rewrite.Headers["X-Injected"]
+		if !found {
+			t.Errorf("Injected header missing from %v", rewrite.Headers)
+		}
+		expected := ""
+		if level == LEVEL_HEADERS {
+			expected = "secret"
+		}
+		if value != expected {
+			t.Errorf("Expected header value %q at level %s, got %q", expected, level, value)
+		}
+		if events[1].ID == id {
+			t.Errorf("IDs should differ, both were %s", id)
+		}
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	if id := tracer.NewID(); id != "" {
+		t.Errorf("Expected no ID, got %s", id)
+	}
+	tracer.RecordChanges("", STEP_REWRITE, tracer.Snap(req), req)
+	tracer.Record(&Event{Step: STEP_DIAL})
+	if err := tracer.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnknownLevel(t *testing.T) {
+	tracer := &Tracer{File: os.DevNull, Level: "everything"}
+	if err := tracer.Open(); err == nil {
+		t.Error("Unknown level should be refused")
+	}
+}
+
+func readEvents(t *testing.T, file string) []*Event {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []*Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		event := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			t.Fatalf("Unable to parse %s: %s", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// STREAM_CHUNK_SIZE is the largest message written by a Stream
+	STREAM_CHUNK_SIZE = 32 * 1024
+)
+
+// Stream is a net.Conn that carries a byte stream over a WebSocket connection
+// as a sequence of binary messages, e.g. to tunnel TCP through a CDN that
+// passes WebSockets through.
+type Stream struct {
+	ws      *Conn
+	pending []byte // rest of the last message read
+}
+
+// NewStream creates a Stream on top of the given WebSocket connection
+func NewStream(ws *Conn) *Stream {
+	return &Stream{ws: ws}
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		_, payload, err := s.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		s.pending = payload
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		end := written + STREAM_CHUNK_SIZE
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := s.ws.WriteMessage(OP_BINARY, b[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Close tells the peer that the stream is done and closes the connection
+func (s *Stream) Close() error {
+	s.ws.writeFrame(OP_CLOSE, nil)
+	return s.ws.Close()
+}
+
+func (s *Stream) LocalAddr() net.Addr                { return s.ws.conn.LocalAddr() }
+func (s *Stream) RemoteAddr() net.Addr               { return s.ws.conn.RemoteAddr() }
+func (s *Stream) SetDeadline(t time.Time) error      { return s.ws.conn.SetDeadline(t) }
+func (s *Stream) SetReadDeadline(t time.Time) error  { return s.ws.conn.SetReadDeadline(t) }
+func (s *Stream) SetWriteDeadline(t time.Time) error { return s.ws.conn.SetWriteDeadline(t) }
@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		ws, err := Upgrade(resp, req)
+		if err != nil {
+			t.Errorf("Unable to upgrade: %s", err)
+			return
+		}
+		// Echo
+		stream := NewStream(ws)
+		io.Copy(stream, stream)
+		stream.Close()
+	}))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+	ws, err := Handshake(conn, req)
+	if err != nil {
+		t.Fatalf("Unable to complete handshake: %s", err)
+	}
+	stream := NewStream(ws)
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	go func() {
+		stream.Write(data)
+		stream.ws.writeFrame(OP_CLOSE, nil)
+	}()
+	echoed, err := ioutil.ReadAll(stream)
+	if err != nil && err != io.EOF {
+		t.Fatalf("Unable to read echo: %s", err)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Errorf("Expected %d bytes echoed, got %d", len(data), len(echoed))
+	}
+}
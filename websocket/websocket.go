@@ -0,0 +1,234 @@
+// package websocket implements the subset of the WebSocket protocol
+// (RFC 6455) needed by flashlight: unfragmented text and binary messages plus
+// the ping/pong and close control frames.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	OP_CONTINUATION = 0x0
+	OP_TEXT         = 0x1
+	OP_BINARY       = 0x2
+	OP_CLOSE        = 0x8
+	OP_PING         = 0x9
+	OP_PONG         = 0xA
+
+	MAX_MESSAGE_SIZE = 1024 * 1024
+
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// Conn is a WebSocket connection
+type Conn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	client     bool // clients have to mask the frames they send
+	writeMutex sync.Mutex
+}
+
+// Upgrade upgrades the given HTTP request to a WebSocket connection.
+func Upgrade(resp http.ResponseWriter, req *http.Request) (*Conn, error) {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		http.Error(resp, "Expected WebSocket upgrade", http.StatusBadRequest)
+		return nil, fmt.Errorf("Request is not a WebSocket upgrade")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(resp, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("Missing Sec-WebSocket-Key")
+	}
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("Unable to hijack connection for WebSocket")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to hijack connection for WebSocket: %s", err)
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", AcceptKey(key))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to complete WebSocket handshake: %s", err)
+	}
+	return &Conn{conn: conn, reader: buffered.Reader}, nil
+}
+
+// Handshake performs the client side of the WebSocket handshake on conn (which
+// is already connected to the server) using the given request, to which it
+// adds the headers required for the upgrade.
+func Handshake(conn net.Conn, req *http.Request) (*Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Unable to generate WebSocket key: %s", err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("Unable to send WebSocket handshake: %s", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read WebSocket handshake response: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("Unexpected response status to WebSocket handshake: %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != AcceptKey(key) {
+		return nil, fmt.Errorf("Invalid Sec-WebSocket-Accept in handshake response")
+	}
+	return &Conn{conn: conn, reader: reader, client: true}, nil
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for the given
+// Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// ReadMessage reads the next text or binary message, transparently answering
+// pings.  It returns io.EOF once the peer closes the connection.
+func (c *Conn) ReadMessage() (opcode byte, payload []byte, err error) {
+	for {
+		var fin bool
+		fin, opcode, payload, err = c.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case OP_PING:
+			if err = c.writeFrame(OP_PONG, payload); err != nil {
+				return
+			}
+		case OP_PONG:
+			// ignore
+		case OP_CLOSE:
+			c.writeFrame(OP_CLOSE, nil)
+			return 0, nil, io.EOF
+		case OP_TEXT, OP_BINARY:
+			if !fin {
+				return 0, nil, fmt.Errorf("Fragmented WebSocket messages are not supported")
+			}
+			return
+		default:
+			return 0, nil, fmt.Errorf("Unexpected WebSocket opcode %d", opcode)
+		}
+	}
+}
+
+// WriteMessage writes a single message with the given opcode (OP_TEXT or
+// OP_BINARY).
+func (c *Conn) WriteMessage(opcode byte, payload []byte) error {
+	return c.writeFrame(opcode, payload)
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(c.reader, header); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(c.reader, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(c.reader, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > MAX_MESSAGE_SIZE {
+		err = fmt.Errorf("WebSocket frame of %d bytes exceeds maximum of %d", length, MAX_MESSAGE_SIZE)
+		return
+	}
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err = io.ReadFull(c.reader, mask); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(length>>8), byte(length))
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(length))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, ext...)
+	}
+	if !c.client {
+		frame = append(frame, payload...)
+	} else {
+		mask := make([]byte, 4)
+		if _, err := rand.Read(mask); err != nil {
+			return fmt.Errorf("Unable to generate WebSocket mask: %s", err)
+		}
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}